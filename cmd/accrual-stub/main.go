@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/accrualstub"
+	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/shopspring/decimal"
+)
+
+// shutdownTimeout время на завершение текущих запросов при остановке
+const shutdownTimeout = 5 * time.Second
+
+// main старт имитации accrual
+func main() {
+	if err := logger.Initialize(); err != nil {
+		panic(err)
+	}
+	// accrual отдает начисление JSON-числом
+	decimal.MarshalJSONWithoutQuotes = true
+
+	address := flag.String("a", "localhost:8081", "accrual stub address")
+	steps := flag.Int("steps", 1, "status requests spent in REGISTERED and then in PROCESSING")
+	autoRegister := flag.Bool("auto-register", true, "register unknown orders on first request instead of 204")
+	defaultAccrual := flag.String("default-accrual", "500", "accrual for auto registered orders")
+	latency := flag.Duration("latency", 0, "delay before each status response")
+	errorRate := flag.Float64("error-rate", 0, "share of status requests answered with 500")
+	rateLimit := flag.Int("rate-limit", 0, "status requests per minute, 0 - unlimited")
+	rulesFile := flag.String("rules", "", "JSON file with reward rules")
+	flag.Parse()
+
+	accrual, err := decimal.NewFromString(*defaultAccrual)
+	if err != nil {
+		logger.Log.Fatal(fmt.Sprintf("Parse default accrual error: %s", err))
+	}
+
+	stub := accrualstub.New(accrualstub.Config{
+		Steps:          *steps,
+		AutoRegister:   *autoRegister,
+		DefaultAccrual: accrual,
+		Latency:        *latency,
+		ErrorRate:      *errorRate,
+		RateLimit:      *rateLimit,
+	})
+	if *rulesFile != "" {
+		if err := loadRules(stub, *rulesFile); err != nil {
+			logger.Log.Fatal(err.Error())
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: *address, Handler: logger.RequestLogger(stub.ServeHTTP)}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Log.Info(fmt.Sprintf("Starting accrual stub on %s", *address))
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Log.Fatal(err.Error())
+	}
+	logger.Log.Info("Accrual stub is stopped")
+}
+
+// loadRules загрузка правил вознаграждения из JSON файла
+func loadRules(stub *accrualstub.Stub, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read rules error: %w", err)
+	}
+
+	var rules []accrualstub.RewardRule
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return fmt.Errorf("parse rules error: %w", err)
+	}
+	for _, rule := range rules {
+		if err := stub.AddRewardRule(rule); err != nil {
+			return fmt.Errorf("add rule error: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/configs"
+	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/shopspring/decimal"
+)
+
+// timeout время на выполнение подкоманды
+const timeout = time.Minute
+
+// Run выполнение подкоманды ledger: reverse возвращает пользователю login списанные по заказу баллы,
+// adjust записывает ручную корректировку баланса, отрицательная сумма уменьшает баланс
+func Run(command, login, orderNumber, amount string) error {
+	var entryType string
+	switch command {
+	case "reverse":
+		entryType = constants.LedgerReversal
+	case "adjust":
+		entryType = constants.LedgerAdjustment
+	default:
+		return fmt.Errorf("unknown ledger command %q, expected reverse or adjust", command)
+	}
+
+	order, err := strconv.Atoi(orderNumber)
+	if err != nil {
+		return fmt.Errorf("invalid order number %q: %w", orderNumber, err)
+	}
+	sum, err := decimal.NewFromString(amount)
+	if err != nil {
+		return fmt.Errorf("invalid amount %q: %w", amount, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Миграции применяет сервер или gophermart migrate, подкоманда работает только с актуальной схемой
+	timeouts := storage.Timeouts{Query: configs.Flags.DBQueryTimeout, Transaction: configs.Flags.DBTxTimeout}
+	store, err := storage.OpenMigratedDB(ctx, configs.Flags.DBConf, timeouts)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	userID, err := store.GetUserIDByName(ctx, login)
+	if err != nil {
+		return fmt.Errorf("failed to find user %q: %w", login, err)
+	}
+	if err := store.AppendLedgerEntry(ctx, userID, order, entryType, sum); err != nil {
+		return err
+	}
+
+	balance, err := store.GetBalanceByUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Balance of %s: current %s, withdrawn %s\n", login, balance.Current, balance.Withdrawn)
+	return nil
+}
@@ -1,10 +1,23 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fngoc/gofermart/cmd/gophermart/ledger"
+	"github.com/fngoc/gofermart/cmd/gophermart/migrate"
 	"github.com/fngoc/gofermart/cmd/gophermart/server"
 	"github.com/fngoc/gofermart/internal/configs"
+	"github.com/fngoc/gofermart/internal/handlers"
+	"github.com/fngoc/gofermart/internal/handlers/jwt"
+	"github.com/fngoc/gofermart/internal/hash"
 	"github.com/fngoc/gofermart/internal/logger"
 	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/throttle"
+	"github.com/fngoc/gofermart/internal/tracing"
+	"github.com/shopspring/decimal"
 )
 
 // main старт программы
@@ -12,16 +25,98 @@ func main() {
 	if err := logger.Initialize(); err != nil {
 		panic(err)
 	}
+	// Денежные суммы отдаются клиентам JSON-числами, а не строками
+	decimal.MarshalJSONWithoutQuotes = true
 
-	configs.ParseArgs()
+	arguments := os.Args[1:]
+	if len(arguments) > 0 && arguments[0] == "migrate" {
+		// Подкоманда: gophermart migrate up|down|status [флаги]
+		if len(arguments) < 2 {
+			logger.Log.Fatal("Usage: gophermart migrate up|down|status [flags]")
+		}
+		configs.ParseArgs(arguments[2:])
+		if err := migrate.Run(arguments[1]); err != nil {
+			logger.Log.Fatal(err.Error())
+		}
+		return
+	}
+	if len(arguments) > 0 && arguments[0] == "ledger" {
+		// Подкоманда: gophermart ledger reverse|adjust <логин> <номер заказа> <сумма> [флаги]
+		if len(arguments) < 5 {
+			logger.Log.Fatal("Usage: gophermart ledger reverse|adjust <login> <order> <amount> [flags]")
+		}
+		configs.ParseArgs(arguments[5:])
+		if err := ledger.Run(arguments[1], arguments[2], arguments[3], arguments[4]); err != nil {
+			logger.Log.Fatal(err.Error())
+		}
+		return
+	}
+
+	configs.ParseArgs(arguments)
 
-	if configs.HasFlagOrEnvPostgresVariable() {
-		if err := storage.InitializeDB(configs.Flags.DBConf); err != nil {
+	storageType, err := configs.ResolveStorageType()
+	if err != nil {
+		logger.Log.Fatal(err.Error())
+	}
+	if err := configs.CheckJWTKeys(storageType); err != nil {
+		logger.Log.Fatal(err.Error())
+	}
+	if configs.Flags.JWTKeysFile == "" && configs.Flags.JWTSecret == "" {
+		logger.Log.Warn("JWT keys are not set, using built-in secret, do not use it in production")
+	}
+	keySet, err := jwt.LoadKeySet(jwt.Config{
+		KeysFile: configs.Flags.JWTKeysFile,
+		Secret:   configs.Flags.JWTSecret,
+		TTL:      configs.Flags.JWTTTL,
+		Issuer:   configs.Flags.JWTIssuer,
+		Audience: configs.Flags.JWTAudience,
+	})
+	if err != nil {
+		logger.Log.Fatal(err.Error())
+	}
+	jwt.SetKeySet(keySet)
+	handlers.SetRefreshTokenTTL(configs.Flags.RefreshTokenTTL)
+	handlers.SetHeartbeatTimeout(configs.Flags.HeartbeatTimeout)
+
+	shutdownTracing, err := tracing.Init(context.Background(), configs.Flags.TraceExporter)
+	if err != nil {
+		logger.Log.Fatal(err.Error())
+	}
+
+	loginPolicy := throttle.DefaultLoginPolicy
+	loginPolicy.FreeAttempts = configs.Flags.LoginAttempts
+	addressPolicy := throttle.DefaultAddressPolicy
+	addressPolicy.FreeAttempts = configs.Flags.AddressAttempts
+	handlers.SetLoginThrottler(throttle.New(loginPolicy, addressPolicy))
+	hash.SetMaxConcurrentHashing(configs.Flags.HashConcurrency)
+
+	switch storageType {
+	case configs.StoragePostgres:
+		timeouts := storage.Timeouts{Query: configs.Flags.DBQueryTimeout, Transaction: configs.Flags.DBTxTimeout}
+		if err := storage.InitializeDB(configs.Flags.DBConf, timeouts); err != nil {
 			logger.Log.Fatal(err.Error())
 		}
+	case configs.StorageMemory:
+		logger.Log.Warn("Using in-memory storage, data will be lost on restart")
+		storage.SetDBInstance(storage.NewMemoryStorage())
 	}
 
-	if err := server.Run(); err != nil {
+	// SIGINT и SIGTERM запускают плавную остановку
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = server.Run(ctx)
+	// Оставшиеся спаны отправляются до закрытия хранилища, но не дольше таймаута остановки
+	tracingCtx, cancel := context.WithTimeout(context.Background(), configs.Flags.ShutdownTimeout)
+	if tracingErr := shutdownTracing(tracingCtx); tracingErr != nil {
+		logger.Log.Error(tracingErr.Error())
+	}
+	cancel()
+	if closeErr := storage.Close(); closeErr != nil {
+		logger.Log.Error(closeErr.Error())
+	}
+	if err != nil {
 		logger.Log.Fatal(err.Error())
 	}
+	logger.Log.Info("Server is stopped")
 }
@@ -0,0 +1,64 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/configs"
+	"github.com/fngoc/gofermart/internal/storage"
+)
+
+// timeout время на выполнение подкоманды
+const timeout = 5 * time.Minute
+
+// Run выполнение подкоманды migrate: up, down или status
+func Run(command string) error {
+	db, err := storage.OpenDB(configs.Flags.DBConf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	switch command {
+	case "up":
+		applied, err := storage.MigrateUp(ctx, db)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied migrations: %d\n", applied)
+	case "down":
+		version, err := storage.MigrateDown(ctx, db)
+		if err != nil {
+			return err
+		}
+		if version == 0 {
+			fmt.Println("No migrations to revert")
+			return nil
+		}
+		fmt.Printf("Reverted migration: %d\n", version)
+	case "status":
+		statuses, err := storage.MigrationsStatus(ctx, db)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.Applied {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", command)
+	}
+	return nil
+}
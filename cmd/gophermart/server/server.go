@@ -1,42 +1,122 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/fngoc/gofermart/internal/configs"
 	"github.com/fngoc/gofermart/internal/handlers"
 	"github.com/fngoc/gofermart/internal/handlers/middlewares"
 	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/metrics"
 	"github.com/fngoc/gofermart/internal/scheduler"
+	"github.com/fngoc/gofermart/internal/tracing"
 	"github.com/go-chi/chi/v5"
 )
 
-// Run запуск сервера
-func Run() error {
+// Run запуск сервера и фоновых задач до отмены ctx. После отмены проверка готовности перестает проходить,
+// через configs.Flags.ShutdownDelay сервер перестает принимать соединения и дожидается текущих запросов,
+// затем останавливается опрос accrual. На обе стадии отводится configs.Flags.ShutdownTimeout
+func Run(ctx context.Context) error {
 	logger.Log.Info("Starting server")
 
 	r := chi.NewRouter()
+	r.Use(tracing.Middleware)
+	r.Use(metrics.Middleware)
+
+	r.Handle("/metrics", metrics.Handler())
+	r.Get("/healthz", handlers.HealthzWebhook)
+	r.Get("/readyz", handlers.ReadyzWebhook)
+	r.Get("/.well-known/jwks.json", logger.RequestLogger(handlers.JWKSWebhook))
 
 	r.Route("/api/user", func(r chi.Router) {
 		//auth
 		r.Post("/register", logger.RequestLogger(middlewares.GzipMiddleware(handlers.RegisterWebhook)))
 		r.Post("/login", logger.RequestLogger(middlewares.GzipMiddleware(handlers.AuntificationWebhook)))
+		r.Post("/token/refresh", logger.RequestLogger(middlewares.GzipMiddleware(handlers.RefreshTokenWebhook)))
+		r.Post("/logout", logger.RequestLogger(middlewares.AuthMiddleware(handlers.LogoutWebhook)))
+		r.Post("/logout-all", logger.RequestLogger(middlewares.AuthMiddleware(handlers.LogoutAllWebhook)))
+
+		//account
+		r.Post("/password", logger.RequestLogger(middlewares.AuthMiddleware(middlewares.GzipMiddleware(handlers.ChangePasswordWebhook))))
+		r.Delete("/", logger.RequestLogger(middlewares.AuthMiddleware(handlers.DeleteUserWebhook)))
 
 		//order
 		r.Post("/orders", logger.RequestLogger(middlewares.AuthMiddleware(middlewares.GzipMiddleware(handlers.LoadOrderWebhook))))
 		r.Get("/orders", logger.RequestLogger(middlewares.AuthMiddleware(middlewares.GzipMiddleware(handlers.ListOrdersWebhook))))
+		r.Get("/orders/{number}", logger.RequestLogger(middlewares.AuthMiddleware(middlewares.GzipMiddleware(handlers.GetOrderWebhook))))
+		r.Get("/orders/{number}/history", logger.RequestLogger(middlewares.AuthMiddleware(middlewares.GzipMiddleware(handlers.GetOrderHistoryWebhook))))
 
 		//balance
 		r.Get("/balance", logger.RequestLogger(middlewares.AuthMiddleware(middlewares.GzipMiddleware(handlers.GetBalanceWebhook))))
-		r.Post("/balance/withdraw", logger.RequestLogger(middlewares.AuthMiddleware(middlewares.GzipMiddleware(handlers.PostWithdrawBalanceWebhook))))
+		r.Post("/balance/withdraw", logger.RequestLogger(middlewares.AuthMiddleware(middlewares.GzipMiddleware(middlewares.IdempotencyMiddleware(handlers.PostWithdrawBalanceWebhook)))))
 
 		//withdrawals
 		r.Get("/withdrawals", logger.RequestLogger(middlewares.AuthMiddleware(middlewares.GzipMiddleware(handlers.ListWithdrawalsBalanceWebhook))))
 	})
 
+	// Фоновые задачи останавливаются отдельно от сервера, уже после завершения текущих запросов
+	schedulerCtx, stopScheduler := context.WithCancel(context.Background())
+	defer stopScheduler()
+
 	logger.Log.Info("Starting accrual checker")
-	go scheduler.FetchOrderStatuses(configs.Flags.AccrualAddress)
-	go scheduler.UpdateOrderStatuses()
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		scheduler.FetchOrderStatuses(schedulerCtx, configs.Flags.AccrualAddress, configs.Flags.AccrualWorkers, configs.Flags.AccrualRateLimit)
+	}()
+	go func() {
+		defer wg.Done()
+		scheduler.UpdateOrderStatuses(schedulerCtx)
+	}()
+	go func() {
+		defer wg.Done()
+		scheduler.ReconcileBalances(schedulerCtx)
+	}()
+	go func() {
+		defer wg.Done()
+		scheduler.CleanupExpired(schedulerCtx)
+	}()
+
+	server := &http.Server{Addr: configs.Flags.ServerAddress, Handler: r}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-serverErr:
+	case <-ctx.Done():
+		logger.Log.Info("Shutting down server")
+		// Проверка готовности перестает проходить, балансировщик успевает убрать реплику до остановки приема соединений
+		handlers.SetShuttingDown()
+		if configs.Flags.ShutdownDelay > 0 {
+			time.Sleep(configs.Flags.ShutdownDelay)
+		}
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), configs.Flags.ShutdownTimeout)
+	defer cancel()
+	if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil && !errors.Is(shutdownErr, http.ErrServerClosed) {
+		err = errors.Join(err, shutdownErr)
+	}
 
-	return http.ListenAndServe(configs.Flags.ServerAddress, r)
+	stopScheduler()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		logger.Log.Info("Background tasks is stopped")
+	case <-shutdownCtx.Done():
+		logger.Log.Warn("Background tasks did not stop in time")
+	}
+	return err
 }
@@ -0,0 +1,334 @@
+// Package accrualstub имитация системы расчета начислений accrual для локального запуска и тестов.
+// Реализует GET /api/orders/{number} с жизненным циклом заказа REGISTERED -> PROCESSING -> PROCESSED/INVALID,
+// правила вознаграждения и внедрение ответов 204, 429 с Retry-After, 500 и задержек
+package accrualstub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	// Registered заказ зарегистрирован, но начисление не рассчитано
+	Registered = "REGISTERED"
+	// Processing расчет начисления в процессе
+	Processing = "PROCESSING"
+	// Processed расчет начисления окончен
+	Processed = "PROCESSED"
+	// Invalid заказ не принят к расчету
+	Invalid = "INVALID"
+
+	// RewardPercent вознаграждение в процентах от цены товара
+	RewardPercent = "%"
+	// RewardPoints фиксированное вознаграждение в баллах
+	RewardPoints = "pt"
+)
+
+// ErrAlreadyExists заказ или правило уже зарегистрированы
+var ErrAlreadyExists = errors.New("already exists")
+
+// Config настройки имитации
+type Config struct {
+	// Steps количество запросов статуса, которое заказ проводит в REGISTERED и затем в PROCESSING,
+	// 0 - финальный статус отдается сразу
+	Steps int
+	// AutoRegister регистрировать неизвестный заказ при первом запросе, иначе на него отвечать 204
+	AutoRegister bool
+	// DefaultAccrual начисление для автоматически зарегистрированных заказов
+	DefaultAccrual decimal.Decimal
+	// Latency задержка перед каждым ответом на запрос статуса
+	Latency time.Duration
+	// ErrorRate доля запросов статуса, на которые отвечается 500, от 0 до 1
+	ErrorRate float64
+	// RateLimit максимальное количество запросов статуса в минуту, 0 - без ограничений
+	RateLimit int
+}
+
+// Good товар в заказе
+type Good struct {
+	Description string          `json:"description"`
+	Price       decimal.Decimal `json:"price"`
+}
+
+// RewardRule правило вознаграждения за товары, в описании которых встречается Match
+type RewardRule struct {
+	Match      string          `json:"match"`
+	Reward     decimal.Decimal `json:"reward"`
+	RewardType string          `json:"reward_type"`
+}
+
+// OrderResponse ответ на запрос статуса заказа
+type OrderResponse struct {
+	Order   string           `json:"order"`
+	Status  string           `json:"status"`
+	Accrual *decimal.Decimal `json:"accrual,omitempty"`
+}
+
+// Fault внедренный ответ, который отдается вместо обычного на ближайшие Count запросов статуса
+type Fault struct {
+	// StatusCode код ответа: 204, 429 или 500
+	StatusCode int
+	// RetryAfter значение заголовка Retry-After для 429
+	RetryAfter time.Duration
+	// Count количество запросов, на которые отдается этот ответ
+	Count int
+}
+
+// order заказ, зарегистрированный в имитации
+type order struct {
+	goods []Good
+	// auto заказ зарегистрирован автоматически при первом запросе
+	auto bool
+	// polls количество запросов статуса
+	polls int
+}
+
+// Stub имитация accrual, реализует http.Handler
+type Stub struct {
+	mutex   sync.Mutex
+	config  Config
+	orders  map[string]*order
+	rules   []RewardRule
+	faults  []Fault
+	window  time.Time
+	counter int
+	router  chi.Router
+}
+
+// New создание имитации с настройками config
+func New(config Config) *Stub {
+	s := &Stub{
+		config: config,
+		orders: make(map[string]*order),
+	}
+
+	r := chi.NewRouter()
+	r.Get("/api/orders/{number}", s.getOrder)
+	r.Post("/api/orders", s.registerOrder)
+	r.Post("/api/goods", s.addRewardRule)
+	s.router = r
+	return s
+}
+
+// ServeHTTP обработка запроса
+func (s *Stub) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	s.router.ServeHTTP(writer, request)
+}
+
+// RegisterOrder регистрация заказа с товарами, заказ без товаров, подходящих под правила, станет INVALID
+func (s *Stub) RegisterOrder(number string, goods []Good) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.orders[number]; ok {
+		return fmt.Errorf("order %s: %w", number, ErrAlreadyExists)
+	}
+	s.orders[number] = &order{goods: goods}
+	return nil
+}
+
+// AddRewardRule добавление правила вознаграждения
+func (s *Stub) AddRewardRule(rule RewardRule) error {
+	if rule.Match == "" {
+		return fmt.Errorf("empty match")
+	}
+	if rule.RewardType != RewardPercent && rule.RewardType != RewardPoints {
+		return fmt.Errorf("unknown reward type: %s", rule.RewardType)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, existing := range s.rules {
+		if existing.Match == rule.Match {
+			return fmt.Errorf("rule for %s: %w", rule.Match, ErrAlreadyExists)
+		}
+	}
+	s.rules = append(s.rules, rule)
+	return nil
+}
+
+// InjectFault внедрение ответа на ближайшие запросы статуса, ответы отдаются в порядке внедрения
+func (s *Stub) InjectFault(fault Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.faults = append(s.faults, fault)
+}
+
+// Polls количество запросов статуса заказа
+func (s *Stub) Polls(number string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if o, ok := s.orders[number]; ok {
+		return o.polls
+	}
+	return 0
+}
+
+// nextFault внедренный или случайный ответ для очередного запроса, вызывается под блокировкой
+func (s *Stub) nextFault(now time.Time) (Fault, bool) {
+	if len(s.faults) > 0 {
+		fault := s.faults[0]
+		s.faults[0].Count--
+		if s.faults[0].Count <= 0 {
+			s.faults = s.faults[1:]
+		}
+		return fault, true
+	}
+
+	if s.config.RateLimit > 0 {
+		if now.Sub(s.window) >= time.Minute {
+			s.window = now
+			s.counter = 0
+		}
+		s.counter++
+		if s.counter > s.config.RateLimit {
+			return Fault{StatusCode: http.StatusTooManyRequests, RetryAfter: s.window.Add(time.Minute).Sub(now)}, true
+		}
+	}
+
+	if s.config.ErrorRate > 0 && rand.Float64() < s.config.ErrorRate {
+		return Fault{StatusCode: http.StatusInternalServerError}, true
+	}
+	return Fault{}, false
+}
+
+// accrual расчет начисления по товарам заказа, false - ни один товар не подошел под правила
+func (s *Stub) accrual(o *order) (decimal.Decimal, bool) {
+	if o.auto {
+		return s.config.DefaultAccrual, true
+	}
+
+	total := decimal.Zero
+	matched := false
+	for _, good := range o.goods {
+		for _, rule := range s.rules {
+			if !strings.Contains(good.Description, rule.Match) {
+				continue
+			}
+			matched = true
+			if rule.RewardType == RewardPercent {
+				total = total.Add(good.Price.Mul(rule.Reward).Div(decimal.NewFromInt(100)))
+			} else {
+				total = total.Add(rule.Reward)
+			}
+			break
+		}
+	}
+	return total.Round(2), matched
+}
+
+// status текущий статус заказа с учетом количества запросов, вызывается под блокировкой
+func (s *Stub) status(number string, o *order) OrderResponse {
+	o.polls++
+	switch {
+	case o.polls <= s.config.Steps:
+		return OrderResponse{Order: number, Status: Registered}
+	case o.polls <= 2*s.config.Steps:
+		return OrderResponse{Order: number, Status: Processing}
+	}
+
+	accrual, ok := s.accrual(o)
+	if !ok {
+		return OrderResponse{Order: number, Status: Invalid}
+	}
+	return OrderResponse{Order: number, Status: Processed, Accrual: &accrual}
+}
+
+// getOrder обработчик запроса статуса заказа, GET /api/orders/{number}
+func (s *Stub) getOrder(writer http.ResponseWriter, request *http.Request) {
+	if s.config.Latency > 0 {
+		select {
+		case <-time.After(s.config.Latency):
+		case <-request.Context().Done():
+			return
+		}
+	}
+
+	number := chi.URLParam(request, "number")
+
+	s.mutex.Lock()
+	fault, injected := s.nextFault(time.Now())
+	var response OrderResponse
+	found := false
+	if !injected {
+		o, ok := s.orders[number]
+		if !ok && s.config.AutoRegister {
+			o = &order{auto: true}
+			s.orders[number] = o
+			ok = true
+		}
+		if ok {
+			response = s.status(number, o)
+			found = true
+		}
+	}
+	s.mutex.Unlock()
+
+	if injected {
+		if fault.StatusCode == http.StatusTooManyRequests {
+			retryAfter := int(fault.RetryAfter.Round(time.Second).Seconds())
+			writer.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+		}
+		writer.WriteHeader(fault.StatusCode)
+		return
+	}
+	if !found {
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(writer).Encode(response)
+}
+
+// registerOrderRequest запрос на регистрацию заказа
+type registerOrderRequest struct {
+	Order string `json:"order"`
+	Goods []Good `json:"goods"`
+}
+
+// registerOrder обработчик регистрации заказа, POST /api/orders
+func (s *Stub) registerOrder(writer http.ResponseWriter, request *http.Request) {
+	var body registerOrderRequest
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil || body.Order == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := s.RegisterOrder(body.Order, body.Goods); err != nil {
+		writer.WriteHeader(http.StatusConflict)
+		return
+	}
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+// addRewardRule обработчик добавления правила вознаграждения, POST /api/goods
+func (s *Stub) addRewardRule(writer http.ResponseWriter, request *http.Request) {
+	var rule RewardRule
+	if err := json.NewDecoder(request.Body).Decode(&rule); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := s.AddRewardRule(rule); err != nil {
+		if errors.Is(err, ErrAlreadyExists) {
+			writer.WriteHeader(http.StatusConflict)
+			return
+		}
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,118 @@
+package accrualstub
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// getOrder запрос статуса заказа у имитации
+func getOrder(t *testing.T, stub *Stub, number string) (*httptest.ResponseRecorder, OrderResponse) {
+	req := httptest.NewRequest(http.MethodGet, "/api/orders/"+number, nil)
+	w := httptest.NewRecorder()
+	stub.ServeHTTP(w, req)
+
+	var response OrderResponse
+	if w.Code == http.StatusOK {
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+	}
+	return w, response
+}
+
+func TestStubLifecycle(t *testing.T) {
+	stub := New(Config{Steps: 1})
+	assert.NoError(t, stub.AddRewardRule(RewardRule{Match: "Bork", Reward: decimal.NewFromInt(10), RewardType: RewardPercent}))
+	assert.NoError(t, stub.AddRewardRule(RewardRule{Match: "LG", Reward: decimal.NewFromInt(25), RewardType: RewardPoints}))
+	assert.NoError(t, stub.RegisterOrder("12345678903", []Good{
+		{Description: "Чайник Bork", Price: decimal.RequireFromString("7000.50")},
+		{Description: "Телевизор LG", Price: decimal.NewFromInt(50000)},
+		{Description: "Пакет", Price: decimal.NewFromInt(5)},
+	}))
+	assert.NoError(t, stub.RegisterOrder("79927398713", []Good{{Description: "Пакет", Price: decimal.NewFromInt(5)}}))
+	assert.ErrorIs(t, stub.RegisterOrder("79927398713", nil), ErrAlreadyExists)
+
+	_, response := getOrder(t, stub, "12345678903")
+	assert.Equal(t, Registered, response.Status)
+	_, response = getOrder(t, stub, "12345678903")
+	assert.Equal(t, Processing, response.Status)
+	_, response = getOrder(t, stub, "12345678903")
+	assert.Equal(t, Processed, response.Status)
+	assert.Equal(t, "725.05", response.Accrual.String())
+
+	// Ни один товар не подошел под правила
+	getOrder(t, stub, "79927398713")
+	getOrder(t, stub, "79927398713")
+	_, response = getOrder(t, stub, "79927398713")
+	assert.Equal(t, Invalid, response.Status)
+	assert.Nil(t, response.Accrual)
+	assert.Equal(t, 3, stub.Polls("79927398713"))
+
+	// Незарегистрированный заказ
+	w, _ := getOrder(t, stub, "2377225624")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestStubAutoRegister(t *testing.T) {
+	stub := New(Config{AutoRegister: true, DefaultAccrual: decimal.NewFromInt(500)})
+
+	w, response := getOrder(t, stub, "2377225624")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, Processed, response.Status)
+	assert.Equal(t, "500", response.Accrual.String())
+}
+
+func TestStubFaults(t *testing.T) {
+	stub := New(Config{AutoRegister: true})
+	stub.InjectFault(Fault{StatusCode: http.StatusTooManyRequests, RetryAfter: 3 * time.Second, Count: 2})
+	stub.InjectFault(Fault{StatusCode: http.StatusInternalServerError})
+
+	w, _ := getOrder(t, stub, "2377225624")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "3", w.Header().Get("Retry-After"))
+	w, _ = getOrder(t, stub, "2377225624")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	w, _ = getOrder(t, stub, "2377225624")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	w, _ = getOrder(t, stub, "2377225624")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestStubRateLimit(t *testing.T) {
+	stub := New(Config{AutoRegister: true, RateLimit: 2})
+
+	for i := 0; i < 2; i++ {
+		w, _ := getOrder(t, stub, "2377225624")
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	w, _ := getOrder(t, stub, "2377225624")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+}
+
+func TestStubAdminAPI(t *testing.T) {
+	stub := New(Config{})
+
+	post := func(path, body string) int {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		stub.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("/api/goods", `{"match":"Bork","reward":10,"reward_type":"%"}`))
+	assert.Equal(t, http.StatusConflict, post("/api/goods", `{"match":"Bork","reward":5,"reward_type":"pt"}`))
+	assert.Equal(t, http.StatusBadRequest, post("/api/goods", `{"match":"LG","reward":5,"reward_type":"x"}`))
+
+	assert.Equal(t, http.StatusAccepted, post("/api/orders", `{"order":"2377225624","goods":[{"description":"Чайник Bork","price":1000}]}`))
+	assert.Equal(t, http.StatusConflict, post("/api/orders", `{"order":"2377225624","goods":[]}`))
+
+	_, response := getOrder(t, stub, "2377225624")
+	assert.Equal(t, Processed, response.Status)
+	assert.Equal(t, "100", response.Accrual.String())
+}
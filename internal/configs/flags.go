@@ -4,7 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
+	"github.com/fngoc/gofermart/internal/hash"
 	"github.com/fngoc/gofermart/internal/logger"
 )
 
@@ -13,23 +16,96 @@ type flags struct {
 	AccrualAddress string
 	ServerAddress  string
 	DBConf         string
+	// AccrualWorkers количество воркеров опроса accrual
+	AccrualWorkers int
+	// AccrualRateLimit общий лимит запросов в секунду к accrual, 0 - без ограничений
+	AccrualRateLimit float64
+	// DBQueryTimeout таймаут одиночного запроса к БД
+	DBQueryTimeout time.Duration
+	// DBTxTimeout таймаут транзакции из нескольких запросов к БД
+	DBTxTimeout time.Duration
+	// StorageType тип хранилища: postgres или memory, пустое значение - postgres при заданных параметрах БД
+	StorageType string
+	// JWTKeysFile путь к JSON файлу с ключами подписи токенов
+	JWTKeysFile string
+	// JWTSecret секрет HS256, если файл ключей не задан, читается только из env
+	JWTSecret string
+	// JWTDevSecret разрешает встроенный секрет при хранилище postgres, только для локального запуска
+	JWTDevSecret bool
+	// JWTTTL время жизни токена доступа
+	JWTTTL time.Duration
+	// RefreshTokenTTL время жизни refresh токена и сессии
+	RefreshTokenTTL time.Duration
+	// JWTIssuer издатель токенов
+	JWTIssuer string
+	// JWTAudience аудитория токенов
+	JWTAudience string
+	// LoginAttempts число неудачных попыток входа подряд по логину до блокировки
+	LoginAttempts int
+	// AddressAttempts число неудачных попыток входа подряд с одного адреса до блокировки
+	AddressAttempts int
+	// HashConcurrency число одновременных вычислений хэша пароля, каждое занимает до 64 МиБ
+	HashConcurrency int
+	// ShutdownTimeout время на завершение текущих запросов и фоновых задач при остановке
+	ShutdownTimeout time.Duration
+	// ShutdownDelay время между отказом проверки готовности и остановкой приема соединений
+	ShutdownDelay time.Duration
+	// HeartbeatTimeout время без heartbeat горутины планировщика, после которого сервис не готов
+	HeartbeatTimeout time.Duration
+	// TraceExporter экспортер спанов трассировки: none, stdout или otlp
+	TraceExporter string
 }
 
 const (
-	defaultServerAddress  string = "localhost:8080"
-	defaultSystemAddress  string = "localhost:9090"
-	defaultPostgresParams        = "host=localhost user=postgres password=postgres dbname=test_db sslmode=disable"
+	defaultServerAddress    string = "localhost:8080"
+	defaultSystemAddress    string = "localhost:9090"
+	defaultPostgresParams          = "host=localhost user=postgres password=postgres dbname=test_db sslmode=disable"
+	defaultAccrualWorkers          = 4
+	defaultAccrualRateLimit        = 10
+	defaultDBQueryTimeout          = 3 * time.Second
+	defaultDBTxTimeout             = 5 * time.Second
+	defaultShutdownTimeout         = 10 * time.Second
+	defaultHeartbeatTimeout        = 30 * time.Second
+	defaultJWTTTL                  = 15 * time.Minute
+	defaultRefreshTokenTTL         = 30 * 24 * time.Hour
+	defaultLoginAttempts           = 5
+	defaultAddressAttempts         = 20
+)
+
+const (
+	// StoragePostgres хранилище в PostgreSQL
+	StoragePostgres = "postgres"
+	// StorageMemory хранилище в памяти процесса, данные теряются при перезапуске
+	StorageMemory = "memory"
 )
 
 // Flags аргументы программы
 var Flags flags
 
 // ParseArgs функция для чтения аргументов программы
-func ParseArgs() {
+func ParseArgs(arguments []string) {
 	flag.StringVar(&Flags.AccrualAddress, "a", defaultServerAddress, "accrual address")
 	flag.StringVar(&Flags.ServerAddress, "r", defaultSystemAddress, "server address")
 	flag.StringVar(&Flags.DBConf, "d", defaultPostgresParams, "db params")
-	flag.Parse()
+	flag.IntVar(&Flags.AccrualWorkers, "w", defaultAccrualWorkers, "accrual polling workers")
+	flag.Float64Var(&Flags.AccrualRateLimit, "l", defaultAccrualRateLimit, "accrual requests per second, 0 - unlimited")
+	flag.DurationVar(&Flags.DBQueryTimeout, "query-timeout", defaultDBQueryTimeout, "db query timeout")
+	flag.DurationVar(&Flags.DBTxTimeout, "tx-timeout", defaultDBTxTimeout, "db transaction timeout")
+	flag.StringVar(&Flags.StorageType, "storage", "", "storage type: postgres or memory")
+	flag.StringVar(&Flags.JWTKeysFile, "jwt-keys", "", "jwt signing keys file")
+	flag.BoolVar(&Flags.JWTDevSecret, "jwt-dev-secret", false, "allow built-in jwt secret with postgres storage")
+	flag.DurationVar(&Flags.JWTTTL, "jwt-ttl", defaultJWTTTL, "jwt lifetime")
+	flag.DurationVar(&Flags.RefreshTokenTTL, "refresh-ttl", defaultRefreshTokenTTL, "refresh token lifetime")
+	flag.StringVar(&Flags.JWTIssuer, "jwt-issuer", "", "jwt issuer")
+	flag.StringVar(&Flags.JWTAudience, "jwt-audience", "", "jwt audience")
+	flag.IntVar(&Flags.LoginAttempts, "login-attempts", defaultLoginAttempts, "failed login attempts per login before lockout")
+	flag.IntVar(&Flags.AddressAttempts, "address-attempts", defaultAddressAttempts, "failed login attempts per client address before lockout")
+	flag.IntVar(&Flags.HashConcurrency, "hash-concurrency", hash.DefaultMaxConcurrentHashing, "concurrent password hashing limit")
+	flag.DurationVar(&Flags.ShutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "graceful shutdown timeout")
+	flag.DurationVar(&Flags.ShutdownDelay, "shutdown-delay", 0, "delay between failing readiness and stopping the server")
+	flag.DurationVar(&Flags.HeartbeatTimeout, "heartbeat-timeout", defaultHeartbeatTimeout, "background tasks heartbeat timeout for readiness")
+	flag.StringVar(&Flags.TraceExporter, "trace-exporter", "none", "trace exporter: none, stdout or otlp")
+	_ = flag.CommandLine.Parse(arguments)
 
 	serverAddressEnv, findAddress := os.LookupEnv("RUN_ADDRESS")
 	accrualAddress, findSystemAddress := os.LookupEnv("ACCRUAL_SYSTEM_ADDRESS")
@@ -44,12 +120,165 @@ func ParseArgs() {
 	if findDBConf {
 		Flags.DBConf = DBConf
 	}
+	if accrualWorkers, find := os.LookupEnv("ACCRUAL_WORKERS"); find {
+		workers, err := strconv.Atoi(accrualWorkers)
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Parse ACCRUAL_WORKERS error: %s", err))
+		} else {
+			Flags.AccrualWorkers = workers
+		}
+	}
+	if accrualRateLimit, find := os.LookupEnv("ACCRUAL_RATE_LIMIT"); find {
+		rps, err := strconv.ParseFloat(accrualRateLimit, 64)
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Parse ACCRUAL_RATE_LIMIT error: %s", err))
+		} else {
+			Flags.AccrualRateLimit = rps
+		}
+	}
+	if queryTimeout, find := os.LookupEnv("DB_QUERY_TIMEOUT"); find {
+		timeout, err := time.ParseDuration(queryTimeout)
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Parse DB_QUERY_TIMEOUT error: %s", err))
+		} else {
+			Flags.DBQueryTimeout = timeout
+		}
+	}
+	if txTimeout, find := os.LookupEnv("DB_TX_TIMEOUT"); find {
+		timeout, err := time.ParseDuration(txTimeout)
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Parse DB_TX_TIMEOUT error: %s", err))
+		} else {
+			Flags.DBTxTimeout = timeout
+		}
+	}
+	if storageType, find := os.LookupEnv("STORAGE_TYPE"); find {
+		Flags.StorageType = storageType
+	}
+	if jwtKeysFile, find := os.LookupEnv("JWT_KEYS_FILE"); find {
+		Flags.JWTKeysFile = jwtKeysFile
+	}
+	Flags.JWTSecret = os.Getenv("JWT_SECRET")
+	if jwtDevSecret, find := os.LookupEnv("JWT_DEV_SECRET"); find {
+		devSecret, err := strconv.ParseBool(jwtDevSecret)
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Parse JWT_DEV_SECRET error: %s", err))
+		} else {
+			Flags.JWTDevSecret = devSecret
+		}
+	}
+	if jwtTTL, find := os.LookupEnv("JWT_TTL"); find {
+		ttl, err := time.ParseDuration(jwtTTL)
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Parse JWT_TTL error: %s", err))
+		} else {
+			Flags.JWTTTL = ttl
+		}
+	}
+	if refreshTTL, find := os.LookupEnv("REFRESH_TOKEN_TTL"); find {
+		ttl, err := time.ParseDuration(refreshTTL)
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Parse REFRESH_TOKEN_TTL error: %s", err))
+		} else {
+			Flags.RefreshTokenTTL = ttl
+		}
+	}
+	if jwtIssuer, find := os.LookupEnv("JWT_ISSUER"); find {
+		Flags.JWTIssuer = jwtIssuer
+	}
+	if jwtAudience, find := os.LookupEnv("JWT_AUDIENCE"); find {
+		Flags.JWTAudience = jwtAudience
+	}
+	if loginAttempts, find := os.LookupEnv("LOGIN_ATTEMPTS"); find {
+		attempts, err := strconv.Atoi(loginAttempts)
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Parse LOGIN_ATTEMPTS error: %s", err))
+		} else {
+			Flags.LoginAttempts = attempts
+		}
+	}
+	if addressAttempts, find := os.LookupEnv("ADDRESS_ATTEMPTS"); find {
+		attempts, err := strconv.Atoi(addressAttempts)
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Parse ADDRESS_ATTEMPTS error: %s", err))
+		} else {
+			Flags.AddressAttempts = attempts
+		}
+	}
+	if hashConcurrency, find := os.LookupEnv("HASH_CONCURRENCY"); find {
+		concurrency, err := strconv.Atoi(hashConcurrency)
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Parse HASH_CONCURRENCY error: %s", err))
+		} else {
+			Flags.HashConcurrency = concurrency
+		}
+	}
+	if shutdownTimeout, find := os.LookupEnv("SHUTDOWN_TIMEOUT"); find {
+		timeout, err := time.ParseDuration(shutdownTimeout)
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Parse SHUTDOWN_TIMEOUT error: %s", err))
+		} else {
+			Flags.ShutdownTimeout = timeout
+		}
+	}
+	if shutdownDelay, find := os.LookupEnv("SHUTDOWN_DELAY"); find {
+		delay, err := time.ParseDuration(shutdownDelay)
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Parse SHUTDOWN_DELAY error: %s", err))
+		} else {
+			Flags.ShutdownDelay = delay
+		}
+	}
+	if heartbeatTimeout, find := os.LookupEnv("HEARTBEAT_TIMEOUT"); find {
+		timeout, err := time.ParseDuration(heartbeatTimeout)
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Parse HEARTBEAT_TIMEOUT error: %s", err))
+		} else {
+			Flags.HeartbeatTimeout = timeout
+		}
+	}
+	if traceExporter, find := os.LookupEnv("TRACE_EXPORTER"); find {
+		Flags.TraceExporter = traceExporter
+	}
+	if Flags.AccrualWorkers < 1 {
+		Flags.AccrualWorkers = 1
+	}
 	logger.Log.Info(
-		fmt.Sprintf("Parse argument's is done, accrual addres: [%s], server addres: [%s], db url: [%s]",
-			Flags.AccrualAddress, Flags.ServerAddress, Flags.DBConf),
+		fmt.Sprintf("Parse argument's is done, accrual addres: [%s], server addres: [%s], db url: [%s], accrual workers: [%d], accrual rps: [%g]",
+			Flags.AccrualAddress, Flags.ServerAddress, Flags.DBConf, Flags.AccrualWorkers, Flags.AccrualRateLimit),
 	)
 }
 
+// ResolveStorageType тип хранилища из -storage или STORAGE_TYPE. Без явного типа используется postgres,
+// если заданы параметры БД. Хранилище в памяти теряет данные при перезапуске, поэтому выбирается
+// только явно, а без параметров БД возвращается ошибка
+func ResolveStorageType() (string, error) {
+	switch Flags.StorageType {
+	case StoragePostgres, StorageMemory:
+		return Flags.StorageType, nil
+	case "":
+		if HasFlagOrEnvPostgresVariable() {
+			return StoragePostgres, nil
+		}
+		return "", fmt.Errorf("database params are not set: use -d or DATABASE_URI, or -storage=%s to run without PostgreSQL", StorageMemory)
+	default:
+		return "", fmt.Errorf("unknown storage type: %s", Flags.StorageType)
+	}
+}
+
+// CheckJWTKeys проверка, что токены не подписываются встроенным секретом в рабочем окружении.
+// Встроенный секрет известен всем, кто видел исходный код, поэтому без файла ключей и JWT_SECRET
+// запуск разрешен только с хранилищем в памяти или с явным -jwt-dev-secret
+func CheckJWTKeys(storageType string) error {
+	if Flags.JWTKeysFile != "" || Flags.JWTSecret != "" {
+		return nil
+	}
+	if storageType == StorageMemory || Flags.JWTDevSecret {
+		return nil
+	}
+	return fmt.Errorf("jwt keys are not set: use -jwt-keys, JWT_KEYS_FILE or JWT_SECRET, or -jwt-dev-secret for local run")
+}
+
 // HasFlagOrEnvPostgresVariable проверка наличия env переменной
 func HasFlagOrEnvPostgresVariable() bool {
 	_, find := os.LookupEnv("DATABASE_URI")
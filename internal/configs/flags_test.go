@@ -55,3 +55,80 @@ func TestHasFlagOrEnvPostgresVariable(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveStorageType(t *testing.T) {
+	os.Unsetenv("DATABASE_URI")
+	defer func() {
+		Flags.StorageType = ""
+		Flags.DBConf = defaultPostgresParams
+	}()
+
+	tests := []struct {
+		name        string
+		storageType string
+		dbConf      string
+		want        string
+		wantErr     bool
+	}{
+		{name: "explicit memory", storageType: StorageMemory, dbConf: defaultPostgresParams, want: StorageMemory},
+		{name: "explicit postgres", storageType: StoragePostgres, dbConf: defaultPostgresParams, want: StoragePostgres},
+		{name: "postgres by db params", dbConf: "host=db user=app dbname=app", want: StoragePostgres},
+		// Без параметров БД хранилище в памяти не выбирается молча
+		{name: "no db params", dbConf: defaultPostgresParams, wantErr: true},
+		{name: "unknown type", storageType: "sqlite", dbConf: defaultPostgresParams, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Flags.StorageType = tt.storageType
+			Flags.DBConf = tt.dbConf
+
+			storageType, err := ResolveStorageType()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, storageType)
+		})
+	}
+}
+
+func TestCheckJWTKeys(t *testing.T) {
+	defer func() {
+		Flags.JWTKeysFile = ""
+		Flags.JWTSecret = ""
+		Flags.JWTDevSecret = false
+	}()
+
+	tests := []struct {
+		name        string
+		keysFile    string
+		secret      string
+		devSecret   bool
+		storageType string
+		wantErr     bool
+	}{
+		{name: "keys file", keysFile: "keys.json", storageType: StoragePostgres},
+		{name: "secret", secret: "secret", storageType: StoragePostgres},
+		{name: "memory storage", storageType: StorageMemory},
+		{name: "dev secret", devSecret: true, storageType: StoragePostgres},
+		// Встроенный секрет не используется с настоящей БД без явного разрешения
+		{name: "built-in secret with postgres", storageType: StoragePostgres, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Flags.JWTKeysFile = tt.keysFile
+			Flags.JWTSecret = tt.secret
+			Flags.JWTDevSecret = tt.devSecret
+
+			err := CheckJWTKeys(tt.storageType)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -4,13 +4,21 @@ package constants
 type contextKey string
 
 const (
-	// New статус нового заказа
-	New string = "NEW"
-	// Processed статус завершенного заказа
-	Processed string = "PROCESSED"
-	// Invalid статус не законченного заказа
-	Invalid string = "INVALID"
+	// LedgerAccrual тип записи журнала операций: начисление за заказ
+	LedgerAccrual string = "ACCRUAL"
+	// LedgerWithdrawal тип записи журнала операций: списание
+	LedgerWithdrawal string = "WITHDRAWAL"
+	// LedgerReversal тип записи журнала операций: возврат списанных баллов
+	LedgerReversal string = "REVERSAL"
+	// LedgerAdjustment тип записи журнала операций: ручная корректировка
+	LedgerAdjustment string = "ADJUSTMENT"
 
+	// HistoryUpload источник записи истории статусов: загрузка заказа пользователем
+	HistoryUpload string = "upload"
+	// HistoryAccrual источник записи истории статусов: ответ accrual
+	HistoryAccrual string = "accrual"
 	// UserNameKey ключ для контекста
 	UserNameKey contextKey = "userName"
+	// SessionIDKey ключ контекста для идентификатора сессии
+	SessionIDKey contextKey = "sessionID"
 )
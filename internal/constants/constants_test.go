@@ -10,13 +10,18 @@ func TestOrderStatusConstants(t *testing.T) {
 	tests := []struct {
 		name     string
 		expected string
-		actual   string
+		actual   OrderStatus
 	}{
 		{
 			name:     "Test New order status",
 			expected: "NEW",
 			actual:   New,
 		},
+		{
+			name:     "Test Processing order status",
+			expected: "PROCESSING",
+			actual:   Processing,
+		},
 		{
 			name:     "Test Processed order status",
 			expected: "PROCESSED",
@@ -31,11 +36,50 @@ func TestOrderStatusConstants(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			assert.Equal(t, tt.expected, tt.actual, "Expected status to match")
+			assert.Equal(t, tt.expected, string(tt.actual), "Expected status to match")
 		})
 	}
 }
 
+func TestParseOrderStatus(t *testing.T) {
+	status, err := ParseOrderStatus("PROCESSING")
+	assert.NoError(t, err)
+	assert.Equal(t, Processing, status)
+
+	_, err = ParseOrderStatus("REGISTERED")
+	assert.Error(t, err)
+	_, err = ParseOrderStatus("new")
+	assert.Error(t, err)
+}
+
+func TestOrderStatusTransitions(t *testing.T) {
+	tests := []struct {
+		from, to OrderStatus
+		allowed  bool
+	}{
+		{from: New, to: Processing, allowed: true},
+		{from: New, to: Processed, allowed: true},
+		{from: New, to: Invalid, allowed: true},
+		{from: Processing, to: Processing, allowed: true},
+		{from: Processing, to: Processed, allowed: true},
+		{from: Processing, to: New, allowed: false},
+		{from: Processed, to: Processing, allowed: false},
+		{from: Processed, to: Processed, allowed: false},
+		{from: Invalid, to: Processed, allowed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.from)+" -> "+string(tt.to), func(t *testing.T) {
+			assert.Equal(t, tt.allowed, tt.from.CanTransitionTo(tt.to))
+		})
+	}
+
+	assert.False(t, New.IsTerminal())
+	assert.False(t, Processing.IsTerminal())
+	assert.True(t, Processed.IsTerminal())
+	assert.True(t, Invalid.IsTerminal())
+}
+
 func TestContextKeyConstants(t *testing.T) {
 	t.Run("Test UserNameKey context key", func(t *testing.T) {
 		expectedKey := contextKey("userName")
@@ -0,0 +1,51 @@
+package constants
+
+import (
+	"fmt"
+	"slices"
+)
+
+// OrderStatus статус заказа в gophermart
+type OrderStatus string
+
+const (
+	// New статус нового заказа, accrual еще не начал его обработку
+	New OrderStatus = "NEW"
+	// Processing статус заказа, который обрабатывается в accrual
+	Processing OrderStatus = "PROCESSING"
+	// Processed статус завершенного заказа, начисление рассчитано
+	Processed OrderStatus = "PROCESSED"
+	// Invalid статус заказа, отклоненного accrual
+	Invalid OrderStatus = "INVALID"
+)
+
+// OrderStatuses все статусы заказа
+var OrderStatuses = []OrderStatus{New, Processing, Invalid, Processed}
+
+// orderTransitions допустимые переходы между статусами, у финальных статусов переходов нет.
+// Повтор нефинального статуса допустим: accrual может несколько раз ответить PROCESSING
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	New:        {New, Processing, Processed, Invalid},
+	Processing: {Processing, Processed, Invalid},
+	Processed:  nil,
+	Invalid:    nil,
+}
+
+// ParseOrderStatus разбор статуса заказа из строки
+func ParseOrderStatus(value string) (OrderStatus, error) {
+	status := OrderStatus(value)
+	if _, ok := orderTransitions[status]; !ok {
+		return "", fmt.Errorf("unknown order status: '%s'", value)
+	}
+	return status, nil
+}
+
+// IsTerminal финальный статус, после него заказ не меняется и не опрашивается
+func (s OrderStatus) IsTerminal() bool {
+	return s == Processed || s == Invalid
+}
+
+// CanTransitionTo допустим ли переход из статуса s в next
+func (s OrderStatus) CanTransitionTo(next OrderStatus) bool {
+	return slices.Contains(orderTransitions[s], next)
+}
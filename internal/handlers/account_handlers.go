@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/fngoc/gofermart/internal/handlers/handlermodels"
+	"github.com/fngoc/gofermart/internal/handlers/middlewares"
+	"github.com/fngoc/gofermart/internal/handlers/problem"
+	"github.com/fngoc/gofermart/internal/hash"
+	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/storage"
+)
+
+// ChangePasswordWebhook обработчик смены пароля, POST HTTP-запрос. Требует текущий пароль,
+// все сессии пользователя, кроме текущей, отзываются
+func ChangePasswordWebhook(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusBadRequest)
+		logger.Log.Info("Method only accepts POST requests")
+		return
+	}
+
+	if !strings.Contains(request.Header.Get("Content-Type"), "application/json") {
+		writer.WriteHeader(http.StatusBadRequest)
+		logger.Log.Info("Need header: 'Content-Type: application/json'")
+		return
+	}
+
+	userName, ok := request.Context().Value(constants.UserNameKey).(string)
+	if !ok {
+		logger.Log.Warn("Something went wrong with jwt token")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sessionID, ok := request.Context().Value(constants.SessionIDKey).(string)
+	if !ok {
+		logger.Log.Warn("Something went wrong with jwt token")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var body handlermodels.ChangePasswordRequest
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		logger.Log.Info(fmt.Sprintf("Decode body error: %s", err))
+		return
+	}
+	if body.CurrentPassword == "" || body.NewPassword == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		logger.Log.Info("Empty current or new password")
+		return
+	}
+
+	// Текущий пароль перебирается так же, как при входе, поэтому попытки ограничиваются общими правилами
+	attempt, err := loginThrottler.Begin(request.Context(), userName, clientAddress(request))
+	if err != nil {
+		problem.WriteError(writer, request, "Change password error", err)
+		return
+	}
+	if attempt.RetryAfter > 0 {
+		writeRetryAfter(writer, attempt.RetryAfter)
+		logger.Log.Info(fmt.Sprintf("Login for user '%s' is locked", userName))
+		return
+	}
+
+	passwordHash, err := storage.Store.GetPasswordHashByUser(request.Context(), userName)
+	if err != nil {
+		releaseLoginAttempt(request.Context(), attempt)
+		problem.WriteError(writer, request, "Change password error", err)
+		return
+	}
+	valid, _, err := hash.VerifyPassword(request.Context(), body.CurrentPassword, passwordHash)
+	if err != nil {
+		releaseLoginAttempt(request.Context(), attempt)
+		problem.WriteError(writer, request, "Change password error", err)
+		return
+	}
+	if !valid {
+		if lockout := loginThrottler.Failure(attempt); lockout > 0 {
+			writeRetryAfter(writer, lockout)
+			return
+		}
+		writer.WriteHeader(http.StatusForbidden)
+		logger.Log.Info("Bad current password")
+		return
+	}
+	// Верный текущий пароль не сбрасывает счетчик логина, попытка только снимается
+	releaseLoginAttempt(request.Context(), attempt)
+
+	newPasswordHash, err := hash.HashPassword(request.Context(), body.NewPassword)
+	if err != nil {
+		problem.WriteError(writer, request, "Change password error", err)
+		return
+	}
+	if err := storage.Store.ChangePassword(request.Context(), userName, newPasswordHash, sessionID); err != nil {
+		problem.WriteError(writer, request, "Change password error", err)
+		return
+	}
+	middlewares.InvalidateUserSessions(userName)
+
+	logger.Log.Info(fmt.Sprintf("Password of user '%s' is changed", userName))
+	writer.WriteHeader(http.StatusOK)
+}
+
+// DeleteUserWebhook обработчик удаления учетной записи, DELETE HTTP-запрос. Пользователь
+// обезличивается, заказы и операции по нему сохраняются для учета
+func DeleteUserWebhook(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodDelete {
+		writer.WriteHeader(http.StatusBadRequest)
+		logger.Log.Info("Method only accepts DELETE requests")
+		return
+	}
+
+	userName, ok := request.Context().Value(constants.UserNameKey).(string)
+	if !ok {
+		logger.Log.Warn("Something went wrong with jwt token")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err := storage.Store.DeleteUser(request.Context(), userName)
+	if err != nil {
+		problem.WriteError(writer, request, "Delete user error", err)
+		return
+	}
+	middlewares.InvalidateUserSessions(userName)
+
+	logger.Log.Info(fmt.Sprintf("User '%s' is deleted", userName))
+	writer.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fngoc/gofermart/internal/handlers/middlewares"
+	"github.com/fngoc/gofermart/internal/hash"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// changePasswordRequest выполнение запроса смены пароля через AuthMiddleware
+func changePasswordRequest(accessToken, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/user/password", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", accessToken)
+	w := httptest.NewRecorder()
+	middlewares.AuthMiddleware(ChangePasswordWebhook)(w, req)
+	return w
+}
+
+// deleteUserRequest выполнение запроса удаления учетной записи через AuthMiddleware
+func deleteUserRequest(accessToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodDelete, "/api/user", nil)
+	req.Header.Set("Authorization", accessToken)
+	w := httptest.NewRecorder()
+	middlewares.AuthMiddleware(DeleteUserWebhook)(w, req)
+	return w
+}
+
+func TestChangePasswordWebhook(t *testing.T) {
+	hash.SetHasher(hash.NewArgon2idHasher(hash.Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+	defer hash.SetHasher(hash.NewArgon2idHasher(hash.DefaultArgon2idParams))
+	storage.SetDBInstance(storage.NewMemoryStorage())
+
+	w := authRequest(RegisterWebhook, `{"login":"password_user","password":"password123"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	current := decodeTokens(t, w)
+	w = authRequest(AuntificationWebhook, `{"login":"password_user","password":"password123"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	other := decodeTokens(t, w)
+
+	w = changePasswordRequest(current.AccessToken, `{"current_password":"wrong","new_password":"newPassword"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = changePasswordRequest(current.AccessToken, `{"current_password":"password123"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = changePasswordRequest(current.AccessToken, `{"current_password":"password123","new_password":"newPassword"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Текущая сессия продолжает работать, остальные отозваны
+	assert.Equal(t, http.StatusOK, refreshRequest(current.RefreshToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, refreshRequest(other.RefreshToken).Code)
+
+	w = authRequest(AuntificationWebhook, `{"login":"password_user","password":"password123"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = authRequest(AuntificationWebhook, `{"login":"password_user","password":"newPassword"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDeleteUserWebhook(t *testing.T) {
+	hash.SetHasher(hash.NewArgon2idHasher(hash.Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+	defer hash.SetHasher(hash.NewArgon2idHasher(hash.DefaultArgon2idParams))
+	memoryStore := storage.NewMemoryStorage()
+	storage.SetDBInstance(memoryStore)
+
+	w := authRequest(RegisterWebhook, `{"login":"deleted_user","password":"password123"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	tokens := decodeTokens(t, w)
+
+	assert.Equal(t, http.StatusOK, deleteUserRequest(tokens.AccessToken).Code)
+
+	// Токены удаленного пользователя больше не действуют, войти нельзя
+	assert.Equal(t, http.StatusUnauthorized, deleteUserRequest(tokens.AccessToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, refreshRequest(tokens.RefreshToken).Code)
+	w = authRequest(AuntificationWebhook, `{"login":"deleted_user","password":"password123"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// Имя можно занять заново
+	w = authRequest(RegisterWebhook, `{"login":"deleted_user","password":"password123"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
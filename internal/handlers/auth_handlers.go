@@ -1,18 +1,34 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fngoc/gofermart/internal/handlers/handlermodels"
 	"github.com/fngoc/gofermart/internal/handlers/jwt"
+	"github.com/fngoc/gofermart/internal/handlers/problem"
 	"github.com/fngoc/gofermart/internal/hash"
 	"github.com/fngoc/gofermart/internal/logger"
 	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/throttle"
 )
 
+// loginThrottler ограничение попыток входа
+var loginThrottler = throttle.New(throttle.DefaultLoginPolicy, throttle.DefaultAddressPolicy)
+
+// SetLoginThrottler замена ограничителя попыток входа
+func SetLoginThrottler(throttler *throttle.Throttler) {
+	loginThrottler = throttler
+}
+
 // RegisterWebhook обработчик регистрации, POST HTTP-запрос
 func RegisterWebhook(writer http.ResponseWriter, request *http.Request) {
 	body, err := authCheckRequest(request)
@@ -22,34 +38,31 @@ func RegisterWebhook(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	if storage.Store.IsUserCreated(body.Login) {
+	if storage.Store.IsUserCreated(request.Context(), body.Login) {
 		writer.WriteHeader(http.StatusConflict)
 		logger.Log.Info("User already exists")
 		return
 	}
 
-	passwordHash, err := hash.HashingPassword(body.Password)
+	passwordHash, err := hash.HashPassword(request.Context(), body.Password)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		logger.Log.Warn(fmt.Sprintf("Registered user error: %s", err))
+		problem.WriteError(writer, request, "Registered user error", err)
 		return
 	}
 
-	jwtToken, err := jwt.BuildJWTByUserName(body.Login)
-	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		logger.Log.Warn(fmt.Sprintf("Registered user error: %s", err))
+	if err := storage.Store.CreateUser(request.Context(), body.Login, passwordHash); err != nil {
+		problem.WriteError(writer, request, "Registered user error", err)
 		return
 	}
-	if err := storage.Store.CreateUser(body.Login, passwordHash, jwtToken); err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		logger.Log.Warn(fmt.Sprintf("Registered user error: %s", err))
+
+	tokens, err := startSession(request.Context(), body.Login)
+	if err != nil {
+		problem.WriteError(writer, request, "Registered user error", err)
 		return
 	}
 
 	logger.Log.Info(fmt.Sprintf("Registered user '%s' successfully", body.Login))
-	writer.Header().Set("Authorization", jwtToken)
-	writer.WriteHeader(http.StatusOK)
+	writeTokens(writer, tokens)
 }
 
 // AuntificationWebhook обработчик аутентификации, POST HTTP-запрос
@@ -61,35 +74,105 @@ func AuntificationWebhook(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	passwordHash, err := hash.HashingPassword(body.Password)
+	// Попытка засчитывается до проверки пароля, параллельные запросы не обходят блокировку
+	attempt, err := loginThrottler.Begin(request.Context(), body.Login, clientAddress(request))
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		logger.Log.Warn(fmt.Sprintf("Auntification user error: %s", err))
+		problem.WriteError(writer, request, "Auntification user error", err)
+		return
+	}
+	if attempt.RetryAfter > 0 {
+		writeRetryAfter(writer, attempt.RetryAfter)
+		logger.Log.Info(fmt.Sprintf("Login for user '%s' is locked", body.Login))
 		return
 	}
 
-	if !storage.Store.IsUserAuthenticated(body.Login, passwordHash) {
-		writer.WriteHeader(http.StatusUnauthorized)
-		logger.Log.Info("Bad username or password")
+	passwordHash, err := storage.Store.GetPasswordHashByUser(request.Context(), body.Login)
+	if errors.Is(err, storage.ErrNotFound) {
+		// Пароль все равно проверяется, иначе по времени ответа видно, что логина нет
+		if err := hash.VerifyDummyPassword(request.Context(), body.Password); err != nil {
+			logger.Log.Warn(fmt.Sprintf("Verify dummy password error: %s", err))
+		}
+		loginFailed(writer, attempt)
+		return
+	}
+	if err != nil {
+		releaseLoginAttempt(request.Context(), attempt)
+		problem.WriteError(writer, request, "Auntification user error", err)
 		return
 	}
 
-	jwtToken, err := jwt.BuildJWTByUserName(body.Login)
+	ok, needsRehash, err := hash.VerifyPassword(request.Context(), body.Password, passwordHash)
 	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		logger.Log.Warn(fmt.Sprintf("Auntification user error: %s", err))
+		releaseLoginAttempt(request.Context(), attempt)
+		problem.WriteError(writer, request, "Auntification user error", err)
 		return
 	}
+	if !ok {
+		loginFailed(writer, attempt)
+		return
+	}
+	if err := loginThrottler.Success(request.Context(), attempt); err != nil {
+		logger.Log.Warn(fmt.Sprintf("Reset login failures error: %s", err))
+	}
+	if needsRehash {
+		// Пароль известен только сейчас, поэтому старый хэш пересчитывается при входе
+		rehashPassword(request.Context(), body.Login, body.Password)
+	}
 
-	if err := storage.Store.SetNewTokenByUser(body.Login, jwtToken); err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		logger.Log.Warn(fmt.Sprintf("Auntification user error: %s", err))
+	tokens, err := startSession(request.Context(), body.Login)
+	if err != nil {
+		problem.WriteError(writer, request, "Auntification user error", err)
 		return
 	}
 
 	logger.Log.Info(fmt.Sprintf("Login user '%s' successfully", body.Login))
-	writer.Header().Set("Authorization", jwtToken)
-	writer.WriteHeader(http.StatusOK)
+	writeTokens(writer, tokens)
+}
+
+// loginFailed неудачная попытка входа: 401, а если попытка привела к блокировке, 429
+func loginFailed(writer http.ResponseWriter, attempt throttle.Attempt) {
+	if lockout := loginThrottler.Failure(attempt); lockout > 0 {
+		writeRetryAfter(writer, lockout)
+		return
+	}
+	writer.WriteHeader(http.StatusUnauthorized)
+	logger.Log.Info("Bad username or password")
+}
+
+// releaseLoginAttempt снятие попытки входа, которая не дошла до проверки пароля из-за ошибки
+func releaseLoginAttempt(ctx context.Context, attempt throttle.Attempt) {
+	if err := loginThrottler.Release(ctx, attempt); err != nil {
+		logger.Log.Warn(fmt.Sprintf("Release login attempt error: %s", err))
+	}
+}
+
+// writeRetryAfter ответ 429 с заголовком Retry-After в целых секундах
+func writeRetryAfter(writer http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	writer.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	writer.WriteHeader(http.StatusTooManyRequests)
+}
+
+// clientAddress адрес клиента без порта
+func clientAddress(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// rehashPassword пересчет хэша пароля текущим алгоритмом, ошибка не мешает входу
+func rehashPassword(ctx context.Context, userName, password string) {
+	passwordHash, err := hash.HashPassword(ctx, password)
+	if err == nil {
+		err = storage.Store.UpdatePasswordHash(ctx, userName, passwordHash)
+	}
+	if err != nil {
+		logger.Log.Warn(fmt.Sprintf("Rehash password for user '%s' error: %s", userName, err))
+		return
+	}
+	logger.Log.Info(fmt.Sprintf("Password hash for user '%s' is upgraded", userName))
 }
 
 // authCheckRequest общие проверки для HTTP-запросов
@@ -115,3 +198,23 @@ func authCheckRequest(request *http.Request) (handlermodels.AuthRequest, error)
 
 	return body, nil
 }
+
+// JWKSWebhook открытые ключи проверки токенов, GET HTTP-запрос
+func JWKSWebhook(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writer.WriteHeader(http.StatusBadRequest)
+		logger.Log.Info("Method only accepts GET requests")
+		return
+	}
+
+	body, err := json.Marshal(jwt.PublicKeys())
+	if err != nil {
+		logger.Log.Warn(fmt.Sprintf("Encode jwks error: %s", err))
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, _ = writer.Write(body)
+}
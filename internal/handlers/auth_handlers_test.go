@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/handlers/problem"
+	"github.com/fngoc/gofermart/internal/hash"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/throttle"
+	"github.com/stretchr/testify/assert"
+)
+
+// authRequest выполнение запроса регистрации или входа
+func authRequest(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestAuntificationWebhook_RehashLegacyPassword(t *testing.T) {
+	hash.SetHasher(hash.NewArgon2idHasher(hash.Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+	defer hash.SetHasher(hash.NewArgon2idHasher(hash.DefaultArgon2idParams))
+
+	memoryStore := storage.NewMemoryStorage()
+	storage.SetDBInstance(memoryStore)
+
+	// Пользователь, зарегистрированный до перехода на argon2id
+	legacyHash, _ := hash.HashingPassword("password123")
+	assert.NoError(t, memoryStore.CreateUser(context.Background(), "legacy_user", legacyHash))
+
+	w := authRequest(AuntificationWebhook, `{"login":"legacy_user","password":"wrong"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = authRequest(AuntificationWebhook, `{"login":"legacy_user","password":"password123"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Authorization"))
+
+	// После входа хэш пересчитан, и вход по-прежнему работает
+	passwordHash, err := memoryStore.GetPasswordHashByUser(context.Background(), "legacy_user")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(passwordHash, "$argon2id$"))
+
+	w = authRequest(AuntificationWebhook, `{"login":"legacy_user","password":"password123"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = authRequest(AuntificationWebhook, `{"login":"unknown_user","password":"password123"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+// countingHasher хэшер, который считает проверки паролей
+type countingHasher struct {
+	hash.Hasher
+	verified atomic.Int32
+}
+
+func (h *countingHasher) Verify(password, encoded string) (bool, bool, error) {
+	h.verified.Add(1)
+	return h.Hasher.Verify(password, encoded)
+}
+
+func TestAuntificationWebhook_UnknownUserVerifiesPassword(t *testing.T) {
+	hasher := &countingHasher{Hasher: hash.NewArgon2idHasher(hash.Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})}
+	hash.SetHasher(hasher)
+	defer hash.SetHasher(hash.NewArgon2idHasher(hash.DefaultArgon2idParams))
+	storage.SetDBInstance(storage.NewMemoryStorage())
+
+	// Для несуществующего логина пароль проверяется так же, как для существующего
+	w := authRequest(AuntificationWebhook, `{"login":"unknown_user","password":"password123"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, int32(1), hasher.verified.Load())
+
+	w = authRequest(RegisterWebhook, `{"login":"known_user","password":"password123"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = authRequest(AuntificationWebhook, `{"login":"known_user","password":"wrong"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, int32(2), hasher.verified.Load())
+}
+
+func TestRegisterWebhook_HashesPassword(t *testing.T) {
+	hash.SetHasher(hash.NewArgon2idHasher(hash.Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+	defer hash.SetHasher(hash.NewArgon2idHasher(hash.DefaultArgon2idParams))
+
+	memoryStore := storage.NewMemoryStorage()
+	storage.SetDBInstance(memoryStore)
+
+	w := authRequest(RegisterWebhook, `{"login":"new_user","password":"password123"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	passwordHash, err := memoryStore.GetPasswordHashByUser(context.Background(), "new_user")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(passwordHash, "$argon2id$"))
+	assert.NotContains(t, passwordHash, "password123")
+
+	w = authRequest(AuntificationWebhook, `{"login":"new_user","password":"password123"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRegisterWebhook_ConcurrentDuplicate(t *testing.T) {
+	hash.SetHasher(hash.NewArgon2idHasher(hash.Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+	defer hash.SetHasher(hash.NewArgon2idHasher(hash.DefaultArgon2idParams))
+
+	// Параллельная регистрация того же логина прошла между проверкой и вставкой
+	storage.SetDBInstance(&mockStorage{
+		IsUserCreatedFunc: func(userName string) bool {
+			return false
+		},
+		CreateUserFunc: func(userName, passwordHash string) error {
+			return fmt.Errorf("insert user: %w", storage.ErrConflict)
+		},
+	})
+
+	w := authRequest(RegisterWebhook, `{"login":"new_user","password":"password123"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, problem.ContentType, w.Header().Get("Content-Type"))
+}
+
+func TestAuntificationWebhook_Lockout(t *testing.T) {
+	hash.SetHasher(hash.NewArgon2idHasher(hash.Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+	defer hash.SetHasher(hash.NewArgon2idHasher(hash.DefaultArgon2idParams))
+	SetLoginThrottler(throttle.New(
+		throttle.Policy{FreeAttempts: 2, BaseLockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour},
+		throttle.DefaultAddressPolicy,
+	))
+	defer SetLoginThrottler(throttle.New(throttle.DefaultLoginPolicy, throttle.DefaultAddressPolicy))
+	storage.SetDBInstance(storage.NewMemoryStorage())
+
+	w := authRequest(RegisterWebhook, `{"login":"locked_user","password":"password123"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	for i := 0; i < 2; i++ {
+		w = authRequest(AuntificationWebhook, `{"login":"locked_user","password":"wrong"}`)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	}
+	w = authRequest(AuntificationWebhook, `{"login":"locked_user","password":"wrong"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	// Во время блокировки не проходит и верный пароль
+	w = authRequest(AuntificationWebhook, `{"login":"locked_user","password":"password123"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// Другой логин с того же адреса не заблокирован
+	w = authRequest(AuntificationWebhook, `{"login":"unknown_user","password":"password123"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
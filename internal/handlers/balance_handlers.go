@@ -11,8 +11,11 @@ import (
 	"github.com/ShiraazMoollatjie/goluhn"
 	"github.com/fngoc/gofermart/internal/constants"
 	"github.com/fngoc/gofermart/internal/handlers/handlermodels"
+	"github.com/fngoc/gofermart/internal/handlers/problem"
 	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/metrics"
 	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/tracing"
 )
 
 // GetBalanceWebhook обработчик получения баланса, GET HTTP-запрос
@@ -29,17 +32,15 @@ func GetBalanceWebhook(writer http.ResponseWriter, request *http.Request) {
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	userID, err := storage.Store.GetUserIDByName(userNameFromToken)
+	userID, err := storage.Store.GetUserIDByName(request.Context(), userNameFromToken)
 	if err != nil {
-		logger.Log.Info(fmt.Sprintf("Balance error: %s", err))
-		writer.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(writer, request, "Balance error", err)
 		return
 	}
 
-	balance, err := storage.Store.GetBalanceByUserID(userID)
+	balance, err := storage.Store.GetBalanceByUserID(request.Context(), userID)
 	if err != nil {
-		logger.Log.Info(fmt.Sprintf("Balance error: %s", err))
-		writer.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(writer, request, "Balance error", err)
 		return
 	}
 
@@ -78,12 +79,19 @@ func PostWithdrawBalanceWebhook(writer http.ResponseWriter, request *http.Reques
 		return
 	}
 
+	if err := body.ValidateSum(); err != nil {
+		logger.Log.Info(fmt.Sprintf("Withdraw sum error: %s", err))
+		writer.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
 	orderID, err := strconv.Atoi(body.Order)
 	if err != nil {
 		logger.Log.Info(fmt.Sprintf("Order error: %s", err))
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	tracing.SetOrderNumber(request.Context(), orderID)
 
 	userNameFromToken, ok := request.Context().Value(constants.UserNameKey).(string)
 	if !ok {
@@ -91,10 +99,9 @@ func PostWithdrawBalanceWebhook(writer http.ResponseWriter, request *http.Reques
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	userID, err := storage.Store.GetUserIDByName(userNameFromToken)
+	userID, err := storage.Store.GetUserIDByName(request.Context(), userNameFromToken)
 	if err != nil {
-		logger.Log.Info(fmt.Sprintf("Balance withdraw error: %s", err))
-		writer.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(writer, request, "Balance withdraw error", err)
 		return
 	}
 
@@ -104,12 +111,11 @@ func PostWithdrawBalanceWebhook(writer http.ResponseWriter, request *http.Reques
 		return
 	}
 
-	_, err = storage.Store.DeductBalance(userID, orderID, body.Sum)
-	if err != nil {
-		logger.Log.Info(fmt.Sprintf("Deduct balance error: %s", err))
-		writer.WriteHeader(http.StatusPaymentRequired)
+	if _, err = storage.Store.DeductBalance(request.Context(), userID, orderID, body.Sum); err != nil {
+		problem.WriteError(writer, request, "Deduct balance error", err)
 		return
 	}
+	metrics.PointsWithdrawn.Add(body.Sum.InexactFloat64())
 
 	writer.WriteHeader(http.StatusOK)
 }
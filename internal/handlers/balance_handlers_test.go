@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/fngoc/gofermart/internal/handlers/problem"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostWithdrawBalanceWebhook_StorageErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		deductErr  error
+		wantStatus int
+	}{
+		{name: "success", deductErr: nil, wantStatus: http.StatusOK},
+		{name: "insufficient funds", deductErr: fmt.Errorf("failed to update balance: %w", storage.ErrInsufficientFunds), wantStatus: http.StatusPaymentRequired},
+		{name: "withdrawal exists", deductErr: storage.ErrWithdrawalExists, wantStatus: http.StatusConflict},
+		{name: "transient", deductErr: fmt.Errorf("failed to update balance: %w", storage.ErrTransient), wantStatus: http.StatusServiceUnavailable},
+		{name: "unknown", deductErr: errors.New("connection refused"), wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage.SetDBInstance(&mockStorage{
+				GetUserIDByNameFunc: func(userName string) (int, error) {
+					return 1, nil
+				},
+				DeductBalanceFunc: func(userID, orderID int, amountToDeduct decimal.Decimal) (decimal.Decimal, error) {
+					return decimal.Zero, tt.deductErr
+				},
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw",
+				bytes.NewBufferString(`{"order":"79927398713","sum":10}`))
+			req.Header.Set("Content-Type", "application/json")
+			req = req.WithContext(context.WithValue(req.Context(), constants.UserNameKey, "test_user"))
+			w := httptest.NewRecorder()
+
+			PostWithdrawBalanceWebhook(w, req)
+
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.deductErr == nil {
+				return
+			}
+			assert.Equal(t, problem.ContentType, w.Header().Get("Content-Type"))
+			var details problem.Details
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &details))
+			assert.Equal(t, tt.wantStatus, details.Status)
+			assert.Equal(t, "/api/user/balance/withdraw", details.Instance)
+			assert.NotContains(t, details.Detail, "connection refused")
+		})
+	}
+}
@@ -1,13 +1,63 @@
 package handlermodels
 
+import (
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
 // AuthRequest схема запроса для регистрации и авторизации
 type AuthRequest struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
 }
 
+// ChangePasswordRequest схема запроса на смену пароля
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// TokenResponse схема ответа с токенами сессии
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	// ExpiresIn время жизни токена доступа в секундах
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// RefreshRequest схема запроса на обновление токенов
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 // WithdrawRequest схема запроса на списание
 type WithdrawRequest struct {
-	Order string  `json:"order"`
-	Sum   float64 `json:"sum"`
+	Order string          `json:"order"`
+	Sum   decimal.Decimal `json:"sum"`
+}
+
+// ValidateSum проверка суммы списания: только положительная и не больше двух знаков после запятой
+func (r WithdrawRequest) ValidateSum() error {
+	if !r.Sum.IsPositive() {
+		return fmt.Errorf("sum must be positive")
+	}
+	if !r.Sum.Equal(r.Sum.Truncate(2)) {
+		return fmt.Errorf("sum must have at most two fractional digits")
+	}
+	return nil
+}
+
+// ComponentHealth состояние компонента сервиса в ответе проверки готовности
+type ComponentHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// LastHeartbeat время последнего heartbeat горутины планировщика
+	LastHeartbeat string `json:"last_heartbeat,omitempty"`
+}
+
+// HealthResponse схема ответа проверок живости и готовности
+type HealthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components,omitempty"`
 }
@@ -2,11 +2,19 @@ package handlermodels
 
 import (
 	"encoding/json"
+	"os"
 	"testing"
 
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestMain(m *testing.M) {
+	// Суммы в JSON сериализуются числами, как в main
+	decimal.MarshalJSONWithoutQuotes = true
+	os.Exit(m.Run())
+}
+
 func TestAuthRequestJSON(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -49,7 +57,7 @@ func TestWithdrawRequestJSON(t *testing.T) {
 			name: "Valid WithdrawRequest",
 			input: WithdrawRequest{
 				Order: "12345",
-				Sum:   100.50,
+				Sum:   decimal.RequireFromString("100.5"),
 			},
 			expectedJSON: `{"order":"12345","sum":100.50}`,
 		},
@@ -70,3 +78,29 @@ func TestWithdrawRequestJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestWithdrawRequestValidateSum(t *testing.T) {
+	tests := []struct {
+		name      string
+		sum       string
+		expectErr bool
+	}{
+		{name: "Valid sum", sum: "100.50", expectErr: false},
+		{name: "Trailing zeros", sum: "100.500", expectErr: false},
+		{name: "Too many fractional digits", sum: "100.505", expectErr: true},
+		{name: "Zero sum", sum: "0", expectErr: true},
+		{name: "Negative sum", sum: "-10", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := WithdrawRequest{Order: "12345", Sum: decimal.RequireFromString(tt.sum)}
+			err := request.ValidateSum()
+			if tt.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
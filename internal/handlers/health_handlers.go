@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/handlers/handlermodels"
+	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/scheduler"
+	"github.com/fngoc/gofermart/internal/storage"
+)
+
+const (
+	// healthOK статус работающего компонента
+	healthOK = "ok"
+	// healthFail статус неработающего компонента
+	healthFail = "fail"
+	// defaultHeartbeatTimeout время без heartbeat, после которого горутина планировщика считается зависшей
+	defaultHeartbeatTimeout = 30 * time.Second
+	// readinessCheckTimeout время на проверки хранилища в проверке готовности
+	readinessCheckTimeout = 2 * time.Second
+)
+
+// heartbeatTimeout время без heartbeat, после которого горутина планировщика считается зависшей
+var heartbeatTimeout = defaultHeartbeatTimeout
+
+// schedulerHeartbeats источник heartbeat горутин планировщика
+var schedulerHeartbeats = scheduler.Heartbeats
+
+// shuttingDown сервис останавливается и не принимает новую нагрузку
+var shuttingDown atomic.Bool
+
+// SetHeartbeatTimeout замена времени без heartbeat, после которого сервис не готов
+func SetHeartbeatTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		heartbeatTimeout = timeout
+	}
+}
+
+// SetShuttingDown отметка о начале остановки, после нее проверка готовности не проходит
+func SetShuttingDown() {
+	shuttingDown.Store(true)
+}
+
+// HealthzWebhook проверка живости: процесс отвечает на запросы, GET HTTP-запрос
+func HealthzWebhook(writer http.ResponseWriter, _ *http.Request) {
+	writeHealth(writer, handlermodels.HealthResponse{Status: healthOK})
+}
+
+// ReadyzWebhook проверка готовности: доступность БД, примененные миграции, heartbeat планировщика
+// и отсутствие остановки, GET HTTP-запрос. Ответ содержит состояние каждого компонента
+func ReadyzWebhook(writer http.ResponseWriter, request *http.Request) {
+	ctx, cancel := context.WithTimeout(request.Context(), readinessCheckTimeout)
+	defer cancel()
+
+	components := make(map[string]handlermodels.ComponentHealth)
+
+	components["database"] = componentHealth("database", storage.Ping(ctx))
+
+	pending, err := storage.PendingMigrations(ctx)
+	components["migrations"] = componentHealth("migrations", err)
+	if err == nil && pending > 0 {
+		components["migrations"] = handlermodels.ComponentHealth{
+			Status: healthFail,
+			Error:  fmt.Sprintf("%d migrations are not applied", pending),
+		}
+	}
+
+	beats := schedulerHeartbeats()
+	for _, component := range scheduler.Components {
+		lastBeat, ok := beats[component]
+		switch {
+		case !ok:
+			components[component] = handlermodels.ComponentHealth{Status: healthFail, Error: "not started"}
+		case time.Since(lastBeat) > heartbeatTimeout:
+			components[component] = handlermodels.ComponentHealth{
+				Status:        healthFail,
+				Error:         fmt.Sprintf("no heartbeat for %s", time.Since(lastBeat).Round(time.Second)),
+				LastHeartbeat: lastBeat.Format(time.RFC3339),
+			}
+		default:
+			components[component] = handlermodels.ComponentHealth{Status: healthOK, LastHeartbeat: lastBeat.Format(time.RFC3339)}
+		}
+	}
+
+	if shuttingDown.Load() {
+		components["shutdown"] = handlermodels.ComponentHealth{Status: healthFail, Error: "shutting down"}
+	}
+
+	response := handlermodels.HealthResponse{Status: healthOK, Components: components}
+	for name, component := range components {
+		if component.Status != healthOK {
+			response.Status = healthFail
+			logger.Log.Debug(fmt.Sprintf("Readiness check failed, %s: %s", name, component.Error))
+		}
+	}
+	writeHealth(writer, response)
+}
+
+// componentHealth состояние компонента по ошибке его проверки, текст ошибки пишется только в лог
+func componentHealth(name string, err error) handlermodels.ComponentHealth {
+	if err != nil {
+		logger.Log.Warn(fmt.Sprintf("Readiness check of %s error: %s", name, err))
+		return handlermodels.ComponentHealth{Status: healthFail, Error: "unavailable"}
+	}
+	return handlermodels.ComponentHealth{Status: healthOK}
+}
+
+// writeHealth запись ответа проверки: 200, если все в порядке, иначе 503
+func writeHealth(writer http.ResponseWriter, response handlermodels.HealthResponse) {
+	body, err := json.Marshal(response)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if response.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	_, _ = writer.Write(body)
+}
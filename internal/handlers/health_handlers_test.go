@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/handlers/handlermodels"
+	"github.com/fngoc/gofermart/internal/scheduler"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthzWebhook(t *testing.T) {
+	w := httptest.NewRecorder()
+	HealthzWebhook(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"status":"ok"}`, w.Body.String())
+}
+
+func TestReadyzWebhook(t *testing.T) {
+	storage.SetDBInstance(storage.NewMemoryStorage())
+	defer func() {
+		schedulerHeartbeats = scheduler.Heartbeats
+		shuttingDown.Store(false)
+	}()
+
+	readyz := func() (int, handlermodels.HealthResponse) {
+		w := httptest.NewRecorder()
+		ReadyzWebhook(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var response handlermodels.HealthResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		return w.Code, response
+	}
+
+	// Все компоненты работают
+	now := time.Now()
+	schedulerHeartbeats = func() map[string]time.Time {
+		return map[string]time.Time{scheduler.AccrualPoller: now, scheduler.StatusUpdater: now}
+	}
+	code, response := readyz()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthOK, response.Status)
+	assert.Equal(t, healthOK, response.Components["database"].Status)
+	assert.Equal(t, healthOK, response.Components["migrations"].Status)
+	assert.Equal(t, healthOK, response.Components[scheduler.AccrualPoller].Status)
+
+	// Опрос accrual завис, горутина обновления статусов не запущена
+	schedulerHeartbeats = func() map[string]time.Time {
+		return map[string]time.Time{scheduler.AccrualPoller: now.Add(-time.Hour)}
+	}
+	code, response = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthFail, response.Status)
+	assert.Equal(t, healthFail, response.Components[scheduler.AccrualPoller].Status)
+	assert.NotEmpty(t, response.Components[scheduler.AccrualPoller].LastHeartbeat)
+	assert.Equal(t, "not started", response.Components[scheduler.StatusUpdater].Error)
+	assert.Equal(t, healthOK, response.Components["database"].Status)
+
+	// Во время остановки готовность не проходит
+	schedulerHeartbeats = func() map[string]time.Time {
+		return map[string]time.Time{scheduler.AccrualPoller: now, scheduler.StatusUpdater: now}
+	}
+	SetShuttingDown()
+	code, response = readyz()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthFail, response.Components["shutdown"].Status)
+
+	// Живость не зависит от готовности
+	w := httptest.NewRecorder()
+	HealthzWebhook(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
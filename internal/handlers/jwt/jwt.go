@@ -1,64 +1,59 @@
 package jwt
 
 import (
-	"fmt"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 )
 
-// Claims структура утверждений, которая включает стандартные утверждения и
-// одно пользовательское UserName
+// Claims структура утверждений, которая включает стандартные утверждения,
+// имя пользователя UserName и идентификатор сессии SessionID
 type Claims struct {
 	jwt.RegisteredClaims
-	UserName string
+	UserName  string
+	SessionID string `json:"sid,omitempty"`
 }
 
 const (
-	// tokenExp жизнь токена
-	tokenExp = time.Hour * 3
-	// secretKey секрет
+	// tokenExp жизнь токена по умолчанию, короткая: долгий вход обеспечивает refresh токен
+	tokenExp = time.Minute * 15
+	// secretKey секрет по умолчанию, только для локального запуска
 	secretKey = "super-secret-key"
 )
 
-// BuildJWTByUserName создаёт токен и возвращает его в виде строки.
-func BuildJWTByUserName(userName string) (string, error) {
-	// создаём новый токен с алгоритмом подписи HS256 и утверждениями — Claims
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
-		RegisteredClaims: jwt.RegisteredClaims{
-			// когда создан токен
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(tokenExp)),
-		},
-		// собственное утверждение
-		UserName: userName,
-	})
+// keys набор ключей, по умолчанию HS256 со встроенным секретом
+var keys, _ = LoadKeySet(Config{})
 
-	// создаём строку токена
-	tokenString, err := token.SignedString([]byte(secretKey))
-	if err != nil {
-		return "", err
-	}
+// SetKeySet замена набора ключей
+func SetKeySet(keySet *KeySet) {
+	keys = keySet
+}
+
+// BuildJWTByUserName создаёт токен сессии sessionID и возвращает его в виде строки.
+func BuildJWTByUserName(userName, sessionID string) (string, error) {
+	return keys.sign(Claims{UserName: userName, SessionID: sessionID})
+}
 
-	// возвращаем строку токена
-	return tokenString, nil
+// ParseToken проверить токен и получить его утверждения
+func ParseToken(tokenString string) (*Claims, error) {
+	return keys.parse(tokenString)
 }
 
 // GetUserNameByToken получить имя пользователя из токена
 func GetUserNameByToken(tokenString string) (string, error) {
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims,
-		func(t *jwt.Token) (interface{}, error) {
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %s", t.Header["alg"])
-			}
-			return []byte(secretKey), nil
-		})
+	claims, err := keys.parse(tokenString)
 	if err != nil {
 		return "", err
 	}
-
-	if !token.Valid {
-		return "", fmt.Errorf("invalid token")
-	}
 	return claims.UserName, nil
 }
+
+// TTL время жизни токена
+func TTL() time.Duration {
+	return keys.ttl
+}
+
+// PublicKeys открытые ключи для проверки токенов сторонними сервисами
+func PublicKeys() JWKS {
+	return keys.JWKS()
+}
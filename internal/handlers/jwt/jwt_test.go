@@ -26,7 +26,7 @@ func TestBuildJWTByUserName(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Генерация токена
-			tokenString, err := BuildJWTByUserName(tt.userName)
+			tokenString, err := BuildJWTByUserName(tt.userName, "sid")
 			assert.NoError(t, err)
 			assert.NotEmpty(t, tokenString)
 
@@ -40,6 +40,7 @@ func TestBuildJWTByUserName(t *testing.T) {
 			assert.NoError(t, err)
 			assert.True(t, token.Valid)
 			assert.Equal(t, tt.userName, claims.UserName)
+			assert.Equal(t, "sid", claims.SessionID)
 			assert.WithinDuration(t, time.Now().Add(tokenExp), claims.ExpiresAt.Time, time.Minute)
 		})
 	}
@@ -70,7 +71,7 @@ func TestGetUserNameByToken(t *testing.T) {
 			// Создаём токен, если это валидный случай
 			if !tt.expectError {
 				var err error
-				tokenString, err = BuildJWTByUserName(tt.userName)
+				tokenString, err = BuildJWTByUserName(tt.userName, "sid")
 				assert.NoError(t, err)
 			} else {
 				// Некорректный токен
@@ -89,3 +90,16 @@ func TestGetUserNameByToken(t *testing.T) {
 		})
 	}
 }
+
+func TestParseToken(t *testing.T) {
+	tokenString, err := BuildJWTByUserName("testUser", "sid")
+	assert.NoError(t, err)
+
+	claims, err := ParseToken(tokenString)
+	assert.NoError(t, err)
+	assert.Equal(t, "testUser", claims.UserName)
+	assert.Equal(t, "sid", claims.SessionID)
+
+	_, err = ParseToken("invalid.token.string")
+	assert.Error(t, err)
+}
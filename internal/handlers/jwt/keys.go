@@ -0,0 +1,323 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// defaultKeyID идентификатор ключа по умолчанию, им же проверяются токены без заголовка kid,
+// выпущенные до появления ротации ключей
+const defaultKeyID = "default"
+
+// Key ключ подписи токенов
+type Key struct {
+	// ID значение заголовка kid
+	ID string
+	// Method алгоритм подписи
+	Method jwt.SigningMethod
+	// signKey ключ подписи, nil - ключ используется только для проверки
+	signKey any
+	// verifyKey ключ проверки
+	verifyKey any
+}
+
+// KeySet набор ключей: одним активным ключом токены подписываются,
+// всеми ключами набора проверяются, что позволяет менять ключи без разлогина пользователей
+type KeySet struct {
+	active   *Key
+	keys     map[string]*Key
+	ttl      time.Duration
+	issuer   string
+	audience string
+}
+
+// Config настройки токенов
+type Config struct {
+	// KeysFile путь к JSON файлу с ключами, см. keysFile
+	KeysFile string
+	// Secret секрет HS256, используется, если файл ключей не задан
+	Secret string
+	// TTL время жизни токена
+	TTL time.Duration
+	// Issuer значение iss, проверяется при разборе токена, если задано
+	Issuer string
+	// Audience значение aud, проверяется при разборе токена, если задано
+	Audience string
+}
+
+// keysFile формат файла ключей. Пути к PEM файлам указываются относительно самого файла
+//
+//	{
+//	  "active": "2024-06",
+//	  "keys": [
+//	    {"kid": "2024-06", "alg": "EdDSA", "private_key_file": "2024-06.pem"},
+//	    {"kid": "2024-01", "alg": "RS256", "public_key_file": "2024-01.pub.pem"},
+//	    {"kid": "default", "alg": "HS256", "secret": "..."}
+//	  ]
+//	}
+type keysFile struct {
+	Active string `json:"active"`
+	Keys   []struct {
+		ID             string `json:"kid"`
+		Algorithm      string `json:"alg"`
+		Secret         string `json:"secret"`
+		PrivateKeyFile string `json:"private_key_file"`
+		PublicKeyFile  string `json:"public_key_file"`
+	} `json:"keys"`
+}
+
+// NewHMACKey ключ HS256
+func NewHMACKey(id string, secret []byte) *Key {
+	return &Key{ID: id, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+}
+
+// NewRSAKey ключ RS256, при privateKey == nil ключ используется только для проверки
+func NewRSAKey(id string, privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey) *Key {
+	key := &Key{ID: id, Method: jwt.SigningMethodRS256, verifyKey: publicKey}
+	if privateKey != nil {
+		key.signKey = privateKey
+		key.verifyKey = &privateKey.PublicKey
+	}
+	return key
+}
+
+// NewEdDSAKey ключ EdDSA (Ed25519), при privateKey == nil ключ используется только для проверки
+func NewEdDSAKey(id string, privateKey ed25519.PrivateKey, publicKey ed25519.PublicKey) *Key {
+	key := &Key{ID: id, Method: jwt.SigningMethodEdDSA, verifyKey: publicKey}
+	if privateKey != nil {
+		key.signKey = privateKey
+		key.verifyKey = privateKey.Public()
+	}
+	return key
+}
+
+// NewKeySet создание набора ключей, токены подписываются ключом activeID
+func NewKeySet(activeID string, keys []*Key, ttl time.Duration, issuer, audience string) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*Key), ttl: ttl, issuer: issuer, audience: audience}
+	for _, key := range keys {
+		if _, ok := ks.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id: %s", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+
+	active, ok := ks.keys[activeID]
+	if !ok {
+		return nil, fmt.Errorf("active key %s not found", activeID)
+	}
+	if active.signKey == nil {
+		return nil, fmt.Errorf("active key %s has no private key", activeID)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("token ttl must be positive")
+	}
+	ks.active = active
+	return ks, nil
+}
+
+// LoadKeySet загрузка ключей из файла или секрета. Без них используется встроенный секрет,
+// что допустимо только для локального запуска
+func LoadKeySet(config Config) (*KeySet, error) {
+	if config.TTL <= 0 {
+		config.TTL = tokenExp
+	}
+
+	if config.KeysFile == "" {
+		secret := config.Secret
+		if secret == "" {
+			secret = secretKey
+		}
+		return NewKeySet(defaultKeyID, []*Key{NewHMACKey(defaultKeyID, []byte(secret))},
+			config.TTL, config.Issuer, config.Audience)
+	}
+
+	content, err := os.ReadFile(config.KeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("read jwt keys error: %w", err)
+	}
+	var file keysFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("parse jwt keys error: %w", err)
+	}
+
+	dir := filepath.Dir(config.KeysFile)
+	readPEM := func(path string) ([]byte, error) {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		return os.ReadFile(path)
+	}
+
+	keys := make([]*Key, 0, len(file.Keys))
+	for _, k := range file.Keys {
+		key, err := loadKey(k.ID, k.Algorithm, k.Secret, k.PrivateKeyFile, k.PublicKeyFile, readPEM)
+		if err != nil {
+			return nil, fmt.Errorf("load jwt key %s error: %w", k.ID, err)
+		}
+		keys = append(keys, key)
+	}
+	return NewKeySet(file.Active, keys, config.TTL, config.Issuer, config.Audience)
+}
+
+// loadKey создание ключа из описания в файле ключей
+func loadKey(id, algorithm, secret, privateKeyFile, publicKeyFile string, readPEM func(string) ([]byte, error)) (*Key, error) {
+	if id == "" {
+		return nil, fmt.Errorf("empty kid")
+	}
+
+	var pemFile string
+	private := privateKeyFile != ""
+	if private {
+		pemFile = privateKeyFile
+	} else {
+		pemFile = publicKeyFile
+	}
+
+	switch algorithm {
+	case jwt.SigningMethodHS256.Alg():
+		if secret == "" {
+			return nil, fmt.Errorf("empty secret")
+		}
+		return NewHMACKey(id, []byte(secret)), nil
+	case jwt.SigningMethodRS256.Alg():
+		content, err := readPEM(pemFile)
+		if err != nil {
+			return nil, err
+		}
+		if private {
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(content)
+			if err != nil {
+				return nil, err
+			}
+			return NewRSAKey(id, privateKey, nil), nil
+		}
+		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(content)
+		if err != nil {
+			return nil, err
+		}
+		return NewRSAKey(id, nil, publicKey), nil
+	case jwt.SigningMethodEdDSA.Alg():
+		content, err := readPEM(pemFile)
+		if err != nil {
+			return nil, err
+		}
+		if private {
+			privateKey, err := jwt.ParseEdPrivateKeyFromPEM(content)
+			if err != nil {
+				return nil, err
+			}
+			return NewEdDSAKey(id, privateKey.(ed25519.PrivateKey), nil), nil
+		}
+		publicKey, err := jwt.ParseEdPublicKeyFromPEM(content)
+		if err != nil {
+			return nil, err
+		}
+		return NewEdDSAKey(id, nil, publicKey.(ed25519.PublicKey)), nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", algorithm)
+	}
+}
+
+// sign подпись утверждений активным ключом
+func (ks *KeySet) sign(claims Claims) (string, error) {
+	now := time.Now()
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ks.ttl))
+	claims.Issuer = ks.issuer
+	if ks.audience != "" {
+		claims.Audience = jwt.ClaimStrings{ks.audience}
+	}
+
+	token := jwt.NewWithClaims(ks.active.Method, claims)
+	token.Header["kid"] = ks.active.ID
+	return token.SignedString(ks.active.signKey)
+}
+
+// parse проверка подписи, срока действия, издателя и аудитории токена
+func (ks *KeySet) parse(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims,
+		func(t *jwt.Token) (interface{}, error) {
+			kid, _ := t.Header["kid"].(string)
+			if kid == "" {
+				kid = defaultKeyID
+			}
+			key, ok := ks.keys[kid]
+			if !ok {
+				return nil, fmt.Errorf("unknown key id: %s", kid)
+			}
+			// Алгоритм берется из ключа, а не из токена, иначе открытый ключ можно выдать за секрет HMAC
+			if t.Method.Alg() != key.Method.Alg() {
+				return nil, fmt.Errorf("unexpected signing method: %s", t.Header["alg"])
+			}
+			return key.verifyKey, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	if ks.issuer != "" && !claims.VerifyIssuer(ks.issuer, true) {
+		return nil, fmt.Errorf("unexpected issuer: %s", claims.Issuer)
+	}
+	if ks.audience != "" && !claims.VerifyAudience(ks.audience, true) {
+		return nil, fmt.Errorf("unexpected audience: %v", claims.Audience)
+	}
+	return claims, nil
+}
+
+// JWK открытый ключ в формате RFC 7517
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	// N и E параметры RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Curve и X параметры Ed25519
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS набор открытых ключей
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS открытые ключи набора, секреты HMAC не публикуются
+func (ks *KeySet) JWKS() JWKS {
+	result := JWKS{Keys: []JWK{}}
+	for _, key := range ks.keys {
+		jwk := JWK{KeyID: key.ID, Algorithm: key.Method.Alg(), Use: "sig"}
+		switch publicKey := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		default:
+			continue
+		}
+		result.Keys = append(result.Keys, jwk)
+	}
+	sort.Slice(result.Keys, func(i, j int) bool {
+		return result.Keys[i].KeyID < result.Keys[j].KeyID
+	})
+	return result
+}
@@ -0,0 +1,176 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeySetRotation(t *testing.T) {
+	oldKey := NewHMACKey("old", []byte("old-secret"))
+	newKey := NewHMACKey("new", []byte("new-secret"))
+
+	before, err := NewKeySet("old", []*Key{oldKey}, time.Hour, "", "")
+	assert.NoError(t, err)
+	oldToken, err := before.sign(Claims{UserName: "testUser"})
+	assert.NoError(t, err)
+
+	// Новый ключ подписывает, старый еще принимается
+	during, err := NewKeySet("new", []*Key{newKey, oldKey}, time.Hour, "", "")
+	assert.NoError(t, err)
+	claims, err := during.parse(oldToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "testUser", claims.UserName)
+
+	newToken, err := during.sign(Claims{UserName: "testUser"})
+	assert.NoError(t, err)
+	parsed, _, err := jwt.NewParser().ParseUnverified(newToken, &Claims{})
+	assert.NoError(t, err)
+	assert.Equal(t, "new", parsed.Header["kid"])
+
+	// Старый ключ выведен из набора
+	after, err := NewKeySet("new", []*Key{newKey}, time.Hour, "", "")
+	assert.NoError(t, err)
+	_, err = after.parse(oldToken)
+	assert.Error(t, err)
+	_, err = after.parse(newToken)
+	assert.NoError(t, err)
+}
+
+func TestKeySetAsymmetric(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	for _, key := range []*Key{NewRSAKey("rsa", rsaKey, nil), NewEdDSAKey("ed", edPrivate, nil)} {
+		t.Run(key.Method.Alg(), func(t *testing.T) {
+			ks, err := NewKeySet(key.ID, []*Key{key}, time.Hour, "", "")
+			assert.NoError(t, err)
+
+			token, err := ks.sign(Claims{UserName: "testUser"})
+			assert.NoError(t, err)
+			claims, err := ks.parse(token)
+			assert.NoError(t, err)
+			assert.Equal(t, "testUser", claims.UserName)
+		})
+	}
+
+	// Ключ только для проверки не может быть активным
+	_, err = NewKeySet("ed", []*Key{NewEdDSAKey("ed", nil, edPublic)}, time.Hour, "", "")
+	assert.Error(t, err)
+}
+
+func TestKeySetRejectsAlgorithmConfusion(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ks, err := NewKeySet("rsa", []*Key{NewRSAKey("rsa", rsaKey, nil)}, time.Hour, "", "")
+	assert.NoError(t, err)
+
+	// Токен HS256, подписанный открытым ключом RSA как секретом
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.NoError(t, err)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{UserName: "attacker"})
+	token.Header["kid"] = "rsa"
+	forged, err := token.SignedString(publicDER)
+	assert.NoError(t, err)
+
+	_, err = ks.parse(forged)
+	assert.Error(t, err)
+}
+
+func TestKeySetClaims(t *testing.T) {
+	key := NewHMACKey(defaultKeyID, []byte("secret"))
+	ks, err := NewKeySet(defaultKeyID, []*Key{key}, time.Hour, "gophermart", "gophermart-api")
+	assert.NoError(t, err)
+
+	token, err := ks.sign(Claims{UserName: "testUser"})
+	assert.NoError(t, err)
+	claims, err := ks.parse(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "gophermart", claims.Issuer)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), claims.ExpiresAt.Time, time.Minute)
+
+	// Другая аудитория и другой издатель
+	other, err := NewKeySet(defaultKeyID, []*Key{key}, time.Hour, "gophermart", "admin-api")
+	assert.NoError(t, err)
+	_, err = other.parse(token)
+	assert.Error(t, err)
+	other, err = NewKeySet(defaultKeyID, []*Key{key}, time.Hour, "someone-else", "gophermart-api")
+	assert.NoError(t, err)
+	_, err = other.parse(token)
+	assert.Error(t, err)
+
+	// Просроченный токен
+	expired, err := NewKeySet(defaultKeyID, []*Key{key}, time.Nanosecond, "", "")
+	assert.NoError(t, err)
+	token, err = expired.sign(Claims{UserName: "testUser"})
+	assert.NoError(t, err)
+	time.Sleep(time.Second)
+	_, err = expired.parse(token)
+	assert.Error(t, err)
+}
+
+func TestLoadKeySetFromFile(t *testing.T) {
+	dir := t.TempDir()
+
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	privateDER, err := x509.MarshalPKCS8PrivateKey(edPrivate)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "ed.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0o600))
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "rsa.pub.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0o600))
+
+	keysPath := filepath.Join(dir, "keys.json")
+	assert.NoError(t, os.WriteFile(keysPath, []byte(`{
+		"active": "ed",
+		"keys": [
+			{"kid": "ed", "alg": "EdDSA", "private_key_file": "ed.pem"},
+			{"kid": "rsa", "alg": "RS256", "public_key_file": "rsa.pub.pem"},
+			{"kid": "default", "alg": "HS256", "secret": "legacy-secret"}
+		]
+	}`), 0o600))
+
+	ks, err := LoadKeySet(Config{KeysFile: keysPath})
+	assert.NoError(t, err)
+
+	token, err := ks.sign(Claims{UserName: "testUser"})
+	assert.NoError(t, err)
+	_, err = ks.parse(token)
+	assert.NoError(t, err)
+
+	// Токен без kid, выпущенный до ротации, проверяется ключом default
+	legacy := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{UserName: "testUser"})
+	legacyToken, err := legacy.SignedString([]byte("legacy-secret"))
+	assert.NoError(t, err)
+	_, err = ks.parse(legacyToken)
+	assert.NoError(t, err)
+
+	// Секрет HMAC в JWKS не попадает
+	jwks := ks.JWKS()
+	assert.Len(t, jwks.Keys, 2)
+	assert.Equal(t, "ed", jwks.Keys[0].KeyID)
+	assert.Equal(t, "OKP", jwks.Keys[0].KeyType)
+	assert.Equal(t, "rsa", jwks.Keys[1].KeyID)
+	assert.Equal(t, "RSA", jwks.Keys[1].KeyType)
+	assert.Equal(t, "AQAB", jwks.Keys[1].E)
+
+	_, err = LoadKeySet(Config{KeysFile: filepath.Join(dir, "missing.json")})
+	assert.Error(t, err)
+}
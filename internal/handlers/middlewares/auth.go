@@ -7,6 +7,7 @@ import (
 
 	"github.com/fngoc/gofermart/internal/constants"
 	"github.com/fngoc/gofermart/internal/handlers/jwt"
+	"github.com/fngoc/gofermart/internal/handlers/problem"
 	"github.com/fngoc/gofermart/internal/logger"
 )
 
@@ -20,14 +21,32 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
-		userName, err := jwt.GetUserNameByToken(token)
+		claims, err := jwt.ParseToken(token)
 		if err != nil {
 			logger.Log.Warn(fmt.Sprintf("Decode jwt error: %s", err))
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		// Токены без сессии выпускались до появления отзыва и отозваны быть не могут
+		if claims.SessionID == "" {
+			logger.Log.Warn("Token without session")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		active, err := sessions.isActive(r.Context(), claims.SessionID, claims.UserName)
+		if err != nil {
+			problem.WriteError(w, r, "Check session error", err)
+			return
+		}
+		if !active {
+			logger.Log.Info(fmt.Sprintf("Session '%s' is revoked or expired", claims.SessionID))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 
-		ctx := context.WithValue(r.Context(), constants.UserNameKey, userName)
+		ctx := context.WithValue(r.Context(), constants.UserNameKey, claims.UserName)
+		ctx = context.WithValue(ctx, constants.SessionIDKey, claims.SessionID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
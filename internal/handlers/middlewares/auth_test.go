@@ -1,13 +1,17 @@
 package middlewares
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/fngoc/gofermart/internal/constants"
 	"github.com/fngoc/gofermart/internal/handlers/jwt"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/storage/storagemodels"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -22,7 +26,20 @@ func mockHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Hello, " + userName))
 }
 
+// setupSessionStorage хранилище в памяти с пользователем testUser и активной сессией sid
+func setupSessionStorage(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	assert.NoError(t, store.CreateUser(context.Background(), "testUser", "hash"))
+	assert.NoError(t, store.CreateSession(context.Background(), storagemodels.Session{
+		ID: "sid", UserName: "testUser", RefreshTokenHash: "hash", ExpiresAt: time.Now().Add(time.Hour),
+	}))
+	storage.SetDBInstance(store)
+	sessions = newSessionCache(sessionCacheTTL, sessionCacheSize)
+}
+
 func TestAuthMiddleware(t *testing.T) {
+	setupSessionStorage(t)
+
 	tests := []struct {
 		name           string
 		token          string
@@ -53,7 +70,7 @@ func TestAuthMiddleware(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			// Генерируем валидный токен для успешного случая
 			if strings.Contains(tt.token, "%s") {
-				tokenString, err := jwt.BuildJWTByUserName("testUser")
+				tokenString, err := jwt.BuildJWTByUserName("testUser", "sid")
 				assert.NoError(t, err)
 				tt.token = strings.Replace(tt.token, "%s", tokenString, 1)
 			}
@@ -81,3 +98,65 @@ func TestAuthMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestAuthMiddlewareSessionRevocation(t *testing.T) {
+	setupSessionStorage(t)
+	handler := AuthMiddleware(mockHandler)
+
+	serve := func(sessionID string) int {
+		token, err := jwt.BuildJWTByUserName("testUser", sessionID)
+		assert.NoError(t, err)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Токен без сессии и токен неизвестной сессии
+	assert.Equal(t, http.StatusUnauthorized, serve(""))
+	assert.Equal(t, http.StatusUnauthorized, serve("unknown"))
+
+	// Результат проверки кэшируется, отзыв вступает в силу после сброса кэша
+	assert.Equal(t, http.StatusOK, serve("sid"))
+	assert.NoError(t, storage.Store.RevokeSession(context.Background(), "sid"))
+	assert.Equal(t, http.StatusOK, serve("sid"))
+	InvalidateSession("sid")
+	assert.Equal(t, http.StatusUnauthorized, serve("sid"))
+}
+
+func TestSessionCacheInvalidateUser(t *testing.T) {
+	setupSessionStorage(t)
+
+	active, err := sessions.isActive(context.Background(), "sid", "testUser")
+	assert.NoError(t, err)
+	assert.True(t, active)
+
+	assert.NoError(t, storage.Store.RevokeUserSessions(context.Background(), "testUser"))
+	InvalidateUserSessions("testUser")
+	active, err = sessions.isActive(context.Background(), "sid", "testUser")
+	assert.NoError(t, err)
+	assert.False(t, active)
+}
+
+func TestSessionCacheEviction(t *testing.T) {
+	setupSessionStorage(t)
+	sessions = newSessionCache(sessionCacheTTL, 2)
+
+	for _, sessionID := range []string{"sid", "first", "second"} {
+		_, err := sessions.isActive(context.Background(), sessionID, "testUser")
+		assert.NoError(t, err)
+		if sessionID == "first" {
+			// Обращение к sid делает его недавно использованным, вытесняется first
+			_, err = sessions.isActive(context.Background(), "sid", "testUser")
+			assert.NoError(t, err)
+		}
+	}
+
+	// Размер кэша не превышает лимит даже при потоке свежих сессий
+	assert.Len(t, sessions.entries, 2)
+	assert.Equal(t, 2, sessions.recent.Len())
+	assert.Contains(t, sessions.entries, "sid")
+	assert.Contains(t, sessions.entries, "second")
+	assert.NotContains(t, sessions.entries, "first")
+}
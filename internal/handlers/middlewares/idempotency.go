@@ -0,0 +1,156 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/fngoc/gofermart/internal/handlers/problem"
+	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+)
+
+const (
+	// IdempotencyKeyHeader заголовок с ключом идемпотентности
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// idempotentReplayedHeader заголовок ответа, повторенного по ключу идемпотентности
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	// maxIdempotencyKeyLength наибольшая длина ключа
+	maxIdempotencyKeyLength = 255
+	// idempotencyReservationTTL время, после которого незавершенный ключ можно захватить заново.
+	// Запрос к этому моменту уже завершен таймаутами БД, а его ответ потерян: реплика упала
+	// или не смогла сохранить ответ
+	idempotencyReservationTTL = time.Minute
+)
+
+// idempotencyWriter запоминает код и тело ответа, передавая их клиенту
+type idempotencyWriter struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (w *idempotencyWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *idempotencyWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+// IdempotencyMiddleware middleware для повтора запросов с заголовком Idempotency-Key: первый ответ
+// сохраняется, повторный запрос с тем же ключом получает его без повторного выполнения.
+// Ключ принадлежит пользователю, поэтому middleware ставится после AuthMiddleware.
+// Ответы 5xx не сохраняются, такой запрос можно повторить с тем же ключом. Повтор отдается
+// с исходным Content-Type
+func IdempotencyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			logger.Log.Info("Idempotency key is too long")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		userName, ok := r.Context().Value(constants.UserNameKey).(string)
+		if !ok {
+			logger.Log.Warn("Something went wrong with jwt token")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		userID, err := storage.Store.GetUserIDByName(r.Context(), userName)
+		if err != nil {
+			problem.WriteError(w, r, "Idempotency error", err)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Log.Info(fmt.Sprintf("Read body error: %s", err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		requestHash := hashRequest(r, body)
+
+		record, reserved, err := storage.Store.ReserveIdempotencyKey(r.Context(), userID, key, requestHash, idempotencyReservationTTL)
+		if err != nil {
+			problem.WriteError(w, r, "Idempotency error", err)
+			return
+		}
+		if !reserved {
+			switch {
+			case record.RequestHash != requestHash:
+				logger.Log.Info("Idempotency key is reused with another request")
+				w.WriteHeader(http.StatusUnprocessableEntity)
+			case record.StatusCode == 0:
+				logger.Log.Info("Request with the same idempotency key is in progress")
+				w.WriteHeader(http.StatusConflict)
+			default:
+				logger.Log.Info(fmt.Sprintf("Replay response for idempotency key '%s'", key))
+				w.Header().Set(idempotentReplayedHeader, "true")
+				if record.ContentType != "" {
+					w.Header().Set("Content-Type", record.ContentType)
+				}
+				w.WriteHeader(record.StatusCode)
+				_, _ = w.Write(record.ResponseBody)
+			}
+			return
+		}
+
+		// Запрос уже выполнен, поэтому ключ сохраняется, даже если клиент отключился
+		ctx := context.WithoutCancel(r.Context())
+		defer func() {
+			// Паника обработчика не оставляет ключ захваченным до истечения idempotencyReservationTTL
+			if p := recover(); p != nil {
+				if err := storage.Store.ReleaseIdempotencyKey(ctx, userID, key); err != nil {
+					logger.Log.Warn(fmt.Sprintf("Release idempotency key error: %s", err))
+				}
+				panic(p)
+			}
+		}()
+
+		iw := &idempotencyWriter{ResponseWriter: w}
+		next.ServeHTTP(iw, r)
+		if iw.statusCode == 0 {
+			iw.statusCode = http.StatusOK
+		}
+
+		if iw.statusCode >= http.StatusInternalServerError {
+			err = storage.Store.ReleaseIdempotencyKey(ctx, userID, key)
+		} else {
+			err = storage.Store.CompleteIdempotencyKey(ctx, userID, key, storagemodels.IdempotencyResponse{
+				StatusCode:   iw.statusCode,
+				ContentType:  w.Header().Get("Content-Type"),
+				ResponseBody: iw.body.Bytes(),
+			})
+		}
+		if err != nil {
+			logger.Log.Warn(fmt.Sprintf("Save idempotency key error: %s", err))
+		}
+	}
+}
+
+// hashRequest хэш метода, пути и тела запроса
+func hashRequest(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
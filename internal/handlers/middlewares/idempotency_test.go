@@ -0,0 +1,103 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/fngoc/gofermart/internal/handlers/problem"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	assert.NoError(t, store.CreateUser(context.Background(), "testUser", "hash"))
+	storage.SetDBInstance(store)
+
+	calls := 0
+	status := http.StatusOK
+	handler := IdempotencyMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("done"))
+	})
+
+	serve := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", bytes.NewBufferString(body))
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		req = req.WithContext(context.WithValue(req.Context(), constants.UserNameKey, "testUser"))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Повтор с тем же ключом получает сохраненный ответ без повторного выполнения
+	w := serve("key-1", `{"order":"2377225624","sum":100}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serve("key-1", `{"order":"2377225624","sum":100}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "done", w.Body.String())
+	assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, 1, calls)
+
+	// Тот же ключ с другим запросом
+	w = serve("key-1", `{"order":"2377225624","sum":200}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Equal(t, 1, calls)
+
+	// Ответ 5xx не сохраняется, запрос можно повторить
+	status = http.StatusInternalServerError
+	w = serve("key-2", `{"order":"2377225624","sum":100}`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	status = http.StatusPaymentRequired
+	w = serve("key-2", `{"order":"2377225624","sum":100}`)
+	assert.Equal(t, http.StatusPaymentRequired, w.Code)
+	assert.Equal(t, 3, calls)
+
+	// Без ключа запрос выполняется каждый раз
+	serve("", `{"order":"2377225624","sum":100}`)
+	serve("", `{"order":"2377225624","sum":100}`)
+	assert.Equal(t, 5, calls)
+}
+
+func TestIdempotencyMiddlewareReplaysContentType(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	assert.NoError(t, store.CreateUser(context.Background(), "testUser", "hash"))
+	storage.SetDBInstance(store)
+
+	calls := 0
+	handler := IdempotencyMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls > 1 {
+			panic("handler failed")
+		}
+		problem.Write(w, r, http.StatusPaymentRequired, "insufficient funds")
+	})
+
+	serve := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/balance/withdraw", bytes.NewBufferString(`{"order":"2377225624","sum":100}`))
+		req.Header.Set(IdempotencyKeyHeader, key)
+		req = req.WithContext(context.WithValue(req.Context(), constants.UserNameKey, "testUser"))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	first := serve("key-1")
+	replayed := serve("key-1")
+	assert.Equal(t, http.StatusPaymentRequired, replayed.Code)
+	assert.Equal(t, "application/problem+json", replayed.Header().Get("Content-Type"))
+	assert.Equal(t, first.Body.String(), replayed.Body.String())
+	assert.Equal(t, 1, calls)
+
+	// Паника обработчика освобождает ключ, повтор выполняется заново, а не получает 409
+	assert.Panics(t, func() { serve("key-2") })
+	assert.Panics(t, func() { serve("key-2") })
+	assert.Equal(t, 3, calls)
+}
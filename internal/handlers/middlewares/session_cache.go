@@ -0,0 +1,115 @@
+package middlewares
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/storage"
+)
+
+const (
+	// sessionCacheTTL время, на которое запоминается результат проверки сессии. Столько же
+	// отозванная на другом экземпляре сервиса сессия может продолжать работать
+	sessionCacheTTL = 10 * time.Second
+	// sessionCacheSize наибольшее число записей в кэше, сверх него вытесняются давно использованные
+	sessionCacheSize = 10000
+)
+
+// sessionCacheEntry результат проверки сессии
+type sessionCacheEntry struct {
+	sessionID string
+	userName  string
+	active    bool
+	expiresAt time.Time
+}
+
+// sessionCache кэш проверок сессий, чтобы не обращаться к хранилищу на каждый запрос.
+// Размер ограничен: при переполнении вытесняются записи, к которым дольше всего не обращались
+type sessionCache struct {
+	mutex sync.Mutex
+	ttl   time.Duration
+	size  int
+	// entries записи по ID сессии, элементы списка recent
+	entries map[string]*list.Element
+	// recent записи от недавно использованных к давно использованным
+	recent *list.List
+}
+
+// sessions кэш проверок сессий
+var sessions = newSessionCache(sessionCacheTTL, sessionCacheSize)
+
+func newSessionCache(ttl time.Duration, size int) *sessionCache {
+	return &sessionCache{ttl: ttl, size: size, entries: make(map[string]*list.Element), recent: list.New()}
+}
+
+// isActive проверка сессии, при промахе кэша результат берется из хранилища
+func (c *sessionCache) isActive(ctx context.Context, sessionID, userName string) (bool, error) {
+	now := time.Now()
+	c.mutex.Lock()
+	if element, ok := c.entries[sessionID]; ok {
+		entry := element.Value.(sessionCacheEntry)
+		if now.Before(entry.expiresAt) {
+			c.recent.MoveToFront(element)
+			c.mutex.Unlock()
+			return entry.active, nil
+		}
+	}
+	c.mutex.Unlock()
+
+	active, err := storage.Store.IsSessionActive(ctx, sessionID)
+	if err != nil {
+		return false, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry := sessionCacheEntry{sessionID: sessionID, userName: userName, active: active, expiresAt: now.Add(c.ttl)}
+	if element, ok := c.entries[sessionID]; ok {
+		element.Value = entry
+		c.recent.MoveToFront(element)
+		return active, nil
+	}
+	c.entries[sessionID] = c.recent.PushFront(entry)
+	for c.recent.Len() > c.size {
+		c.remove(c.recent.Back())
+	}
+	return active, nil
+}
+
+// remove удаление записи из кэша, вызывается под блокировкой
+func (c *sessionCache) remove(element *list.Element) {
+	c.recent.Remove(element)
+	delete(c.entries, element.Value.(sessionCacheEntry).sessionID)
+}
+
+// invalidate удаление сессии из кэша
+func (c *sessionCache) invalidate(sessionID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[sessionID]; ok {
+		c.remove(element)
+	}
+}
+
+// invalidateUser удаление из кэша всех сессий пользователя
+func (c *sessionCache) invalidateUser(userName string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, element := range c.entries {
+		if element.Value.(sessionCacheEntry).userName == userName {
+			c.remove(element)
+		}
+	}
+}
+
+// InvalidateSession сброс кэша после отзыва сессии, чтобы отзыв сразу вступил в силу
+func InvalidateSession(sessionID string) {
+	sessions.invalidate(sessionID)
+}
+
+// InvalidateUserSessions сброс кэша после отзыва всех сессий пользователя
+func InvalidateUserSessions(userName string) {
+	sessions.invalidateUser(userName)
+}
@@ -1,69 +1,169 @@
 package handlers
 
 import (
+	"context"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/constants"
 	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+	"github.com/shopspring/decimal"
 )
 
 // mockStorage имитация хранилища для тестов
 type mockStorage struct {
-	IsUserCreatedFunc             func(userName string) bool
-	IsUserAuthenticatedFunc       func(userName, passwordHash string) bool
-	CreateUserFunc                func(userName, passwordHash, token string) error
-	GetUserIDByNameFunc           func(userName string) (int, error)
-	GetAllTransactionByUserIDFunc func(userID int) ([]storagemodels.Transaction, error)
-	SetNewTokenByUserFunc         func(userName, token string) error
-	GetUserNameByOrderIDFunc      func(orderID int) string
-	CreateOrderFunc               func(userID int, orderID int) error
-	GetAllOrdersByUserIDFunc      func(userID int) ([]storagemodels.Order, error)
-	GetBalanceByUserIDFunc        func(userID int) (storagemodels.Balance, error)
-	DeductBalanceFunc             func(userID, orderID int, amountToDeduct float64) (float64, error)
-	UpdateAccrualDataFunc         func(orderID int, accrual float64, status string) error
-}
-
-func (m *mockStorage) IsUserCreated(userName string) bool {
+	IsUserCreatedFunc                func(userName string) bool
+	GetPasswordHashByUserFunc        func(userName string) (string, error)
+	UpdatePasswordHashFunc           func(userName, passwordHash string) error
+	CreateUserFunc                   func(userName, passwordHash string) error
+	ChangePasswordFunc               func(userName, passwordHash, keepSessionID string) error
+	DeleteUserFunc                   func(userName string) error
+	GetUserIDByNameFunc              func(userName string) (int, error)
+	ListTransactionsByUserIDFunc     func(userID int, query storagemodels.ListQuery) ([]storagemodels.Transaction, *storagemodels.Cursor, error)
+	CreateOrderFunc                  func(userID int, orderID int) (storagemodels.OrderUploadResult, error)
+	GetOrderByNumberFunc             func(userID, orderID int) (storagemodels.OrderDetails, error)
+	ListOrdersByUserIDFunc           func(userID int, query storagemodels.ListQuery) ([]storagemodels.Order, *storagemodels.Cursor, error)
+	GetBalanceByUserIDFunc           func(userID int) (storagemodels.Balance, error)
+	DeductBalanceFunc                func(userID, orderID int, amountToDeduct decimal.Decimal) (decimal.Decimal, error)
+	UpdateAccrualDataFunc            func(orderID int, accrual decimal.Decimal, status constants.OrderStatus, accrualStatus string) (bool, error)
+	LeaseOrdersForCheckFunc          func(limit int, lease time.Duration) ([]storagemodels.QueuedOrder, error)
+	PostponeOrderCheckFunc           func(orderID int, delay time.Duration) error
+	AppendLedgerEntryFunc            func(userID, orderNumber int, entryType string, amount decimal.Decimal) error
+	ReconcileBalancesFunc            func() ([]storagemodels.BalanceDiscrepancy, error)
+	CreateSessionFunc                func(session storagemodels.Session) error
+	RotateSessionFunc                func(oldHash, newHash string, expiresAt time.Time) (storagemodels.Session, error)
+	IsSessionActiveFunc              func(sessionID string) (bool, error)
+	RevokeSessionFunc                func(sessionID string) error
+	RevokeUserSessionsFunc           func(userName string) error
+	RecordLoginFailureFunc           func(key string, policy storagemodels.LoginPolicy) (storagemodels.LoginAttempt, error)
+	ReleaseLoginFailureFunc          func(key string, unlock bool) error
+	ResetLoginFailuresFunc           func(key string) error
+	DeleteExpiredLoginAttemptsFunc   func(retention time.Duration) (int64, error)
+	ReserveIdempotencyKeyFunc        func(userID int, key, requestHash string, reservationTTL time.Duration) (storagemodels.IdempotencyRecord, bool, error)
+	CompleteIdempotencyKeyFunc       func(userID int, key string, response storagemodels.IdempotencyResponse) error
+	ReleaseIdempotencyKeyFunc        func(userID int, key string) error
+	DeleteExpiredIdempotencyKeysFunc func(retention time.Duration) (int64, error)
+}
+
+func (m *mockStorage) IsUserCreated(_ context.Context, userName string) bool {
 	return m.IsUserCreatedFunc(userName)
 }
 
-func (m *mockStorage) IsUserAuthenticated(userName, passwordHash string) bool {
-	return m.IsUserAuthenticatedFunc(userName, passwordHash)
+func (m *mockStorage) GetPasswordHashByUser(_ context.Context, userName string) (string, error) {
+	return m.GetPasswordHashByUserFunc(userName)
 }
 
-func (m *mockStorage) CreateUser(userName, passwordHash, token string) error {
-	return m.CreateUserFunc(userName, passwordHash, token)
+func (m *mockStorage) UpdatePasswordHash(_ context.Context, userName, passwordHash string) error {
+	return m.UpdatePasswordHashFunc(userName, passwordHash)
 }
 
-func (m *mockStorage) SetNewTokenByUser(userName, token string) error {
-	return m.SetNewTokenByUserFunc(userName, token)
+func (m *mockStorage) ChangePassword(_ context.Context, userName, passwordHash, keepSessionID string) error {
+	return m.ChangePasswordFunc(userName, passwordHash, keepSessionID)
 }
 
-func (m *mockStorage) GetUserNameByOrderID(orderID int) string {
-	return m.GetUserNameByOrderIDFunc(orderID)
+func (m *mockStorage) DeleteUser(_ context.Context, userName string) error {
+	return m.DeleteUserFunc(userName)
 }
 
-func (m *mockStorage) CreateOrder(userID int, orderID int) error {
+func (m *mockStorage) CreateUser(_ context.Context, userName, passwordHash string) error {
+	return m.CreateUserFunc(userName, passwordHash)
+}
+
+func (m *mockStorage) CreateOrder(_ context.Context, userID int, orderID int) (storagemodels.OrderUploadResult, error) {
 	return m.CreateOrderFunc(userID, orderID)
 }
 
-func (m *mockStorage) GetAllOrdersByUserID(userID int) ([]storagemodels.Order, error) {
-	return m.GetAllOrdersByUserIDFunc(userID)
+func (m *mockStorage) GetOrderByNumber(_ context.Context, userID, orderID int) (storagemodels.OrderDetails, error) {
+	return m.GetOrderByNumberFunc(userID, orderID)
 }
 
-func (m *mockStorage) GetBalanceByUserID(userID int) (storagemodels.Balance, error) {
+func (m *mockStorage) ListOrdersByUserID(_ context.Context, userID int, query storagemodels.ListQuery) ([]storagemodels.Order, *storagemodels.Cursor, error) {
+	return m.ListOrdersByUserIDFunc(userID, query)
+}
+
+func (m *mockStorage) GetBalanceByUserID(_ context.Context, userID int) (storagemodels.Balance, error) {
 	return m.GetBalanceByUserIDFunc(userID)
 }
 
-func (m *mockStorage) DeductBalance(userID, orderID int, amountToDeduct float64) (float64, error) {
+func (m *mockStorage) DeductBalance(_ context.Context, userID, orderID int, amountToDeduct decimal.Decimal) (decimal.Decimal, error) {
 	return m.DeductBalanceFunc(userID, orderID, amountToDeduct)
 }
 
-func (m *mockStorage) UpdateAccrualData(orderID int, accrual float64, status string) error {
-	return m.UpdateAccrualDataFunc(orderID, accrual, status)
+func (m *mockStorage) UpdateAccrualData(_ context.Context, orderID int, accrual decimal.Decimal, status constants.OrderStatus, accrualStatus string) (bool, error) {
+	return m.UpdateAccrualDataFunc(orderID, accrual, status, accrualStatus)
 }
 
-func (m *mockStorage) GetUserIDByName(userName string) (int, error) {
+func (m *mockStorage) GetUserIDByName(_ context.Context, userName string) (int, error) {
 	return m.GetUserIDByNameFunc(userName)
 }
 
-func (m *mockStorage) GetAllTransactionByUserID(userID int) ([]storagemodels.Transaction, error) {
-	return m.GetAllTransactionByUserIDFunc(userID)
+func (m *mockStorage) ListTransactionsByUserID(_ context.Context, userID int, query storagemodels.ListQuery) ([]storagemodels.Transaction, *storagemodels.Cursor, error) {
+	return m.ListTransactionsByUserIDFunc(userID, query)
+}
+
+func (m *mockStorage) LeaseOrdersForCheck(_ context.Context, limit int, lease time.Duration) ([]storagemodels.QueuedOrder, error) {
+	return m.LeaseOrdersForCheckFunc(limit, lease)
+}
+
+func (m *mockStorage) PostponeOrderCheck(_ context.Context, orderID int, delay time.Duration) error {
+	return m.PostponeOrderCheckFunc(orderID, delay)
+}
+
+func (m *mockStorage) AppendLedgerEntry(_ context.Context, userID, orderNumber int, entryType string, amount decimal.Decimal) error {
+	return m.AppendLedgerEntryFunc(userID, orderNumber, entryType, amount)
+}
+
+func (m *mockStorage) ReconcileBalances(_ context.Context) ([]storagemodels.BalanceDiscrepancy, error) {
+	return m.ReconcileBalancesFunc()
+}
+
+func (m *mockStorage) CreateSession(_ context.Context, session storagemodels.Session) error {
+	return m.CreateSessionFunc(session)
+}
+
+func (m *mockStorage) RotateSession(_ context.Context, oldHash, newHash string, expiresAt time.Time) (storagemodels.Session, error) {
+	return m.RotateSessionFunc(oldHash, newHash, expiresAt)
+}
+
+func (m *mockStorage) IsSessionActive(_ context.Context, sessionID string) (bool, error) {
+	return m.IsSessionActiveFunc(sessionID)
+}
+
+func (m *mockStorage) RevokeSession(_ context.Context, sessionID string) error {
+	return m.RevokeSessionFunc(sessionID)
+}
+
+func (m *mockStorage) RevokeUserSessions(_ context.Context, userName string) error {
+	return m.RevokeUserSessionsFunc(userName)
+}
+
+func (m *mockStorage) RecordLoginFailure(_ context.Context, key string, policy storagemodels.LoginPolicy) (storagemodels.LoginAttempt, error) {
+	return m.RecordLoginFailureFunc(key, policy)
+}
+
+func (m *mockStorage) ReleaseLoginFailure(_ context.Context, key string, unlock bool) error {
+	return m.ReleaseLoginFailureFunc(key, unlock)
+}
+
+func (m *mockStorage) ResetLoginFailures(_ context.Context, key string) error {
+	return m.ResetLoginFailuresFunc(key)
+}
+
+func (m *mockStorage) DeleteExpiredLoginAttempts(_ context.Context, retention time.Duration) (int64, error) {
+	return m.DeleteExpiredLoginAttemptsFunc(retention)
+}
+
+func (m *mockStorage) ReserveIdempotencyKey(_ context.Context, userID int, key, requestHash string, reservationTTL time.Duration) (storagemodels.IdempotencyRecord, bool, error) {
+	return m.ReserveIdempotencyKeyFunc(userID, key, requestHash, reservationTTL)
+}
+
+func (m *mockStorage) CompleteIdempotencyKey(_ context.Context, userID int, key string, response storagemodels.IdempotencyResponse) error {
+	return m.CompleteIdempotencyKeyFunc(userID, key, response)
+}
+
+func (m *mockStorage) ReleaseIdempotencyKey(_ context.Context, userID int, key string) error {
+	return m.ReleaseIdempotencyKeyFunc(userID, key)
+}
+
+func (m *mockStorage) DeleteExpiredIdempotencyKeys(_ context.Context, retention time.Duration) (int64, error) {
+	return m.DeleteExpiredIdempotencyKeysFunc(retention)
 }
@@ -10,9 +10,13 @@ import (
 
 	"github.com/ShiraazMoollatjie/goluhn"
 	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/fngoc/gofermart/internal/handlers/problem"
 	"github.com/fngoc/gofermart/internal/logger"
 	"github.com/fngoc/gofermart/internal/scheduler"
 	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+	"github.com/fngoc/gofermart/internal/tracing"
+	"github.com/go-chi/chi/v5"
 )
 
 // LoadOrderWebhook обработчик сохранения заказа, POST HTTP-запрос
@@ -37,6 +41,7 @@ func LoadOrderWebhook(writer http.ResponseWriter, request *http.Request) {
 		writer.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
+	tracing.SetOrderNumber(request.Context(), orderID)
 
 	if err := goluhn.Validate(strconv.Itoa(orderID)); err != nil {
 		logger.Log.Info("False check Lun Algorithm")
@@ -50,34 +55,27 @@ func LoadOrderWebhook(writer http.ResponseWriter, request *http.Request) {
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	userName := storage.Store.GetUserNameByOrderID(orderID)
-	if userName != "" {
-		if userName == userNameFromToken {
-			writer.WriteHeader(http.StatusOK)
-			return
-		} else if userName != userNameFromToken {
-			writer.WriteHeader(http.StatusConflict)
-			return
-		}
+	userID, err := storage.Store.GetUserIDByName(request.Context(), userNameFromToken)
+	if err != nil {
+		problem.WriteError(writer, request, "Create order error", err)
+		return
 	}
 
-	userID, err := storage.Store.GetUserIDByName(userNameFromToken)
+	result, err := storage.Store.CreateOrder(request.Context(), userID, orderID)
 	if err != nil {
-		logger.Log.Info(fmt.Sprintf("Create order error: %s", err))
-		writer.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(writer, request, "Create order error", err)
 		return
 	}
 
-	if err := storage.Store.CreateOrder(userID, orderID); err != nil {
-		logger.Log.Info(fmt.Sprintf("Create order error: %s", err))
-		writer.WriteHeader(http.StatusInternalServerError)
+	if result == storagemodels.OrderCreated {
+		scheduler.AddOrderInQueue(orderID)
+		writer.WriteHeader(http.StatusAccepted)
 		return
 	}
-	scheduler.AddOrderInQueue(orderID)
-	writer.WriteHeader(http.StatusAccepted)
+	writer.WriteHeader(http.StatusOK)
 }
 
-// ListOrdersWebhook получения всех заказов, GET HTTP-запрос
+// ListOrdersWebhook получение страницы заказов, GET HTTP-запрос
 func ListOrdersWebhook(writer http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
 		writer.WriteHeader(http.StatusBadRequest)
@@ -85,23 +83,28 @@ func ListOrdersWebhook(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	query, err := parseListQuery(request, true)
+	if err != nil {
+		logger.Log.Info(fmt.Sprintf("List order query error: %s", err))
+		problem.Write(writer, request, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	userNameFromToken, ok := request.Context().Value(constants.UserNameKey).(string)
 	if !ok {
 		logger.Log.Warn("Something went wrong with jwt token")
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	userID, err := storage.Store.GetUserIDByName(userNameFromToken)
+	userID, err := storage.Store.GetUserIDByName(request.Context(), userNameFromToken)
 	if err != nil {
-		logger.Log.Info(fmt.Sprintf("List order error: %s", err))
-		writer.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(writer, request, "List order error", err)
 		return
 	}
 
-	orders, err := storage.Store.GetAllOrdersByUserID(userID)
+	orders, next, err := storage.Store.ListOrdersByUserID(request.Context(), userID, query)
 	if err != nil {
-		logger.Log.Info(fmt.Sprintf("Get all orders error: %s", err))
-		writer.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(writer, request, "List order error", err)
 		return
 	}
 
@@ -119,7 +122,77 @@ func ListOrdersWebhook(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	writeNextPage(writer, request, next)
 	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(http.StatusOK)
 	_, _ = writer.Write(buf.Bytes())
 }
+
+// GetOrderWebhook получение заказа пользователя по номеру с историей статусов, GET HTTP-запрос
+func GetOrderWebhook(writer http.ResponseWriter, request *http.Request) {
+	order, ok := findOrder(writer, request)
+	if !ok {
+		return
+	}
+	writeOrderJSON(writer, order)
+}
+
+// GetOrderHistoryWebhook получение истории статусов заказа пользователя, GET HTTP-запрос
+func GetOrderHistoryWebhook(writer http.ResponseWriter, request *http.Request) {
+	order, ok := findOrder(writer, request)
+	if !ok {
+		return
+	}
+	writeOrderJSON(writer, order.History)
+}
+
+// findOrder поиск заказа пользователя по номеру из пути запроса, при ошибке ответ уже записан
+func findOrder(writer http.ResponseWriter, request *http.Request) (storagemodels.OrderDetails, bool) {
+	if request.Method != http.MethodGet {
+		writer.WriteHeader(http.StatusBadRequest)
+		logger.Log.Info("Method only accepts GET requests")
+		return storagemodels.OrderDetails{}, false
+	}
+
+	number := chi.URLParam(request, "number")
+	orderID, err := strconv.Atoi(number)
+	if err != nil || goluhn.Validate(number) != nil {
+		logger.Log.Info(fmt.Sprintf("Invalid order number: '%s'", number))
+		problem.Write(writer, request, http.StatusBadRequest, "invalid order number")
+		return storagemodels.OrderDetails{}, false
+	}
+	tracing.SetOrderNumber(request.Context(), orderID)
+
+	userNameFromToken, ok := request.Context().Value(constants.UserNameKey).(string)
+	if !ok {
+		logger.Log.Warn("Something went wrong with jwt token")
+		writer.WriteHeader(http.StatusBadRequest)
+		return storagemodels.OrderDetails{}, false
+	}
+	userID, err := storage.Store.GetUserIDByName(request.Context(), userNameFromToken)
+	if err != nil {
+		problem.WriteError(writer, request, "Get order error", err)
+		return storagemodels.OrderDetails{}, false
+	}
+
+	order, err := storage.Store.GetOrderByNumber(request.Context(), userID, orderID)
+	if err != nil {
+		problem.WriteError(writer, request, "Get order error", err)
+		return storagemodels.OrderDetails{}, false
+	}
+	return order, true
+}
+
+// writeOrderJSON запись ответа 200 с телом value в JSON
+func writeOrderJSON(writer http.ResponseWriter, value any) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		logger.Log.Warn(fmt.Sprintf("Encode order error: %s", err))
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, _ = writer.Write(body)
+}
@@ -4,24 +4,26 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/fngoc/gofermart/internal/constants"
 	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+	"github.com/go-chi/chi/v5"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestLoadOrderWebhook_Success(t *testing.T) {
 	mockStore := &mockStorage{
-		GetUserNameByOrderIDFunc: func(orderID int) string {
-			return ""
-		},
 		GetUserIDByNameFunc: func(userName string) (int, error) {
 			return 1, nil
 		},
-		CreateOrderFunc: func(userID int, orderID int) error {
-			return nil
+		CreateOrderFunc: func(userID int, orderID int) (storagemodels.OrderUploadResult, error) {
+			return storagemodels.OrderCreated, nil
 		},
 	}
 
@@ -44,8 +46,11 @@ func TestLoadOrderWebhook_Success(t *testing.T) {
 
 func TestLoadOrderWebhook_Conflict(t *testing.T) {
 	mockStore := &mockStorage{
-		GetUserNameByOrderIDFunc: func(orderID int) string {
-			return "another_user"
+		GetUserIDByNameFunc: func(userName string) (int, error) {
+			return 1, nil
+		},
+		CreateOrderFunc: func(userID int, orderID int) (storagemodels.OrderUploadResult, error) {
+			return 0, fmt.Errorf("insert order: %w", storage.ErrDuplicateOrder)
 		},
 	}
 
@@ -104,3 +109,118 @@ func TestLoadOrderWebhook_LuhnCheckFail(t *testing.T) {
 		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
 	}
 }
+
+func TestLoadOrderWebhook_MemoryStorage(t *testing.T) {
+	memoryStore := storage.NewMemoryStorage()
+	assert.NoError(t, memoryStore.CreateUser(context.Background(), "test_user", "hash"))
+	assert.NoError(t, memoryStore.CreateUser(context.Background(), "another_user", "hash"))
+	storage.SetDBInstance(memoryStore)
+
+	loadOrder := func(userName string) int {
+		requestBody, _ := json.Marshal(79927398713)
+		req := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(requestBody))
+		req.Header.Set("Content-Type", "text/plain")
+		req = req.WithContext(context.WithValue(req.Context(), constants.UserNameKey, userName))
+		w := httptest.NewRecorder()
+		LoadOrderWebhook(w, req)
+		return w.Code
+	}
+
+	// Новый заказ, повторная загрузка тем же пользователем и загрузка чужого заказа
+	assert.Equal(t, http.StatusAccepted, loadOrder("test_user"))
+	assert.Equal(t, http.StatusOK, loadOrder("test_user"))
+	assert.Equal(t, http.StatusConflict, loadOrder("another_user"))
+
+	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	req = req.WithContext(context.WithValue(req.Context(), constants.UserNameKey, "test_user"))
+	w := httptest.NewRecorder()
+	ListOrdersWebhook(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var orders []storagemodels.Order
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&orders))
+	assert.Len(t, orders, 1)
+	assert.Equal(t, "79927398713", orders[0].Number)
+	assert.Equal(t, constants.New, orders[0].Status)
+}
+
+func TestGetOrderWebhook_MemoryStorage(t *testing.T) {
+	memoryStore := storage.NewMemoryStorage()
+	assert.NoError(t, memoryStore.CreateUser(context.Background(), "test_user", "hash"))
+	assert.NoError(t, memoryStore.CreateUser(context.Background(), "another_user", "hash"))
+	_, err := memoryStore.CreateOrder(context.Background(), 1, 79927398713)
+	assert.NoError(t, err)
+	_, err = memoryStore.UpdateAccrualData(context.Background(), 79927398713, decimal.RequireFromString("500"), constants.Processed, "PROCESSED")
+	assert.NoError(t, err)
+	storage.SetDBInstance(memoryStore)
+
+	getOrder := func(userName, number string) *httptest.ResponseRecorder {
+		return serveOrder(GetOrderWebhook, userName, number)
+	}
+
+	w := getOrder("test_user", "79927398713")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var order storagemodels.OrderDetails
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&order))
+	assert.Equal(t, "79927398713", order.Number)
+	assert.Equal(t, constants.Processed, order.Status)
+	assert.Equal(t, "500", order.Accrual.String())
+	assert.NotEmpty(t, order.LastCheckedAt)
+	assert.Len(t, order.History, 2)
+
+	// Чужой заказ не раскрывается
+	assert.Equal(t, http.StatusNotFound, getOrder("another_user", "79927398713").Code)
+	// Номер не проходит проверку алгоритмом Луна
+	assert.Equal(t, http.StatusBadRequest, getOrder("test_user", "123").Code)
+	assert.Equal(t, http.StatusBadRequest, getOrder("test_user", "abc").Code)
+}
+
+func TestGetOrderHistoryWebhook_MemoryStorage(t *testing.T) {
+	memoryStore := storage.NewMemoryStorage()
+	assert.NoError(t, memoryStore.CreateUser(context.Background(), "test_user", "hash"))
+	assert.NoError(t, memoryStore.CreateUser(context.Background(), "another_user", "hash"))
+	_, err := memoryStore.CreateOrder(context.Background(), 1, 79927398713)
+	assert.NoError(t, err)
+	for _, accrualStatus := range []string{"REGISTERED", "PROCESSING", "PROCESSING", "PROCESSED"} {
+		status := constants.Processing
+		if accrualStatus == "PROCESSED" {
+			status = constants.Processed
+		}
+		_, err = memoryStore.UpdateAccrualData(context.Background(), 79927398713, decimal.Zero, status, accrualStatus)
+		assert.NoError(t, err)
+	}
+	storage.SetDBInstance(memoryStore)
+
+	w := serveOrder(GetOrderHistoryWebhook, "test_user", "79927398713")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var history []storagemodels.OrderStatusChange
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&history))
+	assert.Len(t, history, 4)
+	assert.Equal(t, constants.New, history[0].Status)
+	assert.Equal(t, constants.HistoryUpload, history[0].Source)
+	assert.Empty(t, history[0].AccrualStatus)
+	// Промежуточные статусы accrual видны в истории, хотя оба показываются как PROCESSING
+	assert.Equal(t, constants.Processing, history[1].Status)
+	assert.Equal(t, "REGISTERED", history[1].AccrualStatus)
+	assert.Equal(t, 1, history[1].PollCount)
+	assert.Equal(t, constants.Processing, history[2].Status)
+	assert.Equal(t, "PROCESSING", history[2].AccrualStatus)
+	assert.Equal(t, 2, history[2].PollCount)
+	assert.Equal(t, constants.Processed, history[3].Status)
+	assert.Equal(t, constants.HistoryAccrual, history[3].Source)
+	assert.Equal(t, 4, history[3].PollCount)
+
+	assert.Equal(t, http.StatusNotFound, serveOrder(GetOrderHistoryWebhook, "another_user", "79927398713").Code)
+}
+
+// serveOrder вызов обработчика заказа с номером в параметре пути
+func serveOrder(handler http.HandlerFunc, userName, number string) *httptest.ResponseRecorder {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("number", number)
+	req := httptest.NewRequest(http.MethodGet, "/orders/"+number, nil)
+	ctx := context.WithValue(req.Context(), constants.UserNameKey, userName)
+	req = req.WithContext(context.WithValue(ctx, chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+)
+
+const (
+	// defaultPageLimit размер страницы списка по умолчанию
+	defaultPageLimit = 50
+	// maxPageLimit наибольший размер страницы списка
+	maxPageLimit = 100
+	// nextCursorHeader заголовок с курсором следующей страницы
+	nextCursorHeader = "X-Next-Cursor"
+)
+
+// parseListQuery разбор параметров списка: limit, cursor, from, to, sort и, если withStatus, status
+func parseListQuery(request *http.Request, withStatus bool) (storagemodels.ListQuery, error) {
+	values := request.URL.Query()
+	query := storagemodels.ListQuery{Limit: defaultPageLimit}
+
+	if limit := values.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > maxPageLimit {
+			return storagemodels.ListQuery{}, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		query.Limit = value
+	}
+
+	if cursor := values.Get("cursor"); cursor != "" {
+		after, err := decodeCursor(cursor)
+		if err != nil {
+			return storagemodels.ListQuery{}, err
+		}
+		query.After = &after
+	}
+
+	if withStatus {
+		for _, value := range values["status"] {
+			for _, status := range strings.Split(value, ",") {
+				orderStatus, err := constants.ParseOrderStatus(strings.ToUpper(strings.TrimSpace(status)))
+				if err != nil {
+					return storagemodels.ListQuery{}, err
+				}
+				query.Statuses = append(query.Statuses, orderStatus)
+			}
+		}
+	}
+
+	var err error
+	if query.From, err = parseListTime(values.Get("from")); err != nil {
+		return storagemodels.ListQuery{}, err
+	}
+	if query.To, err = parseListTime(values.Get("to")); err != nil {
+		return storagemodels.ListQuery{}, err
+	}
+	if !query.From.IsZero() && !query.To.IsZero() && !query.From.Before(query.To) {
+		return storagemodels.ListQuery{}, fmt.Errorf("from must be before to")
+	}
+
+	switch values.Get("sort") {
+	case "", "desc":
+	case "asc":
+		query.Ascending = true
+	default:
+		return storagemodels.ListQuery{}, fmt.Errorf("sort must be 'asc' or 'desc'")
+	}
+
+	return query, nil
+}
+
+// parseListTime разбор границы периода в RFC 3339, пустое значение - без ограничения
+func parseListTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time must be in RFC 3339: '%s'", value)
+	}
+	return parsed.UTC(), nil
+}
+
+// encodeCursor непрозрачное представление курсора для клиента
+func encodeCursor(cursor storagemodels.Cursor) string {
+	raw := fmt.Sprintf("%d:%d", cursor.At.UnixNano(), cursor.Number)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor разбор курсора, выданного encodeCursor
+func decodeCursor(value string) (storagemodels.Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return storagemodels.Cursor{}, fmt.Errorf("invalid cursor")
+	}
+	at, number, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return storagemodels.Cursor{}, fmt.Errorf("invalid cursor")
+	}
+	nanos, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		return storagemodels.Cursor{}, fmt.Errorf("invalid cursor")
+	}
+	orderNumber, err := strconv.Atoi(number)
+	if err != nil {
+		return storagemodels.Cursor{}, fmt.Errorf("invalid cursor")
+	}
+	return storagemodels.Cursor{At: time.Unix(0, nanos).UTC(), Number: orderNumber}, nil
+}
+
+// writeNextPage заголовки со ссылкой на следующую страницу, если она есть
+func writeNextPage(writer http.ResponseWriter, request *http.Request, next *storagemodels.Cursor) {
+	if next == nil {
+		return
+	}
+	cursor := encodeCursor(*next)
+
+	nextURL := *request.URL
+	values := nextURL.Query()
+	values.Set("cursor", cursor)
+	nextURL.RawQuery = values.Encode()
+
+	writer.Header().Set(nextCursorHeader, cursor)
+	writer.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextURL.RequestURI()))
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListQuery(t *testing.T) {
+	cursor := storagemodels.Cursor{At: time.Date(2024, 10, 1, 12, 0, 0, 123456000, time.UTC), Number: 79927398713}
+
+	tests := []struct {
+		name    string
+		query   string
+		want    storagemodels.ListQuery
+		wantErr bool
+	}{
+		{
+			name:  "defaults",
+			query: "",
+			want:  storagemodels.ListQuery{Limit: defaultPageLimit},
+		},
+		{
+			name:  "all parameters",
+			query: "limit=10&cursor=" + encodeCursor(cursor) + "&status=new,processed&status=INVALID&from=2024-10-01T00:00:00%2B03:00&to=2024-11-01T00:00:00Z&sort=asc",
+			want: storagemodels.ListQuery{
+				Limit:     10,
+				After:     &cursor,
+				Statuses:  []constants.OrderStatus{constants.New, constants.Processed, constants.Invalid},
+				From:      time.Date(2024, 9, 30, 21, 0, 0, 0, time.UTC),
+				To:        time.Date(2024, 11, 1, 0, 0, 0, 0, time.UTC),
+				Ascending: true,
+			},
+		},
+		{name: "zero limit", query: "limit=0", wantErr: true},
+		{name: "limit above max", query: "limit=101", wantErr: true},
+		{name: "broken cursor", query: "cursor=abc", wantErr: true},
+		{name: "unknown status", query: "status=DONE", wantErr: true},
+		{name: "bad time", query: "from=yesterday", wantErr: true},
+		{name: "empty period", query: "from=2024-11-01T00:00:00Z&to=2024-10-01T00:00:00Z", wantErr: true},
+		{name: "bad sort", query: "sort=up", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/user/orders?"+tt.query, nil)
+			query, err := parseListQuery(req, true)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, query)
+		})
+	}
+}
+
+func TestListOrdersWebhook_Pages(t *testing.T) {
+	memoryStore := storage.NewMemoryStorage()
+	assert.NoError(t, memoryStore.CreateUser(context.Background(), "test_user", "hash"))
+	for _, orderID := range []int{79927398713, 2377225624, 12345678903} {
+		_, err := memoryStore.CreateOrder(context.Background(), 1, orderID)
+		assert.NoError(t, err)
+	}
+	storage.SetDBInstance(memoryStore)
+
+	listOrders := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req = req.WithContext(context.WithValue(req.Context(), constants.UserNameKey, "test_user"))
+		w := httptest.NewRecorder()
+		ListOrdersWebhook(w, req)
+		return w
+	}
+
+	w := listOrders("/api/user/orders?limit=2&status=NEW")
+	assert.Equal(t, http.StatusOK, w.Code)
+	cursor := w.Header().Get(nextCursorHeader)
+	assert.NotEmpty(t, cursor)
+
+	link := w.Header().Get("Link")
+	assert.True(t, strings.HasSuffix(link, `>; rel="next"`))
+	next, err := url.Parse(strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`))
+	assert.NoError(t, err)
+	assert.Equal(t, "/api/user/orders", next.Path)
+	assert.Equal(t, "2", next.Query().Get("limit"))
+	assert.Equal(t, "NEW", next.Query().Get("status"))
+	assert.Equal(t, cursor, next.Query().Get("cursor"))
+
+	w = listOrders(next.RequestURI())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Link"))
+	assert.Empty(t, w.Header().Get(nextCursorHeader))
+
+	w = listOrders("/api/user/orders?limit=abc")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,81 @@
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/storage"
+)
+
+// ContentType тип содержимого ответа с ошибкой
+const ContentType = "application/problem+json"
+
+// transientRetryAfter значение Retry-After в секундах при временной ошибке хранилища
+const transientRetryAfter = "1"
+
+// Details тело ответа с ошибкой по RFC 7807
+type Details struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// Write ответ с ошибкой status и пояснением detail
+func Write(writer http.ResponseWriter, request *http.Request, status int, detail string) {
+	body, err := json.Marshal(Details{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: request.URL.Path,
+	})
+	if err != nil {
+		writer.WriteHeader(status)
+		return
+	}
+
+	writer.Header().Set("Content-Type", ContentType)
+	writer.WriteHeader(status)
+	_, _ = writer.Write(body)
+}
+
+// WriteError ответ на ошибку хранилища: код выбирается по категории ошибки, подробности
+// внутренних ошибок клиенту не передаются и только пишутся в лог с описанием операции op
+func WriteError(writer http.ResponseWriter, request *http.Request, op string, err error) {
+	status, detail := Status(err)
+	if status >= http.StatusInternalServerError {
+		logger.Log.Warn(fmt.Sprintf("%s: %s", op, err))
+	} else {
+		logger.Log.Info(fmt.Sprintf("%s: %s", op, err))
+	}
+
+	if errors.Is(err, storage.ErrTransient) {
+		writer.Header().Set("Retry-After", transientRetryAfter)
+	}
+	Write(writer, request, status, detail)
+}
+
+// Status код ответа и пояснение для ошибки хранилища
+func Status(err error) (int, string) {
+	switch {
+	case errors.Is(err, storage.ErrWithdrawalExists):
+		return http.StatusConflict, "withdrawal for this order already exists"
+	case errors.Is(err, storage.ErrDuplicateOrder):
+		return http.StatusConflict, "order is already uploaded by another user"
+	case errors.Is(err, storage.ErrConflict):
+		return http.StatusConflict, "conflict with existing data"
+	case errors.Is(err, storage.ErrInsufficientFunds):
+		return http.StatusPaymentRequired, "insufficient funds"
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound, "not found"
+	case errors.Is(err, storage.ErrTransient):
+		return http.StatusServiceUnavailable, "storage is temporarily unavailable"
+	default:
+		return http.StatusInternalServerError, "internal error"
+	}
+}
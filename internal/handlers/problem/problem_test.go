@@ -0,0 +1,58 @@
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "not found", err: fmt.Errorf("user: %w", storage.ErrNotFound), want: http.StatusNotFound},
+		{name: "session not found", err: storage.ErrSessionNotFound, want: http.StatusNotFound},
+		{name: "conflict", err: fmt.Errorf("insert: %w", storage.ErrConflict), want: http.StatusConflict},
+		{name: "duplicate order", err: fmt.Errorf("insert: %w", storage.ErrDuplicateOrder), want: http.StatusConflict},
+		{name: "insufficient funds", err: storage.ErrInsufficientFunds, want: http.StatusPaymentRequired},
+		{name: "transient", err: fmt.Errorf("select: %w", storage.ErrTransient), want: http.StatusServiceUnavailable},
+		{name: "unknown", err: errors.New("boom"), want: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, detail := Status(tt.err)
+			assert.Equal(t, tt.want, status)
+			assert.NotEmpty(t, detail)
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/user/balance", nil)
+	w := httptest.NewRecorder()
+
+	WriteError(w, req, "Balance error", fmt.Errorf("select: %w", storage.ErrTransient))
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, ContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	var details Details
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &details))
+	assert.Equal(t, Details{
+		Type:     "about:blank",
+		Title:    "Service Unavailable",
+		Status:   http.StatusServiceUnavailable,
+		Detail:   "storage is temporarily unavailable",
+		Instance: "/api/user/balance",
+	}, details)
+}
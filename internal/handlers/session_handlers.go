@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/fngoc/gofermart/internal/handlers/handlermodels"
+	"github.com/fngoc/gofermart/internal/handlers/jwt"
+	"github.com/fngoc/gofermart/internal/handlers/middlewares"
+	"github.com/fngoc/gofermart/internal/handlers/problem"
+	"github.com/fngoc/gofermart/internal/hash"
+	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+)
+
+// defaultRefreshTokenTTL время жизни refresh токена по умолчанию
+const defaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+// refreshTokenTTL время жизни refresh токена и сессии
+var refreshTokenTTL = defaultRefreshTokenTTL
+
+// SetRefreshTokenTTL замена времени жизни refresh токена
+func SetRefreshTokenTTL(ttl time.Duration) {
+	if ttl > 0 {
+		refreshTokenTTL = ttl
+	}
+}
+
+// startSession создание сессии пользователя и выпуск первой пары токенов
+func startSession(ctx context.Context, userName string) (handlermodels.TokenResponse, error) {
+	sessionID, err := hash.GenerateToken()
+	if err != nil {
+		return handlermodels.TokenResponse{}, err
+	}
+	refreshToken, err := hash.GenerateToken()
+	if err != nil {
+		return handlermodels.TokenResponse{}, err
+	}
+
+	session := storagemodels.Session{
+		ID:               sessionID,
+		UserName:         userName,
+		RefreshTokenHash: hash.HashToken(refreshToken),
+		ExpiresAt:        time.Now().Add(refreshTokenTTL),
+	}
+	if err := storage.Store.CreateSession(ctx, session); err != nil {
+		return handlermodels.TokenResponse{}, err
+	}
+	return buildTokens(session, refreshToken)
+}
+
+// buildTokens выпуск токена доступа для сессии
+func buildTokens(session storagemodels.Session, refreshToken string) (handlermodels.TokenResponse, error) {
+	accessToken, err := jwt.BuildJWTByUserName(session.UserName, session.ID)
+	if err != nil {
+		return handlermodels.TokenResponse{}, err
+	}
+	return handlermodels.TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(jwt.TTL().Seconds()),
+	}, nil
+}
+
+// writeTokens ответ с токенами, токен доступа дублируется в заголовке Authorization
+func writeTokens(writer http.ResponseWriter, tokens handlermodels.TokenResponse) {
+	body, err := json.Marshal(tokens)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		logger.Log.Warn(fmt.Sprintf("Encode tokens error: %s", err))
+		return
+	}
+
+	writer.Header().Set("Authorization", tokens.AccessToken)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+	_, _ = writer.Write(body)
+}
+
+// RefreshTokenWebhook обработчик обновления токенов по refresh токену, POST HTTP-запрос.
+// Refresh токен одноразовый: в ответе выдается новый, старый перестает действовать
+func RefreshTokenWebhook(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusBadRequest)
+		logger.Log.Info("Method only accepts POST requests")
+		return
+	}
+
+	if !strings.Contains(request.Header.Get("Content-Type"), "application/json") {
+		writer.WriteHeader(http.StatusBadRequest)
+		logger.Log.Info("Need header: 'Content-Type: application/json'")
+		return
+	}
+
+	var body handlermodels.RefreshRequest
+	if err := json.NewDecoder(request.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		logger.Log.Info("Bad refresh request")
+		return
+	}
+
+	refreshToken, err := hash.GenerateToken()
+	if err != nil {
+		problem.WriteError(writer, request, "Refresh token error", err)
+		return
+	}
+
+	session, err := storage.Store.RotateSession(request.Context(), hash.HashToken(body.RefreshToken),
+		hash.HashToken(refreshToken), time.Now().Add(refreshTokenTTL))
+	if errors.Is(err, storage.ErrRefreshTokenReused) {
+		middlewares.InvalidateSession(session.ID)
+		writer.WriteHeader(http.StatusUnauthorized)
+		logger.Log.Warn(fmt.Sprintf("Refresh token reused, session of user '%s' is revoked", session.UserName))
+		return
+	}
+	if errors.Is(err, storage.ErrSessionNotFound) {
+		writer.WriteHeader(http.StatusUnauthorized)
+		logger.Log.Info("Session not found")
+		return
+	}
+	if err != nil {
+		problem.WriteError(writer, request, "Refresh token error", err)
+		return
+	}
+
+	tokens, err := buildTokens(session, refreshToken)
+	if err != nil {
+		problem.WriteError(writer, request, "Refresh token error", err)
+		return
+	}
+	writeTokens(writer, tokens)
+}
+
+// LogoutWebhook обработчик выхода из текущей сессии, POST HTTP-запрос
+func LogoutWebhook(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusBadRequest)
+		logger.Log.Info("Method only accepts POST requests")
+		return
+	}
+
+	sessionID, ok := request.Context().Value(constants.SessionIDKey).(string)
+	if !ok {
+		logger.Log.Warn("Something went wrong with jwt token")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := storage.Store.RevokeSession(request.Context(), sessionID); err != nil {
+		problem.WriteError(writer, request, "Logout error", err)
+		return
+	}
+	middlewares.InvalidateSession(sessionID)
+
+	writer.WriteHeader(http.StatusOK)
+}
+
+// LogoutAllWebhook обработчик выхода из всех сессий пользователя, POST HTTP-запрос
+func LogoutAllWebhook(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusBadRequest)
+		logger.Log.Info("Method only accepts POST requests")
+		return
+	}
+
+	userName, ok := request.Context().Value(constants.UserNameKey).(string)
+	if !ok {
+		logger.Log.Warn("Something went wrong with jwt token")
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := storage.Store.RevokeUserSessions(request.Context(), userName); err != nil {
+		problem.WriteError(writer, request, "Logout all error", err)
+		return
+	}
+	middlewares.InvalidateUserSessions(userName)
+
+	logger.Log.Info(fmt.Sprintf("All sessions of user '%s' are revoked", userName))
+	writer.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fngoc/gofermart/internal/handlers/handlermodels"
+	"github.com/fngoc/gofermart/internal/handlers/middlewares"
+	"github.com/fngoc/gofermart/internal/hash"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// decodeTokens разбор ответа с токенами
+func decodeTokens(t *testing.T, w *httptest.ResponseRecorder) handlermodels.TokenResponse {
+	var tokens handlermodels.TokenResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&tokens))
+	assert.NotEmpty(t, tokens.AccessToken)
+	assert.NotEmpty(t, tokens.RefreshToken)
+	assert.Equal(t, tokens.AccessToken, w.Header().Get("Authorization"))
+	return tokens
+}
+
+// refreshRequest выполнение запроса обновления токенов
+func refreshRequest(refreshToken string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(handlermodels.RefreshRequest{RefreshToken: refreshToken})
+	req := httptest.NewRequest(http.MethodPost, "/api/user/token/refresh", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	RefreshTokenWebhook(w, req)
+	return w
+}
+
+// authorizedRequest выполнение запроса с токеном доступа через AuthMiddleware
+func authorizedRequest(handler http.HandlerFunc, accessToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Set("Authorization", accessToken)
+	w := httptest.NewRecorder()
+	middlewares.AuthMiddleware(handler)(w, req)
+	return w
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	hash.SetHasher(hash.NewArgon2idHasher(hash.Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+	defer hash.SetHasher(hash.NewArgon2idHasher(hash.DefaultArgon2idParams))
+	storage.SetDBInstance(storage.NewMemoryStorage())
+
+	w := authRequest(RegisterWebhook, `{"login":"session_user","password":"password123"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	first := decodeTokens(t, w)
+
+	// Refresh токен одноразовый
+	w = refreshRequest(first.RefreshToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	second := decodeTokens(t, w)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+
+	// Выход завершает только текущую сессию
+	w = authRequest(AuntificationWebhook, `{"login":"session_user","password":"password123"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	other := decodeTokens(t, w)
+
+	assert.Equal(t, http.StatusOK, authorizedRequest(LogoutWebhook, second.AccessToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, authorizedRequest(LogoutWebhook, second.AccessToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, refreshRequest(second.RefreshToken).Code)
+
+	// Выход из всех сессий
+	assert.Equal(t, http.StatusOK, authorizedRequest(LogoutAllWebhook, other.AccessToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, authorizedRequest(LogoutAllWebhook, other.AccessToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, refreshRequest(other.RefreshToken).Code)
+}
+
+func TestRefreshTokenWebhook_Reuse(t *testing.T) {
+	hash.SetHasher(hash.NewArgon2idHasher(hash.Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+	defer hash.SetHasher(hash.NewArgon2idHasher(hash.DefaultArgon2idParams))
+	storage.SetDBInstance(storage.NewMemoryStorage())
+
+	w := authRequest(RegisterWebhook, `{"login":"reuse_user","password":"password123"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	session := decodeTokens(t, w)
+	w = refreshRequest(session.RefreshToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	rotated := decodeTokens(t, w)
+
+	// Повторное предъявление старого токена отзывает сессию вместе с новым токеном
+	assert.Equal(t, http.StatusUnauthorized, refreshRequest(session.RefreshToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, refreshRequest(rotated.RefreshToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, authorizedRequest(LogoutWebhook, rotated.AccessToken).Code)
+
+	assert.Equal(t, http.StatusUnauthorized, refreshRequest("unknown").Code)
+	assert.Equal(t, http.StatusBadRequest, refreshRequest("").Code)
+}
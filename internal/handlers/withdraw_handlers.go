@@ -7,11 +7,12 @@ import (
 	"net/http"
 
 	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/fngoc/gofermart/internal/handlers/problem"
 	"github.com/fngoc/gofermart/internal/logger"
 	"github.com/fngoc/gofermart/internal/storage"
 )
 
-// ListWithdrawalsBalanceWebhook получение истории операций, GET HTTP-запрос
+// ListWithdrawalsBalanceWebhook получение страницы истории операций, GET HTTP-запрос
 func ListWithdrawalsBalanceWebhook(writer http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
 		writer.WriteHeader(http.StatusBadRequest)
@@ -19,23 +20,28 @@ func ListWithdrawalsBalanceWebhook(writer http.ResponseWriter, request *http.Req
 		return
 	}
 
+	query, err := parseListQuery(request, false)
+	if err != nil {
+		logger.Log.Info(fmt.Sprintf("Transactions query error: %s", err))
+		problem.Write(writer, request, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	userNameFromToken, ok := request.Context().Value(constants.UserNameKey).(string)
 	if !ok {
 		logger.Log.Warn("Something went wrong with jwt token")
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	userID, err := storage.Store.GetUserIDByName(userNameFromToken)
+	userID, err := storage.Store.GetUserIDByName(request.Context(), userNameFromToken)
 	if err != nil {
-		logger.Log.Info(fmt.Sprintf("Transactions error: %s", err))
-		writer.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(writer, request, "Transactions error", err)
 		return
 	}
 
-	transactions, err := storage.Store.GetAllTransactionByUserID(userID)
+	transactions, next, err := storage.Store.ListTransactionsByUserID(request.Context(), userID, query)
 	if err != nil {
-		logger.Log.Info(fmt.Sprintf("Transactions error: %s", err))
-		writer.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(writer, request, "Transactions error", err)
 		return
 	}
 
@@ -52,6 +58,7 @@ func ListWithdrawalsBalanceWebhook(writer http.ResponseWriter, request *http.Req
 		return
 	}
 
+	writeNextPage(writer, request, next)
 	writer.Header().Set("Content-Type", "application/json")
 	writer.WriteHeader(http.StatusOK)
 	_, _ = writer.Write(buf.Bytes())
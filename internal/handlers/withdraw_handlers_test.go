@@ -11,11 +11,12 @@ import (
 	"github.com/fngoc/gofermart/internal/constants"
 	"github.com/fngoc/gofermart/internal/storage"
 	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+	"github.com/shopspring/decimal"
 )
 
 func TestListWithdrawalsBalanceWebhook_Success(t *testing.T) {
 	mockTransactions := []storagemodels.Transaction{
-		{OrderNumber: "12345", Sum: 100.50, ProcessedAt: "2024-10-22"},
+		{OrderNumber: "12345", Sum: decimal.RequireFromString("100.5"), ProcessedAt: "2024-10-22"},
 	}
 
 	// Мокаем хранилище
@@ -23,8 +24,8 @@ func TestListWithdrawalsBalanceWebhook_Success(t *testing.T) {
 		GetUserIDByNameFunc: func(userName string) (int, error) {
 			return 1, nil
 		},
-		GetAllTransactionByUserIDFunc: func(userID int) ([]storagemodels.Transaction, error) {
-			return mockTransactions, nil
+		ListTransactionsByUserIDFunc: func(userID int, query storagemodels.ListQuery) ([]storagemodels.Transaction, *storagemodels.Cursor, error) {
+			return mockTransactions, nil, nil
 		},
 	}
 
@@ -63,8 +64,8 @@ func TestListWithdrawalsBalanceWebhook_NoTransactions(t *testing.T) {
 		GetUserIDByNameFunc: func(userName string) (int, error) {
 			return 1, nil
 		},
-		GetAllTransactionByUserIDFunc: func(userID int) ([]storagemodels.Transaction, error) {
-			return []storagemodels.Transaction{}, nil
+		ListTransactionsByUserIDFunc: func(userID int, query storagemodels.ListQuery) ([]storagemodels.Transaction, *storagemodels.Cursor, error) {
+			return []storagemodels.Transaction{}, nil, nil
 		},
 	}
 
@@ -5,7 +5,9 @@ import (
 	"encoding/hex"
 )
 
-// HashingPassword функция для хэширования строки
+// HashingPassword функция для хэширования строки SHA-256 без соли.
+//
+// Deprecated: используется только для проверки старых хэшей, новые пароли хэшируются HashPassword
 func HashingPassword(password string) (string, error) {
 	hash := sha256.Sum256([]byte(password))
 	return hex.EncodeToString(hash[:]), nil
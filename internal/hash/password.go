@@ -0,0 +1,192 @@
+package hash
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Hasher алгоритм хэширования паролей
+type Hasher interface {
+	// Hash хэширование пароля со случайной солью, результат в формате PHC
+	Hash(password string) (string, error)
+	// Verify проверка пароля по хэшу, needsRehash - хэш получен с устаревшими параметрами
+	Verify(password, encoded string) (ok, needsRehash bool, err error)
+}
+
+// Argon2idParams параметры argon2id
+type Argon2idParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2idParams параметры по умолчанию, вторая рекомендация RFC 9106
+var DefaultArgon2idParams = Argon2idParams{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// Argon2idHasher хэширование паролей argon2id
+type Argon2idHasher struct {
+	params Argon2idParams
+}
+
+// NewArgon2idHasher создание хэшера argon2id с параметрами params
+func NewArgon2idHasher(params Argon2idParams) *Argon2idHasher {
+	return &Argon2idHasher{params: params}
+}
+
+// Hash хэширование пароля в формате $argon2id$v=19$m=...,t=...,p=...$соль$хэш
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, h.params.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		h.params.Memory, h.params.Iterations, h.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Verify проверка пароля по хэшу argon2id, параметры берутся из самого хэша
+func (h *Argon2idHasher) Verify(password, encoded string) (bool, bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, false, fmt.Errorf("invalid argon2id hash format")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, false, fmt.Errorf("invalid argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return false, false, fmt.Errorf("unsupported argon2id version: %d", version)
+	}
+
+	var params Argon2idParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return false, false, fmt.Errorf("invalid argon2id params: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, fmt.Errorf("invalid argon2id key: %w", err)
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	actual := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	if subtle.ConstantTimeCompare(actual, key) != 1 {
+		return false, false, nil
+	}
+	return true, params != h.params, nil
+}
+
+// passwordHasher текущий алгоритм хэширования паролей
+var passwordHasher Hasher = NewArgon2idHasher(DefaultArgon2idParams)
+
+// DefaultMaxConcurrentHashing число одновременных вычислений хэша по умолчанию. С DefaultArgon2idParams
+// каждое вычисление занимает 64 МиБ и 4 потока, поэтому пиковая память на хэширование около 256 МиБ
+const DefaultMaxConcurrentHashing = 4
+
+// hashingSlots семафор вычислений хэша: без него поток /register и /login занимает 64 МиБ на каждый запрос
+var hashingSlots = make(chan struct{}, DefaultMaxConcurrentHashing)
+
+// SetMaxConcurrentHashing ограничение числа одновременных вычислений хэша пароля, остальные запросы ждут.
+// Пиковая память на хэширование примерно n * Memory, вызывается до запуска сервера
+func SetMaxConcurrentHashing(n int) {
+	if n < 1 {
+		n = 1
+	}
+	hashingSlots = make(chan struct{}, n)
+}
+
+// acquireHashingSlot занятие слота хэширования, возвращает функцию освобождения.
+// Ожидание слота прерывается отменой ctx, например когда клиент закрыл соединение
+func acquireHashingSlot(ctx context.Context) (func(), error) {
+	slots := hashingSlots
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to wait for hashing slot: %w", ctx.Err())
+	}
+}
+
+// dummyHash хэш произвольного пароля текущим алгоритмом, вычисляется один раз при первом обращении
+var dummyHash = newDummyHash()
+
+// newDummyHash отложенное вычисление dummyHash текущим алгоритмом
+func newDummyHash() func() (string, error) {
+	return sync.OnceValues(func() (string, error) {
+		return passwordHasher.Hash("dummy password")
+	})
+}
+
+// SetHasher замена алгоритма хэширования паролей, старые хэши будут пересчитаны при входе
+func SetHasher(hasher Hasher) {
+	passwordHasher = hasher
+	dummyHash = newDummyHash()
+}
+
+// HashPassword хэширование пароля текущим алгоритмом
+func HashPassword(ctx context.Context, password string) (string, error) {
+	release, err := acquireHashingSlot(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return passwordHasher.Hash(password)
+}
+
+// VerifyPassword проверка пароля по сохраненному хэшу. Хэши SHA-256 без соли, созданные до перехода
+// на текущий алгоритм, тоже проверяются, но всегда помечаются как требующие пересчета
+func VerifyPassword(ctx context.Context, password, encoded string) (ok, needsRehash bool, err error) {
+	if isLegacyHash(encoded) {
+		legacy, _ := HashingPassword(password)
+		return subtle.ConstantTimeCompare([]byte(legacy), []byte(encoded)) == 1, true, nil
+	}
+	release, err := acquireHashingSlot(ctx)
+	if err != nil {
+		return false, false, err
+	}
+	defer release()
+	return passwordHasher.Verify(password, encoded)
+}
+
+// VerifyDummyPassword проверка пароля по dummyHash, результат проверки не важен. Вызывается для
+// несуществующего пользователя, чтобы время ответа не выдавало, есть ли такой логин
+func VerifyDummyPassword(ctx context.Context, password string) error {
+	encoded, err := dummyHash()
+	if err != nil {
+		return err
+	}
+	_, _, err = VerifyPassword(ctx, password, encoded)
+	return err
+}
+
+// isLegacyHash хэш SHA-256 в hex, которым пароли хранились раньше
+func isLegacyHash(encoded string) bool {
+	if len(encoded) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
@@ -0,0 +1,192 @@
+package hash
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testParams облегченные параметры, чтобы тесты не тратили 64 МиБ на каждый хэш
+var testParams = Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func TestArgon2idHasher(t *testing.T) {
+	hasher := NewArgon2idHasher(testParams)
+
+	encoded, err := hasher.Hash("password123")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$"))
+
+	// Соль случайная, одинаковые пароли дают разные хэши
+	other, err := hasher.Hash("password123")
+	assert.NoError(t, err)
+	assert.NotEqual(t, encoded, other)
+
+	ok, needsRehash, err := hasher.Verify("password123", encoded)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, needsRehash)
+
+	ok, _, err = hasher.Verify("wrong", encoded)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Хэш с другими параметрами проверяется, но требует пересчета
+	stronger := NewArgon2idHasher(Argon2idParams{Memory: 2048, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	ok, needsRehash, err = stronger.Verify("password123", encoded)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, needsRehash)
+
+	_, _, err = hasher.Verify("password123", "$bcrypt$invalid")
+	assert.Error(t, err)
+}
+
+func TestVerifyPassword(t *testing.T) {
+	SetHasher(NewArgon2idHasher(testParams))
+	defer SetHasher(NewArgon2idHasher(DefaultArgon2idParams))
+
+	tests := []struct {
+		name        string
+		password    string
+		encoded     string
+		ok          bool
+		needsRehash bool
+	}{
+		{
+			name:        "Legacy SHA-256 hash",
+			password:    "password123",
+			encoded:     "ef92b778bafe771e89245b89ecbc08a44a4e166c06659911881f383d4473e94f",
+			ok:          true,
+			needsRehash: true,
+		},
+		{
+			name:        "Legacy SHA-256 hash with wrong password",
+			password:    "wrong",
+			encoded:     "ef92b778bafe771e89245b89ecbc08a44a4e166c06659911881f383d4473e94f",
+			ok:          false,
+			needsRehash: true,
+		},
+	}
+
+	encoded, err := HashPassword(context.Background(), "password123")
+	assert.NoError(t, err)
+	tests = append(tests, struct {
+		name        string
+		password    string
+		encoded     string
+		ok          bool
+		needsRehash bool
+	}{name: "Current argon2id hash", password: "password123", encoded: encoded, ok: true})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, needsRehash, err := VerifyPassword(context.Background(), tt.password, tt.encoded)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.needsRehash, needsRehash)
+		})
+	}
+}
+
+// concurrencyHasher хэшер, который считает одновременные вызовы
+type concurrencyHasher struct {
+	active atomic.Int32
+	peak   atomic.Int32
+}
+
+func (h *concurrencyHasher) Hash(string) (string, error) {
+	active := h.active.Add(1)
+	defer h.active.Add(-1)
+	for {
+		peak := h.peak.Load()
+		if active <= peak || h.peak.CompareAndSwap(peak, active) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return "", nil
+}
+
+func (h *concurrencyHasher) Verify(string, string) (bool, bool, error) {
+	_, err := h.Hash("")
+	return true, false, err
+}
+
+func TestMaxConcurrentHashing(t *testing.T) {
+	hasher := &concurrencyHasher{}
+	SetHasher(hasher)
+	SetMaxConcurrentHashing(2)
+	defer func() {
+		SetHasher(NewArgon2idHasher(DefaultArgon2idParams))
+		SetMaxConcurrentHashing(DefaultMaxConcurrentHashing)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, _ = HashPassword(context.Background(), "password123")
+		}()
+		go func() {
+			defer wg.Done()
+			_, _, _ = VerifyPassword(context.Background(), "password123", "$argon2id$")
+		}()
+	}
+	wg.Wait()
+
+	// Хэш и проверка делят общие слоты
+	assert.Equal(t, int32(2), hasher.peak.Load())
+}
+
+func TestHashingSlotCanceled(t *testing.T) {
+	SetHasher(NewArgon2idHasher(testParams))
+	SetMaxConcurrentHashing(1)
+	defer func() {
+		SetHasher(NewArgon2idHasher(DefaultArgon2idParams))
+		SetMaxConcurrentHashing(DefaultMaxConcurrentHashing)
+	}()
+
+	// Единственный слот занят, ожидание прерывается отменой контекста
+	release, err := acquireHashingSlot(context.Background())
+	assert.NoError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = HashPassword(ctx, "password123")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	_, _, err = VerifyPassword(ctx, "password123", "$argon2id$")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestVerifyDummyPassword(t *testing.T) {
+	SetHasher(NewArgon2idHasher(testParams))
+	defer SetHasher(NewArgon2idHasher(DefaultArgon2idParams))
+
+	// Хэш вычисляется один раз текущим алгоритмом, дальше выполняется только проверка
+	assert.NoError(t, VerifyDummyPassword(context.Background(), "password123"))
+	first, err := dummyHash()
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(first, "$argon2id$v=19$m=1024,t=1,p=1$"))
+	second, err := dummyHash()
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	SetMaxConcurrentHashing(1)
+	defer SetMaxConcurrentHashing(DefaultMaxConcurrentHashing)
+	release, err := acquireHashingSlot(context.Background())
+	assert.NoError(t, err)
+	defer release()
+	assert.ErrorIs(t, VerifyDummyPassword(ctx, "password123"), context.Canceled)
+}
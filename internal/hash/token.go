@@ -0,0 +1,27 @@
+package hash
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// tokenBytes длина случайной части непрозрачного токена
+const tokenBytes = 32
+
+// GenerateToken случайный непрозрачный токен в base64url
+func GenerateToken() (string, error) {
+	buf := make([]byte, tokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// HashToken хэш токена для хранения в БД. Токен случайный и длинный, поэтому соль
+// и медленный алгоритм не нужны, а поиск по хэшу остается возможным
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,22 @@
+package hash
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateToken(t *testing.T) {
+	first, err := GenerateToken()
+	assert.NoError(t, err)
+	second, err := GenerateToken()
+	assert.NoError(t, err)
+
+	assert.Len(t, first, 43)
+	assert.NotEqual(t, first, second)
+}
+
+func TestHashToken(t *testing.T) {
+	assert.Equal(t, "ef92b778bafe771e89245b89ecbc08a44a4e166c06659911881f383d4473e94f", HashToken("password123"))
+	assert.NotEqual(t, HashToken("first"), HashToken("second"))
+}
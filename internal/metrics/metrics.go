@@ -0,0 +1,120 @@
+// Package metrics метрики сервиса в формате Prometheus
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace префикс имен метрик
+const namespace = "gophermart"
+
+// unmatchedRoute метка маршрута для запросов, не попавших ни в один маршрут
+const unmatchedRoute = "unmatched"
+
+// Registry реестр метрик сервиса, отдается по /metrics
+var Registry = prometheus.NewRegistry()
+
+// factory регистрирует создаваемые метрики в Registry
+var factory = promauto.With(Registry)
+
+var (
+	// HTTPRequests количество HTTP-запросов по методу, маршруту и коду ответа
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by method, route and status.",
+	}, []string{"method", "route", "status"})
+	// HTTPRequestDuration время обработки HTTP-запросов по методу, маршруту и коду ответа
+	HTTPRequestDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by method, route and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+	// AccrualPolls количество запросов к accrual по коду ответа, error - запрос не выполнен
+	AccrualPolls = factory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "accrual_polls_total",
+		Help:      "Number of accrual status requests by response code.",
+	}, []string{"code"})
+	// OrderQueueDepth количество заказов, захваченных репликой для опроса accrual
+	OrderQueueDepth = factory.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "order_queue_depth",
+		Help:      "Number of orders leased by this replica for accrual polling.",
+	})
+	// OrderProcessingTime время от загрузки заказа до статуса PROCESSED
+	OrderProcessingTime = factory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "order_processing_seconds",
+		Help:      "Time from order upload to PROCESSED status.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	// PointsAccrued сумма начисленных баллов
+	PointsAccrued = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "points_accrued_total",
+		Help:      "Total points accrued for processed orders.",
+	})
+	// PointsWithdrawn сумма списанных баллов
+	PointsWithdrawn = factory.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "points_withdrawn_total",
+		Help:      "Total points withdrawn by users.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// RegisterDB регистрация статистики пула соединений БД из sql.DB.Stats()
+func RegisterDB(db *sql.DB) error {
+	return Registry.Register(collectors.NewDBStatsCollector(db, namespace))
+}
+
+// Handler обработчик /metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// statusResponseWriter перехват кода ответа
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter) WriteHeader(statusCode int) {
+	w.status = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Middleware учет HTTP-запросов. Маршрут берется из шаблона chi, а не из пути,
+// чтобы номера заказов не порождали новые ряды метрик
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		route := unmatchedRoute
+		if routeContext := chi.RouteContext(r.Context()); routeContext != nil && routeContext.RoutePattern() != "" {
+			route = routeContext.RoutePattern()
+		}
+		status := strconv.Itoa(sw.status)
+		HTTPRequests.WithLabelValues(r.Method, route, status).Inc()
+		HTTPRequestDuration.WithLabelValues(r.Method, route, status).Observe(time.Since(start).Seconds())
+	})
+}
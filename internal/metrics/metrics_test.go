@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(Middleware)
+	r.Get("/api/user/orders/{number}", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	r.Get("/api/user/balance", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("{}"))
+	})
+
+	for _, path := range []string{"/api/user/orders/79927398713", "/api/user/orders/12345678903", "/api/user/balance", "/unknown"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// Номера заказов сводятся к шаблону маршрута
+	assert.Equal(t, float64(2), testutil.ToFloat64(HTTPRequests.WithLabelValues(http.MethodGet, "/api/user/orders/{number}", "404")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(HTTPRequests.WithLabelValues(http.MethodGet, "/api/user/balance", "200")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(HTTPRequests.WithLabelValues(http.MethodGet, unmatchedRoute, "404")))
+}
+
+func TestHandler(t *testing.T) {
+	PointsWithdrawn.Add(100.25)
+	AccrualPolls.WithLabelValues("200").Inc()
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	for _, name := range []string{
+		"gophermart_points_withdrawn_total",
+		"gophermart_accrual_polls_total{code=\"200\"}",
+		"gophermart_order_queue_depth",
+		"go_goroutines",
+	} {
+		assert.True(t, strings.Contains(body, name), name)
+	}
+}
@@ -0,0 +1,51 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/throttle"
+	"go.uber.org/zap"
+)
+
+const (
+	// cleanupInterval интервал удаления устаревших служебных записей
+	cleanupInterval = time.Hour
+	// idempotencyKeyRetention время хранения ключей идемпотентности, после него повтор запроса выполняется заново
+	idempotencyKeyRetention = 24 * time.Hour
+)
+
+// loginAttemptsRetention время хранения счетчика неудачных попыток входа: после ResetAfter политик
+// счетчик все равно начинается заново, поэтому строка больше не нужна
+var loginAttemptsRetention = max(throttle.DefaultLoginPolicy.ResetAfter, throttle.DefaultAddressPolicy.ResetAfter)
+
+// cleanupExpired удаление устаревших ключей идемпотентности и счетчиков попыток входа
+func cleanupExpired(ctx context.Context) {
+	deleted, err := storage.Store.DeleteExpiredIdempotencyKeys(ctx, idempotencyKeyRetention)
+	if err != nil {
+		logger.Log.Error("Idempotency keys cleanup error", zap.Error(err))
+	} else {
+		logger.Log.Info("Idempotency keys cleanup is done", zap.Int64("deleted", deleted))
+	}
+
+	deleted, err = storage.Store.DeleteExpiredLoginAttempts(ctx, loginAttemptsRetention)
+	if err != nil {
+		logger.Log.Error("Login attempts cleanup error", zap.Error(err))
+		return
+	}
+	logger.Log.Info("Login attempts cleanup is done", zap.Int64("deleted", deleted))
+}
+
+// CleanupExpired горутина для периодического удаления устаревших служебных записей, работает до отмены ctx
+func CleanupExpired(ctx context.Context) {
+	for {
+		cleanupExpired(ctx)
+		select {
+		case <-time.After(cleanupInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package scheduler
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// Горутины планировщика, которые отмечают heartbeat
+const (
+	// AccrualPoller горутина захвата заказов и раздачи их воркерам опроса accrual
+	AccrualPoller = "accrual_poller"
+	// StatusUpdater горутина сохранения ответов accrual
+	StatusUpdater = "status_updater"
+)
+
+// Components горутины планировщика, heartbeat которых проверяется при проверке готовности
+var Components = []string{AccrualPoller, StatusUpdater}
+
+var (
+	// heartbeatsMutex для безопасного доступа к heartbeats
+	heartbeatsMutex sync.Mutex
+	// heartbeats время последнего heartbeat по горутинам
+	heartbeats = make(map[string]time.Time)
+)
+
+// beat отметка о том, что горутина component работает
+func beat(component string) {
+	heartbeatsMutex.Lock()
+	defer heartbeatsMutex.Unlock()
+	heartbeats[component] = time.Now()
+}
+
+// Heartbeats время последнего heartbeat горутин планировщика, не запускавшиеся горутины отсутствуют
+func Heartbeats() map[string]time.Time {
+	heartbeatsMutex.Lock()
+	defer heartbeatsMutex.Unlock()
+	return maps.Clone(heartbeats)
+}
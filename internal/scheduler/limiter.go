@@ -0,0 +1,96 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter token bucket, общий для всех воркеров опроса accrual.
+// Кроме ограничения частоты умеет приостанавливать всех воркеров сразу,
+// например когда accrual ответил 429 с заголовком Retry-After
+type rateLimiter struct {
+	mutex sync.Mutex
+	// rate количество запросов в секунду, 0 - без ограничений
+	rate float64
+	// burst максимальное количество накопленных токенов
+	burst float64
+	// tokens текущее количество токенов
+	tokens float64
+	// last время последнего пополнения токенов
+	last time.Time
+	// pausedUntil время, до которого запросы запрещены
+	pausedUntil time.Time
+}
+
+// newRateLimiter создание лимитера на rps запросов в секунду
+func newRateLimiter(rps float64) *rateLimiter {
+	burst := max(rps, 1)
+	return &rateLimiter{
+		rate:   rps,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Wait блокирует вызывающего до получения токена или окончания паузы,
+// возвращает ошибку контекста, если он отменен раньше
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	for {
+		delay := l.reserve()
+		if delay <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Pause запрет запросов на время d для всех воркеров
+func (l *rateLimiter) Pause(d time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	until := time.Now().Add(d)
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+		// После паузы не отдаем накопленные токены пачкой
+		l.tokens = 0
+		l.last = until
+	}
+}
+
+// Paused действует ли пауза, заданная через Pause
+func (l *rateLimiter) Paused() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return time.Now().Before(l.pausedUntil)
+}
+
+// reserve попытка забрать токен, возвращает время до следующей попытки
+func (l *rateLimiter) reserve() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
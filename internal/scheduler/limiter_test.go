@@ -0,0 +1,74 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	limiter := newRateLimiter(2)
+
+	// Первые два запроса проходят сразу за счет burst
+	assert.Equal(t, time.Duration(0), limiter.reserve())
+	assert.Equal(t, time.Duration(0), limiter.reserve())
+
+	// Третий должен подождать примерно половину секунды
+	delay := limiter.reserve()
+	assert.Greater(t, delay, 400*time.Millisecond)
+	assert.LessOrEqual(t, delay, 500*time.Millisecond)
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := newRateLimiter(0)
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, time.Duration(0), limiter.reserve())
+	}
+}
+
+func TestRateLimiterPause(t *testing.T) {
+	limiter := newRateLimiter(0)
+
+	limiter.Pause(time.Minute)
+	delay := limiter.reserve()
+	assert.Greater(t, delay, 59*time.Second)
+
+	// Более короткая пауза не сокращает уже действующую
+	limiter.Pause(time.Second)
+	delay = limiter.reserve()
+	assert.Greater(t, delay, 59*time.Second)
+}
+
+func TestRateLimiterPaused(t *testing.T) {
+	limiter := newRateLimiter(1)
+	assert.False(t, limiter.Paused())
+
+	limiter.Pause(50 * time.Millisecond)
+	assert.True(t, limiter.Paused())
+	assert.Eventually(t, func() bool { return !limiter.Paused() }, time.Second, 10*time.Millisecond)
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	limiter := newRateLimiter(0)
+	limiter.Pause(50 * time.Millisecond)
+
+	start := time.Now()
+	assert.NoError(t, limiter.Wait(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestRateLimiterWaitCanceled(t *testing.T) {
+	limiter := newRateLimiter(1)
+	limiter.Pause(time.Minute)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := limiter.Wait(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
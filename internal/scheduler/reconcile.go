@@ -0,0 +1,45 @@
+package scheduler
+
+import (
+	"context"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/storage"
+	"go.uber.org/zap"
+)
+
+// reconcileInterval интервал сверки балансов с журналом операций
+const reconcileInterval = time.Hour
+
+// reconcileBalances сверка балансов, каждое расхождение пишется в лог отдельной записью
+func reconcileBalances(ctx context.Context) {
+	discrepancies, err := storage.Store.ReconcileBalances(ctx)
+	if err != nil {
+		logger.Log.Error("Balance reconciliation error", zap.Error(err))
+		return
+	}
+
+	for _, d := range discrepancies {
+		logger.Log.Warn("Balance discrepancy",
+			zap.Int("user_id", d.UserID),
+			zap.Stringer("cached_current", d.CachedCurrent),
+			zap.Stringer("cached_withdrawn", d.CachedWithdrawn),
+			zap.Stringer("ledger_current", d.LedgerCurrent),
+			zap.Stringer("ledger_withdrawn", d.LedgerWithdrawn),
+		)
+	}
+	logger.Log.Info("Balance reconciliation is done", zap.Int("discrepancies", len(discrepancies)))
+}
+
+// ReconcileBalances горутина для периодической сверки балансов с журналом операций, работает до отмены ctx
+func ReconcileBalances(ctx context.Context) {
+	for {
+		reconcileBalances(ctx)
+		select {
+		case <-time.After(reconcileInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
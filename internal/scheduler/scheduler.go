@@ -1,9 +1,10 @@
 package scheduler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"strconv"
 	"sync"
@@ -11,24 +12,61 @@ import (
 
 	"github.com/fngoc/gofermart/internal/constants"
 	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/metrics"
 	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/tracing"
+	"github.com/shopspring/decimal"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // AccrualOrderResponse структура ответа
 type AccrualOrderResponse struct {
-	Order   string  `json:"order"`
-	Status  string  `json:"status"`
-	Accrual float64 `json:"accrual,omitempty"`
+	Order   string          `json:"order"`
+	Status  string          `json:"status"`
+	Accrual decimal.Decimal `json:"accrual,omitempty"`
+	// spanContext спан опроса accrual, к которому привязывается сохранение ответа
+	spanContext trace.SpanContext
 }
 
+// accrualStatuses соответствие статусов accrual статусам заказа в gophermart. REGISTERED означает,
+// что accrual уже принял заказ, поэтому пользователь видит его в PROCESSING. Исходный статус
+// сохраняется вместе с заказом и в истории статусов
+var accrualStatuses = map[string]constants.OrderStatus{
+	"REGISTERED": constants.Processing,
+	"PROCESSING": constants.Processing,
+	"INVALID":    constants.Invalid,
+	"PROCESSED":  constants.Processed,
+}
+
+const (
+	// leaseBatchSize максимальное количество заказов в очереди реплики без ограничения частоты запросов
+	leaseBatchSize = 100
+	// leaseDuration время, на которое заказ закрепляется за репликой
+	leaseDuration = 30 * time.Second
+	// checkInterval интервал между опросами одного и того же заказа
+	checkInterval = 2 * time.Second
+	// accrualRequestTimeout таймаут запроса к accrual, ограничивает и время остановки воркеров
+	accrualRequestTimeout = 10 * time.Second
+)
+
+// accrualClient клиент для запросов к accrual
+var accrualClient = &http.Client{Timeout: accrualRequestTimeout, Transport: tracing.Transport(http.DefaultTransport)}
+
 // OrderManager структура менеджера заказов
 type OrderManager struct {
-	// ordersForCheck структура для хранения состояния заказов
-	ordersForCheck map[int]string
+	// ordersForCheck заказы, захваченные этой репликой и ожидающие опроса, со сроком lease по часам реплики
+	ordersForCheck map[int]time.Time
 	// mutex для безопасного доступа к данным заказов
 	mutex sync.RWMutex
 	// orderStatusChan канал для передачи обновленных данных заказа
 	orderStatusChan chan AccrualOrderResponse
+	// ordersQueue очередь заказов для воркеров опроса
+	ordersQueue chan int
+	// wakeUp сигнал о появлении нового заказа, прерывает ожидание между проходами
+	wakeUp chan struct{}
 }
 
 // orderManagerInstant инстанс менеджера заказов
@@ -42,31 +80,128 @@ var once sync.Once
 func LazyInitialiseOrderManager() {
 	once.Do(func() {
 		orderManagerInstant = &OrderManager{
-			ordersForCheck:  make(map[int]string),
+			ordersForCheck:  make(map[int]time.Time),
 			mutex:           sync.RWMutex{},
 			orderStatusChan: make(chan AccrualOrderResponse),
+			ordersQueue:     make(chan int, leaseBatchSize),
+			wakeUp:          make(chan struct{}, 1),
 		}
 	})
 }
 
-// AddOrderInQueue добавление заказа в очередь на обновление
+// AddOrderInQueue уведомление о новом заказе. Сам заказ уже сохранен в БД с next_check_at = NOW(),
+// поэтому он будет захвачен на ближайшем проходе, здесь только будим опрос
 func AddOrderInQueue(orderID int) {
 	LazyInitialiseOrderManager()
+	select {
+	case orderManagerInstant.wakeUp <- struct{}{}:
+		logger.Log.Debug(fmt.Sprintf("Order %d added to queue", orderID))
+	default:
+	}
+}
+
+// leaseBatch максимальное количество заказов в очереди реплики при ограничении rps запросов в секунду.
+// Очередь должна быть опрошена до истечения lease, с запасом на таймаут самого запроса к accrual
+func leaseBatch(rps float64) int {
+	if rps <= 0 {
+		return leaseBatchSize
+	}
+	return min(leaseBatchSize, max(1, int(rps*(leaseDuration-accrualRequestTimeout).Seconds())))
+}
+
+// leaseOrders захват заказов из БД в очередь реплики, возвращает только новые для реплики заказы.
+// Захватывается не больше batch заказов вместе с уже захваченными, но lease все равно может истечь,
+// пока заказ ждет воркера, например при медленном accrual, поэтому воркер проверяет его через leaseExpired.
+// При старте так же восстанавливает все заказы с нефинальным статусом, которые не успели обработать до перезапуска
+func leaseOrders(ctx context.Context, batch int) []int {
+	orderManagerInstant.mutex.RLock()
+	limit := batch - len(orderManagerInstant.ordersForCheck)
+	orderManagerInstant.mutex.RUnlock()
+	if limit <= 0 {
+		return nil
+	}
+
+	// Срок считается до запроса, поэтому он не позже срока lease в БД
+	leasedUntil := time.Now().Add(leaseDuration)
+	orders, err := storage.Store.LeaseOrdersForCheck(ctx, limit, leaseDuration)
+	if err != nil {
+		logger.Log.Error(fmt.Sprintf("Lease orders error: %s", err))
+		return nil
+	}
+
+	orderManagerInstant.mutex.Lock()
+	defer orderManagerInstant.mutex.Unlock()
+	var orderIDs []int
+	for _, order := range orders {
+		if _, ok := orderManagerInstant.ordersForCheck[order.OrderID]; !ok {
+			orderManagerInstant.ordersForCheck[order.OrderID] = leasedUntil
+			orderIDs = append(orderIDs, order.OrderID)
+		}
+	}
+	updateQueueDepth()
+	return orderIDs
+}
+
+// leaseExpired истек ли lease заказа или истечет ли он до ответа accrual.
+// Такой заказ могла захватить другая реплика, поэтому он не опрашивается и не освобождается в БД
+func leaseExpired(orderID int) bool {
+	orderManagerInstant.mutex.RLock()
+	defer orderManagerInstant.mutex.RUnlock()
+	leasedUntil, ok := orderManagerInstant.ordersForCheck[orderID]
+	return !ok || time.Until(leasedUntil) < accrualRequestTimeout
+}
+
+// forgetOrder удаление заказа из очереди реплики
+func forgetOrder(orderID int) {
 	orderManagerInstant.mutex.Lock()
-	orderManagerInstant.ordersForCheck[orderID] = constants.New
-	orderManagerInstant.mutex.Unlock()
+	defer orderManagerInstant.mutex.Unlock()
+	delete(orderManagerInstant.ordersForCheck, orderID)
+	updateQueueDepth()
 }
 
-// requestOrderStatus функция для запроса статуса заказа у стороннего сервиса
-func requestOrderStatus(orderID int, accrualAddress string) time.Duration {
-	var timeOut = 2 * time.Second
+// updateQueueDepth обновление метрики размера очереди реплики, вызывается под блокировкой
+func updateQueueDepth() {
+	metrics.OrderQueueDepth.Set(float64(len(orderManagerInstant.ordersForCheck)))
+}
+
+// releaseOrder удаление заказа из очереди реплики и перенос следующего опроса в БД.
+// Выполняется и во время остановки, иначе заказ останется захваченным до истечения lease
+func releaseOrder(ctx context.Context, orderID int, delay time.Duration) {
+	forgetOrder(orderID)
+
+	if err := storage.Store.PostponeOrderCheck(context.WithoutCancel(ctx), orderID, delay); err != nil {
+		logger.Log.Error(fmt.Sprintf("Postpone order %d check error: %s", orderID, err))
+	}
+}
+
+// requestOrderStatus функция для запроса статуса заказа у стороннего сервиса.
+// Начатый запрос не прерывается отменой ctx, чтобы заказ был обработан до конца
+func requestOrderStatus(ctx context.Context, orderID int, accrualAddress string, limiter *rateLimiter) {
+	var timeOut = checkInterval
+	spanCtx, span := tracing.Start(ctx, "accrual.poll", tracing.OrderNumber(orderID))
+	defer span.End()
+	// Запрос не прерывается остановкой воркеров, его ограничивает таймаут клиента
+	req, err := http.NewRequestWithContext(context.WithoutCancel(spanCtx), http.MethodGet,
+		fmt.Sprintf("%s/api/orders/%d", accrualAddress, orderID), nil)
+	if err != nil {
+		tracing.End(span, err)
+		logger.Log.Error(fmt.Sprintf("Request creation error for order %d: %s", orderID, err))
+		releaseOrder(ctx, orderID, timeOut)
+		return
+	}
 	// Выполняем запрос к стороннему сервису
-	resp, err := http.Get(fmt.Sprintf("%s/api/orders/%d", accrualAddress, orderID))
+	resp, err := accrualClient.Do(req)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		metrics.AccrualPolls.WithLabelValues("error").Inc()
 		logger.Log.Info(fmt.Sprintf("Request error for order %d: %s", orderID, err))
-		return timeOut
+		releaseOrder(ctx, orderID, timeOut)
+		return
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	metrics.AccrualPolls.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
 
 	switch resp.StatusCode {
 	case http.StatusOK:
@@ -74,70 +209,176 @@ func requestOrderStatus(orderID int, accrualAddress string) time.Duration {
 		err := json.NewDecoder(resp.Body).Decode(&orderResponse)
 		if err != nil {
 			logger.Log.Warn(fmt.Sprintf("Response decoding error for order %d: %s", orderID, err))
-			return timeOut
+			releaseOrder(ctx, orderID, timeOut)
+			return
 		}
+		orderResponse.spanContext = span.SpanContext()
 		// Отправляем обновлённые данные в канал
 		orderManagerInstant.orderStatusChan <- orderResponse
-		return timeOut
 	case http.StatusNoContent:
 		logger.Log.Info(fmt.Sprintf("Order %d is not registered in the billing system", orderID))
-		return timeOut
+		releaseOrder(ctx, orderID, timeOut)
 	case http.StatusTooManyRequests:
 		// Обрабатываем заголовок Retry-After
 		retryAfter := resp.Header.Get("Retry-After")
 		retrySeconds, err := strconv.Atoi(retryAfter)
 		if err != nil {
-			log.Printf("Retry-After header parsing error for order %d: %s", orderID, err)
-			return timeOut
+			logger.Log.Warn(fmt.Sprintf("Retry-After header parsing error for order %d: %s", orderID, err))
+			releaseOrder(ctx, orderID, timeOut)
+			return
 		}
 		logger.Log.Info(fmt.Sprintf("Number of requests for order %d exceeded, repeat in %d seconds", orderID, retrySeconds))
-		return time.Duration(retrySeconds) * time.Second
+		timeOut = time.Duration(retrySeconds) * time.Second
+		// Приостанавливаем всех воркеров, а не только текущий
+		limiter.Pause(timeOut)
+		releaseOrder(ctx, orderID, timeOut)
 	case http.StatusInternalServerError:
 		logger.Log.Warn(fmt.Sprintf("Internal server error for order %d", orderID))
-		return timeOut
+		releaseOrder(ctx, orderID, timeOut)
 	default:
 		logger.Log.Warn(fmt.Sprintf("Unexpected response code %d for order %d", resp.StatusCode, orderID))
-		return timeOut
+		releaseOrder(ctx, orderID, timeOut)
+	}
+}
+
+// pollOrders воркер опроса, забирает заказы из очереди и запрашивает их статус.
+// После отмены ctx и во время паузы после 429 оставшиеся в очереди заказы не опрашиваются,
+// а сразу освобождаются, чтобы их lease не истек в очереди
+func pollOrders(ctx context.Context, accrualAddress string, limiter *rateLimiter) {
+	for orderID := range orderManagerInstant.ordersQueue {
+		if ctx.Err() != nil || limiter.Paused() || limiter.Wait(ctx) != nil {
+			releaseOrder(ctx, orderID, 0)
+			continue
+		}
+		if leaseExpired(orderID) {
+			logger.Log.Info(fmt.Sprintf("Lease of order %d expired in queue, skipping", orderID))
+			forgetOrder(orderID)
+			continue
+		}
+		requestOrderStatus(ctx, orderID, accrualAddress, limiter)
 	}
 }
 
-// FetchOrderStatuses горутина для опроса стороннего сервиса
-func FetchOrderStatuses(accrualAddress string) {
+// enqueueOrders передача заказов воркерам, при отмене ctx непереданные заказы освобождаются
+func enqueueOrders(ctx context.Context, orderIDs []int) bool {
+	for i, orderID := range orderIDs {
+		select {
+		case orderManagerInstant.ordersQueue <- orderID:
+		case <-ctx.Done():
+			for _, id := range orderIDs[i:] {
+				releaseOrder(ctx, id, 0)
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// FetchOrderStatuses горутина для опроса стороннего сервиса: захватывает заказы из БД
+// и раздает их пулу из workers воркеров с общим ограничением rps запросов в секунду.
+// После отмены ctx дожидается, пока воркеры закончат текущие заказы, и закрывает канал статусов
+func FetchOrderStatuses(ctx context.Context, accrualAddress string, workers int, rps float64) {
 	LazyInitialiseOrderManager()
+	limiter := newRateLimiter(rps)
+	batch := leaseBatch(rps)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pollOrders(ctx, accrualAddress, limiter)
+		}()
+	}
+	defer func() {
+		close(orderManagerInstant.ordersQueue)
+		wg.Wait()
+		// UpdateOrderStatuses сохранит уже полученные ответы и завершится
+		close(orderManagerInstant.orderStatusChan)
+		logger.Log.Info("Accrual checker is stopped")
+	}()
+
 	for {
-		// Проходим по всем заказам
-		orderManagerInstant.mutex.RLock()
-		var timeOut time.Duration
-		for orderID, status := range orderManagerInstant.ordersForCheck {
-			if status == constants.Processed || status == constants.Invalid {
-				delete(orderManagerInstant.ordersForCheck, orderID)
-				continue // Пропускаем заказы с финальными статусами
-			}
-			timeOut = requestOrderStatus(orderID, accrualAddress) // Для каждого заказа запускаем запрос
+		beat(AccrualPoller)
+		// Забираем из БД заказы, которые пора проверить, и отдаем воркерам.
+		// Во время паузы после 429 заказы не захватываются, их опросят после паузы или другие реплики
+		if !limiter.Paused() && !enqueueOrders(ctx, leaseOrders(ctx, batch)) {
+			return
 		}
-		orderManagerInstant.mutex.RUnlock()
 
-		time.Sleep(timeOut) // Интервал опроса сервиса
+		// Интервал между проходами, новый заказ прерывает ожидание
+		select {
+		case <-time.After(checkInterval):
+		case <-orderManagerInstant.wakeUp:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-// UpdateOrderStatuses горутина для обновления статусов заказов
-func UpdateOrderStatuses() {
+// UpdateOrderStatuses горутина для обновления статусов заказов, работает до закрытия канала статусов.
+// Ответы, полученные до остановки, сохраняются и после отмены ctx
+func UpdateOrderStatuses(ctx context.Context) {
 	LazyInitialiseOrderManager()
-	defer close(orderManagerInstant.orderStatusChan)
+	ctx = context.WithoutCancel(ctx)
+	// Без ответов accrual горутина отмечает heartbeat по таймеру
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
 	for {
-		for updatedOrder := range orderManagerInstant.orderStatusChan {
-			orderManagerInstant.mutex.Lock()
-			orderID, err := strconv.Atoi(updatedOrder.Order)
-			if err == nil {
-				err := storage.Store.UpdateAccrualData(orderID, updatedOrder.Accrual, updatedOrder.Status)
-				if err != nil {
-					logger.Log.Error(fmt.Sprintf("Error updating order status %d, status %s: %s", orderID, updatedOrder.Status, err))
-					continue
-				}
-				logger.Log.Info(fmt.Sprintf("Order status updated %s: %s", updatedOrder.Order, updatedOrder.Status))
+		beat(StatusUpdater)
+		select {
+		case updatedOrder, ok := <-orderManagerInstant.orderStatusChan:
+			if !ok {
+				logger.Log.Info("Order status updater is stopped")
+				return
 			}
-			orderManagerInstant.mutex.Unlock()
+			updateOrderStatus(ctx, updatedOrder)
+		case <-ticker.C:
 		}
 	}
 }
+
+// updateOrderStatus сохранение ответа accrual по заказу
+func updateOrderStatus(ctx context.Context, updatedOrder AccrualOrderResponse) {
+	ctx, span := tracing.Start(trace.ContextWithSpanContext(ctx, updatedOrder.spanContext), "order.update_status",
+		tracing.OrderNumberKey.String(updatedOrder.Order), attribute.String("accrual.status", updatedOrder.Status))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	orderID, err := strconv.Atoi(updatedOrder.Order)
+	if err != nil {
+		logger.Log.Warn(fmt.Sprintf("Invalid order number in accrual response: %s", updatedOrder.Order))
+		return
+	}
+
+	status, ok := accrualStatuses[updatedOrder.Status]
+	if !ok {
+		logger.Log.Warn(fmt.Sprintf("Unknown accrual status for order %d: %s", orderID, updatedOrder.Status))
+		releaseOrder(ctx, orderID, checkInterval)
+		return
+	}
+
+	credited, err := storage.Store.UpdateAccrualData(ctx, orderID, updatedOrder.Accrual, status, updatedOrder.Status)
+	if errors.Is(err, storage.ErrInvalidTransition) {
+		logger.Log.Warn(fmt.Sprintf("Rejected accrual status for order %d: %s", orderID, err))
+		releaseOrder(ctx, orderID, checkInterval)
+		return
+	}
+	if err != nil {
+		logger.Log.Error(fmt.Sprintf("Error updating order status %d, status %s: %s", orderID, status, err))
+		releaseOrder(ctx, orderID, checkInterval)
+		return
+	}
+	logger.Log.Info(fmt.Sprintf("Order status updated %s: %s (accrual %s)", updatedOrder.Order, status, updatedOrder.Status))
+	if credited {
+		metrics.PointsAccrued.Add(updatedOrder.Accrual.InexactFloat64())
+		logger.Log.Info(fmt.Sprintf("Order %s credited with %s points", updatedOrder.Order, updatedOrder.Accrual))
+	}
+
+	if status.IsTerminal() {
+		// Финальный статус, больше заказ не опрашиваем
+		forgetOrder(orderID)
+		return
+	}
+	releaseOrder(ctx, orderID, checkInterval)
+}
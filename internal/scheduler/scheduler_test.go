@@ -0,0 +1,302 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/accrualstub"
+	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/metrics"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+	"github.com/fngoc/gofermart/internal/tracing"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// stubStorage хранилище, в котором переопределены только методы, нужные планировщику
+type stubStorage struct {
+	storage.Storage
+	mutex     sync.Mutex
+	leased    bool
+	updated   map[int]constants.OrderStatus
+	postponed map[int]time.Duration
+}
+
+func (s *stubStorage) LeaseOrdersForCheck(_ context.Context, _ int, _ time.Duration) ([]storagemodels.QueuedOrder, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.leased {
+		return nil, nil
+	}
+	s.leased = true
+	return []storagemodels.QueuedOrder{{OrderID: 1, Status: constants.New}, {OrderID: 2, Status: constants.New}}, nil
+}
+
+func (s *stubStorage) PostponeOrderCheck(ctx context.Context, orderID int, delay time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.postponed[orderID] = delay
+	return ctx.Err()
+}
+
+func (s *stubStorage) UpdateAccrualData(ctx context.Context, orderID int, _ decimal.Decimal, status constants.OrderStatus, _ string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.updated[orderID] = status
+	return status == constants.Processed, ctx.Err()
+}
+
+// resetOrderManager сброс менеджера заказов, после остановки его каналы закрыты
+func resetOrderManager() {
+	orderManagerInstant = nil
+	once = sync.Once{}
+}
+
+func TestFetchOrderStatusesShutdown(t *testing.T) {
+	assert.NoError(t, logger.Initialize())
+	resetOrderManager()
+	defer resetOrderManager()
+
+	stub := &stubStorage{updated: make(map[int]constants.OrderStatus), postponed: make(map[int]time.Duration)}
+	storage.SetDBInstance(stub)
+
+	requested := make(chan struct{}, 2)
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		// Ответ приходит уже после отмены контекста
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"order":"1","status":"PROCESSED","accrual":500}`)
+	}))
+	defer accrual.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// Один воркер и один запрос в секунду: второй заказ не успеет уйти в accrual
+		FetchOrderStatuses(ctx, accrual.URL, 1, 1)
+	}()
+	go func() {
+		defer wg.Done()
+		UpdateOrderStatuses(ctx)
+	}()
+
+	<-requested
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduler did not stop")
+	}
+
+	// Текущий заказ обработан до конца, несмотря на отмену
+	assert.Equal(t, constants.Processed, stub.updated[1])
+	// Второй заказ не опрашивался и освобожден для других реплик
+	_, ok := stub.updated[2]
+	assert.False(t, ok)
+	delay, ok := stub.postponed[2]
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), delay)
+	assert.Len(t, requested, 0)
+}
+
+func TestLeaseBatch(t *testing.T) {
+	// Без ограничения частоты очередь ограничена только своим размером
+	assert.Equal(t, leaseBatchSize, leaseBatch(0))
+	assert.Equal(t, leaseBatchSize, leaseBatch(50))
+	// Очередь успевает уйти в accrual до истечения lease
+	assert.Equal(t, 10, leaseBatch(0.5))
+	assert.Equal(t, 1, leaseBatch(0.01))
+}
+
+func TestPollOrdersSkipsStaleLeases(t *testing.T) {
+	assert.NoError(t, logger.Initialize())
+	resetOrderManager()
+	defer resetOrderManager()
+	LazyInitialiseOrderManager()
+
+	stub := &stubStorage{updated: make(map[int]constants.OrderStatus), postponed: make(map[int]time.Duration)}
+	storage.SetDBInstance(stub)
+
+	requested := make(chan struct{}, 1)
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer accrual.Close()
+
+	// Lease заказа истек, пока он ждал воркера
+	orderManagerInstant.ordersForCheck[1] = time.Now().Add(-time.Second)
+	orderManagerInstant.ordersQueue <- 1
+	close(orderManagerInstant.ordersQueue)
+	pollOrders(context.Background(), accrual.URL, newRateLimiter(0))
+
+	// Заказ не опрашивается и не освобождается в БД, его могла захватить другая реплика
+	assert.Len(t, requested, 0)
+	assert.NotContains(t, stub.postponed, 1)
+	assert.NotContains(t, orderManagerInstant.ordersForCheck, 1)
+}
+
+func TestPollOrdersReleasesQueueOnPause(t *testing.T) {
+	assert.NoError(t, logger.Initialize())
+	resetOrderManager()
+	defer resetOrderManager()
+	LazyInitialiseOrderManager()
+
+	stub := &stubStorage{updated: make(map[int]constants.OrderStatus), postponed: make(map[int]time.Duration)}
+	storage.SetDBInstance(stub)
+
+	limiter := newRateLimiter(0)
+	limiter.Pause(time.Minute)
+	for _, orderID := range []int{1, 2} {
+		orderManagerInstant.ordersForCheck[orderID] = time.Now().Add(leaseDuration)
+		orderManagerInstant.ordersQueue <- orderID
+	}
+	close(orderManagerInstant.ordersQueue)
+
+	done := make(chan struct{})
+	go func() {
+		pollOrders(context.Background(), "http://accrual.invalid", limiter)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker waited for the pause to end")
+	}
+
+	// Заказы из очереди сразу освобождены, а не ждут конца паузы с истекающим lease
+	assert.Equal(t, map[int]time.Duration{1: 0, 2: 0}, stub.postponed)
+	assert.Empty(t, orderManagerInstant.ordersForCheck)
+}
+
+func TestUpdateOrderStatusesMapsAccrualStatuses(t *testing.T) {
+	assert.NoError(t, logger.Initialize())
+	resetOrderManager()
+	defer resetOrderManager()
+	LazyInitialiseOrderManager()
+
+	stub := &stubStorage{updated: make(map[int]constants.OrderStatus), postponed: make(map[int]time.Duration)}
+	storage.SetDBInstance(stub)
+
+	go func() {
+		orderManagerInstant.orderStatusChan <- AccrualOrderResponse{Order: "1", Status: "REGISTERED"}
+		orderManagerInstant.orderStatusChan <- AccrualOrderResponse{Order: "2", Status: "DONE"}
+		orderManagerInstant.orderStatusChan <- AccrualOrderResponse{Order: "3", Status: "INVALID"}
+		close(orderManagerInstant.orderStatusChan)
+	}()
+	UpdateOrderStatuses(context.Background())
+
+	// REGISTERED для пользователя уже PROCESSING, заказ опрашивается дальше
+	assert.Equal(t, constants.Processing, stub.updated[1])
+	assert.Contains(t, stub.postponed, 1)
+	// Неизвестный статус не сохраняется, заказ будет опрошен повторно
+	assert.NotContains(t, stub.updated, 2)
+	assert.Contains(t, stub.postponed, 2)
+	// Финальный статус снимает заказ с опроса
+	assert.Equal(t, constants.Invalid, stub.updated[3])
+	assert.NotContains(t, stub.postponed, 3)
+}
+
+func TestSchedulerWithAccrualStub(t *testing.T) {
+	assert.NoError(t, logger.Initialize())
+	resetOrderManager()
+	defer resetOrderManager()
+
+	memoryStore := storage.NewMemoryStorage()
+	storage.SetDBInstance(memoryStore)
+	ctx := context.Background()
+	assert.NoError(t, memoryStore.CreateUser(ctx, "testUser", "hash"))
+	_, err := memoryStore.CreateOrder(ctx, 1, 2377225624)
+	assert.NoError(t, err)
+
+	throttledPolls := testutil.ToFloat64(metrics.AccrualPolls.WithLabelValues("429"))
+	accrued := testutil.ToFloat64(metrics.PointsAccrued)
+	spans := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	stub := accrualstub.New(accrualstub.Config{AutoRegister: true, DefaultAccrual: decimal.RequireFromString("729.98")})
+	// Первый запрос упирается в лимит accrual
+	stub.InjectFault(accrualstub.Fault{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Second})
+	accrual := httptest.NewServer(stub)
+	defer accrual.Close()
+
+	schedulerCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		FetchOrderStatuses(schedulerCtx, accrual.URL, 2, 0)
+	}()
+	go func() {
+		defer wg.Done()
+		UpdateOrderStatuses(schedulerCtx)
+	}()
+	AddOrderInQueue(2377225624)
+
+	assert.Eventually(t, func() bool {
+		balance, err := memoryStore.GetBalanceByUserID(ctx, 1)
+		return err == nil && balance.Current.String() == "729.98"
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// Обе горутины планировщика отметили heartbeat
+	beats := Heartbeats()
+	for _, component := range Components {
+		assert.WithinDuration(t, time.Now(), beats[component], 10*time.Second, component)
+	}
+
+	cancel()
+	wg.Wait()
+
+	orders, _, err := memoryStore.ListOrdersByUserID(ctx, 1, storagemodels.ListQuery{Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, constants.Processed, orders[0].Status)
+	assert.Equal(t, 1, stub.Polls("2377225624"))
+
+	assert.Equal(t, throttledPolls+1, testutil.ToFloat64(metrics.AccrualPolls.WithLabelValues("429")))
+	assert.InDelta(t, accrued+729.98, testutil.ToFloat64(metrics.PointsAccrued), 1e-9)
+
+	// Сохранение ответа accrual продолжает трассировку успешного опроса
+	polls := make(map[trace.SpanID]sdktrace.ReadOnlySpan)
+	var updates []sdktrace.ReadOnlySpan
+	for _, span := range spans.Ended() {
+		switch span.Name() {
+		case "accrual.poll":
+			polls[span.SpanContext().SpanID()] = span
+		case "order.update_status":
+			updates = append(updates, span)
+		}
+	}
+	assert.Len(t, polls, 2)
+	assert.Len(t, updates, 1)
+	assert.Contains(t, updates[0].Attributes(), tracing.OrderNumberKey.String("2377225624"))
+	poll, ok := polls[updates[0].Parent().SpanID()]
+	assert.True(t, ok)
+	if ok {
+		assert.Contains(t, poll.Attributes(), tracing.OrderNumberKey.String("2377225624"))
+		assert.Equal(t, poll.SpanContext().TraceID(), updates[0].SpanContext().TraceID())
+	}
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.OrderQueueDepth))
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Категории ошибок хранилища. Ошибки методов Storage оборачивают одну из них вместе с исходной ошибкой,
+// поэтому проверяются через errors.Is
+var (
+	// ErrNotFound запись не найдена
+	ErrNotFound = errors.New("not found")
+	// ErrConflict запись противоречит существующим данным, например нарушена уникальность
+	ErrConflict = errors.New("conflict")
+	// ErrInsufficientFunds на балансе недостаточно баллов
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	// ErrTransient временная ошибка БД: недоступность, таймаут, конфликт сериализации. Запрос можно повторить
+	ErrTransient = errors.New("transient storage error")
+
+	// ErrWithdrawalExists списание с таким номером заказа у пользователя уже есть
+	ErrWithdrawalExists = fmt.Errorf("withdrawal already exists: %w", ErrConflict)
+	// ErrDuplicateOrder заказ с таким номером уже загружен другим пользователем
+	ErrDuplicateOrder = fmt.Errorf("order uploaded by another user: %w", ErrConflict)
+	// ErrReversalNotCovered возврат по заказу без списания или больше списанной и еще не возвращенной суммы
+	ErrReversalNotCovered = fmt.Errorf("reversal is not covered by withdrawal: %w", ErrConflict)
+	// ErrInvalidTransition недопустимая смена статуса заказа, например выход из финального статуса
+	ErrInvalidTransition = fmt.Errorf("invalid order status transition: %w", ErrConflict)
+	// ErrSessionNotFound сессия не найдена, отозвана или истекла
+	ErrSessionNotFound = fmt.Errorf("session: %w", ErrNotFound)
+	// ErrRefreshTokenReused предъявлен уже замененный refresh токен, сессия отозвана
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// Коды ошибок PostgreSQL
+const (
+	uniqueViolation      = "23505"
+	foreignKeyViolation  = "23503"
+	serializationFailure = "40001"
+	deadlockDetected     = "40P01"
+	lockNotAvailable     = "55P03"
+	tooManyConnections   = "53300"
+	adminShutdown        = "57P01"
+	cannotConnectNow     = "57P03"
+	// connectionException класс ошибок соединения 08xxx
+	connectionException = "08"
+)
+
+// Error ошибка операции хранилища
+type Error struct {
+	// Op описание операции
+	Op string
+	// Kind категория ошибки, nil - ошибка без категории
+	Kind error
+	// Err исходная ошибка
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, e.Err)
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Kind == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// wrapError оборачивание ошибки операции op с определением категории
+func wrapError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Op: op, Kind: classify(err), Err: err}
+}
+
+// classify категория ошибки по ее типу и коду PostgreSQL
+func classify(err error) error {
+	for _, kind := range []error{ErrNotFound, ErrConflict, ErrInsufficientFunds, ErrTransient} {
+		if errors.Is(err, kind) {
+			return nil
+		}
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case uniqueViolation, foreignKeyViolation:
+			return ErrConflict
+		case serializationFailure, deadlockDetected, lockNotAvailable, tooManyConnections, adminShutdown, cannotConnectNow:
+			return ErrTransient
+		}
+		if strings.HasPrefix(pgErr.Code, connectionException) {
+			return ErrTransient
+		}
+		return nil
+	}
+
+	var netErr net.Error
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNotFound
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone):
+		return ErrTransient
+	case pgconn.Timeout(err), pgconn.SafeToRetry(err), errors.As(err, &netErr):
+		return ErrTransient
+	}
+	return nil
+}
+
+// isUniqueViolation ошибка нарушения уникальности
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
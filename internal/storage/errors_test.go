@@ -0,0 +1,47 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrapError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kind error
+	}{
+		{name: "no rows", err: sql.ErrNoRows, kind: ErrNotFound},
+		{name: "unique violation", err: &pgconn.PgError{Code: "23505"}, kind: ErrConflict},
+		{name: "foreign key violation", err: &pgconn.PgError{Code: "23503"}, kind: ErrConflict},
+		{name: "serialization failure", err: &pgconn.PgError{Code: "40001"}, kind: ErrTransient},
+		{name: "deadlock", err: &pgconn.PgError{Code: "40P01"}, kind: ErrTransient},
+		{name: "connection failure", err: &pgconn.PgError{Code: "08006"}, kind: ErrTransient},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, kind: ErrTransient},
+		{name: "conn done", err: sql.ErrConnDone, kind: ErrTransient},
+		{name: "insufficient funds", err: ErrInsufficientFunds, kind: ErrInsufficientFunds},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := wrapError("op", tt.err)
+			assert.ErrorIs(t, err, tt.kind)
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, "op: "+tt.err.Error(), err.Error())
+		})
+	}
+
+	t.Run("syntax error has no category", func(t *testing.T) {
+		err := wrapError("op", &pgconn.PgError{Code: "42601"})
+		for _, kind := range []error{ErrNotFound, ErrConflict, ErrInsufficientFunds, ErrTransient} {
+			assert.False(t, errors.Is(err, kind))
+		}
+	})
+
+	assert.NoError(t, wrapError("op", nil))
+}
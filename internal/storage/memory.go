@@ -0,0 +1,785 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/fngoc/gofermart/internal/metrics"
+	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+	"github.com/fngoc/gofermart/internal/utils"
+	"github.com/shopspring/decimal"
+)
+
+// MemoryStorage реализация Storage в памяти процесса для локального запуска без PostgreSQL и для тестов.
+// Все операции выполняются под одной блокировкой, поэтому составные операции атомарны так же,
+// как транзакции SQLStorage. Данные теряются при перезапуске
+type MemoryStorage struct {
+	mutex sync.RWMutex
+	// lastUserID последний выданный идентификатор пользователя
+	lastUserID int
+	// users пользователи по имени
+	users map[string]*memoryUser
+	// orders заказы по номеру
+	orders map[int]*memoryOrder
+	// balances закэшированные балансы по userID
+	balances map[int]*storagemodels.Balance
+	// transactions история списаний
+	transactions []memoryTransaction
+	// ledger журнал операций
+	ledger []memoryLedgerEntry
+	// sessions сессии по идентификатору
+	sessions map[string]*memorySession
+	// loginAttempts неудачные попытки входа по ключу
+	loginAttempts map[string]*memoryLoginAttempts
+	// idempotencyKeys ответы на запросы с ключом идемпотентности
+	idempotencyKeys map[memoryIdempotencyKey]*memoryIdempotencyRecord
+}
+
+// memoryUser пользователь
+type memoryUser struct {
+	id       int
+	name     string
+	password string
+}
+
+// memoryOrder заказ
+type memoryOrder struct {
+	userID        int
+	orderID       int
+	status        constants.OrderStatus
+	accrualStatus string
+	accrual       decimal.NullDecimal
+	createdAt     time.Time
+	nextCheckAt   time.Time
+	lastCheckedAt time.Time
+	pollCount     int
+	history       []storagemodels.OrderStatusChange
+}
+
+// cursor позиция заказа в списке
+func (o *memoryOrder) cursor() storagemodels.Cursor {
+	return storagemodels.Cursor{At: o.createdAt, Number: o.orderID}
+}
+
+// memoryTransaction списание из истории операций
+type memoryTransaction struct {
+	userID      int
+	orderNumber int
+	sum         decimal.Decimal
+	processedAt time.Time
+}
+
+// cursor позиция списания в истории
+func (t memoryTransaction) cursor() storagemodels.Cursor {
+	return storagemodels.Cursor{At: t.processedAt, Number: t.orderNumber}
+}
+
+// memoryLedgerEntry запись журнала операций
+type memoryLedgerEntry struct {
+	userID      int
+	orderNumber int
+	entryType   string
+	amount      decimal.Decimal
+}
+
+// memorySession сессия пользователя
+type memorySession struct {
+	storagemodels.Session
+	previousTokenHash string
+	revoked           bool
+}
+
+// memoryIdempotencyKey ключ идемпотентности пользователя
+type memoryIdempotencyKey struct {
+	userID int
+	key    string
+}
+
+// memoryIdempotencyRecord ответ по ключу идемпотентности со временем захвата ключа
+type memoryIdempotencyRecord struct {
+	storagemodels.IdempotencyRecord
+	createdAt time.Time
+}
+
+// memoryLoginAttempts неудачные попытки входа
+type memoryLoginAttempts struct {
+	failures      int
+	lastFailureAt time.Time
+	lockedUntil   time.Time
+}
+
+// active сессия не отозвана и не истекла
+func (s *memorySession) active() bool {
+	return !s.revoked && s.ExpiresAt.After(time.Now())
+}
+
+// NewMemoryStorage создание пустого хранилища в памяти
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		users:           make(map[string]*memoryUser),
+		orders:          make(map[int]*memoryOrder),
+		balances:        make(map[int]*storagemodels.Balance),
+		sessions:        make(map[string]*memorySession),
+		loginAttempts:   make(map[string]*memoryLoginAttempts),
+		idempotencyKeys: make(map[memoryIdempotencyKey]*memoryIdempotencyRecord),
+	}
+}
+
+// formatTime время в формате, который отдает SQLStorage
+func formatTime(t time.Time) string {
+	return utils.ConvertTime(t.UTC().Format(time.RFC3339Nano))
+}
+
+// IsUserCreated проверка на существование пользователя
+func (s *MemoryStorage) IsUserCreated(_ context.Context, userName string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, ok := s.users[userName]
+	return ok
+}
+
+// GetPasswordHashByUser получение хэша пароля пользователя
+func (s *MemoryStorage) GetPasswordHashByUser(_ context.Context, userName string) (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	user, ok := s.users[userName]
+	if !ok {
+		return "", wrapError("failed to get password hash", sql.ErrNoRows)
+	}
+	return user.password, nil
+}
+
+// UpdatePasswordHash замена хэша пароля пользователя
+func (s *MemoryStorage) UpdatePasswordHash(_ context.Context, userName, passwordHash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if user, ok := s.users[userName]; ok {
+		user.password = passwordHash
+	}
+	return nil
+}
+
+// ChangePassword смена пароля пользователя с отзывом всех его сессий, кроме keepSessionID
+func (s *MemoryStorage) ChangePassword(_ context.Context, userName, passwordHash, keepSessionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	user, ok := s.users[userName]
+	if !ok {
+		return wrapError("failed to update password", sql.ErrNoRows)
+	}
+	user.password = passwordHash
+	for id, session := range s.sessions {
+		if session.UserName == userName && id != keepSessionID {
+			session.revoked = true
+		}
+	}
+	return nil
+}
+
+// DeleteUser обезличивание пользователя с отзывом сессий, заказы и операции остаются
+func (s *MemoryStorage) DeleteUser(_ context.Context, userName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.users[userName]; !ok {
+		return wrapError("failed to anonymise user", sql.ErrNoRows)
+	}
+	for _, session := range s.sessions {
+		if session.UserName == userName {
+			session.revoked = true
+		}
+	}
+
+	// Заказы и операции ссылаются на идентификатор пользователя, поэтому запись пользователя не нужна
+	delete(s.users, userName)
+	return nil
+}
+
+// CreateUser создание пользователя вместе с нулевым балансом
+func (s *MemoryStorage) CreateUser(_ context.Context, userName, passwordHash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.users[userName]; ok {
+		return wrapError("failed to insert user and get user_id", fmt.Errorf("user %s: %w", userName, ErrConflict))
+	}
+
+	s.lastUserID++
+	s.users[userName] = &memoryUser{id: s.lastUserID, name: userName, password: passwordHash}
+	s.balances[s.lastUserID] = &storagemodels.Balance{}
+	return nil
+}
+
+// GetUserIDByName получение идентификатора пользователя по userName
+func (s *MemoryStorage) GetUserIDByName(_ context.Context, userName string) (int, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	user, ok := s.users[userName]
+	if !ok {
+		return 0, wrapError("failed to get user id", sql.ErrNoRows)
+	}
+	return user.id, nil
+}
+
+// CreateOrder создание заказа или определение владельца уже загруженного
+func (s *MemoryStorage) CreateOrder(_ context.Context, userID int, orderID int) (storagemodels.OrderUploadResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if order, ok := s.orders[orderID]; ok {
+		return orderUploadResult(userID, orderID, order.userID, false)
+	}
+
+	now := time.Now()
+	s.orders[orderID] = &memoryOrder{
+		userID:      userID,
+		orderID:     orderID,
+		status:      constants.New,
+		createdAt:   now,
+		nextCheckAt: now,
+		history: []storagemodels.OrderStatusChange{{
+			Status:    constants.New,
+			Source:    constants.HistoryUpload,
+			ChangedAt: formatTime(now),
+		}},
+	}
+	return storagemodels.OrderCreated, nil
+}
+
+// ListOrdersByUserID получение страницы заказов пользователя и курсора следующей страницы
+func (s *MemoryStorage) ListOrdersByUserID(_ context.Context, userID int, query storagemodels.ListQuery) ([]storagemodels.Order, *storagemodels.Cursor, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var orders []*memoryOrder
+	for _, order := range s.orders {
+		if order.userID != userID || !inPage(order.cursor(), query) {
+			continue
+		}
+		if len(query.Statuses) > 0 && !slices.Contains(query.Statuses, order.status) {
+			continue
+		}
+		orders = append(orders, order)
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		return cursorBefore(orders[i].cursor(), orders[j].cursor(), query.Ascending)
+	})
+
+	cursors := make([]storagemodels.Cursor, 0, len(orders))
+	for _, order := range orders {
+		cursors = append(cursors, order.cursor())
+	}
+	size, next := pageSize(cursors, query.Limit)
+
+	var result []storagemodels.Order
+	for _, order := range orders[:size] {
+		var accrual *decimal.Decimal
+		if order.accrual.Valid && !order.accrual.Decimal.IsZero() {
+			value := order.accrual.Decimal
+			accrual = &value
+		}
+		result = append(result, storagemodels.Order{
+			Number:     fmt.Sprint(order.orderID),
+			Status:     order.status,
+			Accrual:    accrual,
+			UploadedAt: formatTime(order.createdAt),
+		})
+	}
+	return result, next, nil
+}
+
+// GetOrderByNumber получение заказа пользователя с историей статусов
+func (s *MemoryStorage) GetOrderByNumber(_ context.Context, userID, orderID int) (storagemodels.OrderDetails, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	order, ok := s.orders[orderID]
+	if !ok || order.userID != userID {
+		return storagemodels.OrderDetails{}, wrapError("failed to get order", sql.ErrNoRows)
+	}
+
+	result := storagemodels.OrderDetails{
+		Order: storagemodels.Order{
+			Number:     fmt.Sprint(order.orderID),
+			Status:     order.status,
+			UploadedAt: formatTime(order.createdAt),
+		},
+		PollCount: order.pollCount,
+		History:   slices.Clone(order.history),
+	}
+	if order.accrual.Valid && !order.accrual.Decimal.IsZero() {
+		value := order.accrual.Decimal
+		result.Accrual = &value
+	}
+	if !order.lastCheckedAt.IsZero() {
+		result.LastCheckedAt = formatTime(order.lastCheckedAt)
+	}
+	return result, nil
+}
+
+// GetBalanceByUserID получение баланса пользователя, баланс считается по журналу операций
+func (s *MemoryStorage) GetBalanceByUserID(_ context.Context, userID int) (storagemodels.Balance, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.ledgerBalance(userID), nil
+}
+
+// ledgerBalance сумма журнала операций пользователя, вызывается под блокировкой
+func (s *MemoryStorage) ledgerBalance(userID int) storagemodels.Balance {
+	var result storagemodels.Balance
+	for _, entry := range s.ledger {
+		if entry.userID != userID {
+			continue
+		}
+		result.Current = result.Current.Add(entry.amount)
+		if entry.entryType == constants.LedgerWithdrawal || entry.entryType == constants.LedgerReversal {
+			result.Withdrawn = result.Withdrawn.Sub(entry.amount)
+		}
+	}
+	return result
+}
+
+// DeductBalance вычет баланса пользователя, средства проверяются по журналу операций,
+// списание записывается в историю операций и журнал
+func (s *MemoryStorage) DeductBalance(_ context.Context, userID, orderID int, amountToDeduct decimal.Decimal) (decimal.Decimal, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	balance, ok := s.balances[userID]
+	current := s.ledgerBalance(userID).Current
+	if !ok || current.LessThan(amountToDeduct) {
+		return decimal.Zero, wrapError("failed to update balance", ErrInsufficientFunds)
+	}
+	for _, transaction := range s.transactions {
+		if transaction.userID == userID && transaction.orderNumber == orderID {
+			return decimal.Zero, ErrWithdrawalExists
+		}
+	}
+
+	balance.Current = balance.Current.Sub(amountToDeduct)
+	balance.Withdrawn = balance.Withdrawn.Add(amountToDeduct)
+	s.transactions = append(s.transactions, memoryTransaction{
+		userID:      userID,
+		orderNumber: orderID,
+		sum:         amountToDeduct,
+		processedAt: time.Now(),
+	})
+	s.ledger = append(s.ledger, memoryLedgerEntry{
+		userID:      userID,
+		orderNumber: orderID,
+		entryType:   constants.LedgerWithdrawal,
+		amount:      amountToDeduct.Neg(),
+	})
+	return current.Sub(amountToDeduct), nil
+}
+
+// ListTransactionsByUserID получение страницы истории списаний пользователя и курсора следующей страницы
+func (s *MemoryStorage) ListTransactionsByUserID(_ context.Context, userID int, query storagemodels.ListQuery) ([]storagemodels.Transaction, *storagemodels.Cursor, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var transactions []memoryTransaction
+	for _, transaction := range s.transactions {
+		if transaction.userID == userID && inPage(transaction.cursor(), query) {
+			transactions = append(transactions, transaction)
+		}
+	}
+	sort.Slice(transactions, func(i, j int) bool {
+		return cursorBefore(transactions[i].cursor(), transactions[j].cursor(), query.Ascending)
+	})
+
+	cursors := make([]storagemodels.Cursor, 0, len(transactions))
+	for _, transaction := range transactions {
+		cursors = append(cursors, transaction.cursor())
+	}
+	size, next := pageSize(cursors, query.Limit)
+
+	var result []storagemodels.Transaction
+	for _, transaction := range transactions[:size] {
+		result = append(result, storagemodels.Transaction{
+			OrderNumber: fmt.Sprint(transaction.orderNumber),
+			Sum:         transaction.sum,
+			ProcessedAt: formatTime(transaction.processedAt),
+		})
+	}
+	return result, next, nil
+}
+
+// UpdateAccrualData обновление заказа по ответу accrual, баллы начисляются только при переходе
+// заказа в PROCESSED, смена статуса или исходного статуса accrual записывается в историю,
+// недопустимый переход дает ErrInvalidTransition. Возвращает true, если начисление произошло
+func (s *MemoryStorage) UpdateAccrualData(_ context.Context, orderID int, accrual decimal.Decimal, status constants.OrderStatus, accrualStatus string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	order, ok := s.orders[orderID]
+	if !ok {
+		return false, wrapError("failed to find userID", sql.ErrNoRows)
+	}
+	if skip, err := orderTransition(order.status, status); skip || err != nil {
+		return false, wrapError("failed to update order", err)
+	}
+
+	now := time.Now()
+	order.pollCount++
+	if order.status != status || order.accrualStatus != accrualStatus {
+		order.history = append(order.history, storagemodels.OrderStatusChange{
+			Status:        status,
+			AccrualStatus: accrualStatus,
+			Source:        constants.HistoryAccrual,
+			PollCount:     order.pollCount,
+			ChangedAt:     formatTime(now),
+		})
+	}
+	order.status = status
+	order.accrualStatus = accrualStatus
+	order.accrual = decimal.NewNullDecimal(accrual)
+	order.lastCheckedAt = now
+	if status == constants.Processed {
+		metrics.OrderProcessingTime.Observe(now.Sub(order.createdAt).Seconds())
+	}
+
+	credited := status == constants.Processed && accrual.IsPositive()
+	if credited {
+		if balance, ok := s.balances[order.userID]; ok {
+			balance.Current = balance.Current.Add(accrual)
+		}
+		s.ledger = append(s.ledger, memoryLedgerEntry{
+			userID:      order.userID,
+			orderNumber: orderID,
+			entryType:   constants.LedgerAccrual,
+			amount:      accrual,
+		})
+	}
+	return credited, nil
+}
+
+// LeaseOrdersForCheck захват заказов с нефинальным статусом для опроса accrual на время lease
+func (s *MemoryStorage) LeaseOrdersForCheck(_ context.Context, limit int, lease time.Duration) ([]storagemodels.QueuedOrder, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	var due []*memoryOrder
+	for _, order := range s.orders {
+		if order.status.IsTerminal() {
+			continue
+		}
+		if !order.nextCheckAt.After(now) {
+			due = append(due, order)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].nextCheckAt.Before(due[j].nextCheckAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	var result []storagemodels.QueuedOrder
+	for _, order := range due {
+		order.nextCheckAt = now.Add(lease)
+		result = append(result, storagemodels.QueuedOrder{OrderID: order.orderID, Status: order.status})
+	}
+	return result, nil
+}
+
+// PostponeOrderCheck перенос следующего опроса заказа, снимает lease с заказа
+func (s *MemoryStorage) PostponeOrderCheck(_ context.Context, orderID int, delay time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if order, ok := s.orders[orderID]; ok {
+		order.nextCheckAt = time.Now().Add(delay)
+	}
+	return nil
+}
+
+// AppendLedgerEntry добавление в журнал операций возврата или ручной корректировки
+// с обновлением закэшированного баланса, возврат покрывается списанием по тому же заказу
+func (s *MemoryStorage) AppendLedgerEntry(_ context.Context, userID, orderNumber int, entryType string, amount decimal.Decimal) error {
+	var withdrawnDelta decimal.Decimal
+	switch entryType {
+	case constants.LedgerReversal:
+		if !amount.IsPositive() {
+			return fmt.Errorf("reversal amount must be positive")
+		}
+		withdrawnDelta = amount
+	case constants.LedgerAdjustment:
+	default:
+		return fmt.Errorf("unsupported ledger entry type: %s", entryType)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	balance, ok := s.balances[userID]
+	if !ok || s.ledgerBalance(userID).Current.Add(amount).IsNegative() {
+		return wrapError("failed to update balance", ErrInsufficientFunds)
+	}
+	if entryType == constants.LedgerReversal {
+		var withdrawn, reversed decimal.Decimal
+		for _, entry := range s.ledger {
+			if entry.userID != userID || entry.orderNumber != orderNumber {
+				continue
+			}
+			switch entry.entryType {
+			case constants.LedgerWithdrawal:
+				withdrawn = withdrawn.Sub(entry.amount)
+			case constants.LedgerReversal:
+				reversed = reversed.Add(entry.amount)
+			}
+		}
+		if reversed.Add(amount).GreaterThan(withdrawn) {
+			return ErrReversalNotCovered
+		}
+	}
+
+	balance.Current = balance.Current.Add(amount)
+	balance.Withdrawn = balance.Withdrawn.Sub(withdrawnDelta)
+	s.ledger = append(s.ledger, memoryLedgerEntry{
+		userID:      userID,
+		orderNumber: orderNumber,
+		entryType:   entryType,
+		amount:      amount,
+	})
+	return nil
+}
+
+// ReconcileBalances сверка закэшированных балансов с журналом операций,
+// возвращает пользователей, у которых они расходятся
+func (s *MemoryStorage) ReconcileBalances(_ context.Context) ([]storagemodels.BalanceDiscrepancy, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var result []storagemodels.BalanceDiscrepancy
+	for userID, cached := range s.balances {
+		ledger := s.ledgerBalance(userID)
+		if cached.Current.Equal(ledger.Current) && cached.Withdrawn.Equal(ledger.Withdrawn) {
+			continue
+		}
+		result = append(result, storagemodels.BalanceDiscrepancy{
+			UserID:          userID,
+			CachedCurrent:   cached.Current,
+			CachedWithdrawn: cached.Withdrawn,
+			LedgerCurrent:   ledger.Current,
+			LedgerWithdrawn: ledger.Withdrawn,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UserID < result[j].UserID
+	})
+	return result, nil
+}
+
+// CreateSession создание сессии пользователя
+func (s *MemoryStorage) CreateSession(_ context.Context, session storagemodels.Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.users[session.UserName]; !ok {
+		return wrapError("failed to insert session", fmt.Errorf("user %s: %w", session.UserName, ErrNotFound))
+	}
+	if _, ok := s.sessions[session.ID]; ok {
+		return wrapError("failed to insert session", fmt.Errorf("session %s: %w", session.ID, ErrConflict))
+	}
+	s.sessions[session.ID] = &memorySession{Session: session}
+	return nil
+}
+
+// RotateSession замена refresh токена сессии, повторное предъявление замененного токена отзывает сессию
+func (s *MemoryStorage) RotateSession(_ context.Context, refreshTokenHash, newRefreshTokenHash string, expiresAt time.Time) (storagemodels.Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, session := range s.sessions {
+		current := session.RefreshTokenHash == refreshTokenHash
+		if !current && session.previousTokenHash != refreshTokenHash {
+			continue
+		}
+		if !session.active() {
+			return storagemodels.Session{}, ErrSessionNotFound
+		}
+		if !current {
+			session.revoked = true
+			return session.Session, ErrRefreshTokenReused
+		}
+
+		session.previousTokenHash = session.RefreshTokenHash
+		session.RefreshTokenHash = newRefreshTokenHash
+		session.ExpiresAt = expiresAt
+		return session.Session, nil
+	}
+	return storagemodels.Session{}, ErrSessionNotFound
+}
+
+// IsSessionActive проверка, что сессия не отозвана и не истекла
+func (s *MemoryStorage) IsSessionActive(_ context.Context, sessionID string) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	session, ok := s.sessions[sessionID]
+	return ok && session.active(), nil
+}
+
+// RevokeSession отзыв сессии
+func (s *MemoryStorage) RevokeSession(_ context.Context, sessionID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if session, ok := s.sessions[sessionID]; ok {
+		session.revoked = true
+	}
+	return nil
+}
+
+// RevokeUserSessions отзыв всех сессий пользователя
+func (s *MemoryStorage) RevokeUserSessions(_ context.Context, userName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, session := range s.sessions {
+		if session.UserName == userName {
+			session.revoked = true
+		}
+	}
+	return nil
+}
+
+// RecordLoginFailure учет попытки входа по ключу как неудачной с блокировкой по правилам policy,
+// попытка по заблокированному ключу отклоняется без учета
+func (s *MemoryStorage) RecordLoginFailure(_ context.Context, key string, policy storagemodels.LoginPolicy) (storagemodels.LoginAttempt, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	attempts, ok := s.loginAttempts[key]
+	if !ok {
+		attempts = &memoryLoginAttempts{}
+		s.loginAttempts[key] = attempts
+	}
+	if attempts.lockedUntil.After(now) {
+		return storagemodels.LoginAttempt{Rejected: true, Failures: attempts.failures, Lockout: attempts.lockedUntil.Sub(now)}, nil
+	}
+	if attempts.lastFailureAt.Before(now.Add(-policy.ResetAfter)) {
+		attempts.failures = 0
+	}
+	attempts.failures++
+	attempts.lastFailureAt = now
+	lockout := policy.Lockout(attempts.failures)
+	attempts.lockedUntil = time.Time{}
+	if lockout > 0 {
+		attempts.lockedUntil = now.Add(lockout)
+	}
+	return storagemodels.LoginAttempt{Failures: attempts.failures, Lockout: lockout}, nil
+}
+
+// ReleaseLoginFailure снятие засчитанной попытки входа по ключу, unlock снимает и блокировку этой попытки
+func (s *MemoryStorage) ReleaseLoginFailure(_ context.Context, key string, unlock bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if attempts, ok := s.loginAttempts[key]; ok {
+		attempts.failures = max(attempts.failures-1, 0)
+		if unlock {
+			attempts.lockedUntil = time.Time{}
+		}
+	}
+	return nil
+}
+
+// ResetLoginFailures сброс неудачных попыток входа по ключу
+func (s *MemoryStorage) ResetLoginFailures(_ context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.loginAttempts, key)
+	return nil
+}
+
+// DeleteExpiredLoginAttempts удаление счетчиков неудачных попыток входа без неудач дольше retention
+// и без действующей блокировки
+func (s *MemoryStorage) DeleteExpiredLoginAttempts(_ context.Context, retention time.Duration) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	var deleted int64
+	for key, attempts := range s.loginAttempts {
+		if now.Sub(attempts.lastFailureAt) > retention && !attempts.lockedUntil.After(now) {
+			delete(s.loginAttempts, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// ReserveIdempotencyKey захват ключа идемпотентности пользователя, для уже известного ключа возвращается
+// сохраненная запись и false
+func (s *MemoryStorage) ReserveIdempotencyKey(_ context.Context, userID int, key, requestHash string, reservationTTL time.Duration) (storagemodels.IdempotencyRecord, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id := memoryIdempotencyKey{userID: userID, key: key}
+	now := time.Now()
+	record, ok := s.idempotencyKeys[id]
+	if ok && (record.StatusCode != 0 || now.Sub(record.createdAt) < reservationTTL) {
+		return record.IdempotencyRecord, false, nil
+	}
+	s.idempotencyKeys[id] = &memoryIdempotencyRecord{
+		IdempotencyRecord: storagemodels.IdempotencyRecord{RequestHash: requestHash},
+		createdAt:         now,
+	}
+	return storagemodels.IdempotencyRecord{RequestHash: requestHash}, true, nil
+}
+
+// CompleteIdempotencyKey сохранение ответа на запрос с ключом идемпотентности
+func (s *MemoryStorage) CompleteIdempotencyKey(_ context.Context, userID int, key string, response storagemodels.IdempotencyResponse) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if record, ok := s.idempotencyKeys[memoryIdempotencyKey{userID: userID, key: key}]; ok {
+		record.IdempotencyResponse = response
+		record.ResponseBody = append([]byte(nil), response.ResponseBody...)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey освобождение незавершенного ключа
+func (s *MemoryStorage) ReleaseIdempotencyKey(_ context.Context, userID int, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id := memoryIdempotencyKey{userID: userID, key: key}
+	if record, ok := s.idempotencyKeys[id]; ok && record.StatusCode == 0 {
+		delete(s.idempotencyKeys, id)
+	}
+	return nil
+}
+
+// DeleteExpiredIdempotencyKeys удаление ключей идемпотентности старше retention
+func (s *MemoryStorage) DeleteExpiredIdempotencyKeys(_ context.Context, retention time.Duration) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var deleted int64
+	for id, record := range s.idempotencyKeys {
+		if time.Since(record.createdAt) > retention {
+			delete(s.idempotencyKeys, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,472 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMemoryStorageUsers тестирует создание и аутентификацию пользователей
+func TestMemoryStorageUsers(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+
+	assert.False(t, s.IsUserCreated(ctx, "testUser"))
+	assert.NoError(t, s.CreateUser(ctx, "testUser", "hash"))
+	assert.True(t, s.IsUserCreated(ctx, "testUser"))
+	assert.Error(t, s.CreateUser(ctx, "testUser", "hash"))
+
+	passwordHash, err := s.GetPasswordHashByUser(ctx, "testUser")
+	assert.NoError(t, err)
+	assert.Equal(t, "hash", passwordHash)
+	assert.NoError(t, s.UpdatePasswordHash(ctx, "testUser", "newHash"))
+	passwordHash, err = s.GetPasswordHashByUser(ctx, "testUser")
+	assert.NoError(t, err)
+	assert.Equal(t, "newHash", passwordHash)
+	_, err = s.GetPasswordHashByUser(ctx, "unknown")
+	assert.Error(t, err)
+
+	userID, err := s.GetUserIDByName(ctx, "testUser")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, userID)
+
+	_, err = s.GetUserIDByName(ctx, "unknown")
+	assert.Error(t, err)
+}
+
+// TestMemoryStorageAccrualAndWithdraw тестирует начисление за заказ и списание
+func TestMemoryStorageAccrualAndWithdraw(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUser(ctx, "testUser", "hash"))
+	assert.NoError(t, s.CreateUser(ctx, "anotherUser", "hash"))
+
+	result, err := s.CreateOrder(ctx, 1, 12345)
+	assert.NoError(t, err)
+	assert.Equal(t, storagemodels.OrderCreated, result)
+	result, err = s.CreateOrder(ctx, 1, 12345)
+	assert.NoError(t, err)
+	assert.Equal(t, storagemodels.OrderUploadedByUser, result)
+	_, err = s.CreateOrder(ctx, 2, 12345)
+	assert.ErrorIs(t, err, ErrDuplicateOrder)
+
+	// Заказ сразу доступен для опроса и захватывается только один раз
+	leased, err := s.LeaseOrdersForCheck(ctx, 10, time.Minute)
+	assert.NoError(t, err)
+	assert.Len(t, leased, 1)
+	leased, err = s.LeaseOrdersForCheck(ctx, 10, time.Minute)
+	assert.NoError(t, err)
+	assert.Len(t, leased, 0)
+
+	credited, err := s.UpdateAccrualData(ctx, 12345, decimal.RequireFromString("500.50"), constants.Processed, "PROCESSED")
+	assert.NoError(t, err)
+	assert.True(t, credited)
+
+	// Повторный ответ accrual не начисляет баллы второй раз
+	credited, err = s.UpdateAccrualData(ctx, 12345, decimal.RequireFromString("500.50"), constants.Processed, "PROCESSED")
+	assert.NoError(t, err)
+	assert.False(t, credited)
+
+	orders, _, err := s.ListOrdersByUserID(ctx, 1, storagemodels.ListQuery{Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, orders, 1)
+	assert.Equal(t, "500.5", orders[0].Accrual.String())
+
+	newBalance, err := s.DeductBalance(ctx, 1, 2377225624, decimal.RequireFromString("100.25"))
+	assert.NoError(t, err)
+	assert.Equal(t, "400.25", newBalance.String())
+
+	_, err = s.DeductBalance(ctx, 1, 2377225624, decimal.RequireFromString("1000"))
+	assert.Error(t, err)
+
+	// Повторное списание с тем же номером заказа не проходит
+	_, err = s.DeductBalance(ctx, 1, 2377225624, decimal.RequireFromString("100.25"))
+	assert.ErrorIs(t, err, ErrWithdrawalExists)
+
+	balance, err := s.GetBalanceByUserID(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "400.25", balance.Current.String())
+	assert.Equal(t, "100.25", balance.Withdrawn.String())
+
+	transactions, _, err := s.ListTransactionsByUserID(ctx, 1, storagemodels.ListQuery{Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, transactions, 1)
+	assert.Equal(t, "2377225624", transactions[0].OrderNumber)
+
+	discrepancies, err := s.ReconcileBalances(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, discrepancies)
+}
+
+// TestMemoryStorageConcurrentDeduct тестирует, что параллельные списания не уводят баланс в минус
+func TestMemoryStorageConcurrentDeduct(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUser(ctx, "testUser", "hash"))
+	assert.NoError(t, s.AppendLedgerEntry(ctx, 1, 0, constants.LedgerAdjustment, decimal.NewFromInt(10)))
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var succeeded int
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(orderID int) {
+			defer wg.Done()
+			if _, err := s.DeductBalance(ctx, 1, orderID, decimal.NewFromInt(1)); err == nil {
+				mutex.Lock()
+				succeeded++
+				mutex.Unlock()
+			}
+		}(1000 + i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 10, succeeded)
+	balance, err := s.GetBalanceByUserID(ctx, 1)
+	assert.NoError(t, err)
+	assert.True(t, balance.Current.IsZero())
+	assert.Equal(t, "10", balance.Withdrawn.String())
+}
+
+// TestMemoryStorageSessions тестирует замену refresh токена и отзыв сессий
+func TestMemoryStorageSessions(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUser(ctx, "testUser", "hash"))
+	expiresAt := time.Now().Add(time.Hour)
+
+	assert.Error(t, s.CreateSession(ctx, storagemodels.Session{ID: "sid", UserName: "unknown", RefreshTokenHash: "first", ExpiresAt: expiresAt}))
+	assert.NoError(t, s.CreateSession(ctx, storagemodels.Session{ID: "sid", UserName: "testUser", RefreshTokenHash: "first", ExpiresAt: expiresAt}))
+	assert.NoError(t, s.CreateSession(ctx, storagemodels.Session{ID: "other", UserName: "testUser", RefreshTokenHash: "other", ExpiresAt: expiresAt}))
+
+	session, err := s.RotateSession(ctx, "first", "second", expiresAt)
+	assert.NoError(t, err)
+	assert.Equal(t, "sid", session.ID)
+	assert.Equal(t, "testUser", session.UserName)
+
+	_, err = s.RotateSession(ctx, "unknown", "third", expiresAt)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+
+	// Замененный токен предъявлен повторно: сессия отзывается, текущий токен тоже перестает работать
+	session, err = s.RotateSession(ctx, "first", "third", expiresAt)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+	assert.Equal(t, "sid", session.ID)
+	active, err := s.IsSessionActive(ctx, "sid")
+	assert.NoError(t, err)
+	assert.False(t, active)
+	_, err = s.RotateSession(ctx, "second", "third", expiresAt)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+
+	active, err = s.IsSessionActive(ctx, "other")
+	assert.NoError(t, err)
+	assert.True(t, active)
+	assert.NoError(t, s.RevokeUserSessions(ctx, "testUser"))
+	active, err = s.IsSessionActive(ctx, "other")
+	assert.NoError(t, err)
+	assert.False(t, active)
+}
+
+// TestMemoryStorageLoginAttempts тестирует учет неудачных попыток входа
+func TestMemoryStorageLoginAttempts(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+	policy := storagemodels.LoginPolicy{FreeAttempts: 3, BaseLockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour}
+
+	for i := 1; i <= 3; i++ {
+		attempt, err := s.RecordLoginFailure(ctx, "login:testUser", policy)
+		assert.NoError(t, err)
+		assert.Equal(t, storagemodels.LoginAttempt{Failures: i}, attempt)
+	}
+
+	// Давняя неудача не учитывается
+	time.Sleep(10 * time.Millisecond)
+	attempt, err := s.RecordLoginFailure(ctx, "login:testUser", storagemodels.LoginPolicy{FreeAttempts: 3, ResetAfter: time.Millisecond})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, attempt.Failures)
+
+	// Попытка сверх правил блокирует ключ, следующая отклоняется без учета
+	for i := 2; i <= 4; i++ {
+		attempt, err = s.RecordLoginFailure(ctx, "login:testUser", policy)
+		assert.NoError(t, err)
+	}
+	assert.False(t, attempt.Rejected)
+	assert.Equal(t, 4, attempt.Failures)
+	assert.Equal(t, time.Minute, attempt.Lockout)
+	attempt, err = s.RecordLoginFailure(ctx, "login:testUser", policy)
+	assert.NoError(t, err)
+	assert.True(t, attempt.Rejected)
+	assert.Equal(t, 4, attempt.Failures)
+	assert.InDelta(t, time.Minute, attempt.Lockout, float64(time.Second))
+
+	// Снятие попытки с блокировкой возвращает счетчик и разрешает вход
+	assert.NoError(t, s.ReleaseLoginFailure(ctx, "login:testUser", true))
+	attempt, err = s.RecordLoginFailure(ctx, "login:testUser", policy)
+	assert.NoError(t, err)
+	assert.False(t, attempt.Rejected)
+	assert.Equal(t, 4, attempt.Failures)
+
+	assert.NoError(t, s.ResetLoginFailures(ctx, "login:testUser"))
+	attempt, err = s.RecordLoginFailure(ctx, "login:testUser", policy)
+	assert.NoError(t, err)
+	assert.Equal(t, storagemodels.LoginAttempt{Failures: 1}, attempt)
+
+	// Давние счетчики удаляются, заблокированные остаются до конца блокировки
+	_, err = s.RecordLoginFailure(ctx, "ip:10.0.0.1", storagemodels.LoginPolicy{BaseLockout: time.Minute, MaxLockout: time.Minute, ResetAfter: time.Hour})
+	assert.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	deleted, err := s.DeleteExpiredLoginAttempts(ctx, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), deleted)
+	deleted, err = s.DeleteExpiredLoginAttempts(ctx, time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	attempt, err = s.RecordLoginFailure(ctx, "ip:10.0.0.1", policy)
+	assert.NoError(t, err)
+	assert.True(t, attempt.Rejected)
+}
+
+// TestMemoryStorageDeleteUser тестирует обезличивание пользователя с сохранением заказов и операций
+func TestMemoryStorageDeleteUser(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUser(ctx, "testUser", "hash"))
+	_, err := s.CreateOrder(ctx, 1, 12345)
+	assert.NoError(t, err)
+	assert.NoError(t, s.CreateSession(ctx, storagemodels.Session{ID: "sid", UserName: "testUser", RefreshTokenHash: "hash", ExpiresAt: time.Now().Add(time.Hour)}))
+
+	assert.NoError(t, s.DeleteUser(ctx, "testUser"))
+	assert.Error(t, s.DeleteUser(ctx, "testUser"))
+	assert.False(t, s.IsUserCreated(ctx, "testUser"))
+	_, err = s.GetPasswordHashByUser(ctx, "deleted:1")
+	assert.Error(t, err)
+	active, err := s.IsSessionActive(ctx, "sid")
+	assert.NoError(t, err)
+	assert.False(t, active)
+
+	orders, _, err := s.ListOrdersByUserID(ctx, 1, storagemodels.ListQuery{Limit: 10})
+	assert.NoError(t, err)
+	assert.Len(t, orders, 1)
+
+	// Имя свободно для новой регистрации
+	assert.NoError(t, s.CreateUser(ctx, "testUser", "hash"))
+	userID, err := s.GetUserIDByName(ctx, "testUser")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, userID)
+}
+
+// TestMemoryStorageDeleteUserKeepsLookalikeLogin тестирует, что удаление не затрагивает пользователя
+// с логином, похожим на обезличенное имя
+func TestMemoryStorageDeleteUserKeepsLookalikeLogin(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUser(ctx, "testUser", "hash"))
+	assert.NoError(t, s.CreateUser(ctx, "deleted:1", "lookalike_hash"))
+
+	assert.NoError(t, s.DeleteUser(ctx, "testUser"))
+
+	userID, err := s.GetUserIDByName(ctx, "deleted:1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, userID)
+	passwordHash, err := s.GetPasswordHashByUser(ctx, "deleted:1")
+	assert.NoError(t, err)
+	assert.Equal(t, "lookalike_hash", passwordHash)
+}
+
+// TestMemoryStorageListPages тестирует страницы списка заказов с курсором и фильтрами
+func TestMemoryStorageListPages(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUser(ctx, "testUser", "hash"))
+
+	base := time.Date(2024, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i := 1; i <= 5; i++ {
+		_, err := s.CreateOrder(ctx, 1, i)
+		assert.NoError(t, err)
+		s.orders[i].createdAt = base.Add(time.Duration(i) * time.Hour)
+	}
+	// Заказы с одинаковым временем различаются номером
+	s.orders[4].createdAt = s.orders[5].createdAt
+	s.orders[2].status = constants.Processed
+
+	var numbers []string
+	query := storagemodels.ListQuery{Limit: 2}
+	for {
+		orders, next, err := s.ListOrdersByUserID(ctx, 1, query)
+		assert.NoError(t, err)
+		for _, order := range orders {
+			numbers = append(numbers, order.Number)
+		}
+		if next == nil {
+			break
+		}
+		query.After = next
+	}
+	assert.Equal(t, []string{"5", "4", "3", "2", "1"}, numbers)
+
+	orders, next, err := s.ListOrdersByUserID(ctx, 1, storagemodels.ListQuery{
+		Limit:     10,
+		From:      base.Add(2 * time.Hour),
+		To:        base.Add(5 * time.Hour),
+		Ascending: true,
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, next)
+	assert.Len(t, orders, 2)
+	assert.Equal(t, "2", orders[0].Number)
+	assert.Equal(t, "3", orders[1].Number)
+
+	orders, _, err = s.ListOrdersByUserID(ctx, 1, storagemodels.ListQuery{Limit: 10, Statuses: []constants.OrderStatus{constants.Processed}})
+	assert.NoError(t, err)
+	assert.Len(t, orders, 1)
+	assert.Equal(t, "2", orders[0].Number)
+}
+
+// TestMemoryStorageOrderHistory тестирует историю статусов заказа
+func TestMemoryStorageOrderHistory(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUser(ctx, "testUser", "hash"))
+	assert.NoError(t, s.CreateUser(ctx, "anotherUser", "hash"))
+
+	_, err := s.CreateOrder(ctx, 1, 12345)
+	assert.NoError(t, err)
+
+	order, err := s.GetOrderByNumber(ctx, 1, 12345)
+	assert.NoError(t, err)
+	assert.Equal(t, constants.New, order.Status)
+	assert.Empty(t, order.LastCheckedAt)
+	assert.Len(t, order.History, 1)
+
+	// Повтор того же статуса не попадает в историю, но отмечает проверку.
+	// REGISTERED -> PROCESSING не меняет статус заказа, но записывается в историю
+	_, err = s.UpdateAccrualData(ctx, 12345, decimal.Zero, constants.Processing, "REGISTERED")
+	assert.NoError(t, err)
+	_, err = s.UpdateAccrualData(ctx, 12345, decimal.Zero, constants.Processing, "REGISTERED")
+	assert.NoError(t, err)
+	_, err = s.UpdateAccrualData(ctx, 12345, decimal.Zero, constants.Processing, "PROCESSING")
+	assert.NoError(t, err)
+	_, err = s.UpdateAccrualData(ctx, 12345, decimal.RequireFromString("10"), constants.Processed, "PROCESSED")
+	assert.NoError(t, err)
+
+	order, err = s.GetOrderByNumber(ctx, 1, 12345)
+	assert.NoError(t, err)
+	assert.Equal(t, "10", order.Accrual.String())
+	assert.NotEmpty(t, order.LastCheckedAt)
+	assert.Equal(t, 4, order.PollCount)
+	statuses := make([]constants.OrderStatus, 0, len(order.History))
+	accrualStatuses := make([]string, 0, len(order.History))
+	for _, change := range order.History {
+		statuses = append(statuses, change.Status)
+		accrualStatuses = append(accrualStatuses, change.AccrualStatus)
+	}
+	assert.Equal(t, []constants.OrderStatus{constants.New, constants.Processing, constants.Processing, constants.Processed}, statuses)
+	assert.Equal(t, []string{"", "REGISTERED", "PROCESSING", "PROCESSED"}, accrualStatuses)
+	assert.Equal(t, constants.HistoryUpload, order.History[0].Source)
+	assert.Equal(t, 0, order.History[0].PollCount)
+	assert.Equal(t, 3, order.History[2].PollCount)
+	assert.Equal(t, constants.HistoryAccrual, order.History[3].Source)
+	assert.Equal(t, 4, order.History[3].PollCount)
+
+	// Из финального статуса заказ не выходит
+	_, err = s.UpdateAccrualData(ctx, 12345, decimal.Zero, constants.Processing, "PROCESSING")
+	assert.ErrorIs(t, err, ErrInvalidTransition)
+
+	// Чужой заказ не отличается от несуществующего
+	_, err = s.GetOrderByNumber(ctx, 2, 12345)
+	assert.ErrorIs(t, err, ErrNotFound)
+	_, err = s.GetOrderByNumber(ctx, 1, 54321)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+// TestMemoryStorageIdempotencyKeys тестирует захват брошенного ключа идемпотентности и удаление устаревших ключей
+func TestMemoryStorageIdempotencyKeys(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+
+	_, reserved, err := s.ReserveIdempotencyKey(ctx, 1, "key", "hash", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	// Ключ еще выполняется
+	record, reserved, err := s.ReserveIdempotencyKey(ctx, 1, "key", "hash", time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, 0, record.StatusCode)
+
+	// Ответ не сохранен дольше reservationTTL, ключ захватывается заново
+	_, reserved, err = s.ReserveIdempotencyKey(ctx, 1, "key", "hash", 0)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+
+	// Завершенный ключ не захватывается независимо от возраста
+	assert.NoError(t, s.CompleteIdempotencyKey(ctx, 1, "key", storagemodels.IdempotencyResponse{
+		StatusCode:   402,
+		ContentType:  "application/problem+json",
+		ResponseBody: []byte("body"),
+	}))
+	record, reserved, err = s.ReserveIdempotencyKey(ctx, 1, "key", "hash", 0)
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, 402, record.StatusCode)
+	assert.Equal(t, "application/problem+json", record.ContentType)
+
+	deleted, err := s.DeleteExpiredIdempotencyKeys(ctx, time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), deleted)
+	deleted, err = s.DeleteExpiredIdempotencyKeys(ctx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	_, reserved, err = s.ReserveIdempotencyKey(ctx, 1, "key", "hash", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+}
+
+// TestMemoryStorageDeductChecksLedger тестирует, что средства проверяются по журналу операций, а не по кэшу баланса
+func TestMemoryStorageDeductChecksLedger(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUser(ctx, "testUser", "hash"))
+	assert.NoError(t, s.AppendLedgerEntry(ctx, 1, 0, constants.LedgerAdjustment, decimal.NewFromInt(10)))
+
+	// Кэш баланса разошелся с журналом
+	s.balances[1].Current = decimal.NewFromInt(1000)
+
+	_, err := s.DeductBalance(ctx, 1, 2377225624, decimal.NewFromInt(100))
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.ErrorIs(t, s.AppendLedgerEntry(ctx, 1, 0, constants.LedgerAdjustment, decimal.NewFromInt(-100)), ErrInsufficientFunds)
+
+	newBalance, err := s.DeductBalance(ctx, 1, 2377225624, decimal.NewFromInt(4))
+	assert.NoError(t, err)
+	assert.Equal(t, "6", newBalance.String())
+}
+
+// TestMemoryStorageReversal тестирует, что возврат покрывается списанием по тому же заказу
+func TestMemoryStorageReversal(t *testing.T) {
+	s := NewMemoryStorage()
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUser(ctx, "testUser", "hash"))
+	assert.NoError(t, s.AppendLedgerEntry(ctx, 1, 0, constants.LedgerAdjustment, decimal.NewFromInt(100)))
+	_, err := s.DeductBalance(ctx, 1, 2377225624, decimal.NewFromInt(40))
+	assert.NoError(t, err)
+
+	// Заказ без списания и сумма больше списанной
+	assert.ErrorIs(t, s.AppendLedgerEntry(ctx, 1, 12345, constants.LedgerReversal, decimal.NewFromInt(10)), ErrReversalNotCovered)
+	assert.ErrorIs(t, s.AppendLedgerEntry(ctx, 1, 2377225624, constants.LedgerReversal, decimal.NewFromInt(41)), ErrReversalNotCovered)
+
+	assert.NoError(t, s.AppendLedgerEntry(ctx, 1, 2377225624, constants.LedgerReversal, decimal.NewFromInt(30)))
+	// Повтор команды не возвращает баллы сверх списанного
+	assert.ErrorIs(t, s.AppendLedgerEntry(ctx, 1, 2377225624, constants.LedgerReversal, decimal.NewFromInt(30)), ErrReversalNotCovered)
+	assert.NoError(t, s.AppendLedgerEntry(ctx, 1, 2377225624, constants.LedgerReversal, decimal.NewFromInt(10)))
+
+	balance, err := s.GetBalanceByUserID(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "100", balance.Current.String())
+	assert.Equal(t, "0", balance.Withdrawn.String())
+}
@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+)
+
+// migrationsFS SQL файлы миграций, вшитые в бинарник
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// migrationsLockID ключ advisory lock, под которым реплики применяют миграции по очереди
+const migrationsLockID int64 = 7_204_331_905
+
+// migrationFileName формат имени файла миграции: 0001_name.up.sql или 0001_name.down.sql
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// migration версия схемы с SQL для применения и отката
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// loadMigrations чтение миграций из migrationsFS, отсортированных по версии
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file name: %s", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+		content, err := fs.ReadFile(migrationsFS, "migrations/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		} else if m.name != match[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s and %s", version, m.name, match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	result := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", m.version, m.name)
+		}
+		result = append(result, *m)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].version < result[j].version
+	})
+	return result, nil
+}
+
+// withMigrationLock выполнение fn на отдельном соединении под advisory lock,
+// чтобы несколько реплик не применяли миграции одновременно
+func withMigrationLock(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationsLockID); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	defer func() {
+		// Контекст мог истечь, снимаем блокировку в любом случае
+		_, _ = conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationsLockID)
+	}()
+
+	_, err = conn.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	return fn(conn)
+}
+
+// queryer соединение или пул, из которого читается schema_migrations
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// appliedMigrations версии примененных миграций и время их применения
+func appliedMigrations(ctx context.Context, conn queryer) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		result[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// applyMigration выполнение SQL миграции и запись о ней в schema_migrations в одной транзакции
+func applyMigration(ctx context.Context, conn *sql.Conn, query, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// MigrateUp применение всех непримененных миграций, возвращает их количество
+func MigrateUp(ctx context.Context, db *sql.DB) (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("failed to read schema_migrations: %w", err)
+		}
+
+		for _, m := range migrations {
+			if _, ok := applied[m.version]; ok {
+				continue
+			}
+			err := applyMigration(ctx, conn, m.up,
+				`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.version, m.name)
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s: %w", m.version, m.name, err)
+			}
+			logger.Log.Info(fmt.Sprintf("Migration %d_%s applied", m.version, m.name))
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// MigrateDown откат последней примененной миграции, возвращает ее версию или 0, если откатывать нечего
+func MigrateDown(ctx context.Context, db *sql.DB) (int, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("failed to read schema_migrations: %w", err)
+		}
+
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.version]; !ok {
+				continue
+			}
+			err := applyMigration(ctx, conn, m.down,
+				`DELETE FROM schema_migrations WHERE version = $1`, m.version)
+			if err != nil {
+				return fmt.Errorf("failed to revert migration %d_%s: %w", m.version, m.name, err)
+			}
+			logger.Log.Info(fmt.Sprintf("Migration %d_%s reverted", m.version, m.name))
+			version = m.version
+			return nil
+		}
+		return nil
+	})
+	return version, err
+}
+
+// MigrationsStatus состояние всех известных миграций
+func MigrationsStatus(ctx context.Context, db *sql.DB) ([]storagemodels.MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []storagemodels.MigrationStatus
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("failed to read schema_migrations: %w", err)
+		}
+
+		for _, m := range migrations {
+			status := storagemodels.MigrationStatus{Version: m.version, Name: m.name}
+			if appliedAt, ok := applied[m.version]; ok {
+				status.Applied = true
+				status.AppliedAt = appliedAt
+			}
+			result = append(result, status)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// PendingMigrations количество вшитых миграций, еще не примененных к БД. Читает schema_migrations
+// без блокировки миграций, поэтому подходит для частых проверок готовности
+func (s SQLStorage) PendingMigrations(ctx context.Context) (int, error) {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, err
+	}
+	applied, err := appliedMigrations(ctx, s.db)
+	if err != nil {
+		return 0, wrapError("failed to read schema_migrations", err)
+	}
+
+	var pending int
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; !ok {
+			pending++
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLoadMigrations проверяет, что вшитые миграции упорядочены и у каждой есть up и down
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.version, "migration versions must be sequential")
+		assert.NotEmpty(t, m.name)
+		assert.NotEmpty(t, m.up)
+		assert.NotEmpty(t, m.down)
+	}
+}
+
+// TestMigrateUp тестирует функцию MigrateUp
+func TestMigrateUp(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	migrations, err := loadMigrations()
+	assert.NoError(t, err)
+	last := migrations[len(migrations)-1]
+
+	// Тест 1: применяется только последняя миграция
+	applied := sqlmock.NewRows([]string{"version", "applied_at"})
+	for _, m := range migrations[:len(migrations)-1] {
+		applied.AddRow(m.version, time.Now())
+	}
+
+	mock.ExpectExec(`SELECT pg_advisory_lock\(\$1\)`).
+		WithArgs(migrationsLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version, applied_at FROM schema_migrations`).
+		WillReturnRows(applied)
+	mock.ExpectBegin()
+	mock.ExpectExec(`.+`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations \(version, name\) VALUES \(\$1, \$2\)`).
+		WithArgs(last.version, last.name).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).
+		WithArgs(migrationsLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	count, err := MigrateUp(context.Background(), db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+
+	// Тест 2: ошибка миграции откатывает транзакцию и снимает блокировку
+	mock.ExpectExec(`SELECT pg_advisory_lock\(\$1\)`).
+		WithArgs(migrationsLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version, applied_at FROM schema_migrations`).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`.+`).
+		WillReturnError(fmt.Errorf("syntax error"))
+	mock.ExpectRollback()
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).
+		WithArgs(migrationsLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	count, err = MigrateUp(context.Background(), db)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to apply migration 1_")
+	assert.Equal(t, 0, count)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+// TestMigrateDown тестирует функцию MigrateDown
+func TestMigrateDown(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// Тест 1: откатывается последняя примененная миграция
+	mock.ExpectExec(`SELECT pg_advisory_lock\(\$1\)`).
+		WithArgs(migrationsLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version, applied_at FROM schema_migrations`).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).
+			AddRow(1, time.Now()).
+			AddRow(2, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec(`DROP INDEX IF EXISTS orders_next_check_at_idx`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM schema_migrations WHERE version = \$1`).
+		WithArgs(2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).
+		WithArgs(migrationsLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	version, err := MigrateDown(context.Background(), db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+
+	// Тест 2: нечего откатывать
+	mock.ExpectExec(`SELECT pg_advisory_lock\(\$1\)`).
+		WithArgs(migrationsLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version, applied_at FROM schema_migrations`).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}))
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).
+		WithArgs(migrationsLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	version, err = MigrateDown(context.Background(), db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+// TestPendingMigrations тестирует функцию PendingMigrations
+func TestPendingMigrations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	migrations, err := loadMigrations()
+	assert.NoError(t, err)
+	store := SQLStorage{db: db}
+
+	// Тест 1: не применена последняя миграция
+	applied := sqlmock.NewRows([]string{"version", "applied_at"})
+	for _, m := range migrations[:len(migrations)-1] {
+		applied.AddRow(m.version, time.Now())
+	}
+	mock.ExpectQuery(`SELECT version, applied_at FROM schema_migrations`).
+		WillReturnRows(applied)
+
+	pending, err := store.PendingMigrations(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pending)
+
+	// Тест 2: schema_migrations недоступна
+	mock.ExpectQuery(`SELECT version, applied_at FROM schema_migrations`).
+		WillReturnError(fmt.Errorf("relation does not exist"))
+
+	_, err = store.PendingMigrations(context.Background())
+	assert.Error(t, err)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestPing тестирует проверку доступности хранилища
+func TestPing(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+
+	mock.ExpectPing()
+	assert.NoError(t, Ping(context.Background()))
+
+	mock.ExpectPing().WillReturnError(driver.ErrBadConn)
+	assert.ErrorIs(t, Ping(context.Background()), ErrTransient)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	// Хранилище в памяти всегда доступно и не имеет миграций
+	SetDBInstance(NewMemoryStorage())
+	assert.NoError(t, Ping(context.Background()))
+	pending, err := PendingMigrations(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, pending)
+}
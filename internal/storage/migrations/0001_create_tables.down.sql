@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS transaction_history;
+DROP TABLE IF EXISTS balances;
+DROP TABLE IF EXISTS orders;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,4 @@
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS next_check_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS orders_next_check_at_idx ON orders (next_check_at)
+    WHERE status NOT IN ('PROCESSED', 'INVALID');
@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS ledger (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    order_number BIGINT NOT NULL,
+    entry_type VARCHAR NOT NULL,
+    amount NUMERIC(20, 2) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS ledger_accrual_order_idx ON ledger (order_number)
+    WHERE entry_type = 'ACCRUAL';
+
+CREATE INDEX IF NOT EXISTS ledger_user_id_idx ON ledger (user_id);
+
+-- Перенос в журнал операций начислений и списаний, сделанных до его появления
+INSERT INTO ledger (user_id, order_number, entry_type, amount, created_at)
+SELECT user_id, order_id, 'ACCRUAL', accrual, created_at FROM orders
+    WHERE status = 'PROCESSED' AND accrual > 0
+ON CONFLICT (order_number) WHERE entry_type = 'ACCRUAL' DO NOTHING;
+
+INSERT INTO ledger (user_id, order_number, entry_type, amount, created_at)
+SELECT th.user_id, th.order_number, 'WITHDRAWAL', -th.transaction_sum, th.processed_at
+    FROM transaction_history th
+    WHERE NOT EXISTS (SELECT 1 FROM ledger l
+        WHERE l.entry_type = 'WITHDRAWAL' AND l.user_id = th.user_id AND l.order_number = th.order_number);
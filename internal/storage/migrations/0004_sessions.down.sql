@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS token TEXT NOT NULL DEFAULT '';
+
+DROP TABLE IF EXISTS sessions;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS sessions (
+    id VARCHAR PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    refresh_token_hash VARCHAR NOT NULL UNIQUE,
+    previous_token_hash VARCHAR,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+CREATE INDEX IF NOT EXISTS sessions_previous_token_hash_idx ON sessions (previous_token_hash);
+
+-- Токен в users никогда не проверялся, сессии его заменяют
+ALTER TABLE users DROP COLUMN IF EXISTS token;
@@ -0,0 +1,2 @@
+-- Удаленный пользователь обезличивается, но строка остается: на нее ссылаются заказы и история списаний
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
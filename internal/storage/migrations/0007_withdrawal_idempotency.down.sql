@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS idempotency_keys;
+
+DROP INDEX IF EXISTS transaction_history_user_order_idx;
@@ -0,0 +1,14 @@
+-- Номер заказа списания уникален для пользователя. Если индекс не создается, в истории уже есть
+-- повторные списания, их нужно разобрать вручную: каждое из них действительно уменьшило баланс
+CREATE UNIQUE INDEX IF NOT EXISTS transaction_history_user_order_idx ON transaction_history (user_id, order_number);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id INTEGER NOT NULL,
+    key VARCHAR NOT NULL,
+    request_hash VARCHAR NOT NULL,
+    status_code INTEGER,
+    response_body BYTEA,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, key),
+    FOREIGN KEY (user_id) REFERENCES users(id)
+);
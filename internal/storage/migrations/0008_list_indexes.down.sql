@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS transaction_history_user_processed_at_idx;
+
+DROP INDEX IF EXISTS orders_user_created_at_idx;
@@ -0,0 +1,5 @@
+-- Страницы списков выбираются по пользователю в порядке времени, номер заказа различает записи
+-- с одинаковым временем
+CREATE INDEX IF NOT EXISTS orders_user_created_at_idx ON orders (user_id, created_at, order_id);
+
+CREATE INDEX IF NOT EXISTS transaction_history_user_processed_at_idx ON transaction_history (user_id, processed_at, order_number);
@@ -0,0 +1,18 @@
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS poll_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id SERIAL PRIMARY KEY,
+    order_id BIGINT NOT NULL,
+    status VARCHAR NOT NULL,
+    source VARCHAR NOT NULL,
+    poll_count INTEGER NOT NULL DEFAULT 0,
+    changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (order_id) REFERENCES orders(order_id)
+);
+
+CREATE INDEX IF NOT EXISTS order_status_history_order_idx ON order_status_history (order_id, changed_at);
+
+-- Для загруженных ранее заказов известен только текущий статус, он записывается на время загрузки
+-- с источником migration
+INSERT INTO order_status_history (order_id, status, source, changed_at)
+SELECT order_id, status, 'migration', created_at FROM orders;
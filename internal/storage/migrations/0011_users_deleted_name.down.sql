@@ -0,0 +1,3 @@
+UPDATE users SET user_name = 'deleted:' || id WHERE user_name IS NULL;
+
+ALTER TABLE users ALTER COLUMN user_name SET NOT NULL;
@@ -0,0 +1,4 @@
+-- Имя удаленного пользователя стирается в NULL: обезличенное имя вида deleted:<id> могло совпасть с настоящим логином
+ALTER TABLE users ALTER COLUMN user_name DROP NOT NULL;
+
+UPDATE users SET user_name = NULL WHERE deleted_at IS NOT NULL;
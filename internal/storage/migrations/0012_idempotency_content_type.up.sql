@@ -0,0 +1,4 @@
+-- Повтор ответа отдается с исходным Content-Type, например application/problem+json
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS content_type VARCHAR;
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);
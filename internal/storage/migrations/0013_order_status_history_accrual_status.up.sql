@@ -0,0 +1,4 @@
+-- Исходный статус accrual: REGISTERED и PROCESSING оба показываются пользователю как PROCESSING,
+-- поэтому в истории и в заказе хранится и сам ответ accrual
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS accrual_status VARCHAR;
+ALTER TABLE order_status_history ADD COLUMN IF NOT EXISTS accrual_status VARCHAR;
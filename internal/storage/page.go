@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+)
+
+// pageQuery SQL выборки страницы списка пользователя. Фильтры и курсор применяются к колонке времени
+// timeColumn и колонке номера заказа numberColumn, выбирается на одну запись больше страницы,
+// чтобы узнать, есть ли следующая
+func pageQuery(selectFrom, timeColumn, numberColumn string, userID int, query storagemodels.ListQuery) (string, []any) {
+	args := []any{userID}
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	conditions := []string{"user_id = $1"}
+	if len(query.Statuses) > 0 {
+		placeholders := make([]string, 0, len(query.Statuses))
+		for _, status := range query.Statuses {
+			placeholders = append(placeholders, arg(status))
+		}
+		conditions = append(conditions, fmt.Sprintf("status IN (%s)", strings.Join(placeholders, ", ")))
+	}
+	if !query.From.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("%s >= %s", timeColumn, arg(query.From)))
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("%s < %s", timeColumn, arg(query.To)))
+	}
+
+	direction, comparison := "DESC", "<"
+	if query.Ascending {
+		direction, comparison = "ASC", ">"
+	}
+	if query.After != nil {
+		conditions = append(conditions, fmt.Sprintf("(%s, %s) %s (%s, %s)",
+			timeColumn, numberColumn, comparison, arg(query.After.At), arg(query.After.Number)))
+	}
+
+	limit := arg(query.Limit + 1)
+	return fmt.Sprintf("%s WHERE %s ORDER BY %s %s, %s %s LIMIT %s",
+		selectFrom, strings.Join(conditions, " AND "),
+		timeColumn, direction, numberColumn, direction, limit), args
+}
+
+// cursorBefore порядок записей в списке: a раньше b
+func cursorBefore(a, b storagemodels.Cursor, ascending bool) bool {
+	if !a.At.Equal(b.At) {
+		return a.At.Before(b.At) == ascending
+	}
+	if a.Number == b.Number {
+		return false
+	}
+	return (a.Number < b.Number) == ascending
+}
+
+// inPage проверка записи с позицией cursor по периоду и курсору query
+func inPage(cursor storagemodels.Cursor, query storagemodels.ListQuery) bool {
+	if !query.From.IsZero() && cursor.At.Before(query.From) {
+		return false
+	}
+	if !query.To.IsZero() && !cursor.At.Before(query.To) {
+		return false
+	}
+	return query.After == nil || cursorBefore(*query.After, cursor, query.Ascending)
+}
+
+// pageSize число записей страницы по упорядоченным позициям выборки cursors и курсор следующей страницы,
+// nil - страница последняя
+func pageSize(cursors []storagemodels.Cursor, limit int) (int, *storagemodels.Cursor) {
+	if len(cursors) <= limit {
+		return len(cursors), nil
+	}
+	next := cursors[limit-1]
+	return limit, &next
+}
@@ -3,125 +3,191 @@ package storage
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"time"
 
+	"github.com/XSAM/otelsql"
 	"github.com/fngoc/gofermart/internal/constants"
 	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/metrics"
 	"github.com/fngoc/gofermart/internal/storage/storagemodels"
-	"github.com/fngoc/gofermart/internal/utils"
+	"github.com/fngoc/gofermart/internal/tracing"
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/shopspring/decimal"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 // Storage интерфейс для работы с хранилищем данных
 type Storage interface {
-	IsUserCreated(userName string) bool
-	IsUserAuthenticated(userName, passwordHash string) bool
-	CreateUser(userName, passwordHash, token string) error
-	SetNewTokenByUser(userName, token string) error
-	GetUserNameByOrderID(orderID int) string
-	CreateOrder(userID int, orderID int) error
-	GetAllOrdersByUserID(userID int) ([]storagemodels.Order, error)
-	GetBalanceByUserID(userID int) (storagemodels.Balance, error)
-	GetUserIDByName(userName string) (int, error)
-	GetAllTransactionByUserID(userID int) ([]storagemodels.Transaction, error)
-	DeductBalance(userID, orderID int, amountToDeduct float64) (float64, error)
-	UpdateAccrualData(orderID int, accrual float64, status string) error
+	IsUserCreated(ctx context.Context, userName string) bool
+	GetPasswordHashByUser(ctx context.Context, userName string) (string, error)
+	UpdatePasswordHash(ctx context.Context, userName, passwordHash string) error
+	ChangePassword(ctx context.Context, userName, passwordHash, keepSessionID string) error
+	DeleteUser(ctx context.Context, userName string) error
+	CreateUser(ctx context.Context, userName, passwordHash string) error
+	CreateOrder(ctx context.Context, userID int, orderID int) (storagemodels.OrderUploadResult, error)
+	ListOrdersByUserID(ctx context.Context, userID int, query storagemodels.ListQuery) ([]storagemodels.Order, *storagemodels.Cursor, error)
+	GetOrderByNumber(ctx context.Context, userID, orderID int) (storagemodels.OrderDetails, error)
+	GetBalanceByUserID(ctx context.Context, userID int) (storagemodels.Balance, error)
+	GetUserIDByName(ctx context.Context, userName string) (int, error)
+	ListTransactionsByUserID(ctx context.Context, userID int, query storagemodels.ListQuery) ([]storagemodels.Transaction, *storagemodels.Cursor, error)
+	DeductBalance(ctx context.Context, userID, orderID int, amountToDeduct decimal.Decimal) (decimal.Decimal, error)
+	UpdateAccrualData(ctx context.Context, orderID int, accrual decimal.Decimal, status constants.OrderStatus, accrualStatus string) (bool, error)
+	LeaseOrdersForCheck(ctx context.Context, limit int, lease time.Duration) ([]storagemodels.QueuedOrder, error)
+	PostponeOrderCheck(ctx context.Context, orderID int, delay time.Duration) error
+	AppendLedgerEntry(ctx context.Context, userID, orderNumber int, entryType string, amount decimal.Decimal) error
+	ReconcileBalances(ctx context.Context) ([]storagemodels.BalanceDiscrepancy, error)
+	CreateSession(ctx context.Context, session storagemodels.Session) error
+	RotateSession(ctx context.Context, refreshTokenHash, newRefreshTokenHash string, expiresAt time.Time) (storagemodels.Session, error)
+	IsSessionActive(ctx context.Context, sessionID string) (bool, error)
+	RevokeSession(ctx context.Context, sessionID string) error
+	RevokeUserSessions(ctx context.Context, userName string) error
+	RecordLoginFailure(ctx context.Context, key string, policy storagemodels.LoginPolicy) (storagemodels.LoginAttempt, error)
+	ReleaseLoginFailure(ctx context.Context, key string, unlock bool) error
+	ResetLoginFailures(ctx context.Context, key string) error
+	DeleteExpiredLoginAttempts(ctx context.Context, retention time.Duration) (int64, error)
+	ReserveIdempotencyKey(ctx context.Context, userID int, key, requestHash string, reservationTTL time.Duration) (storagemodels.IdempotencyRecord, bool, error)
+	CompleteIdempotencyKey(ctx context.Context, userID int, key string, response storagemodels.IdempotencyResponse) error
+	ReleaseIdempotencyKey(ctx context.Context, userID int, key string) error
+	DeleteExpiredIdempotencyKeys(ctx context.Context, retention time.Duration) (int64, error)
 }
 
 // SQLStorage реализация Storage на основе SQL базы данных
 type SQLStorage struct {
 	db *sql.DB
+	// queryTimeout таймаут одиночного запроса, 0 - только контекст вызывающего
+	queryTimeout time.Duration
+	// txTimeout таймаут операции из нескольких запросов в транзакции, 0 - только контекст вызывающего
+	txTimeout time.Duration
+}
+
+// Timeouts таймауты операций с БД
+type Timeouts struct {
+	Query       time.Duration
+	Transaction time.Duration
 }
 
 var Store Storage
 
-// InitializeDB инициализация базы данных
-func InitializeDB(dbConf string) error {
-	pqx, err := sql.Open("pgx", dbConf)
+// migrationsTimeout время на применение миграций при старте
+const migrationsTimeout = time.Minute
+
+// createOrderAttempts число попыток загрузки заказа, если владелец уже загруженного заказа еще не виден
+const createOrderAttempts = 3
+
+// OpenDB открытие пула соединений с PostgreSQL, каждый запрос к БД пишется в трассировку отдельным спаном
+func OpenDB(dbConf string) (*sql.DB, error) {
+	return otelsql.Open("pgx", dbConf,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{
+			OmitConnResetSession: true,
+			OmitRows:             true,
+			OmitConnectorConnect: true,
+		}))
+}
+
+// OpenMigratedDB подключение к БД без применения миграций для служебных подкоманд.
+// Если схема отстает от вшитых миграций, возвращается ошибка, чтобы подкоманда не работала со старой схемой
+func OpenMigratedDB(ctx context.Context, dbConf string, timeouts Timeouts) (SQLStorage, error) {
+	pqx, err := OpenDB(dbConf)
+	if err != nil {
+		return SQLStorage{}, err
+	}
+
+	store := SQLStorage{db: pqx, queryTimeout: timeouts.Query, txTimeout: timeouts.Transaction}
+	pending, err := store.PendingMigrations(ctx)
+	if err == nil && pending > 0 {
+		err = fmt.Errorf("database schema is outdated, pending migrations: %d, run gophermart migrate up", pending)
+	}
+	if err != nil {
+		_ = pqx.Close()
+		return SQLStorage{}, err
+	}
+	return store, nil
+}
+
+// InitializeDB инициализация базы данных и применение миграций
+func InitializeDB(dbConf string, timeouts Timeouts) error {
+	pqx, err := OpenDB(dbConf)
 	if err != nil {
 		return err
 	}
 
-	SetDBInstance(SQLStorage{db: pqx})
+	SetDBInstance(SQLStorage{db: pqx, queryTimeout: timeouts.Query, txTimeout: timeouts.Transaction})
+	if err := metrics.RegisterDB(pqx); err != nil {
+		return err
+	}
 
-	if err := createTables(pqx); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), migrationsTimeout)
+	defer cancel()
+
+	applied, err := MigrateUp(ctx, pqx)
+	if err != nil {
 		return err
 	}
+	logger.Log.Info(fmt.Sprintf("Database migrations is done, applied: %d", applied))
 	return nil
 }
 
-// createTables создание таблиц
-func createTables(db *sql.DB) error {
-	createUserTableQuery := `
-	CREATE TABLE IF NOT EXISTS users (
-		id SERIAL PRIMARY KEY,
-		user_name VARCHAR NOT NULL UNIQUE,
-		password TEXT NOT NULL,
-		token TEXT NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	)`
-	createOrderTableQuery := `
-	CREATE TABLE IF NOT EXISTS orders (
-		id SERIAL PRIMARY KEY,
-		order_id BIGINT NOT NULL UNIQUE,
-		user_id INTEGER NOT NULL,
-		accrual NUMERIC(20, 2),
-		status VARCHAR NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (user_id) REFERENCES users(id)
-	)`
-	createBalancesTableQuery := `
-	CREATE TABLE IF NOT EXISTS balances (
-	   id SERIAL PRIMARY KEY,
-	   user_id INTEGER NOT NULL UNIQUE,
-	   current_balance NUMERIC(20, 2),
-	   withdrawn NUMERIC(20, 2),
-	   created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-	   FOREIGN KEY (user_id) REFERENCES users(id)
-	)`
-	createTransactionHistoryTableQuery := `
-	CREATE TABLE IF NOT EXISTS transaction_history (
-	   id SERIAL PRIMARY KEY,
-	   user_id INTEGER NOT NULL,
-	   order_number BIGINT NOT NULL,
-	   transaction_sum NUMERIC(20, 2),
-	   processed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-	   FOREIGN KEY (user_id) REFERENCES users(id)
-	)`
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	_, errUser := db.ExecContext(ctx, createUserTableQuery)
-	if errUser != nil {
-		return errUser
-	}
-	_, errData := db.ExecContext(ctx, createOrderTableQuery)
-	if errData != nil {
-		return errData
-	}
-	_, errBalance := db.ExecContext(ctx, createBalancesTableQuery)
-	if errBalance != nil {
-		return errBalance
-	}
-	_, errTransaction := db.ExecContext(ctx, createTransactionHistoryTableQuery)
-	if errTransaction != nil {
-		return errTransaction
-	}
-	logger.Log.Info("Database table created")
-	return nil
+// withTimeout ограничение контекста вызывающего таймаутом операции
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 func SetDBInstance(sqlStorage Storage) {
 	Store = sqlStorage
 }
 
+// Close освобождение ресурсов хранилища, например пула соединений с БД
+func Close() error {
+	if closer, ok := Store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Close закрытие пула соединений с БД
+func (s SQLStorage) Close() error {
+	return s.db.Close()
+}
+
+// Ping проверка доступности хранилища, хранилище без проверки доступности считается доступным
+func Ping(ctx context.Context) error {
+	if pinger, ok := Store.(interface{ Ping(context.Context) error }); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+// PendingMigrations количество непримененных миграций, у хранилища без миграций всегда 0
+func PendingMigrations(ctx context.Context) (int, error) {
+	if migrator, ok := Store.(interface {
+		PendingMigrations(context.Context) (int, error)
+	}); ok {
+		return migrator.PendingMigrations(ctx)
+	}
+	return 0, nil
+}
+
+// Ping проверка соединения с БД
+func (s SQLStorage) Ping(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	return wrapError("failed to ping database", s.db.PingContext(ctx))
+}
+
 // IsUserCreated проверка на существование пользователя
-func (s SQLStorage) IsUserCreated(userName string) bool {
+func (s SQLStorage) IsUserCreated(ctx context.Context, userName string) bool {
 	var isCreated bool
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
 	defer cancel()
 
 	row := s.db.QueryRowContext(ctx,
@@ -135,88 +201,140 @@ func (s SQLStorage) IsUserCreated(userName string) bool {
 	return isCreated
 }
 
-// IsUserAuthenticated проверка на авторизацию пользователя
-func (s SQLStorage) IsUserAuthenticated(userName, passwordHash string) bool {
-	var IsAuthenticated bool
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// GetPasswordHashByUser получение хэша пароля пользователя, сам пароль проверяется вне БД
+func (s SQLStorage) GetPasswordHashByUser(ctx context.Context, userName string) (string, error) {
+	var passwordHash string
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
 	defer cancel()
 
 	row := s.db.QueryRowContext(ctx,
-		`SELECT EXISTS (SELECT 1 FROM users 
-                WHERE user_name = $1 AND password = $2)`, userName, passwordHash)
-	err := row.Scan(&IsAuthenticated)
+		`SELECT password FROM users
+                WHERE user_name = $1 AND deleted_at IS NULL;`, userName)
+	err := row.Scan(&passwordHash)
 	if err != nil {
-		return false
+		return "", wrapError("failed to get password hash", err)
 	}
-	return IsAuthenticated
+	return passwordHash, nil
 }
 
-// CreateUser создание пользователя
-func (s SQLStorage) CreateUser(userName, passwordHash, token string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// UpdatePasswordHash замена хэша пароля пользователя, например при пересчете хэша после входа
+func (s SQLStorage) UpdatePasswordHash(ctx context.Context, userName, passwordHash string) error {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE users SET password = $1 
+             	WHERE user_name = $2;`, passwordHash, userName)
+	return wrapError("failed to update password hash", err)
+}
+
+// ChangePassword смена пароля пользователя с отзывом всех его сессий, кроме keepSessionID
+func (s SQLStorage) ChangePassword(ctx context.Context, userName, passwordHash, keepSessionID string) error {
+	ctx, cancel := withTimeout(ctx, s.txTimeout)
 	defer cancel()
 
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return wrapError("failed to begin transaction", err)
 	}
 
 	var userID int
 	err = tx.QueryRowContext(ctx,
-		`INSERT INTO users (user_name, password, token) VALUES ($1, $2, $3) 
-				RETURNING id`, userName, passwordHash, token).Scan(&userID)
+		`UPDATE users SET password = $2
+				WHERE user_name = $1 AND deleted_at IS NULL
+				RETURNING id`, userName, passwordHash).Scan(&userID)
 	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("failed to insert user and get user_id: %w", err)
+		_ = tx.Rollback()
+		return wrapError("failed to update password", err)
 	}
 
 	_, err = tx.ExecContext(ctx,
-		`INSERT INTO balances (user_id, current_balance, withdrawn) VALUES ($1, $2, $3)`,
-		userID, 0, 0)
+		`UPDATE sessions SET revoked_at = NOW()
+				WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL`, userID, keepSessionID)
 	if err != nil {
 		_ = tx.Rollback()
-		return fmt.Errorf("failed to insert balance: %w", err)
+		return wrapError("failed to revoke sessions", err)
 	}
 
 	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return wrapError("failed to commit transaction", err)
 	}
 	return nil
 }
 
-// SetNewTokenByUser обновление токена авторизации
-func (s SQLStorage) SetNewTokenByUser(userName, token string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// DeleteUser удаление пользователя. Имя и пароль стираются, сессии отзываются, а заказы,
+// история списаний и журнал операций остаются для учета. Имя заменяется на NULL, а не на вычисляемое
+// значение, которое мог бы занять другой пользователь, и освобождается для новой регистрации
+func (s SQLStorage) DeleteUser(ctx context.Context, userName string) error {
+	ctx, cancel := withTimeout(ctx, s.txTimeout)
 	defer cancel()
 
-	_, err := s.db.ExecContext(ctx,
-		`UPDATE users SET token = $1 
-             	WHERE user_name = $2;`, token, userName)
-	return err
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError("failed to begin transaction", err)
+	}
+
+	var userID int
+	err = tx.QueryRowContext(ctx,
+		`UPDATE users SET user_name = NULL, password = '', deleted_at = NOW()
+				WHERE user_name = $1 AND deleted_at IS NULL
+				RETURNING id`, userName).Scan(&userID)
+	if err != nil {
+		_ = tx.Rollback()
+		return wrapError("failed to anonymise user", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE sessions SET revoked_at = NOW()
+				WHERE user_id = $1 AND revoked_at IS NULL`, userID)
+	if err != nil {
+		_ = tx.Rollback()
+		return wrapError("failed to revoke sessions", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return wrapError("failed to commit transaction", err)
+	}
+	return nil
 }
 
-// GetUserNameByOrderID получение имени пользователя по orderID
-func (s SQLStorage) GetUserNameByOrderID(orderID int) string {
-	var userName string
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// CreateUser создание пользователя
+func (s SQLStorage) CreateUser(ctx context.Context, userName, passwordHash string) error {
+	ctx, cancel := withTimeout(ctx, s.txTimeout)
 	defer cancel()
 
-	row := s.db.QueryRowContext(ctx,
-		`SELECT users.user_name FROM orders
-    			JOIN users 
-    			    ON orders.user_id = users.id
-                WHERE orders.order_id = $1;`, orderID)
-	err := row.Scan(&userName)
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError("failed to begin transaction", err)
+	}
+
+	var userID int
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO users (user_name, password) VALUES ($1, $2) 
+				RETURNING id`, userName, passwordHash).Scan(&userID)
 	if err != nil {
-		return ""
+		tx.Rollback()
+		return wrapError("failed to insert user and get user_id", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO balances (user_id, current_balance, withdrawn) VALUES ($1, $2, $3)`,
+		userID, 0, 0)
+	if err != nil {
+		_ = tx.Rollback()
+		return wrapError("failed to insert balance", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return wrapError("failed to commit transaction", err)
 	}
-	return userName
+	return nil
 }
 
 // GetUserIDByName получение имени пользователя по userName
-func (s SQLStorage) GetUserIDByName(userName string) (int, error) {
+func (s SQLStorage) GetUserIDByName(ctx context.Context, userName string) (int, error) {
 	var id int
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
 	defer cancel()
 
 	row := s.db.QueryRowContext(ctx,
@@ -224,237 +342,847 @@ func (s SQLStorage) GetUserIDByName(userName string) (int, error) {
           		WHERE user_name = $1;`, userName)
 	err := row.Scan(&id)
 	if err != nil {
-		return 0, err
+		return 0, wrapError("failed to get user id", err)
 	}
 	return id, nil
 }
 
-// CreateOrder создание заказа
-func (s SQLStorage) CreateOrder(userID int, orderID int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// CreateOrder создание заказа. Вставка и определение владельца уже загруженного заказа
+// выполняются одним запросом, поэтому параллельные загрузки одного номера не гоняются
+func (s SQLStorage) CreateOrder(ctx context.Context, userID int, orderID int) (storagemodels.OrderUploadResult, error) {
+	ctx, span := tracing.Start(ctx, "storage.CreateOrder", tracing.OrderNumber(orderID))
+	result, err := s.createOrder(ctx, userID, orderID)
+	tracing.End(span, err)
+	return result, err
+}
+
+// createOrder загрузка заказа внутри спана CreateOrder
+func (s SQLStorage) createOrder(ctx context.Context, userID int, orderID int) (storagemodels.OrderUploadResult, error) {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
 	defer cancel()
 
-	_, err := s.db.ExecContext(ctx,
-		`INSERT INTO orders (user_id, order_id, status) VALUES ($1, $2, $3)`,
-		userID, orderID, constants.New)
-	if err != nil {
-		return err
+	// Заказ, вставленный параллельной транзакцией, может не попасть в снимок запроса:
+	// вставка пропускается, а владелец не находится. Повторный запрос его уже видит
+	for attempt := 0; attempt < createOrderAttempts; attempt++ {
+		var ownerID int
+		var inserted bool
+		err := s.db.QueryRowContext(ctx,
+			`WITH inserted AS (
+				INSERT INTO orders (user_id, order_id, status) VALUES ($1, $2, $3)
+				ON CONFLICT (order_id) DO NOTHING
+				RETURNING user_id, order_id
+			), history AS (
+				INSERT INTO order_status_history (order_id, status, source) SELECT order_id, $3, $4 FROM inserted
+			)
+			SELECT user_id, TRUE FROM inserted
+			UNION ALL
+			SELECT user_id, FALSE FROM orders WHERE order_id = $2
+			LIMIT 1`,
+			userID, orderID, constants.New, constants.HistoryUpload).Scan(&ownerID, &inserted)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, wrapError("failed to insert order", err)
+		}
+		return orderUploadResult(userID, orderID, ownerID, inserted)
 	}
-	return nil
+	return 0, wrapError("failed to insert order", fmt.Errorf("owner of order %d is not visible: %w", orderID, ErrTransient))
+}
+
+// orderUploadResult результат загрузки заказа пользователем userID по владельцу заказа ownerID.
+// Заказ другого пользователя дает ErrDuplicateOrder
+func orderUploadResult(userID, orderID, ownerID int, inserted bool) (storagemodels.OrderUploadResult, error) {
+	switch {
+	case inserted:
+		return storagemodels.OrderCreated, nil
+	case ownerID == userID:
+		return storagemodels.OrderUploadedByUser, nil
+	default:
+		return 0, wrapError("failed to insert order", fmt.Errorf("order %d: %w", orderID, ErrDuplicateOrder))
+	}
+}
+
+// orderTransition проверка смены статуса заказа previous на next. Повтор финального статуса
+// ничего не меняет: skip = true, недопустимый переход дает ErrInvalidTransition
+func orderTransition(previous, next constants.OrderStatus) (skip bool, err error) {
+	if previous.IsTerminal() && previous == next {
+		return true, nil
+	}
+	if !previous.CanTransitionTo(next) {
+		return false, fmt.Errorf("order status %s -> %s: %w", previous, next, ErrInvalidTransition)
+	}
+	return false, nil
 }
 
-// GetAllOrdersByUserID получение всех заказов по userID
-func (s SQLStorage) GetAllOrdersByUserID(userID int) ([]storagemodels.Order, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// ListOrdersByUserID получение страницы заказов пользователя и курсора следующей страницы
+func (s SQLStorage) ListOrdersByUserID(ctx context.Context, userID int, query storagemodels.ListQuery) ([]storagemodels.Order, *storagemodels.Cursor, error) {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
 	defer cancel()
 
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT order_id, status, accrual, created_at FROM orders
-                WHERE user_id = $1 ORDER BY created_at DESC`, userID)
+	sqlQuery, args := pageQuery(`SELECT order_id, status, accrual, created_at FROM orders`,
+		"created_at", "order_id", userID, query)
+	rows, err := s.db.QueryContext(ctx, sqlQuery, args...)
 	if err != nil {
-		return nil, err
-	}
-	if rows.Err() != nil {
-		return nil, rows.Err()
+		return nil, nil, wrapError("failed to get orders", err)
 	}
+	defer rows.Close()
 
 	var result []storagemodels.Order
+	var cursors []storagemodels.Cursor
 	for rows.Next() {
-		var orderID string
-		var status string
-		var accrual sql.NullString
-		var createdAt string
+		var orderID int
+		var status constants.OrderStatus
+		var accrual decimal.NullDecimal
+		var createdAt time.Time
 
 		if err := rows.Scan(&orderID, &status, &accrual, &createdAt); err != nil {
-			return nil, err
+			return nil, nil, wrapError("failed to get orders", err)
 		}
 
 		var accrualDecimal *decimal.Decimal
-		var accrualFloat float64
-		if accrual.Valid {
-			value, err := decimal.NewFromString(accrual.String)
-			if err != nil {
-				return nil, err
-			}
-			if !value.IsZero() {
-				accrualDecimal = &value
-			}
-			f, _ := accrualDecimal.Float64()
-			accrualFloat = f
+		if accrual.Valid && !accrual.Decimal.IsZero() {
+			accrualDecimal = &accrual.Decimal
 		}
 
 		result = append(result, storagemodels.Order{
-			Number:     orderID,
+			Number:     strconv.Itoa(orderID),
 			Status:     status,
-			Accrual:    accrualFloat,
-			UploadedAt: utils.ConvertTime(createdAt),
+			Accrual:    accrualDecimal,
+			UploadedAt: formatTime(createdAt),
 		})
+		cursors = append(cursors, storagemodels.Cursor{At: createdAt, Number: orderID})
 	}
-	return result, nil
+	if err := rows.Err(); err != nil {
+		return nil, nil, wrapError("failed to get orders", err)
+	}
+
+	size, next := pageSize(cursors, query.Limit)
+	return result[:size], next, nil
 }
 
-// GetBalanceByUserID получение баланса пользователя
-func (s SQLStorage) GetBalanceByUserID(userID int) (storagemodels.Balance, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// GetOrderByNumber получение заказа пользователя с историей статусов. Заказ другого пользователя
+// не отличается от несуществующего: ошибка ErrNotFound
+func (s SQLStorage) GetOrderByNumber(ctx context.Context, userID, orderID int) (storagemodels.OrderDetails, error) {
+	ctx, span := tracing.Start(ctx, "storage.GetOrderByNumber", tracing.OrderNumber(orderID))
+	order, err := s.getOrderByNumber(ctx, userID, orderID)
+	tracing.End(span, err)
+	return order, err
+}
+
+// getOrderByNumber чтение заказа и истории внутри спана GetOrderByNumber
+func (s SQLStorage) getOrderByNumber(ctx context.Context, userID, orderID int) (storagemodels.OrderDetails, error) {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
 	defer cancel()
 
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT current_balance, withdrawn FROM balances
-                WHERE user_id = $1`, userID)
+	var status constants.OrderStatus
+	var accrual decimal.NullDecimal
+	var createdAt time.Time
+	var lastCheckedAt sql.NullTime
+	var pollCount int
+	err := s.db.QueryRowContext(ctx,
+		`SELECT status, accrual, created_at, last_checked_at, poll_count FROM orders
+				WHERE order_id = $1 AND user_id = $2`, orderID, userID).
+		Scan(&status, &accrual, &createdAt, &lastCheckedAt, &pollCount)
 	if err != nil {
-		return storagemodels.Balance{}, err
+		return storagemodels.OrderDetails{}, wrapError("failed to get order", err)
+	}
+
+	result := storagemodels.OrderDetails{
+		Order: storagemodels.Order{
+			Number:     strconv.Itoa(orderID),
+			Status:     status,
+			UploadedAt: formatTime(createdAt),
+		},
+		PollCount: pollCount,
+		History:   []storagemodels.OrderStatusChange{},
 	}
-	if rows.Err() != nil {
-		return storagemodels.Balance{}, rows.Err()
+	if accrual.Valid && !accrual.Decimal.IsZero() {
+		result.Accrual = &accrual.Decimal
+	}
+	if lastCheckedAt.Valid {
+		result.LastCheckedAt = formatTime(lastCheckedAt.Time)
 	}
 
-	var result storagemodels.Balance
-	for rows.Next() {
-		var currentBalance string
-		var withdrawn string
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT status, COALESCE(accrual_status, ''), source, poll_count, changed_at FROM order_status_history
+				WHERE order_id = $1 ORDER BY changed_at, id`, orderID)
+	if err != nil {
+		return storagemodels.OrderDetails{}, wrapError("failed to get order history", err)
+	}
+	defer rows.Close()
 
-		if err := rows.Scan(&currentBalance, &withdrawn); err != nil {
-			return storagemodels.Balance{}, err
+	for rows.Next() {
+		var change storagemodels.OrderStatusChange
+		var changedAt time.Time
+		if err := rows.Scan(&change.Status, &change.AccrualStatus, &change.Source, &change.PollCount, &changedAt); err != nil {
+			return storagemodels.OrderDetails{}, wrapError("failed to get order history", err)
 		}
+		change.ChangedAt = formatTime(changedAt)
+		result.History = append(result.History, change)
+	}
+	if err := rows.Err(); err != nil {
+		return storagemodels.OrderDetails{}, wrapError("failed to get order history", err)
+	}
+	return result, nil
+}
 
-		currentBalanceDecimal, errCurrentBalance := decimal.NewFromString(currentBalance)
-		if errCurrentBalance != nil {
-			return storagemodels.Balance{}, errCurrentBalance
-		}
-		currentFloat, _ := currentBalanceDecimal.Float64()
+// GetBalanceByUserID получение баланса пользователя, баланс считается по журналу операций
+func (s SQLStorage) GetBalanceByUserID(ctx context.Context, userID int) (storagemodels.Balance, error) {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
 
-		withdrawnDecimal, errWithdrawn := decimal.NewFromString(withdrawn)
-		if errWithdrawn != nil {
-			return storagemodels.Balance{}, errWithdrawn
-		}
-		withdrawnFloat, _ := withdrawnDecimal.Float64()
+	var result storagemodels.Balance
+	err := s.db.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(amount), 0),
+					COALESCE(-SUM(amount) FILTER (WHERE entry_type IN ($2, $3)), 0)
+				FROM ledger
+                WHERE user_id = $1`, userID, constants.LedgerWithdrawal, constants.LedgerReversal).
+		Scan(&result.Current, &result.Withdrawn)
+	if err != nil {
+		return storagemodels.Balance{}, wrapError("failed to get balance", err)
+	}
+	return result, nil
+}
 
-		result = storagemodels.Balance{
-			Current:   currentFloat,
-			Withdrawn: withdrawnFloat,
-		}
+// lockLedgerBalance блокировка строки balances пользователя и текущий баланс по журналу операций.
+// Все изменения баланса сначала блокируют эту строку, поэтому сумма журнала не меняется до конца транзакции.
+// Пользователь без строки balances считается пользователем с нулевым балансом
+func lockLedgerBalance(ctx context.Context, tx *sql.Tx, userID int) (decimal.Decimal, error) {
+	var lockedUserID int
+	err := tx.QueryRowContext(ctx,
+		`SELECT user_id FROM balances WHERE user_id = $1 FOR UPDATE`, userID).Scan(&lockedUserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return decimal.Zero, ErrInsufficientFunds
+	}
+	if err != nil {
+		return decimal.Zero, err
 	}
 
-	return result, nil
+	var current decimal.Decimal
+	err = tx.QueryRowContext(ctx,
+		`SELECT COALESCE(SUM(amount), 0) FROM ledger WHERE user_id = $1`, userID).Scan(&current)
+	return current, err
 }
 
-// DeductBalance вычет баланса пользователя
-func (s SQLStorage) DeductBalance(userID, orderID int, amountToDeduct float64) (float64, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// DeductBalance вычет баланса пользователя. Средства проверяются по журналу операций, как и в
+// GetBalanceByUserID, а строка balances служит кэшем баланса и блокировкой от параллельных списаний
+func (s SQLStorage) DeductBalance(ctx context.Context, userID, orderID int, amountToDeduct decimal.Decimal) (decimal.Decimal, error) {
+	ctx, cancel := withTimeout(ctx, s.txTimeout)
 	defer cancel()
 
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+		return decimal.Zero, wrapError("failed to begin transaction", err)
 	}
 
-	var newBalance float64
-	err = tx.QueryRowContext(ctx,
+	current, err := lockLedgerBalance(ctx, tx, userID)
+	if err != nil {
+		_ = tx.Rollback()
+		return decimal.Zero, wrapError("failed to get balance", err)
+	}
+	if current.LessThan(amountToDeduct) {
+		_ = tx.Rollback()
+		return decimal.Zero, wrapError("failed to update balance", ErrInsufficientFunds)
+	}
+
+	_, err = tx.ExecContext(ctx,
 		`UPDATE balances
 				SET current_balance = current_balance - $1, withdrawn = withdrawn + $1
-				WHERE user_id = $2 AND current_balance >= $1
-				RETURNING current_balance`, amountToDeduct, userID).Scan(&newBalance)
+				WHERE user_id = $2`, amountToDeduct, userID)
 	if err != nil {
 		_ = tx.Rollback()
-		return 0, fmt.Errorf("failed to update balance: %w", err)
+		return decimal.Zero, wrapError("failed to update balance", err)
 	}
 
 	_, err = tx.ExecContext(ctx,
 		`INSERT INTO transaction_history (user_id, order_number, transaction_sum) VALUES ($1, $2, $3)`,
 		userID, orderID, amountToDeduct)
+	if isUniqueViolation(err) {
+		_ = tx.Rollback()
+		return decimal.Zero, ErrWithdrawalExists
+	}
 	if err != nil {
 		_ = tx.Rollback()
-		return 0, fmt.Errorf("failed to insert transaction history: %w", err)
+		return decimal.Zero, wrapError("failed to insert transaction history", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO ledger (user_id, order_number, entry_type, amount) VALUES ($1, $2, $3, $4)`,
+		userID, orderID, constants.LedgerWithdrawal, amountToDeduct.Neg())
+	if err != nil {
+		_ = tx.Rollback()
+		return decimal.Zero, wrapError("failed to insert ledger entry", err)
 	}
 
 	if err = tx.Commit(); err != nil {
-		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+		return decimal.Zero, wrapError("failed to commit transaction", err)
 	}
 
-	return newBalance, nil
+	return current.Sub(amountToDeduct), nil
 }
 
-// GetAllTransactionByUserID получение истории операций пользователя
-func (s SQLStorage) GetAllTransactionByUserID(userID int) ([]storagemodels.Transaction, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// ListTransactionsByUserID получение страницы истории списаний пользователя и курсора следующей страницы
+func (s SQLStorage) ListTransactionsByUserID(ctx context.Context, userID int, query storagemodels.ListQuery) ([]storagemodels.Transaction, *storagemodels.Cursor, error) {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
 	defer cancel()
 
-	rows, err := s.db.QueryContext(ctx,
-		`SELECT order_number, transaction_sum, processed_at FROM transaction_history
-                WHERE user_id = $1 ORDER BY processed_at DESC`, userID)
+	sqlQuery, args := pageQuery(`SELECT order_number, transaction_sum, processed_at FROM transaction_history`,
+		"processed_at", "order_number", userID, query)
+	rows, err := s.db.QueryContext(ctx, sqlQuery, args...)
 	if err != nil {
-		return nil, err
-	}
-	if rows.Err() != nil {
-		return nil, rows.Err()
+		return nil, nil, wrapError("failed to get transactions", err)
 	}
+	defer rows.Close()
 
 	var result []storagemodels.Transaction
+	var cursors []storagemodels.Cursor
 	for rows.Next() {
-		var orderNumber string
-		var transactionSum string
-		var processedAt string
+		var orderNumber int
+		var transactionSum decimal.Decimal
+		var processedAt time.Time
 
 		if err := rows.Scan(&orderNumber, &transactionSum, &processedAt); err != nil {
-			return nil, err
-		}
-
-		transactionSumDecimal, err := decimal.NewFromString(transactionSum)
-		if err != nil {
-			return nil, err
+			return nil, nil, wrapError("failed to get transactions", err)
 		}
-		transactionSumFloat, _ := transactionSumDecimal.Float64()
 
 		result = append(result, storagemodels.Transaction{
-			OrderNumber: orderNumber,
-			Sum:         transactionSumFloat,
-			ProcessedAt: utils.ConvertTime(processedAt),
+			OrderNumber: strconv.Itoa(orderNumber),
+			Sum:         transactionSum,
+			ProcessedAt: formatTime(processedAt),
 		})
+		cursors = append(cursors, storagemodels.Cursor{At: processedAt, Number: orderNumber})
 	}
-	return result, nil
+	if err := rows.Err(); err != nil {
+		return nil, nil, wrapError("failed to get transactions", err)
+	}
+
+	size, next := pageSize(cursors, query.Limit)
+	return result[:size], next, nil
+}
+
+// UpdateAccrualData обновление заказа по ответу accrual. Баллы начисляются только при переходе
+// заказа в PROCESSED: предыдущий статус читается под блокировкой строки в той же транзакции,
+// а начисление записывается в журнал операций. Каждый ответ увеличивает счетчик опросов заказа.
+// В заказе хранится статус gophermart status и исходный статус accrualStatus, смена любого из них
+// записывается в историю статусов в той же транзакции. Недопустимый переход статуса
+// дает ErrInvalidTransition. Возвращает true, если начисление произошло
+func (s SQLStorage) UpdateAccrualData(ctx context.Context, orderID int, accrual decimal.Decimal, status constants.OrderStatus, accrualStatus string) (bool, error) {
+	ctx, span := tracing.Start(ctx, "storage.UpdateAccrualData",
+		tracing.OrderNumber(orderID), attribute.String("order.status", string(status)))
+	credited, err := s.updateAccrualData(ctx, orderID, accrual, status, accrualStatus)
+	span.SetAttributes(attribute.Bool("order.credited", credited))
+	tracing.End(span, err)
+	return credited, err
 }
 
-// UpdateAccrualData обновление заказа
-func (s SQLStorage) UpdateAccrualData(orderID int, accrual float64, status string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// updateAccrualData обновление заказа в транзакции внутри спана UpdateAccrualData
+func (s SQLStorage) updateAccrualData(ctx context.Context, orderID int, accrual decimal.Decimal, status constants.OrderStatus, accrualStatus string) (bool, error) {
+	ctx, cancel := withTimeout(ctx, s.txTimeout)
 	defer cancel()
 
 	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+		return false, wrapError("failed to begin transaction", err)
 	}
 
 	var userID int
+	var previousStatus constants.OrderStatus
+	var previousAccrualStatus string
 	row := tx.QueryRowContext(ctx,
-		`SELECT user_id FROM orders
-                WHERE order_id = $1;`, orderID)
-	err = row.Scan(&userID)
+		`SELECT user_id, status, COALESCE(accrual_status, '') FROM orders
+                WHERE order_id = $1 FOR UPDATE;`, orderID)
+	err = row.Scan(&userID, &previousStatus, &previousAccrualStatus)
 	if err != nil {
 		_ = tx.Rollback()
-		return fmt.Errorf("failed to find userID: %w", err)
+		return false, wrapError("failed to find userID", err)
 	}
 
-	_, err = tx.ExecContext(ctx,
-		`UPDATE orders SET status = $1, accrual = $2 
-             	WHERE order_id = $3;`, status, accrual, orderID)
+	if skip, err := orderTransition(previousStatus, status); skip || err != nil {
+		// Повторный ответ accrual по заказу в финальном статусе ничего не меняет
+		_ = tx.Rollback()
+		return false, wrapError("failed to update order", err)
+	}
+
+	var pollCount int
+	var age float64
+	err = tx.QueryRowContext(ctx,
+		`UPDATE orders SET status = $1, accrual = $2, accrual_status = $4, last_checked_at = NOW(), poll_count = poll_count + 1
+             	WHERE order_id = $3 RETURNING poll_count, EXTRACT(EPOCH FROM NOW() - created_at);`,
+		status, accrual, orderID, accrualStatus).Scan(&pollCount, &age)
 
 	if err != nil {
 		_ = tx.Rollback()
-		return fmt.Errorf("failed to update order: %w", err)
+		return false, wrapError("failed to update order", err)
 	}
 
-	_, err = tx.ExecContext(ctx,
-		`UPDATE balances
+	// REGISTERED -> PROCESSING не меняет статус заказа, но тоже попадает в историю
+	if status != previousStatus || accrualStatus != previousAccrualStatus {
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO order_status_history (order_id, status, accrual_status, source, poll_count) VALUES ($1, $2, $3, $4, $5)`,
+			orderID, status, accrualStatus, constants.HistoryAccrual, pollCount)
+		if err != nil {
+			_ = tx.Rollback()
+			return false, wrapError("failed to insert order status history", err)
+		}
+	}
+
+	credited := status == constants.Processed && accrual.IsPositive()
+	if credited {
+		_, err = tx.ExecContext(ctx,
+			`UPDATE balances
 				SET current_balance = current_balance + $1
 				WHERE user_id = $2 `, accrual, userID)
 
+		if err != nil {
+			_ = tx.Rollback()
+			return false, wrapError("failed to update balance", err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`INSERT INTO ledger (user_id, order_number, entry_type, amount) VALUES ($1, $2, $3, $4)`,
+			userID, orderID, constants.LedgerAccrual, accrual)
+		if err != nil {
+			_ = tx.Rollback()
+			return false, wrapError("failed to insert ledger entry", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, wrapError("failed to commit transaction", err)
+	}
+	if status == constants.Processed {
+		metrics.OrderProcessingTime.Observe(age)
+	}
+	return credited, nil
+}
+
+// LeaseOrdersForCheck захват заказов с нефинальным статусом для опроса accrual.
+// Заказы блокируются через FOR UPDATE SKIP LOCKED, а next_check_at сдвигается на время lease,
+// поэтому несколько реплик не опрашивают один и тот же заказ одновременно.
+// Если реплика упала, заказ снова станет доступен после истечения lease
+func (s SQLStorage) LeaseOrdersForCheck(ctx context.Context, limit int, lease time.Duration) ([]storagemodels.QueuedOrder, error) {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx,
+		`UPDATE orders SET next_check_at = NOW() + make_interval(secs => $1)
+				WHERE order_id IN (SELECT order_id FROM orders
+					WHERE status NOT IN ($2, $3) AND next_check_at <= NOW()
+					ORDER BY next_check_at
+					LIMIT $4
+					FOR UPDATE SKIP LOCKED)
+				RETURNING order_id, status`, lease.Seconds(), constants.Processed, constants.Invalid, limit)
+	if err != nil {
+		return nil, wrapError("failed to lease orders", err)
+	}
+	defer rows.Close()
+
+	var result []storagemodels.QueuedOrder
+	for rows.Next() {
+		var order storagemodels.QueuedOrder
+		if err := rows.Scan(&order.OrderID, &order.Status); err != nil {
+			return nil, wrapError("failed to lease orders", err)
+		}
+		result = append(result, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError("failed to lease orders", err)
+	}
+	return result, nil
+}
+
+// PostponeOrderCheck перенос следующего опроса заказа, снимает lease с заказа
+func (s SQLStorage) PostponeOrderCheck(ctx context.Context, orderID int, delay time.Duration) error {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE orders SET next_check_at = NOW() + make_interval(secs => $1)
+             	WHERE order_id = $2;`, delay.Seconds(), orderID)
+	return wrapError("failed to postpone order check", err)
+}
+
+// AppendLedgerEntry добавление в журнал операций возврата или ручной корректировки
+// с обновлением закэшированного баланса в той же транзакции. Отрицательная корректировка
+// проверяется по журналу операций, баланс не может уйти в минус. Возврат покрывается списанием
+// по тому же заказу за вычетом уже возвращенного, иначе ErrReversalNotCovered
+func (s SQLStorage) AppendLedgerEntry(ctx context.Context, userID, orderNumber int, entryType string, amount decimal.Decimal) error {
+	var withdrawnDelta decimal.Decimal
+	switch entryType {
+	case constants.LedgerReversal:
+		if !amount.IsPositive() {
+			return fmt.Errorf("reversal amount must be positive")
+		}
+		withdrawnDelta = amount
+	case constants.LedgerAdjustment:
+	default:
+		return fmt.Errorf("unsupported ledger entry type: %s", entryType)
+	}
+
+	ctx, cancel := withTimeout(ctx, s.txTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError("failed to begin transaction", err)
+	}
+
+	current, err := lockLedgerBalance(ctx, tx, userID)
+	if err != nil {
+		_ = tx.Rollback()
+		return wrapError("failed to get balance", err)
+	}
+	if current.Add(amount).IsNegative() {
+		_ = tx.Rollback()
+		return wrapError("failed to update balance", ErrInsufficientFunds)
+	}
+
+	if entryType == constants.LedgerReversal {
+		// Записи журнала пользователя не меняются, пока строка balances заблокирована
+		var withdrawn, reversed decimal.Decimal
+		err = tx.QueryRowContext(ctx,
+			`SELECT COALESCE(-SUM(amount) FILTER (WHERE entry_type = $3), 0),
+					COALESCE(SUM(amount) FILTER (WHERE entry_type = $4), 0)
+				FROM ledger
+				WHERE user_id = $1 AND order_number = $2`,
+			userID, orderNumber, constants.LedgerWithdrawal, constants.LedgerReversal).Scan(&withdrawn, &reversed)
+		if err != nil {
+			_ = tx.Rollback()
+			return wrapError("failed to get withdrawal", err)
+		}
+		if reversed.Add(amount).GreaterThan(withdrawn) {
+			_ = tx.Rollback()
+			return ErrReversalNotCovered
+		}
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE balances
+				SET current_balance = current_balance + $1, withdrawn = withdrawn - $2
+				WHERE user_id = $3`, amount, withdrawnDelta, userID)
+	if err != nil {
+		_ = tx.Rollback()
+		return wrapError("failed to update balance", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO ledger (user_id, order_number, entry_type, amount) VALUES ($1, $2, $3, $4)`,
+		userID, orderNumber, entryType, amount)
 	if err != nil {
 		_ = tx.Rollback()
-		return fmt.Errorf("failed to update balance: %w", err)
+		return wrapError("failed to insert ledger entry", err)
 	}
 
 	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return wrapError("failed to commit transaction", err)
+	}
+	return nil
+}
+
+// ReconcileBalances сверка закэшированных балансов с журналом операций,
+// возвращает пользователей, у которых они расходятся. Сверка проходит по всем пользователям,
+// поэтому ограничена только контекстом вызывающего
+func (s SQLStorage) ReconcileBalances(ctx context.Context) ([]storagemodels.BalanceDiscrepancy, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT b.user_id, b.current_balance, b.withdrawn, COALESCE(l.current, 0), COALESCE(l.withdrawn, 0)
+				FROM balances b
+				LEFT JOIN (SELECT user_id, SUM(amount) AS current,
+						COALESCE(-SUM(amount) FILTER (WHERE entry_type IN ($1, $2)), 0) AS withdrawn
+					FROM ledger GROUP BY user_id) l
+					ON l.user_id = b.user_id
+				WHERE b.current_balance <> COALESCE(l.current, 0) OR b.withdrawn <> COALESCE(l.withdrawn, 0)
+				ORDER BY b.user_id`, constants.LedgerWithdrawal, constants.LedgerReversal)
+	if err != nil {
+		return nil, wrapError("failed to reconcile balances", err)
+	}
+	defer rows.Close()
+
+	var result []storagemodels.BalanceDiscrepancy
+	for rows.Next() {
+		var discrepancy storagemodels.BalanceDiscrepancy
+		if err := rows.Scan(&discrepancy.UserID, &discrepancy.CachedCurrent, &discrepancy.CachedWithdrawn,
+			&discrepancy.LedgerCurrent, &discrepancy.LedgerWithdrawn); err != nil {
+			return nil, wrapError("failed to reconcile balances", err)
+		}
+		result = append(result, discrepancy)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError("failed to reconcile balances", err)
+	}
+	return result, nil
+}
+
+// CreateSession создание сессии пользователя
+func (s SQLStorage) CreateSession(ctx context.Context, session storagemodels.Session) error {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO sessions (id, user_id, refresh_token_hash, expires_at)
+				SELECT $1, id, $3, $4 FROM users WHERE user_name = $2`,
+		session.ID, session.UserName, session.RefreshTokenHash, session.ExpiresAt)
+	if err != nil {
+		return wrapError("failed to insert session", err)
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return wrapError("failed to insert session", fmt.Errorf("user %s: %w", session.UserName, ErrNotFound))
+	}
+	return nil
+}
+
+// RotateSession замена refresh токена сессии. Повторное предъявление уже замененного токена
+// означает, что он утек, поэтому такая сессия отзывается целиком и возвращается вместе с ErrRefreshTokenReused
+func (s SQLStorage) RotateSession(ctx context.Context, refreshTokenHash, newRefreshTokenHash string, expiresAt time.Time) (storagemodels.Session, error) {
+	ctx, cancel := withTimeout(ctx, s.txTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storagemodels.Session{}, wrapError("failed to begin transaction", err)
+	}
+
+	var session storagemodels.Session
+	var current, active bool
+	err = tx.QueryRowContext(ctx,
+		`SELECT s.id, u.user_name, s.refresh_token_hash = $1, s.revoked_at IS NULL AND s.expires_at > NOW()
+				FROM sessions s
+				JOIN users u ON u.id = s.user_id AND u.deleted_at IS NULL
+				WHERE s.refresh_token_hash = $1 OR s.previous_token_hash = $1
+				FOR UPDATE OF s`, refreshTokenHash).Scan(&session.ID, &session.UserName, &current, &active)
+	if errors.Is(err, sql.ErrNoRows) {
+		_ = tx.Rollback()
+		return storagemodels.Session{}, ErrSessionNotFound
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return storagemodels.Session{}, wrapError("failed to find session", err)
+	}
+	if !active {
+		_ = tx.Rollback()
+		return storagemodels.Session{}, ErrSessionNotFound
+	}
+
+	if !current {
+		_, err = tx.ExecContext(ctx,
+			`UPDATE sessions SET revoked_at = NOW() WHERE id = $1`, session.ID)
+		if err != nil {
+			_ = tx.Rollback()
+			return storagemodels.Session{}, wrapError("failed to revoke session", err)
+		}
+		if err = tx.Commit(); err != nil {
+			return storagemodels.Session{}, wrapError("failed to commit transaction", err)
+		}
+		return session, ErrRefreshTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE sessions
+				SET previous_token_hash = refresh_token_hash, refresh_token_hash = $1, expires_at = $2
+				WHERE id = $3`, newRefreshTokenHash, expiresAt, session.ID)
+	if err != nil {
+		_ = tx.Rollback()
+		return storagemodels.Session{}, wrapError("failed to update session", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return storagemodels.Session{}, wrapError("failed to commit transaction", err)
+	}
+	session.RefreshTokenHash = newRefreshTokenHash
+	session.ExpiresAt = expiresAt
+	return session, nil
+}
+
+// IsSessionActive проверка, что сессия не отозвана и не истекла
+func (s SQLStorage) IsSessionActive(ctx context.Context, sessionID string) (bool, error) {
+	var active bool
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	row := s.db.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM sessions 
+                WHERE id = $1 AND revoked_at IS NULL AND expires_at > NOW())`, sessionID)
+	if err := row.Scan(&active); err != nil {
+		return false, wrapError("failed to check session", err)
+	}
+	return active, nil
+}
+
+// RevokeSession отзыв сессии
+func (s SQLStorage) RevokeSession(ctx context.Context, sessionID string) error {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE sessions SET revoked_at = NOW() 
+             	WHERE id = $1 AND revoked_at IS NULL;`, sessionID)
+	return wrapError("failed to revoke session", err)
+}
+
+// RevokeUserSessions отзыв всех сессий пользователя
+func (s SQLStorage) RevokeUserSessions(ctx context.Context, userName string) error {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE sessions SET revoked_at = NOW() 
+             	WHERE user_id = (SELECT id FROM users WHERE user_name = $1) AND revoked_at IS NULL;`, userName)
+	return wrapError("failed to revoke sessions", err)
+}
+
+// loginLockoutSQL блокировка после failures неудач подряд по правилам из параметров $3-$5,
+// то же, что storagemodels.LoginPolicy.Lockout. Показатель степени ограничен, чтобы не переполнить double
+func loginLockoutSQL(failures string) string {
+	return fmt.Sprintf(`CASE WHEN %[1]s > $3
+		THEN NOW() + make_interval(secs => LEAST($5, $4 * power(2, LEAST(%[1]s - $3 - 1, 30)))) END`, failures)
+}
+
+// RecordLoginFailure учет попытки входа по ключу как неудачной. Счетчик увеличивается и блокировка
+// по правилам policy ставится одним запросом, только если ключ не заблокирован, иначе попытка отклоняется
+// без учета. Счетчик начинается заново, если предыдущая неудача была раньше policy.ResetAfter
+func (s SQLStorage) RecordLoginFailure(ctx context.Context, key string, policy storagemodels.LoginPolicy) (storagemodels.LoginAttempt, error) {
+	var result storagemodels.LoginAttempt
+	var lockout float64
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	failures := `CASE WHEN login_attempts.last_failure_at < NOW() - make_interval(secs => $2)
+					THEN 1 ELSE login_attempts.failures + 1 END`
+	err := s.db.QueryRowContext(ctx,
+		`INSERT INTO login_attempts (key, failures, last_failure_at, locked_until)
+				VALUES ($1, 1, NOW(), `+loginLockoutSQL("1")+`)
+				ON CONFLICT (key) DO UPDATE SET
+					failures = `+failures+`,
+					last_failure_at = NOW(),
+					locked_until = `+loginLockoutSQL(failures)+`
+				WHERE login_attempts.locked_until IS NULL OR login_attempts.locked_until <= NOW()
+				RETURNING failures, COALESCE(EXTRACT(EPOCH FROM locked_until - NOW()), 0)`,
+		key, policy.ResetAfter.Seconds(), policy.FreeAttempts, policy.BaseLockout.Seconds(), policy.MaxLockout.Seconds()).
+		Scan(&result.Failures, &lockout)
+	if err == nil {
+		result.Lockout = time.Duration(lockout * float64(time.Second))
+		return result, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return storagemodels.LoginAttempt{}, wrapError("failed to record login failure", err)
+	}
+
+	// Ключ заблокирован, попытка не засчитана, остаток блокировки нужен только для Retry-After
+	result.Rejected = true
+	err = s.db.QueryRowContext(ctx,
+		`SELECT failures, GREATEST(EXTRACT(EPOCH FROM locked_until - NOW()), 0) FROM login_attempts
+				WHERE key = $1 AND locked_until IS NOT NULL`, key).
+		Scan(&result.Failures, &lockout)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return storagemodels.LoginAttempt{}, wrapError("failed to record login failure", err)
+	}
+	result.Lockout = time.Duration(lockout * float64(time.Second))
+	return result, nil
+}
+
+// ReleaseLoginFailure снятие засчитанной попытки входа по ключу, если она не оказалась неудачей.
+// unlock снимает и блокировку, наступившую на этой попытке
+func (s SQLStorage) ReleaseLoginFailure(ctx context.Context, key string, unlock bool) error {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE login_attempts SET failures = GREATEST(failures - 1, 0),
+					locked_until = CASE WHEN $2 THEN NULL ELSE locked_until END
+				WHERE key = $1`, key, unlock)
+	return wrapError("failed to release login failure", err)
+}
+
+// ResetLoginFailures сброс неудачных попыток входа по ключу
+func (s SQLStorage) ResetLoginFailures(ctx context.Context, key string) error {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, `DELETE FROM login_attempts WHERE key = $1`, key)
+	return wrapError("failed to reset login failures", err)
+}
+
+// DeleteExpiredLoginAttempts удаление счетчиков неудачных попыток входа без неудач дольше retention
+// и без действующей блокировки, возвращает число удаленных счетчиков
+func (s SQLStorage) DeleteExpiredLoginAttempts(ctx context.Context, retention time.Duration) (int64, error) {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx,
+		`DELETE FROM login_attempts
+				WHERE last_failure_at < NOW() - make_interval(secs => $1)
+					AND (locked_until IS NULL OR locked_until <= NOW())`, retention.Seconds())
+	if err != nil {
+		return 0, wrapError("failed to delete expired login attempts", err)
+	}
+	deleted, err := result.RowsAffected()
+	return deleted, wrapError("failed to delete expired login attempts", err)
+}
+
+// ReserveIdempotencyKey захват ключа идемпотентности пользователя. Если ключ уже был, возвращается
+// сохраненная запись и false, иначе ключ закрепляется за запросом до CompleteIdempotencyKey.
+// Незавершенный ключ старше reservationTTL считается брошенным (реплика упала или не смогла сохранить ответ)
+// и захватывается заново
+func (s SQLStorage) ReserveIdempotencyKey(ctx context.Context, userID int, key, requestHash string, reservationTTL time.Duration) (storagemodels.IdempotencyRecord, bool, error) {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx,
+		`INSERT INTO idempotency_keys (user_id, key, request_hash, created_at) VALUES ($1, $2, $3, NOW())
+				ON CONFLICT (user_id, key) DO UPDATE
+				SET request_hash = EXCLUDED.request_hash, created_at = EXCLUDED.created_at
+				WHERE idempotency_keys.status_code IS NULL
+					AND idempotency_keys.created_at < NOW() - make_interval(secs => $4)`,
+		userID, key, requestHash, reservationTTL.Seconds())
+	if err != nil {
+		return storagemodels.IdempotencyRecord{}, false, wrapError("failed to reserve idempotency key", err)
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 1 {
+		return storagemodels.IdempotencyRecord{RequestHash: requestHash}, true, nil
+	}
+
+	var record storagemodels.IdempotencyRecord
+	err = s.db.QueryRowContext(ctx,
+		`SELECT request_hash, COALESCE(status_code, 0), COALESCE(content_type, ''), response_body FROM idempotency_keys
+				WHERE user_id = $1 AND key = $2`, userID, key).
+		Scan(&record.RequestHash, &record.StatusCode, &record.ContentType, &record.ResponseBody)
+	if err != nil {
+		return storagemodels.IdempotencyRecord{}, false, wrapError("failed to get idempotency key", err)
+	}
+	return record, false, nil
+}
+
+// CompleteIdempotencyKey сохранение ответа на запрос с ключом идемпотентности
+func (s SQLStorage) CompleteIdempotencyKey(ctx context.Context, userID int, key string, response storagemodels.IdempotencyResponse) error {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		`UPDATE idempotency_keys SET status_code = $3, content_type = $4, response_body = $5
+				WHERE user_id = $1 AND key = $2`, userID, key, response.StatusCode, response.ContentType, response.ResponseBody)
+	return wrapError("failed to complete idempotency key", err)
+}
+
+// ReleaseIdempotencyKey освобождение незавершенного ключа, чтобы запрос можно было повторить
+func (s SQLStorage) ReleaseIdempotencyKey(ctx context.Context, userID int, key string) error {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx,
+		`DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2 AND status_code IS NULL`, userID, key)
+	return wrapError("failed to release idempotency key", err)
+}
+
+// DeleteExpiredIdempotencyKeys удаление ключей идемпотентности старше retention, возвращает число удаленных ключей
+func (s SQLStorage) DeleteExpiredIdempotencyKeys(ctx context.Context, retention time.Duration) (int64, error) {
+	ctx, cancel := withTimeout(ctx, s.queryTimeout)
+	defer cancel()
+
+	result, err := s.db.ExecContext(ctx,
+		`DELETE FROM idempotency_keys WHERE created_at < NOW() - make_interval(secs => $1)`, retention.Seconds())
+	if err != nil {
+		return 0, wrapError("failed to delete expired idempotency keys", err)
 	}
-	return err
+	deleted, err := result.RowsAffected()
+	return deleted, wrapError("failed to delete expired idempotency keys", err)
 }
@@ -11,6 +11,8 @@ import (
 	"github.com/fngoc/gofermart/internal/storage/storagemodels"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -34,7 +36,7 @@ func TestIsUserCreated(t *testing.T) {
 		WithArgs("testUser").WillReturnRows(rows)
 
 	// Проверяем результат работы функции
-	isCreated := Store.IsUserCreated("testUser")
+	isCreated := Store.IsUserCreated(context.Background(), "testUser")
 	assert.True(t, isCreated)
 
 	// Проверяем, что все ожидаемые запросы были вызваны
@@ -42,34 +44,120 @@ func TestIsUserCreated(t *testing.T) {
 	assert.NoError(t, err)
 }
 
-// TestIsUserAuthenticated тестирует функцию IsUserAuthenticated
-func TestIsUserAuthenticated(t *testing.T) {
+// TestGetPasswordHashByUser тестирует функцию GetPasswordHashByUser
+func TestGetPasswordHashByUser(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 
 	SetDBInstance(SQLStorage{db: db})
 
-	_, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	// Тест 1: успешная аутентификация
-	rows := sqlmock.NewRows([]string{"exists"}).AddRow(true)
-	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM users WHERE user_name = \$1 AND password = \$2\)`).
-		WithArgs("testUser", "testPasswordHash").
+	// Тест 1: пользователь найден
+	rows := sqlmock.NewRows([]string{"password"}).AddRow("testPasswordHash")
+	mock.ExpectQuery(`SELECT password FROM users WHERE user_name = \$1 AND deleted_at IS NULL`).
+		WithArgs("testUser").
 		WillReturnRows(rows)
 
-	isAuthenticated := Store.IsUserAuthenticated("testUser", "testPasswordHash")
-	assert.True(t, isAuthenticated)
+	passwordHash, err := Store.GetPasswordHashByUser(context.Background(), "testUser")
+	assert.NoError(t, err)
+	assert.Equal(t, "testPasswordHash", passwordHash)
 
-	// Тест 2: неуспешная аутентификация (неверный логин или пароль)
-	rows = sqlmock.NewRows([]string{"exists"}).AddRow(false)
-	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM users WHERE user_name = \$1 AND password = \$2\)`).
-		WithArgs("wrongUser", "wrongPasswordHash").
-		WillReturnRows(rows)
+	// Тест 2: пользователь не найден
+	mock.ExpectQuery(`SELECT password FROM users WHERE user_name = \$1`).
+		WithArgs("wrongUser").
+		WillReturnError(sql.ErrNoRows)
+
+	_, err = Store.GetPasswordHashByUser(context.Background(), "wrongUser")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+// TestUpdatePasswordHash тестирует функцию UpdatePasswordHash
+func TestUpdatePasswordHash(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+
+	mock.ExpectExec(`UPDATE users SET password = \$1 WHERE user_name = \$2`).
+		WithArgs("newPasswordHash", "testUser").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = Store.UpdatePasswordHash(context.Background(), "testUser", "newPasswordHash")
+	assert.NoError(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+// TestChangePassword тестирует функцию ChangePassword
+func TestChangePassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+
+	// Тест 1: пароль изменен, остальные сессии отозваны
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE users SET password = \$2 WHERE user_name = \$1 AND deleted_at IS NULL RETURNING id`).
+		WithArgs("testUser", "newPasswordHash").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(`UPDATE sessions SET revoked_at = NOW\(\) WHERE user_id = \$1 AND id <> \$2 AND revoked_at IS NULL`).
+		WithArgs(1, "sid").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	err = Store.ChangePassword(context.Background(), "testUser", "newPasswordHash", "sid")
+	assert.NoError(t, err)
+
+	// Тест 2: пользователь не найден
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE users SET password`).
+		WithArgs("wrongUser", "newPasswordHash").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	err = Store.ChangePassword(context.Background(), "wrongUser", "newPasswordHash", "sid")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+// TestDeleteUser тестирует функцию DeleteUser
+func TestDeleteUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+
+	// Тест 1: пользователь обезличен, сессии отозваны, заказы и история списаний не трогаются
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE users SET user_name = NULL, password = '', deleted_at = NOW\(\) WHERE user_name = \$1 AND deleted_at IS NULL RETURNING id`).
+		WithArgs("testUser").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(`UPDATE sessions SET revoked_at = NOW\(\) WHERE user_id = \$1 AND revoked_at IS NULL`).
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = Store.DeleteUser(context.Background(), "testUser")
+	assert.NoError(t, err)
+
+	// Тест 2: пользователь не найден или уже удален
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE users SET user_name = NULL`).
+		WithArgs("testUser").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
 
-	isAuthenticated = Store.IsUserAuthenticated("wrongUser", "wrongPasswordHash")
-	assert.False(t, isAuthenticated)
+	err = Store.DeleteUser(context.Background(), "testUser")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
 
 	err = mock.ExpectationsWereMet()
 	assert.NoError(t, err)
@@ -90,7 +178,7 @@ func TestCreateUser(t *testing.T) {
 	mock.ExpectBegin()
 
 	mock.ExpectQuery(`INSERT INTO users`).
-		WithArgs("testUser", "passwordHash", "token").
+		WithArgs("testUser", "passwordHash").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 
 	mock.ExpectExec(`INSERT INTO balances`).
@@ -99,7 +187,7 @@ func TestCreateUser(t *testing.T) {
 
 	mock.ExpectCommit()
 
-	err = Store.CreateUser("testUser", "passwordHash", "token")
+	err = Store.CreateUser(context.Background(), "testUser", "passwordHash")
 	assert.NoError(t, err)
 
 	err = mock.ExpectationsWereMet()
@@ -109,12 +197,12 @@ func TestCreateUser(t *testing.T) {
 	mock.ExpectBegin()
 
 	mock.ExpectQuery(`INSERT INTO users`).
-		WithArgs("testUser", "passwordHash", "token").
+		WithArgs("testUser", "passwordHash").
 		WillReturnError(fmt.Errorf("insertion error"))
 
 	mock.ExpectRollback()
 
-	err = Store.CreateUser("testUser", "passwordHash", "token")
+	err = Store.CreateUser(context.Background(), "testUser", "passwordHash")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to insert user")
 
@@ -122,7 +210,7 @@ func TestCreateUser(t *testing.T) {
 	mock.ExpectBegin()
 
 	mock.ExpectQuery(`INSERT INTO users`).
-		WithArgs("testUser", "passwordHash", "token").
+		WithArgs("testUser", "passwordHash").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 
 	mock.ExpectExec(`INSERT INTO balances`).
@@ -131,7 +219,7 @@ func TestCreateUser(t *testing.T) {
 
 	mock.ExpectRollback()
 
-	err = Store.CreateUser("testUser", "passwordHash", "token")
+	err = Store.CreateUser(context.Background(), "testUser", "passwordHash")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to insert balance")
 
@@ -139,7 +227,7 @@ func TestCreateUser(t *testing.T) {
 	mock.ExpectBegin()
 
 	mock.ExpectQuery(`INSERT INTO users`).
-		WithArgs("testUser", "passwordHash", "token").
+		WithArgs("testUser", "passwordHash").
 		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
 
 	mock.ExpectExec(`INSERT INTO balances`).
@@ -148,70 +236,11 @@ func TestCreateUser(t *testing.T) {
 
 	mock.ExpectCommit().WillReturnError(fmt.Errorf("commit error"))
 
-	err = Store.CreateUser("testUser", "passwordHash", "token")
+	err = Store.CreateUser(context.Background(), "testUser", "passwordHash")
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to commit transaction")
 }
 
-// TestSetNewTokenByUser тестирует функцию SetNewTokenByUser
-func TestSetNewTokenByUser(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	assert.NoError(t, err)
-	defer db.Close()
-
-	SetDBInstance(SQLStorage{db: db})
-
-	_, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	// Тест 1: успешное обновление токена
-	mock.ExpectExec(`UPDATE users SET token = \$1 WHERE user_name = \$2`).
-		WithArgs("newtoken", "testuser").
-		WillReturnResult(sqlmock.NewResult(1, 1))
-
-	err = Store.SetNewTokenByUser("testuser", "newtoken")
-	assert.NoError(t, err)
-
-	err = mock.ExpectationsWereMet()
-	assert.NoError(t, err)
-
-	// Тест 2: ошибка при выполнении запроса обновления токена
-	mock.ExpectExec(`UPDATE users SET token = \$1 WHERE user_name = \$2`).
-		WithArgs("newtoken", "testuser").
-		WillReturnError(sqlmock.ErrCancelled)
-
-	err = Store.SetNewTokenByUser("testuser", "newtoken")
-	assert.Error(t, err)
-	assert.Equal(t, sqlmock.ErrCancelled, err)
-
-	err = mock.ExpectationsWereMet()
-	assert.NoError(t, err)
-}
-
-// TestGetUserNameByOrderID тестирует функцию GetUserNameByOrderID
-func TestGetUserNameByOrderID(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	assert.NoError(t, err)
-	defer db.Close()
-
-	SetDBInstance(SQLStorage{db: db})
-
-	_, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	// Тест 1: успешное получение имени пользователя
-	rows := sqlmock.NewRows([]string{"user_name"}).AddRow("testUser")
-	mock.ExpectQuery(`SELECT users.user_name FROM orders JOIN users ON orders.user_id = users.id WHERE orders.order_id = \$1`).
-		WithArgs(123).
-		WillReturnRows(rows)
-
-	userName := Store.GetUserNameByOrderID(123)
-	assert.Equal(t, "testUser", userName)
-
-	err = mock.ExpectationsWereMet()
-	assert.NoError(t, err)
-}
-
 // TestGetUserIDByName тестирует функцию GetUserIDByName
 func TestGetUserIDByName(t *testing.T) {
 	db, mock, err := sqlmock.New()
@@ -229,7 +258,7 @@ func TestGetUserIDByName(t *testing.T) {
 		WithArgs("testUser").
 		WillReturnRows(rows)
 
-	userID, err := Store.GetUserIDByName("testUser")
+	userID, err := Store.GetUserIDByName(context.Background(), "testUser")
 	assert.NoError(t, err)
 	assert.Equal(t, 1, userID)
 
@@ -241,10 +270,11 @@ func TestGetUserIDByName(t *testing.T) {
 		WithArgs("unknownUser").
 		WillReturnError(sql.ErrNoRows)
 
-	userID, err = Store.GetUserIDByName("unknownUser")
+	userID, err = Store.GetUserIDByName(context.Background(), "unknownUser")
 	assert.Error(t, err)
 	assert.Equal(t, 0, userID)
-	assert.Equal(t, sql.ErrNoRows, err)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	assert.ErrorIs(t, err, ErrNotFound)
 
 	err = mock.ExpectationsWereMet()
 	assert.NoError(t, err)
@@ -254,10 +284,10 @@ func TestGetUserIDByName(t *testing.T) {
 		WithArgs("errorUser").
 		WillReturnError(sqlmock.ErrCancelled)
 
-	userID, err = Store.GetUserIDByName("errorUser")
+	userID, err = Store.GetUserIDByName(context.Background(), "errorUser")
 	assert.Error(t, err)
 	assert.Equal(t, 0, userID)
-	assert.Equal(t, sqlmock.ErrCancelled, err)
+	assert.ErrorIs(t, err, sqlmock.ErrCancelled)
 
 	err = mock.ExpectationsWereMet()
 	assert.NoError(t, err)
@@ -271,85 +301,229 @@ func TestCreateOrder(t *testing.T) {
 
 	SetDBInstance(SQLStorage{db: db})
 
-	_, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	query := `WITH inserted AS \( INSERT INTO orders \(user_id, order_id, status\) VALUES \(\$1, \$2, \$3\) ` +
+		`ON CONFLICT \(order_id\) DO NOTHING RETURNING user_id, order_id \), ` +
+		`history AS \( INSERT INTO order_status_history \(order_id, status, source\) SELECT order_id, \$3, \$4 FROM inserted \) ` +
+		`SELECT user_id, TRUE FROM inserted UNION ALL SELECT user_id, FALSE FROM orders WHERE order_id = \$2 LIMIT 1`
+
+	// Тест 1: новый заказ, заказ этого же пользователя и заказ другого пользователя
+	tests := []struct {
+		ownerID  int
+		inserted bool
+		want     storagemodels.OrderUploadResult
+		wantErr  error
+	}{
+		{ownerID: 1, inserted: true, want: storagemodels.OrderCreated},
+		{ownerID: 1, inserted: false, want: storagemodels.OrderUploadedByUser},
+		{ownerID: 2, inserted: false, wantErr: ErrDuplicateOrder},
+	}
+	for _, tt := range tests {
+		mock.ExpectQuery(query).
+			WithArgs(1, 123, constants.New, constants.HistoryUpload).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "inserted"}).AddRow(tt.ownerID, tt.inserted))
+
+		result, err := Store.CreateOrder(context.Background(), 1, 123)
+		if tt.wantErr != nil {
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.ErrorIs(t, err, ErrConflict)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, tt.want, result)
+	}
 
-	// Тест 1: успешное создание заказа
-	mock.ExpectExec(`INSERT INTO orders \(user_id, order_id, status\) VALUES \(\$1, \$2, \$3\)`).
-		WithArgs(1, 123, constants.New).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+
+	// Тест 2: заказ параллельной транзакции не попал в снимок, запрос повторяется
+	mock.ExpectQuery(query).
+		WithArgs(1, 123, constants.New, constants.HistoryUpload).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "inserted"}))
+	mock.ExpectQuery(query).
+		WithArgs(1, 123, constants.New, constants.HistoryUpload).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "inserted"}).AddRow(2, false))
+
+	_, err = Store.CreateOrder(context.Background(), 1, 123)
+	assert.ErrorIs(t, err, ErrDuplicateOrder)
 
-	err = Store.CreateOrder(1, 123)
+	err = mock.ExpectationsWereMet()
 	assert.NoError(t, err)
 
+	// Тест 3: владелец так и не виден
+	for i := 0; i < createOrderAttempts; i++ {
+		mock.ExpectQuery(query).
+			WithArgs(1, 123, constants.New, constants.HistoryUpload).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "inserted"}))
+	}
+
+	_, err = Store.CreateOrder(context.Background(), 1, 123)
+	assert.ErrorIs(t, err, ErrTransient)
+
 	err = mock.ExpectationsWereMet()
 	assert.NoError(t, err)
 
-	// Тест 2: ошибка при выполнении запроса на создание заказа
-	mock.ExpectExec(`INSERT INTO orders \(user_id, order_id, status\) VALUES \(\$1, \$2, \$3\)`).
-		WithArgs(1, 123, constants.New).
+	// Тест 4: ошибка при выполнении запроса на создание заказа
+	mock.ExpectQuery(query).
+		WithArgs(1, 123, constants.New, constants.HistoryUpload).
 		WillReturnError(sql.ErrConnDone)
 
-	err = Store.CreateOrder(1, 123)
+	_, err = Store.CreateOrder(context.Background(), 1, 123)
 	assert.Error(t, err)
-	assert.Equal(t, sql.ErrConnDone, err)
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+	assert.ErrorIs(t, err, ErrTransient)
 
 	err = mock.ExpectationsWereMet()
 	assert.NoError(t, err)
 }
 
-// TestGetAllOrdersByUserID тестирует функцию GetAllOrdersByUserID
-func TestGetAllOrdersByUserID(t *testing.T) {
+// TestListOrdersByUserID тестирует функцию ListOrdersByUserID
+func TestListOrdersByUserID(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 
 	SetDBInstance(SQLStorage{db: db})
 
-	// Тест 1: успешное получение заказов
-	rows := sqlmock.NewRows([]string{"order_id", "status", "accrual", "created_at"}).
-		AddRow("123", "NEW", "100.50", "2023-10-22T12:00:00Z").
-		AddRow("124", "PROCESSED", sql.NullString{String: "200.75", Valid: true}, "2023-10-21T11:00:00Z")
+	firstAt := time.Date(2023, 10, 22, 12, 0, 0, 0, time.UTC)
+	secondAt := time.Date(2023, 10, 21, 11, 0, 0, 0, time.UTC)
+	columns := []string{"order_id", "status", "accrual", "created_at"}
 
-	mock.ExpectQuery(`SELECT order_id, status, accrual, created_at FROM orders WHERE user_id = \$1 ORDER BY created_at DESC`).
-		WithArgs(1).
+	// Тест 1: первая страница, есть следующая
+	rows := sqlmock.NewRows(columns).
+		AddRow(123, "NEW", "100.50", firstAt).
+		AddRow(124, "PROCESSED", sql.NullString{String: "200.75", Valid: true}, secondAt).
+		AddRow(125, "NEW", nil, secondAt)
+
+	mock.ExpectQuery(`SELECT order_id, status, accrual, created_at FROM orders WHERE user_id = \$1 `+
+		`ORDER BY created_at DESC, order_id DESC LIMIT \$2`).
+		WithArgs(1, 3).
 		WillReturnRows(rows)
 
-	orders, err := Store.GetAllOrdersByUserID(1)
+	orders, next, err := Store.ListOrdersByUserID(context.Background(), 1, storagemodels.ListQuery{Limit: 2})
 	assert.NoError(t, err)
 	assert.Len(t, orders, 2)
 	assert.Equal(t, "123", orders[0].Number)
-	assert.Equal(t, "NEW", orders[0].Status)
-	assert.Equal(t, 100.50, orders[0].Accrual)
+	assert.Equal(t, constants.New, orders[0].Status)
+	assert.Equal(t, "100.5", orders[0].Accrual.String())
+	assert.Equal(t, "2023-10-22T15:00:00+03:00", orders[0].UploadedAt)
 	assert.Equal(t, "124", orders[1].Number)
-	assert.Equal(t, 200.75, orders[1].Accrual)
+	assert.Equal(t, "200.75", orders[1].Accrual.String())
+	assert.Equal(t, &storagemodels.Cursor{At: secondAt, Number: 124}, next)
 
 	err = mock.ExpectationsWereMet()
 	assert.NoError(t, err)
 
-	// Тест 2: ошибка при выполнении запроса
-	mock.ExpectQuery(`SELECT order_id, status, accrual, created_at FROM orders WHERE user_id = \$1 ORDER BY created_at DESC`).
-		WithArgs(1).
+	// Тест 2: следующая страница с фильтрами по статусу и периоду, старые первыми
+	from := time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 11, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT order_id, status, accrual, created_at FROM orders WHERE user_id = \$1 `+
+		`AND status IN \(\$2, \$3\) AND created_at >= \$4 AND created_at < \$5 `+
+		`AND \(created_at, order_id\) > \(\$6, \$7\) ORDER BY created_at ASC, order_id ASC LIMIT \$8`).
+		WithArgs(1, "NEW", "PROCESSED", from, to, secondAt, 124, 3).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(125, "NEW", nil, secondAt))
+
+	orders, next, err = Store.ListOrdersByUserID(context.Background(), 1, storagemodels.ListQuery{
+		Limit:     2,
+		After:     &storagemodels.Cursor{At: secondAt, Number: 124},
+		Statuses:  []constants.OrderStatus{constants.New, constants.Processed},
+		From:      from,
+		To:        to,
+		Ascending: true,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, orders, 1)
+	assert.Nil(t, orders[0].Accrual)
+	assert.Nil(t, next)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+
+	// Тест 3: ошибка при выполнении запроса
+	mock.ExpectQuery(`SELECT order_id, status, accrual, created_at FROM orders`).
+		WithArgs(1, 3).
 		WillReturnError(sql.ErrConnDone)
 
-	orders, err = Store.GetAllOrdersByUserID(1)
+	orders, _, err = Store.ListOrdersByUserID(context.Background(), 1, storagemodels.ListQuery{Limit: 2})
 	assert.Error(t, err)
 	assert.Nil(t, orders)
-	assert.Equal(t, sql.ErrConnDone, err)
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+	assert.ErrorIs(t, err, ErrTransient)
 
-	// Тест 3: ошибка при сканировании строки
-	rowsWithScanError := sqlmock.NewRows([]string{"order_id", "status", "accrual", "created_at"}).
+	// Тест 4: ошибка при сканировании строки
+	rowsWithScanError := sqlmock.NewRows(columns).
 		AddRow(nil, nil, nil, nil) // Неправильные данные
 
-	mock.ExpectQuery(`SELECT order_id, status, accrual, created_at FROM orders WHERE user_id = \$1 ORDER BY created_at DESC`).
-		WithArgs(1).
+	mock.ExpectQuery(`SELECT order_id, status, accrual, created_at FROM orders`).
+		WithArgs(1, 3).
 		WillReturnRows(rowsWithScanError)
 
-	orders, err = Store.GetAllOrdersByUserID(1)
+	orders, _, err = Store.ListOrdersByUserID(context.Background(), 1, storagemodels.ListQuery{Limit: 2})
 	assert.Error(t, err)
 	assert.Nil(t, orders)
 }
 
+// TestGetOrderByNumber тестирует функцию GetOrderByNumber
+func TestGetOrderByNumber(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+
+	createdAt := time.Date(2023, 10, 22, 12, 0, 0, 0, time.UTC)
+	checkedAt := time.Date(2023, 10, 22, 12, 5, 0, 0, time.UTC)
+
+	// Тест 1: заказ с историей статусов
+	mock.ExpectQuery(`SELECT status, accrual, created_at, last_checked_at, poll_count FROM orders WHERE order_id = \$1 AND user_id = \$2`).
+		WithArgs(123, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "accrual", "created_at", "last_checked_at", "poll_count"}).
+			AddRow("PROCESSED", "100.50", createdAt, checkedAt, 3))
+	mock.ExpectQuery(`SELECT status, COALESCE\(accrual_status, ''\), source, poll_count, changed_at FROM order_status_history WHERE order_id = \$1 ORDER BY changed_at, id`).
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "accrual_status", "source", "poll_count", "changed_at"}).
+			AddRow("NEW", "", constants.HistoryUpload, 0, createdAt).
+			AddRow("PROCESSED", "PROCESSED", constants.HistoryAccrual, 3, checkedAt))
+
+	order, err := Store.GetOrderByNumber(context.Background(), 1, 123)
+	assert.NoError(t, err)
+	assert.Equal(t, "123", order.Number)
+	assert.Equal(t, constants.Processed, order.Status)
+	assert.Equal(t, "100.5", order.Accrual.String())
+	assert.Equal(t, "2023-10-22T15:00:00+03:00", order.UploadedAt)
+	assert.Equal(t, "2023-10-22T15:05:00+03:00", order.LastCheckedAt)
+	assert.Equal(t, 3, order.PollCount)
+	assert.Equal(t, []storagemodels.OrderStatusChange{
+		{Status: "NEW", Source: constants.HistoryUpload, ChangedAt: "2023-10-22T15:00:00+03:00"},
+		{Status: "PROCESSED", AccrualStatus: "PROCESSED", Source: constants.HistoryAccrual, PollCount: 3, ChangedAt: "2023-10-22T15:05:00+03:00"},
+	}, order.History)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+
+	// Тест 2: заказ не найден или принадлежит другому пользователю
+	mock.ExpectQuery(`SELECT status, accrual, created_at, last_checked_at, poll_count FROM orders`).
+		WithArgs(123, 2).
+		WillReturnError(sql.ErrNoRows)
+
+	_, err = Store.GetOrderByNumber(context.Background(), 2, 123)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// Тест 3: ошибка при чтении истории
+	mock.ExpectQuery(`SELECT status, accrual, created_at, last_checked_at, poll_count FROM orders`).
+		WithArgs(123, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"status", "accrual", "created_at", "last_checked_at", "poll_count"}).
+			AddRow("NEW", nil, createdAt, nil, 0))
+	mock.ExpectQuery(`SELECT status, COALESCE\(accrual_status, ''\), source, poll_count, changed_at FROM order_status_history`).
+		WithArgs(123).
+		WillReturnError(sql.ErrConnDone)
+
+	_, err = Store.GetOrderByNumber(context.Background(), 1, 123)
+	assert.ErrorIs(t, err, ErrTransient)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
 // TestGetBalanceByUserID тестирует функцию GetBalanceByUserID
 func TestGetBalanceByUserID(t *testing.T) {
 	db, mock, err := sqlmock.New()
@@ -358,31 +532,32 @@ func TestGetBalanceByUserID(t *testing.T) {
 
 	SetDBInstance(SQLStorage{db: db})
 
-	// Тест 1: успешное получение баланса пользователя
+	// Тест 1: успешное получение баланса пользователя из журнала операций
 	rows := sqlmock.NewRows([]string{"current_balance", "withdrawn"}).
 		AddRow("100.50", "50.25")
 
-	mock.ExpectQuery(`SELECT current_balance, withdrawn FROM balances WHERE user_id = \$1`).
-		WithArgs(1).
+	mock.ExpectQuery(`SELECT COALESCE\(SUM\(amount\), 0\), COALESCE\(-SUM\(amount\) FILTER \(WHERE entry_type IN \(\$2, \$3\)\), 0\) FROM ledger WHERE user_id = \$1`).
+		WithArgs(1, constants.LedgerWithdrawal, constants.LedgerReversal).
 		WillReturnRows(rows)
 
-	balance, err := Store.GetBalanceByUserID(1)
+	balance, err := Store.GetBalanceByUserID(context.Background(), 1)
 	assert.NoError(t, err)
-	assert.Equal(t, 100.50, balance.Current)
-	assert.Equal(t, 50.25, balance.Withdrawn)
+	assert.Equal(t, "100.5", balance.Current.String())
+	assert.Equal(t, "50.25", balance.Withdrawn.String())
 
 	err = mock.ExpectationsWereMet()
 	assert.NoError(t, err)
 
 	// Тест 2: ошибка при выполнении запроса
-	mock.ExpectQuery(`SELECT current_balance, withdrawn FROM balances WHERE user_id = \$1`).
-		WithArgs(1).
+	mock.ExpectQuery(`SELECT COALESCE\(SUM\(amount\), 0\), COALESCE\(-SUM\(amount\) FILTER \(WHERE entry_type IN \(\$2, \$3\)\), 0\) FROM ledger WHERE user_id = \$1`).
+		WithArgs(1, constants.LedgerWithdrawal, constants.LedgerReversal).
 		WillReturnError(sql.ErrConnDone)
 
-	balance, err = Store.GetBalanceByUserID(1)
+	balance, err = Store.GetBalanceByUserID(context.Background(), 1)
 	assert.Error(t, err)
 	assert.Equal(t, storagemodels.Balance{}, balance)
-	assert.Equal(t, sql.ErrConnDone, err)
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+	assert.ErrorIs(t, err, ErrTransient)
 
 	err = mock.ExpectationsWereMet()
 	assert.NoError(t, err)
@@ -391,13 +566,18 @@ func TestGetBalanceByUserID(t *testing.T) {
 	rowsWithScanError := sqlmock.NewRows([]string{"current_balance", "withdrawn"}).
 		AddRow("invalid_balance", "50.25") // Неверный формат баланса
 
-	mock.ExpectQuery(`SELECT current_balance, withdrawn FROM balances WHERE user_id = \$1`).
-		WithArgs(1).
-		WillReturnRows(rowsWithScanError)
+	mock.ExpectQuery(`SELECT COALESCE\(SUM\(amount\), 0\), COALESCE\(-SUM\(amount\) FILTER \(WHERE entry_type IN \(\$2, \$3\)\), 0\) FROM ledger WHERE user_id = \$1`).
+		WithArgs(1, constants.LedgerWithdrawal, constants.LedgerReversal).
+		WillReturnRows(rowsWithScanError).
+		RowsWillBeClosed()
 
-	balance, err = Store.GetBalanceByUserID(1)
+	balance, err = Store.GetBalanceByUserID(context.Background(), 1)
 	assert.Error(t, err)
 	assert.Equal(t, storagemodels.Balance{}, balance)
+
+	// Строки закрываются и при ошибке сканирования, соединение возвращается в пул
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
 }
 
 // TestDeductBalance тестирует функцию DeductBalance
@@ -409,135 +589,222 @@ func TestDeductBalance(t *testing.T) {
 
 	SetDBInstance(SQLStorage{db: db})
 
-	_, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	// expectLedgerBalance блокировка строки balances и баланс по журналу операций
+	expectLedgerBalance := func(current int64) {
+		mock.ExpectQuery(`SELECT user_id FROM balances WHERE user_id = \$1 FOR UPDATE`).
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+		mock.ExpectQuery(`SELECT COALESCE\(SUM\(amount\), 0\) FROM ledger WHERE user_id = \$1`).
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(current))
+	}
+	// expectDeduct обновление кэша баланса и запись списания в историю
+	expectDeduct := func() {
+		mock.ExpectExec(`UPDATE balances SET current_balance = current_balance - \$1, withdrawn = withdrawn \+ \$1 WHERE user_id = \$2`).
+			WithArgs(decimal.NewFromInt(100), 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`INSERT INTO transaction_history \(user_id, order_number, transaction_sum\) VALUES \(\$1, \$2, \$3\)`).
+			WithArgs(1, 123, decimal.NewFromInt(100)).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
 
 	// Тест 1: успешное вычитание баланса и добавление в историю транзакций
 	mock.ExpectBegin()
-
-	mock.ExpectQuery(`UPDATE balances SET current_balance = current_balance - \$1, withdrawn = withdrawn + \$1 WHERE user_id = \$2 AND current_balance >= \$1 RETURNING current_balance`).
-		WithArgs(100.0, 1).
-		WillReturnRows(sqlmock.NewRows([]string{"current_balance"}).AddRow(900.0))
-
-	mock.ExpectExec(`INSERT INTO transaction_history \(user_id, order_number, transaction_sum\) VALUES \(\$1, \$2, \$3\)`).
-		WithArgs(1, 123, 100.0).
+	expectLedgerBalance(1000)
+	expectDeduct()
+	mock.ExpectExec(`INSERT INTO ledger \(user_id, order_number, entry_type, amount\) VALUES \(\$1, \$2, \$3, \$4\)`).
+		WithArgs(1, 123, constants.LedgerWithdrawal, decimal.NewFromInt(-100)).
 		WillReturnResult(sqlmock.NewResult(1, 1))
-
 	mock.ExpectCommit()
 
-	_ = mock.ExpectationsWereMet()
+	newBalance, err := Store.DeductBalance(context.Background(), 1, 123, decimal.NewFromInt(100))
+	assert.NoError(t, err)
+	assert.Equal(t, "900", newBalance.String())
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
 
 	// Тест 2: ошибка при начале транзакции
 	mock.ExpectBegin().WillReturnError(fmt.Errorf("transaction begin error"))
 
-	newBalance, err := Store.DeductBalance(1, 123, 100.0)
+	newBalance, err = Store.DeductBalance(context.Background(), 1, 123, decimal.NewFromInt(100))
 	assert.Error(t, err)
-	assert.Equal(t, 0.0, newBalance)
+	assert.True(t, newBalance.IsZero())
+
+	// Тест 3: баланс по журналу меньше суммы списания, кэш баланса не проверяется и не меняется
+	mock.ExpectBegin()
+	expectLedgerBalance(50)
+	mock.ExpectRollback()
+
+	newBalance, err = Store.DeductBalance(context.Background(), 1, 123, decimal.NewFromInt(100))
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.True(t, newBalance.IsZero())
 
-	// Тест 3: ошибка при обновлении баланса
+	// Тест 4: у пользователя нет строки баланса
 	mock.ExpectBegin()
-	mock.ExpectQuery(`UPDATE balances SET current_balance = current_balance - \$1, withdrawn = withdrawn + \$1 WHERE user_id = \$2 AND current_balance >= \$1 RETURNING current_balance`).
-		WithArgs(100.0, 1).
+	mock.ExpectQuery(`SELECT user_id FROM balances`).
+		WithArgs(1).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	newBalance, err = Store.DeductBalance(context.Background(), 1, 123, decimal.NewFromInt(100))
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+	assert.True(t, newBalance.IsZero())
+
+	// Тест 5: ошибка при обновлении баланса
+	mock.ExpectBegin()
+	expectLedgerBalance(1000)
+	mock.ExpectExec(`UPDATE balances SET current_balance = current_balance - \$1`).
+		WithArgs(decimal.NewFromInt(100), 1).
 		WillReturnError(fmt.Errorf("update balance error"))
 	mock.ExpectRollback()
 
-	newBalance, err = Store.DeductBalance(1, 123, 100.0)
+	newBalance, err = Store.DeductBalance(context.Background(), 1, 123, decimal.NewFromInt(100))
 	assert.Error(t, err)
-	assert.Equal(t, 0.0, newBalance)
+	assert.True(t, newBalance.IsZero())
 
-	// Тест 4: ошибка при добавлении в историю транзакций
+	// Тест 6: ошибка при добавлении в историю транзакций
 	mock.ExpectBegin()
-	mock.ExpectQuery(`UPDATE balances SET current_balance = current_balance - \$1, withdrawn = withdrawn + \$1 WHERE user_id = \$2 AND current_balance >= \$1 RETURNING current_balance`).
-		WithArgs(100.0, 1).
-		WillReturnRows(sqlmock.NewRows([]string{"current_balance"}).AddRow(900.0))
-
+	expectLedgerBalance(1000)
+	mock.ExpectExec(`UPDATE balances SET current_balance = current_balance - \$1`).
+		WithArgs(decimal.NewFromInt(100), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectExec(`INSERT INTO transaction_history \(user_id, order_number, transaction_sum\) VALUES \(\$1, \$2, \$3\)`).
-		WithArgs(1, 123, 100.0).
+		WithArgs(1, 123, decimal.NewFromInt(100)).
 		WillReturnError(fmt.Errorf("insert history error"))
+	mock.ExpectRollback()
+
+	newBalance, err = Store.DeductBalance(context.Background(), 1, 123, decimal.NewFromInt(100))
+	assert.Error(t, err)
+	assert.True(t, newBalance.IsZero())
 
+	// Тест 7: ошибка при записи в журнал операций
+	mock.ExpectBegin()
+	expectLedgerBalance(1000)
+	expectDeduct()
+	mock.ExpectExec(`INSERT INTO ledger`).
+		WithArgs(1, 123, constants.LedgerWithdrawal, decimal.NewFromInt(-100)).
+		WillReturnError(fmt.Errorf("insert ledger error"))
 	mock.ExpectRollback()
 
-	newBalance, err = Store.DeductBalance(1, 123, 100.0)
+	newBalance, err = Store.DeductBalance(context.Background(), 1, 123, decimal.NewFromInt(100))
 	assert.Error(t, err)
-	assert.Equal(t, 0.0, newBalance)
+	assert.Contains(t, err.Error(), "failed to insert ledger entry")
+	assert.True(t, newBalance.IsZero())
 
-	// Тест 5: ошибка при коммите транзакции
+	// Тест 8: списание с таким номером заказа уже есть, баланс не меняется
 	mock.ExpectBegin()
-	mock.ExpectQuery(`UPDATE balances SET current_balance = current_balance - \$1, withdrawn = withdrawn + \$1 WHERE user_id = \$2 AND current_balance >= \$1 RETURNING current_balance`).
-		WithArgs(100.0, 1).
-		WillReturnRows(sqlmock.NewRows([]string{"current_balance"}).AddRow(900.0))
+	expectLedgerBalance(1000)
+	mock.ExpectExec(`UPDATE balances SET current_balance = current_balance - \$1`).
+		WithArgs(decimal.NewFromInt(100), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO transaction_history`).
+		WithArgs(1, 123, decimal.NewFromInt(100)).
+		WillReturnError(&pgconn.PgError{Code: "23505"})
+	mock.ExpectRollback()
 
-	mock.ExpectExec(`INSERT INTO transaction_history \(user_id, order_number, transaction_sum\) VALUES \(\$1, \$2, \$3\)`).
-		WithArgs(1, 123, 100.0).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	newBalance, err = Store.DeductBalance(context.Background(), 1, 123, decimal.NewFromInt(100))
+	assert.ErrorIs(t, err, ErrWithdrawalExists)
+	assert.True(t, newBalance.IsZero())
 
+	// Тест 9: ошибка при коммите транзакции
+	mock.ExpectBegin()
+	expectLedgerBalance(1000)
+	expectDeduct()
+	mock.ExpectExec(`INSERT INTO ledger \(user_id, order_number, entry_type, amount\) VALUES \(\$1, \$2, \$3, \$4\)`).
+		WithArgs(1, 123, constants.LedgerWithdrawal, decimal.NewFromInt(-100)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit().WillReturnError(fmt.Errorf("commit error"))
 
-	newBalance, err = Store.DeductBalance(1, 123, 100.0)
+	newBalance, err = Store.DeductBalance(context.Background(), 1, 123, decimal.NewFromInt(100))
 	assert.Error(t, err)
-	assert.Equal(t, 0.0, newBalance)
+	assert.True(t, newBalance.IsZero())
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
 }
 
-// TestGetAllTransactionByUserID тестирует функцию GetAllTransactionByUserID
-func TestGetAllTransactionByUserID(t *testing.T) {
+// TestListTransactionsByUserID тестирует функцию ListTransactionsByUserID
+func TestListTransactionsByUserID(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	assert.NoError(t, err)
 	defer db.Close()
 
 	SetDBInstance(SQLStorage{db: db})
 
+	firstAt := time.Date(2023, 10, 22, 12, 0, 0, 0, time.UTC)
+	secondAt := time.Date(2023, 10, 21, 11, 0, 0, 0, time.UTC)
+	columns := []string{"order_number", "transaction_sum", "processed_at"}
+	query := `SELECT order_number, transaction_sum, processed_at FROM transaction_history WHERE user_id = \$1 ` +
+		`ORDER BY processed_at DESC, order_number DESC LIMIT \$2`
+
 	// Тест 1: успешное получение истории транзакций пользователя
-	rows := sqlmock.NewRows([]string{"order_number", "transaction_sum", "processed_at"}).
-		AddRow("123", "100.50", "2023-10-22T12:00:00Z").
-		AddRow("124", "200.75", "2023-10-21T11:00:00Z")
+	rows := sqlmock.NewRows(columns).
+		AddRow(123, "100.50", firstAt).
+		AddRow(124, "200.75", secondAt)
 
-	mock.ExpectQuery(`SELECT order_number, transaction_sum, processed_at FROM transaction_history WHERE user_id = \$1 ORDER BY processed_at DESC`).
-		WithArgs(1).
+	mock.ExpectQuery(query).
+		WithArgs(1, 11).
 		WillReturnRows(rows)
 
-	transactions, err := Store.GetAllTransactionByUserID(1)
+	transactions, next, err := Store.ListTransactionsByUserID(context.Background(), 1, storagemodels.ListQuery{Limit: 10})
 	assert.NoError(t, err)
 	assert.Len(t, transactions, 2)
 	assert.Equal(t, "123", transactions[0].OrderNumber)
-	assert.Equal(t, 100.50, transactions[0].Sum)
+	assert.Equal(t, "100.5", transactions[0].Sum.String())
 	assert.Equal(t, "124", transactions[1].OrderNumber)
-	assert.Equal(t, 200.75, transactions[1].Sum)
+	assert.Equal(t, "200.75", transactions[1].Sum.String())
+	assert.Nil(t, next)
 
 	err = mock.ExpectationsWereMet()
 	assert.NoError(t, err)
 
-	// Тест 2: ошибка при выполнении запроса
-	mock.ExpectQuery(`SELECT order_number, transaction_sum, processed_at FROM transaction_history WHERE user_id = \$1 ORDER BY processed_at DESC`).
-		WithArgs(1).
+	// Тест 2: страница заполнена, курсор указывает на последнюю запись страницы
+	mock.ExpectQuery(query).
+		WithArgs(1, 2).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(123, "100.50", firstAt).AddRow(124, "200.75", secondAt))
+
+	transactions, next, err = Store.ListTransactionsByUserID(context.Background(), 1, storagemodels.ListQuery{Limit: 1})
+	assert.NoError(t, err)
+	assert.Len(t, transactions, 1)
+	assert.Equal(t, &storagemodels.Cursor{At: firstAt, Number: 123}, next)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+
+	// Тест 3: ошибка при выполнении запроса
+	mock.ExpectQuery(query).
+		WithArgs(1, 11).
 		WillReturnError(sql.ErrConnDone)
 
-	transactions, err = Store.GetAllTransactionByUserID(1)
+	transactions, _, err = Store.ListTransactionsByUserID(context.Background(), 1, storagemodels.ListQuery{Limit: 10})
 	assert.Error(t, err)
 	assert.Nil(t, transactions)
-	assert.Equal(t, sql.ErrConnDone, err)
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+	assert.ErrorIs(t, err, ErrTransient)
 
-	// Тест 3: ошибка при обработке строк
-	rowsWithError := sqlmock.NewRows([]string{"order_number", "transaction_sum", "processed_at"}).
-		AddRow("125", "300.50", "2023-10-20T10:00:00Z").
-		RowError(0, sql.ErrNoRows)
+	// Тест 4: ошибка при обработке строк
+	rowsWithError := sqlmock.NewRows(columns).
+		AddRow(125, "300.50", secondAt).
+		RowError(0, sql.ErrConnDone)
 
-	mock.ExpectQuery(`SELECT order_number, transaction_sum, processed_at FROM transaction_history WHERE user_id = \$1 ORDER BY processed_at DESC`).
-		WithArgs(1).
+	mock.ExpectQuery(query).
+		WithArgs(1, 11).
 		WillReturnRows(rowsWithError)
 
-	transactions, err = Store.GetAllTransactionByUserID(1)
+	transactions, _, err = Store.ListTransactionsByUserID(context.Background(), 1, storagemodels.ListQuery{Limit: 10})
 	assert.Nil(t, transactions)
-	assert.Nil(t, err)
+	assert.ErrorIs(t, err, sql.ErrConnDone)
 
-	// Тест 4: ошибка при сканировании строки
-	rowsWithScanError := sqlmock.NewRows([]string{"order_number", "transaction_sum", "processed_at"}).
-		AddRow("invalid_order", "invalid_sum", "2023-10-22T12:00:00Z") // Неправильные данные
+	// Тест 5: ошибка при сканировании строки
+	rowsWithScanError := sqlmock.NewRows(columns).
+		AddRow("invalid_order", "invalid_sum", firstAt) // Неправильные данные
 
-	mock.ExpectQuery(`SELECT order_number, transaction_sum, processed_at FROM transaction_history WHERE user_id = \$1 ORDER BY processed_at DESC`).
-		WithArgs(1).
+	mock.ExpectQuery(query).
+		WithArgs(1, 11).
 		WillReturnRows(rowsWithScanError)
 
-	transactions, err = Store.GetAllTransactionByUserID(1)
+	transactions, _, err = Store.ListTransactionsByUserID(context.Background(), 1, storagemodels.ListQuery{Limit: 10})
 	assert.Error(t, err)
 	assert.Nil(t, transactions)
 }
@@ -550,99 +817,764 @@ func TestUpdateAccrualData(t *testing.T) {
 
 	SetDBInstance(SQLStorage{db: db})
 
-	// Тест 1: успешное обновление данных заказа и баланса
+	// Тест 1: успешное обновление данных заказа, баланса и журнала операций
 	mock.ExpectBegin()
 
-	mock.ExpectQuery(`SELECT user_id FROM orders WHERE order_id = \$1`).
+	mock.ExpectQuery(`SELECT user_id, status, COALESCE\(accrual_status, ''\) FROM orders WHERE order_id = \$1 FOR UPDATE`).
 		WithArgs(123).
-		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "accrual_status"}).AddRow(1, "NEW", ""))
 
-	mock.ExpectExec(`UPDATE orders SET status = \$1, accrual = \$2 WHERE order_id = \$3`).
-		WithArgs("PROCESSED", 100.0, 123).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`UPDATE orders SET status = \$1, accrual = \$2, accrual_status = \$4, last_checked_at = NOW\(\), poll_count = poll_count \+ 1 WHERE order_id = \$3 RETURNING poll_count, EXTRACT\(EPOCH FROM NOW\(\) - created_at\)`).
+		WithArgs("PROCESSED", decimal.NewFromInt(100), 123, "PROCESSED").
+		WillReturnRows(sqlmock.NewRows([]string{"poll_count", "age"}).AddRow(1, 60.5))
 
-	mock.ExpectExec(`UPDATE balances SET current_balance = current_balance + \$1 WHERE user_id = \$2`).
-		WithArgs(100.0, 1).
+	mock.ExpectExec(`INSERT INTO order_status_history \(order_id, status, accrual_status, source, poll_count\) VALUES \(\$1, \$2, \$3, \$4, \$5\)`).
+		WithArgs(123, "PROCESSED", "PROCESSED", constants.HistoryAccrual, 1).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	mock.ExpectCommit()
+	mock.ExpectExec(`UPDATE balances SET current_balance = current_balance \+ \$1 WHERE user_id = \$2`).
+		WithArgs(decimal.NewFromInt(100), 1).
+		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	Store.UpdateAccrualData(123, 100.0, "PROCESSED")
+	mock.ExpectExec(`INSERT INTO ledger \(user_id, order_number, entry_type, amount\) VALUES \(\$1, \$2, \$3, \$4\)`).
+		WithArgs(1, 123, constants.LedgerAccrual, decimal.NewFromInt(100)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	mock.ExpectationsWereMet()
+	mock.ExpectCommit()
 
-	// Тест 2: ошибка при начале транзакции
-	mock.ExpectBegin().WillReturnError(fmt.Errorf("transaction begin error"))
+	credited, err := Store.UpdateAccrualData(context.Background(), 123, decimal.NewFromInt(100), "PROCESSED", "PROCESSED")
+	assert.NoError(t, err)
+	assert.True(t, credited)
 
-	err = Store.UpdateAccrualData(123, 100.0, "PROCESSED")
-	assert.Error(t, err)
-	assert.Contains(t, err.Error(), "failed to begin transaction")
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
 
-	// Тест 3: ошибка при поиске userID по orderID
+	// Тест 2: повторный PROCESSED не начисляет баллы второй раз
 	mock.ExpectBegin()
 
-	mock.ExpectQuery(`SELECT user_id FROM orders WHERE order_id = \$1`).
+	mock.ExpectQuery(`SELECT user_id, status, COALESCE\(accrual_status, ''\) FROM orders WHERE order_id = \$1 FOR UPDATE`).
 		WithArgs(123).
-		WillReturnError(sql.ErrNoRows)
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "accrual_status"}).AddRow(1, "PROCESSED", "PROCESSED"))
 
 	mock.ExpectRollback()
 
-	err = Store.UpdateAccrualData(123, 100.0, "PROCESSED")
-	assert.Error(t, err)
+	credited, err = Store.UpdateAccrualData(context.Background(), 123, decimal.NewFromInt(100), "PROCESSED", "PROCESSED")
+	assert.NoError(t, err)
+	assert.False(t, credited)
 
-	// Тест 4: ошибка при обновлении заказа
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+
+	// Тест 3: промежуточный статус обновляет заказ без начисления
 	mock.ExpectBegin()
 
-	mock.ExpectQuery(`SELECT user_id FROM orders WHERE order_id = \$1`).
+	mock.ExpectQuery(`SELECT user_id, status, COALESCE\(accrual_status, ''\) FROM orders WHERE order_id = \$1 FOR UPDATE`).
 		WithArgs(123).
-		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "accrual_status"}).AddRow(1, "NEW", ""))
 
-	mock.ExpectExec(`UPDATE orders SET status = \$1, accrual = \$2 WHERE order_id = \$3`).
-		WithArgs("PROCESSED", 100.0, 123).
-		WillReturnError(fmt.Errorf("update order error"))
+	mock.ExpectQuery(`UPDATE orders SET status = \$1, accrual = \$2, accrual_status = \$4, last_checked_at = NOW\(\), poll_count = poll_count \+ 1 WHERE order_id = \$3 RETURNING poll_count, EXTRACT\(EPOCH FROM NOW\(\) - created_at\)`).
+		WithArgs("PROCESSING", decimal.Zero, 123, "PROCESSING").
+		WillReturnRows(sqlmock.NewRows([]string{"poll_count", "age"}).AddRow(1, 60.5))
 
-	mock.ExpectRollback()
+	mock.ExpectExec(`INSERT INTO order_status_history \(order_id, status, accrual_status, source, poll_count\) VALUES \(\$1, \$2, \$3, \$4, \$5\)`).
+		WithArgs(123, "PROCESSING", "PROCESSING", constants.HistoryAccrual, 1).
+		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	err = Store.UpdateAccrualData(123, 100.0, "PROCESSED")
-	assert.Error(t, err)
+	mock.ExpectCommit()
 
-	// Тест 5: ошибка при обновлении баланса
+	credited, err = Store.UpdateAccrualData(context.Background(), 123, decimal.Zero, "PROCESSING", "PROCESSING")
+	assert.NoError(t, err)
+	assert.False(t, credited)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+
+	// Тест 4: повтор того же промежуточного статуса не пишется в историю
 	mock.ExpectBegin()
 
-	mock.ExpectQuery(`SELECT user_id FROM orders WHERE order_id = \$1`).
+	mock.ExpectQuery(`SELECT user_id, status, COALESCE\(accrual_status, ''\) FROM orders WHERE order_id = \$1 FOR UPDATE`).
 		WithArgs(123).
-		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "accrual_status"}).AddRow(1, "PROCESSING", "PROCESSING"))
 
-	mock.ExpectExec(`UPDATE orders SET status = \$1, accrual = \$2 WHERE order_id = \$3`).
-		WithArgs("PROCESSED", 100.0, 123).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`UPDATE orders SET status = \$1, accrual = \$2, accrual_status = \$4, last_checked_at = NOW\(\), poll_count = poll_count \+ 1 WHERE order_id = \$3 RETURNING poll_count, EXTRACT\(EPOCH FROM NOW\(\) - created_at\)`).
+		WithArgs("PROCESSING", decimal.Zero, 123, "PROCESSING").
+		WillReturnRows(sqlmock.NewRows([]string{"poll_count", "age"}).AddRow(2, 60.5))
 
-	mock.ExpectExec(`UPDATE balances SET current_balance = current_balance + \$1 WHERE user_id = \$2`).
-		WithArgs(100.0, 1).
-		WillReturnError(fmt.Errorf("update balance error"))
+	mock.ExpectCommit()
 
-	mock.ExpectRollback()
+	credited, err = Store.UpdateAccrualData(context.Background(), 123, decimal.Zero, "PROCESSING", "PROCESSING")
+	assert.NoError(t, err)
+	assert.False(t, credited)
 
-	err = Store.UpdateAccrualData(123, 100.0, "PROCESSED")
-	assert.Error(t, err)
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
 
-	// Тест 6: ошибка при коммите транзакции
+	// Тест 5: смена статуса accrual без смены статуса заказа пишется в историю
 	mock.ExpectBegin()
 
-	mock.ExpectQuery(`SELECT user_id FROM orders WHERE order_id = \$1`).
+	mock.ExpectQuery(`SELECT user_id, status, COALESCE\(accrual_status, ''\) FROM orders WHERE order_id = \$1 FOR UPDATE`).
 		WithArgs(123).
-		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "accrual_status"}).AddRow(1, "PROCESSING", "REGISTERED"))
 
-	mock.ExpectExec(`UPDATE orders SET status = \$1, accrual = \$2 WHERE order_id = \$3`).
-		WithArgs("PROCESSED", 100.0, 123).
-		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`UPDATE orders SET status = \$1, accrual = \$2, accrual_status = \$4, last_checked_at = NOW\(\), poll_count = poll_count \+ 1 WHERE order_id = \$3 RETURNING poll_count, EXTRACT\(EPOCH FROM NOW\(\) - created_at\)`).
+		WithArgs("PROCESSING", decimal.Zero, 123, "PROCESSING").
+		WillReturnRows(sqlmock.NewRows([]string{"poll_count", "age"}).AddRow(3, 60.5))
 
-	mock.ExpectExec(`UPDATE balances SET current_balance = current_balance + \$1 WHERE user_id = \$2`).
-		WithArgs(100.0, 1).
+	mock.ExpectExec(`INSERT INTO order_status_history \(order_id, status, accrual_status, source, poll_count\) VALUES \(\$1, \$2, \$3, \$4, \$5\)`).
+		WithArgs(123, "PROCESSING", "PROCESSING", constants.HistoryAccrual, 3).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	mock.ExpectCommit().WillReturnError(fmt.Errorf("commit error"))
+	mock.ExpectCommit()
 
-	err = Store.UpdateAccrualData(123, 100.0, "PROCESSED")
-	assert.Error(t, err)
+	credited, err = Store.UpdateAccrualData(context.Background(), 123, decimal.Zero, "PROCESSING", "PROCESSING")
+	assert.NoError(t, err)
+	assert.False(t, credited)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+
+	// Тест 6: выход из финального статуса и возврат в NEW отклоняются
+	for _, tt := range []struct{ previous, status constants.OrderStatus }{
+		{previous: constants.Processed, status: constants.Processing},
+		{previous: constants.Invalid, status: constants.Processed},
+		{previous: constants.Processing, status: constants.New},
+	} {
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT user_id, status, COALESCE\(accrual_status, ''\) FROM orders WHERE order_id = \$1 FOR UPDATE`).
+			WithArgs(123).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "accrual_status"}).AddRow(1, tt.previous, string(tt.previous)))
+		mock.ExpectRollback()
+
+		credited, err = Store.UpdateAccrualData(context.Background(), 123, decimal.Zero, tt.status, string(tt.status))
+		assert.ErrorIs(t, err, ErrInvalidTransition)
+		assert.ErrorIs(t, err, ErrConflict)
+		assert.False(t, credited)
+	}
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+
+	// Тест 7: ошибка при начале транзакции
+	mock.ExpectBegin().WillReturnError(fmt.Errorf("transaction begin error"))
+
+	_, err = Store.UpdateAccrualData(context.Background(), 123, decimal.NewFromInt(100), "PROCESSED", "PROCESSED")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to begin transaction")
+
+	// Тест 8: ошибка при поиске userID по orderID
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(`SELECT user_id, status, COALESCE\(accrual_status, ''\) FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WithArgs(123).
+		WillReturnError(sql.ErrNoRows)
+
+	mock.ExpectRollback()
+
+	_, err = Store.UpdateAccrualData(context.Background(), 123, decimal.NewFromInt(100), "PROCESSED", "PROCESSED")
+	assert.Error(t, err)
+
+	// Тест 9: ошибка при обновлении заказа
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(`SELECT user_id, status, COALESCE\(accrual_status, ''\) FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "accrual_status"}).AddRow(1, "NEW", ""))
+
+	mock.ExpectQuery(`UPDATE orders SET status = \$1, accrual = \$2, accrual_status = \$4, last_checked_at = NOW\(\), poll_count = poll_count \+ 1 WHERE order_id = \$3 RETURNING poll_count, EXTRACT\(EPOCH FROM NOW\(\) - created_at\)`).
+		WithArgs("PROCESSED", decimal.NewFromInt(100), 123, "PROCESSED").
+		WillReturnError(fmt.Errorf("update order error"))
+
+	mock.ExpectRollback()
+
+	_, err = Store.UpdateAccrualData(context.Background(), 123, decimal.NewFromInt(100), "PROCESSED", "PROCESSED")
+	assert.Error(t, err)
+
+	// Тест 10: ошибка при обновлении баланса
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(`SELECT user_id, status, COALESCE\(accrual_status, ''\) FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "accrual_status"}).AddRow(1, "NEW", ""))
+
+	mock.ExpectQuery(`UPDATE orders SET status = \$1, accrual = \$2, accrual_status = \$4, last_checked_at = NOW\(\), poll_count = poll_count \+ 1 WHERE order_id = \$3 RETURNING poll_count, EXTRACT\(EPOCH FROM NOW\(\) - created_at\)`).
+		WithArgs("PROCESSED", decimal.NewFromInt(100), 123, "PROCESSED").
+		WillReturnRows(sqlmock.NewRows([]string{"poll_count", "age"}).AddRow(1, 60.5))
+
+	mock.ExpectExec(`INSERT INTO order_status_history \(order_id, status, accrual_status, source, poll_count\) VALUES \(\$1, \$2, \$3, \$4, \$5\)`).
+		WithArgs(123, "PROCESSED", "PROCESSED", constants.HistoryAccrual, 1).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(`UPDATE balances SET current_balance = current_balance \+ \$1 WHERE user_id = \$2`).
+		WithArgs(decimal.NewFromInt(100), 1).
+		WillReturnError(fmt.Errorf("update balance error"))
+
+	mock.ExpectRollback()
+
+	_, err = Store.UpdateAccrualData(context.Background(), 123, decimal.NewFromInt(100), "PROCESSED", "PROCESSED")
+	assert.Error(t, err)
+
+	// Тест 11: ошибка при записи в журнал операций
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(`SELECT user_id, status, COALESCE\(accrual_status, ''\) FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "accrual_status"}).AddRow(1, "NEW", ""))
+
+	mock.ExpectQuery(`UPDATE orders SET status = \$1, accrual = \$2, accrual_status = \$4, last_checked_at = NOW\(\), poll_count = poll_count \+ 1 WHERE order_id = \$3 RETURNING poll_count, EXTRACT\(EPOCH FROM NOW\(\) - created_at\)`).
+		WithArgs("PROCESSED", decimal.NewFromInt(100), 123, "PROCESSED").
+		WillReturnRows(sqlmock.NewRows([]string{"poll_count", "age"}).AddRow(1, 60.5))
+
+	mock.ExpectExec(`INSERT INTO order_status_history \(order_id, status, accrual_status, source, poll_count\) VALUES \(\$1, \$2, \$3, \$4, \$5\)`).
+		WithArgs(123, "PROCESSED", "PROCESSED", constants.HistoryAccrual, 1).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(`UPDATE balances SET current_balance = current_balance \+ \$1 WHERE user_id = \$2`).
+		WithArgs(decimal.NewFromInt(100), 1).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(`INSERT INTO ledger`).
+		WithArgs(1, 123, constants.LedgerAccrual, decimal.NewFromInt(100)).
+		WillReturnError(fmt.Errorf("insert ledger error"))
+
+	mock.ExpectRollback()
+
+	_, err = Store.UpdateAccrualData(context.Background(), 123, decimal.NewFromInt(100), "PROCESSED", "PROCESSED")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to insert ledger entry")
+
+	// Тест 12: ошибка при коммите транзакции
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(`SELECT user_id, status, COALESCE\(accrual_status, ''\) FROM orders WHERE order_id = \$1 FOR UPDATE`).
+		WithArgs(123).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "status", "accrual_status"}).AddRow(1, "NEW", ""))
+
+	mock.ExpectQuery(`UPDATE orders SET status = \$1, accrual = \$2, accrual_status = \$4, last_checked_at = NOW\(\), poll_count = poll_count \+ 1 WHERE order_id = \$3 RETURNING poll_count, EXTRACT\(EPOCH FROM NOW\(\) - created_at\)`).
+		WithArgs("PROCESSED", decimal.NewFromInt(100), 123, "PROCESSED").
+		WillReturnRows(sqlmock.NewRows([]string{"poll_count", "age"}).AddRow(1, 60.5))
+
+	mock.ExpectExec(`INSERT INTO order_status_history \(order_id, status, accrual_status, source, poll_count\) VALUES \(\$1, \$2, \$3, \$4, \$5\)`).
+		WithArgs(123, "PROCESSED", "PROCESSED", constants.HistoryAccrual, 1).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(`UPDATE balances SET current_balance = current_balance \+ \$1 WHERE user_id = \$2`).
+		WithArgs(decimal.NewFromInt(100), 1).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectExec(`INSERT INTO ledger`).
+		WithArgs(1, 123, constants.LedgerAccrual, decimal.NewFromInt(100)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	mock.ExpectCommit().WillReturnError(fmt.Errorf("commit error"))
+
+	credited, err = Store.UpdateAccrualData(context.Background(), 123, decimal.NewFromInt(100), "PROCESSED", "PROCESSED")
+	assert.Error(t, err)
+	assert.False(t, credited)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+// TestLeaseOrdersForCheck тестирует функцию LeaseOrdersForCheck
+func TestLeaseOrdersForCheck(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+
+	// Тест 1: успешный захват заказов с нефинальным статусом
+	rows := sqlmock.NewRows([]string{"order_id", "status"}).
+		AddRow(123, "NEW").
+		AddRow(124, "PROCESSING")
+
+	mock.ExpectQuery(`UPDATE orders SET next_check_at = NOW\(\) \+ make_interval\(secs => \$1\) WHERE order_id IN \(SELECT order_id FROM orders WHERE status NOT IN \(\$2, \$3\) AND next_check_at <= NOW\(\) ORDER BY next_check_at LIMIT \$4 FOR UPDATE SKIP LOCKED\) RETURNING order_id, status`).
+		WithArgs(30.0, constants.Processed, constants.Invalid, 100).
+		WillReturnRows(rows)
+
+	orders, err := Store.LeaseOrdersForCheck(context.Background(), 100, 30*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []storagemodels.QueuedOrder{
+		{OrderID: 123, Status: "NEW"},
+		{OrderID: 124, Status: "PROCESSING"},
+	}, orders)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+
+	// Тест 2: ошибка при выполнении запроса
+	mock.ExpectQuery(`UPDATE orders SET next_check_at`).
+		WithArgs(30.0, constants.Processed, constants.Invalid, 100).
+		WillReturnError(sql.ErrConnDone)
+
+	orders, err = Store.LeaseOrdersForCheck(context.Background(), 100, 30*time.Second)
+	assert.Error(t, err)
+	assert.Nil(t, orders)
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+	assert.ErrorIs(t, err, ErrTransient)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+// TestPostponeOrderCheck тестирует функцию PostponeOrderCheck
+func TestPostponeOrderCheck(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+
+	// Тест 1: успешный перенос опроса
+	mock.ExpectExec(`UPDATE orders SET next_check_at = NOW\(\) \+ make_interval\(secs => \$1\) WHERE order_id = \$2`).
+		WithArgs(2.0, 123).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err = Store.PostponeOrderCheck(context.Background(), 123, 2*time.Second)
+	assert.NoError(t, err)
+
+	// Тест 2: ошибка при выполнении запроса
+	mock.ExpectExec(`UPDATE orders SET next_check_at`).
+		WithArgs(2.0, 123).
+		WillReturnError(sql.ErrConnDone)
+
+	err = Store.PostponeOrderCheck(context.Background(), 123, 2*time.Second)
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+	assert.ErrorIs(t, err, ErrTransient)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+// TestAppendLedgerEntry тестирует функцию AppendLedgerEntry
+func TestAppendLedgerEntry(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+
+	// expectLedgerBalance блокировка строки balances и баланс по журналу операций
+	expectLedgerBalance := func(current int64) {
+		mock.ExpectQuery(`SELECT user_id FROM balances WHERE user_id = \$1 FOR UPDATE`).
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+		mock.ExpectQuery(`SELECT COALESCE\(SUM\(amount\), 0\) FROM ledger WHERE user_id = \$1`).
+			WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow(current))
+	}
+
+	// expectWithdrawal списанная и уже возвращенная по заказу 123 суммы
+	expectWithdrawal := func(withdrawn, reversed int64) {
+		mock.ExpectQuery(`SELECT COALESCE\(-SUM\(amount\) FILTER \(WHERE entry_type = \$3\), 0\), `+
+			`COALESCE\(SUM\(amount\) FILTER \(WHERE entry_type = \$4\), 0\) FROM ledger WHERE user_id = \$1 AND order_number = \$2`).
+			WithArgs(1, 123, constants.LedgerWithdrawal, constants.LedgerReversal).
+			WillReturnRows(sqlmock.NewRows([]string{"withdrawn", "reversed"}).AddRow(withdrawn, reversed))
+	}
+
+	// Тест 1: возврат списанных баллов уменьшает withdrawn
+	mock.ExpectBegin()
+	expectLedgerBalance(0)
+	expectWithdrawal(100, 50)
+	mock.ExpectExec(`UPDATE balances SET current_balance = current_balance \+ \$1, withdrawn = withdrawn - \$2 WHERE user_id = \$3`).
+		WithArgs(decimal.NewFromInt(50), decimal.NewFromInt(50), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO ledger \(user_id, order_number, entry_type, amount\) VALUES \(\$1, \$2, \$3, \$4\)`).
+		WithArgs(1, 123, constants.LedgerReversal, decimal.NewFromInt(50)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err = Store.AppendLedgerEntry(context.Background(), 1, 123, constants.LedgerReversal, decimal.NewFromInt(50))
+	assert.NoError(t, err)
+
+	// Тест: возврат по заказу без списания
+	mock.ExpectBegin()
+	expectLedgerBalance(0)
+	expectWithdrawal(0, 0)
+	mock.ExpectRollback()
+
+	err = Store.AppendLedgerEntry(context.Background(), 1, 123, constants.LedgerReversal, decimal.NewFromInt(50))
+	assert.ErrorIs(t, err, ErrReversalNotCovered)
+
+	// Тест: повторный возврат уже возвращенного списания
+	mock.ExpectBegin()
+	expectLedgerBalance(100)
+	expectWithdrawal(100, 100)
+	mock.ExpectRollback()
+
+	err = Store.AppendLedgerEntry(context.Background(), 1, 123, constants.LedgerReversal, decimal.NewFromInt(1))
+	assert.ErrorIs(t, err, ErrReversalNotCovered)
+
+	// Тест 2: отрицательная корректировка при нехватке баланса по журналу
+	mock.ExpectBegin()
+	expectLedgerBalance(100)
+	mock.ExpectRollback()
+
+	err = Store.AppendLedgerEntry(context.Background(), 1, 0, constants.LedgerAdjustment, decimal.NewFromInt(-500))
+	assert.ErrorIs(t, err, ErrInsufficientFunds)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+
+	// Тест 3: начисления и списания нельзя добавить в обход их операций
+	err = Store.AppendLedgerEntry(context.Background(), 1, 123, constants.LedgerAccrual, decimal.NewFromInt(50))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported ledger entry type")
+
+	// Тест 4: возврат должен быть положительным
+	err = Store.AppendLedgerEntry(context.Background(), 1, 123, constants.LedgerReversal, decimal.NewFromInt(-50))
+	assert.Error(t, err)
+}
+
+// TestReconcileBalances тестирует функцию ReconcileBalances
+func TestReconcileBalances(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+
+	// Тест 1: найдено расхождение
+	rows := sqlmock.NewRows([]string{"user_id", "current_balance", "withdrawn", "current", "withdrawn"}).
+		AddRow(1, "200", "0", "100", "0")
+	mock.ExpectQuery(`SELECT b.user_id, b.current_balance, b.withdrawn`).
+		WithArgs(constants.LedgerWithdrawal, constants.LedgerReversal).
+		WillReturnRows(rows)
+
+	discrepancies, err := Store.ReconcileBalances(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, discrepancies, 1)
+	assert.Equal(t, 1, discrepancies[0].UserID)
+	assert.Equal(t, "200", discrepancies[0].CachedCurrent.String())
+	assert.Equal(t, "100", discrepancies[0].LedgerCurrent.String())
+	assert.True(t, discrepancies[0].CachedWithdrawn.IsZero())
+	assert.True(t, discrepancies[0].LedgerWithdrawn.IsZero())
+
+	// Тест 2: ошибка при выполнении запроса
+	mock.ExpectQuery(`SELECT b.user_id, b.current_balance, b.withdrawn`).
+		WithArgs(constants.LedgerWithdrawal, constants.LedgerReversal).
+		WillReturnError(sql.ErrConnDone)
+
+	discrepancies, err = Store.ReconcileBalances(context.Background())
+	assert.ErrorIs(t, err, sql.ErrConnDone)
+	assert.ErrorIs(t, err, ErrTransient)
+	assert.Nil(t, discrepancies)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+// TestQueryTimeout проверяет, что запрос прерывается по таймауту операции и по отмене контекста вызывающего
+func TestQueryTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db, queryTimeout: 10 * time.Millisecond})
+
+	// Тест 1: таймаут операции
+	mock.ExpectQuery(`SELECT id FROM users WHERE user_name = \$1`).
+		WithArgs("testUser").
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	start := time.Now()
+	_, err = Store.GetUserIDByName(context.Background(), "testUser")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	// Тест 2: контекст вызывающего уже отменен
+	SetDBInstance(SQLStorage{db: db})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	mock.ExpectQuery(`SELECT id FROM users WHERE user_name = \$1`).
+		WithArgs("testUser").
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	start = time.Now()
+	_, err = Store.GetUserIDByName(ctx, "testUser")
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+// TestCreateSession тестирует функцию CreateSession
+func TestCreateSession(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+	expiresAt := time.Now().Add(time.Hour)
+	session := storagemodels.Session{ID: "sid", UserName: "testUser", RefreshTokenHash: "hash", ExpiresAt: expiresAt}
+
+	// Тест 1: сессия создана
+	mock.ExpectExec(`INSERT INTO sessions \(id, user_id, refresh_token_hash, expires_at\) SELECT \$1, id, \$3, \$4 FROM users WHERE user_name = \$2`).
+		WithArgs("sid", "testUser", "hash", expiresAt).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err = Store.CreateSession(context.Background(), session)
+	assert.NoError(t, err)
+
+	// Тест 2: пользователь не найден
+	mock.ExpectExec(`INSERT INTO sessions`).
+		WithArgs("sid", "testUser", "hash", expiresAt).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err = Store.CreateSession(context.Background(), session)
+	assert.Error(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+// TestRotateSession тестирует функцию RotateSession
+func TestRotateSession(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+	expiresAt := time.Now().Add(time.Hour)
+	selectSession := `SELECT s.id, u.user_name, s.refresh_token_hash = \$1, s.revoked_at IS NULL AND s.expires_at > NOW\(\) FROM sessions s`
+
+	// Тест 1: токен заменен
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectSession).
+		WithArgs("oldHash").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_name", "current", "active"}).AddRow("sid", "testUser", true, true))
+	mock.ExpectExec(`UPDATE sessions SET previous_token_hash = refresh_token_hash, refresh_token_hash = \$1, expires_at = \$2 WHERE id = \$3`).
+		WithArgs("newHash", expiresAt, "sid").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	session, err := Store.RotateSession(context.Background(), "oldHash", "newHash", expiresAt)
+	assert.NoError(t, err)
+	assert.Equal(t, "sid", session.ID)
+	assert.Equal(t, "testUser", session.UserName)
+	assert.Equal(t, "newHash", session.RefreshTokenHash)
+
+	// Тест 2: повторное предъявление замененного токена отзывает сессию
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectSession).
+		WithArgs("oldHash").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_name", "current", "active"}).AddRow("sid", "testUser", false, true))
+	mock.ExpectExec(`UPDATE sessions SET revoked_at = NOW\(\) WHERE id = \$1`).
+		WithArgs("sid").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	session, err = Store.RotateSession(context.Background(), "oldHash", "newHash", expiresAt)
+	assert.ErrorIs(t, err, ErrRefreshTokenReused)
+	assert.Equal(t, "sid", session.ID)
+
+	// Тест 3: сессия не найдена
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectSession).
+		WithArgs("unknownHash").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	_, err = Store.RotateSession(context.Background(), "unknownHash", "newHash", expiresAt)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+
+	// Тест 4: сессия отозвана или истекла
+	mock.ExpectBegin()
+	mock.ExpectQuery(selectSession).
+		WithArgs("oldHash").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_name", "current", "active"}).AddRow("sid", "testUser", true, false))
+	mock.ExpectRollback()
+
+	_, err = Store.RotateSession(context.Background(), "oldHash", "newHash", expiresAt)
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+// TestSessionRevocation тестирует функции IsSessionActive, RevokeSession и RevokeUserSessions
+func TestSessionRevocation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+
+	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM sessions WHERE id = \$1 AND revoked_at IS NULL AND expires_at > NOW\(\)\)`).
+		WithArgs("sid").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	active, err := Store.IsSessionActive(context.Background(), "sid")
+	assert.NoError(t, err)
+	assert.True(t, active)
+
+	mock.ExpectExec(`UPDATE sessions SET revoked_at = NOW\(\) WHERE id = \$1 AND revoked_at IS NULL`).
+		WithArgs("sid").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = Store.RevokeSession(context.Background(), "sid")
+	assert.NoError(t, err)
+
+	mock.ExpectExec(`UPDATE sessions SET revoked_at = NOW\(\) WHERE user_id = \(SELECT id FROM users WHERE user_name = \$1\) AND revoked_at IS NULL`).
+		WithArgs("testUser").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	err = Store.RevokeUserSessions(context.Background(), "testUser")
+	assert.NoError(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+// TestLoginAttempts тестирует функции учета неудачных попыток входа
+func TestLoginAttempts(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+	policy := storagemodels.LoginPolicy{FreeAttempts: 5, BaseLockout: 30 * time.Second, MaxLockout: 15 * time.Minute, ResetAfter: time.Hour}
+	recordQuery := `INSERT INTO login_attempts \(key, failures, last_failure_at, locked_until\) VALUES \(\$1, 1, NOW\(\), CASE WHEN 1 > \$3 ` +
+		`THEN NOW\(\) \+ make_interval\(secs => LEAST\(\$5, \$4 \* power\(2, LEAST\(1 - \$3 - 1, 30\)\)\)\) END\) ` +
+		`ON CONFLICT \(key\) DO UPDATE SET failures = CASE WHEN login_attempts.last_failure_at < NOW\(\) - make_interval\(secs => \$2\) ` +
+		`THEN 1 ELSE login_attempts.failures \+ 1 END, last_failure_at = NOW\(\), locked_until = CASE WHEN CASE .+ END > \$3 .+ END ` +
+		`WHERE login_attempts.locked_until IS NULL OR login_attempts.locked_until <= NOW\(\) ` +
+		`RETURNING failures, COALESCE\(EXTRACT\(EPOCH FROM locked_until - NOW\(\)\), 0\)`
+
+	// Тест 1: попытка засчитана без блокировки
+	mock.ExpectQuery(recordQuery).
+		WithArgs("login:testUser", float64(3600), 5, float64(30), float64(900)).
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "lockout"}).AddRow(3, 0.0))
+
+	attempt, err := Store.RecordLoginFailure(context.Background(), "login:testUser", policy)
+	assert.NoError(t, err)
+	assert.Equal(t, storagemodels.LoginAttempt{Failures: 3}, attempt)
+
+	// Тест 2: попытка засчитана и заблокировала ключ тем же запросом
+	mock.ExpectQuery(recordQuery).
+		WithArgs("login:testUser", float64(3600), 5, float64(30), float64(900)).
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "lockout"}).AddRow(6, 30.0))
+
+	attempt, err = Store.RecordLoginFailure(context.Background(), "login:testUser", policy)
+	assert.NoError(t, err)
+	assert.Equal(t, storagemodels.LoginAttempt{Failures: 6, Lockout: 30 * time.Second}, attempt)
+
+	// Тест 3: ключ заблокирован, попытка отклонена без учета
+	mock.ExpectQuery(recordQuery).
+		WithArgs("login:testUser", float64(3600), 5, float64(30), float64(900)).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(`SELECT failures, GREATEST\(EXTRACT\(EPOCH FROM locked_until - NOW\(\)\), 0\) FROM login_attempts ` +
+		`WHERE key = \$1 AND locked_until IS NOT NULL`).
+		WithArgs("login:testUser").
+		WillReturnRows(sqlmock.NewRows([]string{"failures", "lockout"}).AddRow(6, 12.5))
+
+	attempt, err = Store.RecordLoginFailure(context.Background(), "login:testUser", policy)
+	assert.NoError(t, err)
+	assert.Equal(t, storagemodels.LoginAttempt{Rejected: true, Failures: 6, Lockout: 12500 * time.Millisecond}, attempt)
+
+	// Тест 4: ошибка при учете попытки
+	mock.ExpectQuery(`INSERT INTO login_attempts`).
+		WithArgs("ip:10.0.0.1", float64(3600), 5, float64(30), float64(900)).
+		WillReturnError(sql.ErrConnDone)
+
+	_, err = Store.RecordLoginFailure(context.Background(), "ip:10.0.0.1", policy)
+	assert.ErrorIs(t, err, ErrTransient)
+
+	// Тест 5: снятие попытки вместе с ее блокировкой
+	mock.ExpectExec(`UPDATE login_attempts SET failures = GREATEST\(failures - 1, 0\), `+
+		`locked_until = CASE WHEN \$2 THEN NULL ELSE locked_until END WHERE key = \$1`).
+		WithArgs("ip:10.0.0.1", true).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = Store.ReleaseLoginFailure(context.Background(), "ip:10.0.0.1", true)
+	assert.NoError(t, err)
+
+	mock.ExpectExec(`DELETE FROM login_attempts WHERE key = \$1`).
+		WithArgs("login:testUser").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = Store.ResetLoginFailures(context.Background(), "login:testUser")
+	assert.NoError(t, err)
+
+	// Тест 6: удаление давних счетчиков без действующей блокировки
+	mock.ExpectExec(`DELETE FROM login_attempts WHERE last_failure_at < NOW\(\) - make_interval\(secs => \$1\) ` +
+		`AND \(locked_until IS NULL OR locked_until <= NOW\(\)\)`).
+		WithArgs(float64(86400)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	deleted, err := Store.DeleteExpiredLoginAttempts(context.Background(), 24*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
+}
+
+// TestIdempotencyKeys тестирует функции работы с ключами идемпотентности
+func TestIdempotencyKeys(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	SetDBInstance(SQLStorage{db: db})
+
+	// Тест 1: новый ключ закрепляется за запросом
+	mock.ExpectExec(`INSERT INTO idempotency_keys \(user_id, key, request_hash, created_at\) VALUES \(\$1, \$2, \$3, NOW\(\)\) `+
+		`ON CONFLICT \(user_id, key\) DO UPDATE SET request_hash = EXCLUDED.request_hash, created_at = EXCLUDED.created_at `+
+		`WHERE idempotency_keys.status_code IS NULL AND idempotency_keys.created_at < NOW\(\) - make_interval\(secs => \$4\)`).
+		WithArgs(1, "key", "hash", float64(60)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	record, reserved, err := Store.ReserveIdempotencyKey(context.Background(), 1, "key", "hash", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	assert.Equal(t, "hash", record.RequestHash)
+
+	mock.ExpectExec(`UPDATE idempotency_keys SET status_code = \$3, content_type = \$4, response_body = \$5 WHERE user_id = \$1 AND key = \$2`).
+		WithArgs(1, "key", 402, "application/problem+json", []byte("body")).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = Store.CompleteIdempotencyKey(context.Background(), 1, "key", storagemodels.IdempotencyResponse{
+		StatusCode:   402,
+		ContentType:  "application/problem+json",
+		ResponseBody: []byte("body"),
+	})
+	assert.NoError(t, err)
+
+	// Тест 2: ключ уже использован, возвращается сохраненный ответ
+	mock.ExpectExec(`INSERT INTO idempotency_keys`).
+		WithArgs(1, "key", "hash", float64(60)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT request_hash, COALESCE\(status_code, 0\), COALESCE\(content_type, ''\), response_body FROM idempotency_keys WHERE user_id = \$1 AND key = \$2`).
+		WithArgs(1, "key").
+		WillReturnRows(sqlmock.NewRows([]string{"request_hash", "status_code", "content_type", "response_body"}).
+			AddRow("hash", 402, "application/problem+json", []byte("body")))
+
+	record, reserved, err = Store.ReserveIdempotencyKey(context.Background(), 1, "key", "hash", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, 402, record.StatusCode)
+	assert.Equal(t, "application/problem+json", record.ContentType)
+	assert.Equal(t, []byte("body"), record.ResponseBody)
+
+	// Тест 3: незавершенный ключ освобождается
+	mock.ExpectExec(`DELETE FROM idempotency_keys WHERE user_id = \$1 AND key = \$2 AND status_code IS NULL`).
+		WithArgs(1, "other").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = Store.ReleaseIdempotencyKey(context.Background(), 1, "other")
+	assert.NoError(t, err)
+
+	// Тест 4: удаление устаревших ключей
+	mock.ExpectExec(`DELETE FROM idempotency_keys WHERE created_at < NOW\(\) - make_interval\(secs => \$1\)`).
+		WithArgs(float64(86400)).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	deleted, err := Store.DeleteExpiredIdempotencyKeys(context.Background(), 24*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), deleted)
+
+	err = mock.ExpectationsWereMet()
+	assert.NoError(t, err)
 }
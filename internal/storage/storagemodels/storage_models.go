@@ -1,22 +1,161 @@
 package storagemodels
 
+import (
+	"time"
+
+	"github.com/fngoc/gofermart/internal/constants"
+	"github.com/shopspring/decimal"
+)
+
 // Order схема для получения заказа из БД
 type Order struct {
-	Number     string  `json:"number"`
-	Status     string  `json:"status"`
-	Accrual    float64 `json:"accrual,omitempty"`
-	UploadedAt string  `json:"uploaded_at"`
+	Number     string                `json:"number"`
+	Status     constants.OrderStatus `json:"status"`
+	Accrual    *decimal.Decimal      `json:"accrual,omitempty"`
+	UploadedAt string                `json:"uploaded_at"`
+}
+
+// OrderStatusChange запись истории статусов заказа: источник изменения, исходный статус accrual
+// и число ответов accrual по заказу к моменту изменения
+type OrderStatusChange struct {
+	Status        constants.OrderStatus `json:"status"`
+	AccrualStatus string                `json:"accrual_status,omitempty"`
+	Source        string                `json:"source"`
+	PollCount     int                   `json:"poll_count"`
+	ChangedAt     string                `json:"changed_at"`
+}
+
+// OrderDetails схема заказа с временем последнего ответа accrual, числом ответов и историей статусов
+type OrderDetails struct {
+	Order
+	LastCheckedAt string              `json:"last_checked_at,omitempty"`
+	PollCount     int                 `json:"poll_count"`
+	History       []OrderStatusChange `json:"history"`
+}
+
+// OrderUploadResult результат загрузки номера заказа
+type OrderUploadResult int
+
+const (
+	// OrderCreated заказ загружен впервые
+	OrderCreated OrderUploadResult = iota + 1
+	// OrderUploadedByUser заказ уже загружен этим же пользователем
+	OrderUploadedByUser
+)
+
+// Cursor позиция записи в списке: время записи и номер заказа, различающий записи с одинаковым временем
+type Cursor struct {
+	At     time.Time
+	Number int
+}
+
+// ListQuery параметры выборки страницы списка
+type ListQuery struct {
+	// Limit размер страницы
+	Limit int
+	// After курсор последней записи предыдущей страницы, nil - первая страница
+	After *Cursor
+	// Statuses допустимые статусы заказов, пусто - любые
+	Statuses []constants.OrderStatus
+	// From начало периода включительно, нулевое значение - без ограничения
+	From time.Time
+	// To конец периода не включительно, нулевое значение - без ограничения
+	To time.Time
+	// Ascending старые записи первыми
+	Ascending bool
 }
 
 // Balance схема для баланса из БД
 type Balance struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current   decimal.Decimal `json:"current"`
+	Withdrawn decimal.Decimal `json:"withdrawn"`
 }
 
 // Transaction схема для истории операций из БД
 type Transaction struct {
-	OrderNumber string  `json:"order"`
-	Sum         float64 `json:"sum"`
-	ProcessedAt string  `json:"processed_at"`
+	OrderNumber string          `json:"order"`
+	Sum         decimal.Decimal `json:"sum"`
+	ProcessedAt string          `json:"processed_at"`
+}
+
+// QueuedOrder схема заказа, захваченного для опроса accrual
+type QueuedOrder struct {
+	OrderID int
+	Status  constants.OrderStatus
+}
+
+// BalanceDiscrepancy расхождение между закэшированным балансом и суммой журнала операций
+type BalanceDiscrepancy struct {
+	UserID          int
+	CachedCurrent   decimal.Decimal
+	CachedWithdrawn decimal.Decimal
+	LedgerCurrent   decimal.Decimal
+	LedgerWithdrawn decimal.Decimal
+}
+
+// MigrationStatus состояние миграции схемы БД
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Session сессия пользователя, в которой выдаются токены доступа
+type Session struct {
+	ID       string
+	UserName string
+	// RefreshTokenHash хэш текущего refresh токена, сам токен не хранится
+	RefreshTokenHash string
+	ExpiresAt        time.Time
+}
+
+// LoginPolicy правила блокировки входа по одному ключу
+type LoginPolicy struct {
+	// FreeAttempts число неудачных попыток подряд без блокировки
+	FreeAttempts int
+	// BaseLockout блокировка после первой попытки сверх FreeAttempts, каждая следующая удваивает ее
+	BaseLockout time.Duration
+	// MaxLockout наибольшая блокировка
+	MaxLockout time.Duration
+	// ResetAfter время без неудачных попыток, после которого счетчик начинается заново
+	ResetAfter time.Duration
+}
+
+// Lockout длительность блокировки после failures неудачных попыток подряд
+func (p LoginPolicy) Lockout(failures int) time.Duration {
+	over := failures - p.FreeAttempts
+	if over <= 0 {
+		return 0
+	}
+	lockout := p.BaseLockout
+	for i := 1; i < over && lockout < p.MaxLockout; i++ {
+		lockout *= 2
+	}
+	return min(lockout, p.MaxLockout)
+}
+
+// LoginAttempt результат учета попытки входа по одному ключу
+type LoginAttempt struct {
+	// Rejected ключ уже заблокирован, попытка не засчитана
+	Rejected bool
+	// Failures число засчитанных попыток подряд вместе с этой
+	Failures int
+	// Lockout оставшееся время блокировки: действующей для отклоненной попытки или наступившей на этой
+	Lockout time.Duration
+}
+
+// IdempotencyResponse ответ на запрос с ключом идемпотентности
+type IdempotencyResponse struct {
+	// StatusCode код ответа, 0 - запрос еще выполняется
+	StatusCode   int
+	ContentType  string
+	ResponseBody []byte
+}
+
+// IdempotencyRecord сохраненный ответ на запрос с ключом идемпотентности
+type IdempotencyRecord struct {
+	// RequestHash хэш запроса, ключ нельзя использовать с другим запросом
+	RequestHash string
+	IdempotencyResponse
 }
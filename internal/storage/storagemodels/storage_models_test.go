@@ -2,12 +2,22 @@ package storagemodels
 
 import (
 	"encoding/json"
+	"os"
 	"testing"
 
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 )
 
+func TestMain(m *testing.M) {
+	// Денежные суммы сериализуются JSON-числами, как в main
+	decimal.MarshalJSONWithoutQuotes = true
+	os.Exit(m.Run())
+}
+
 func TestOrderJSON(t *testing.T) {
+	accrual := decimal.RequireFromString("150.75")
+
 	tests := []struct {
 		name         string
 		input        Order
@@ -18,7 +28,7 @@ func TestOrderJSON(t *testing.T) {
 			input: Order{
 				Number:     "123456",
 				Status:     "PROCESSED",
-				Accrual:    150.75,
+				Accrual:    &accrual,
 				UploadedAt: "2024-10-18T12:00:00Z",
 			},
 			expectedJSON: `{"number":"123456","status":"PROCESSED","accrual":150.75,"uploaded_at":"2024-10-18T12:00:00Z"}`,
@@ -59,8 +69,8 @@ func TestBalanceJSON(t *testing.T) {
 		{
 			name: "Valid Balance",
 			input: Balance{
-				Current:   500.75,
-				Withdrawn: 100.25,
+				Current:   decimal.RequireFromString("500.75"),
+				Withdrawn: decimal.RequireFromString("100.25"),
 			},
 			expectedJSON: `{"current":500.75,"withdrawn":100.25}`,
 		},
@@ -92,7 +102,7 @@ func TestTransactionJSON(t *testing.T) {
 			name: "Valid Transaction",
 			input: Transaction{
 				OrderNumber: "987654",
-				Sum:         200.50,
+				Sum:         decimal.RequireFromString("200.5"),
 				ProcessedAt: "2024-10-18T14:00:00Z",
 			},
 			expectedJSON: `{"order":"987654","sum":200.50,"processed_at":"2024-10-18T14:00:00Z"}`,
@@ -0,0 +1,133 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/fngoc/gofermart/internal/storage/storagemodels"
+	"go.uber.org/zap"
+)
+
+// Policy правила блокировки по одному ключу
+type Policy = storagemodels.LoginPolicy
+
+var (
+	// DefaultLoginPolicy правила по умолчанию для логина
+	DefaultLoginPolicy = Policy{FreeAttempts: 5, BaseLockout: 30 * time.Second, MaxLockout: 15 * time.Minute, ResetAfter: 24 * time.Hour}
+	// DefaultAddressPolicy правила по умолчанию для адреса клиента, мягче, так как за одним адресом
+	// может быть много пользователей
+	DefaultAddressPolicy = Policy{FreeAttempts: 20, BaseLockout: 30 * time.Second, MaxLockout: time.Hour, ResetAfter: 24 * time.Hour}
+)
+
+const (
+	loginKeyPrefix   = "login:"
+	addressKeyPrefix = "ip:"
+)
+
+// Throttler ограничение попыток входа по логину и по адресу клиента. Счетчики хранятся в storage.Store,
+// поэтому переживают перезапуск и общие для всех экземпляров сервиса
+type Throttler struct {
+	login   Policy
+	address Policy
+}
+
+// New создание ограничителя попыток входа
+func New(login, address Policy) *Throttler {
+	return &Throttler{login: login, address: address}
+}
+
+// Attempt попытка входа, засчитанная до проверки пароля
+type Attempt struct {
+	// RetryAfter время до снятия блокировки, если попытка отклонена
+	RetryAfter time.Duration
+	login      string
+	address    string
+	// loginResult и addressResult учет попытки по ключам логина и адреса
+	loginResult   storagemodels.LoginAttempt
+	addressResult storagemodels.LoginAttempt
+}
+
+// Begin учет попытки входа до проверки пароля. Попытка засчитывается как неудачная тем же запросом,
+// который проверяет блокировку и блокирует ключ при превышении правил, поэтому параллельные запросы
+// не проверят больше паролей, чем разрешено. Если логин или адрес уже заблокирован, попытка отклоняется
+// с RetryAfter. Результат проверки пароля передается в Failure, Success или Release
+func (t *Throttler) Begin(ctx context.Context, login, address string) (Attempt, error) {
+	attempt := Attempt{login: login, address: address}
+	var err error
+	attempt.loginResult, err = storage.Store.RecordLoginFailure(ctx, loginKeyPrefix+login, t.login)
+	if err != nil {
+		return Attempt{}, err
+	}
+	if attempt.loginResult.Rejected {
+		attempt.RetryAfter = retryAfter(attempt.loginResult)
+		return attempt, nil
+	}
+
+	attempt.addressResult, err = storage.Store.RecordLoginFailure(ctx, addressKeyPrefix+address, t.address)
+	if err == nil && attempt.addressResult.Rejected {
+		attempt.RetryAfter = retryAfter(attempt.addressResult)
+	}
+	if err != nil || attempt.RetryAfter > 0 {
+		// Попытка не дошла до проверки пароля и не считается неудачей логина
+		if releaseErr := release(ctx, loginKeyPrefix+login, attempt.loginResult); releaseErr != nil {
+			logger.Log.Warn(fmt.Sprintf("Release login attempt error: %s", releaseErr))
+		}
+	}
+	if err != nil {
+		return Attempt{}, err
+	}
+	return attempt, nil
+}
+
+// Failure неверный пароль, возвращает время блокировки, если она наступила на этой попытке
+func (t *Throttler) Failure(attempt Attempt) time.Duration {
+	logLockout(loginKeyPrefix+attempt.login, attempt, attempt.loginResult)
+	logLockout(addressKeyPrefix+attempt.address, attempt, attempt.addressResult)
+	return max(attempt.loginResult.Lockout, attempt.addressResult.Lockout)
+}
+
+// Success верный пароль: сброс счетчика логина и снятие попытки со счетчика адреса. Счетчик адреса
+// не сбрасывается, иначе вход в свою учетную запись позволял бы перебирать пароли чужих
+func (t *Throttler) Success(ctx context.Context, attempt Attempt) error {
+	if err := storage.Store.ResetLoginFailures(ctx, loginKeyPrefix+attempt.login); err != nil {
+		return err
+	}
+	return release(ctx, addressKeyPrefix+attempt.address, attempt.addressResult)
+}
+
+// Release снятие попытки, которая не была неудачей: пароль верный, но счетчик логина не сбрасывается,
+// или проверка не состоялась из-за ошибки
+func (t *Throttler) Release(ctx context.Context, attempt Attempt) error {
+	if err := release(ctx, loginKeyPrefix+attempt.login, attempt.loginResult); err != nil {
+		return err
+	}
+	return release(ctx, addressKeyPrefix+attempt.address, attempt.addressResult)
+}
+
+// release снятие засчитанной попытки по ключу вместе с блокировкой, если она наступила на этой попытке
+func release(ctx context.Context, key string, result storagemodels.LoginAttempt) error {
+	return storage.Store.ReleaseLoginFailure(ctx, key, result.Lockout > 0)
+}
+
+// retryAfter время до снятия блокировки отклоненной попытки, не меньше секунды
+func retryAfter(result storagemodels.LoginAttempt) time.Duration {
+	return max(result.Lockout, time.Second)
+}
+
+// logLockout запись в лог блокировки, наступившей на неудачной попытке
+func logLockout(key string, attempt Attempt, result storagemodels.LoginAttempt) {
+	if result.Lockout == 0 {
+		return
+	}
+	logger.Log.Warn("Login locked",
+		zap.String("event", "login_lockout"),
+		zap.String("key", key),
+		zap.String("login", attempt.login),
+		zap.String("address", attempt.address),
+		zap.Int("failures", result.Failures),
+		zap.Duration("lockout", result.Lockout),
+	)
+}
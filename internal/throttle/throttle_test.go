@@ -0,0 +1,115 @@
+package throttle
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fngoc/gofermart/internal/logger"
+	"github.com/fngoc/gofermart/internal/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyLockout(t *testing.T) {
+	policy := Policy{FreeAttempts: 3, BaseLockout: time.Second, MaxLockout: 5 * time.Second}
+
+	assert.Equal(t, time.Duration(0), policy.Lockout(1))
+	assert.Equal(t, time.Duration(0), policy.Lockout(3))
+	assert.Equal(t, time.Second, policy.Lockout(4))
+	assert.Equal(t, 2*time.Second, policy.Lockout(5))
+	assert.Equal(t, 4*time.Second, policy.Lockout(6))
+	assert.Equal(t, 5*time.Second, policy.Lockout(7))
+	assert.Equal(t, 5*time.Second, policy.Lockout(100))
+}
+
+func TestThrottler(t *testing.T) {
+	assert.NoError(t, logger.Initialize())
+	storage.SetDBInstance(storage.NewMemoryStorage())
+	ctx := context.Background()
+	throttler := New(
+		Policy{FreeAttempts: 2, BaseLockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour},
+		Policy{FreeAttempts: 3, BaseLockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour},
+	)
+
+	// fail неудачная попытка входа, возвращает отказ до проверки пароля и блокировку после нее
+	fail := func(login, address string) (time.Duration, time.Duration) {
+		attempt, err := throttler.Begin(ctx, login, address)
+		assert.NoError(t, err)
+		if attempt.RetryAfter > 0 {
+			return attempt.RetryAfter, 0
+		}
+		return 0, throttler.Failure(attempt)
+	}
+
+	for i := 0; i < 2; i++ {
+		retryAfter, lockout := fail("user", "10.0.0.1")
+		assert.Zero(t, retryAfter)
+		assert.Zero(t, lockout)
+	}
+
+	// Третья неудача блокирует логин, адрес еще не заблокирован
+	retryAfter, lockout := fail("user", "10.0.0.1")
+	assert.Zero(t, retryAfter)
+	assert.InDelta(t, time.Minute, lockout, float64(time.Second))
+	retryAfter, _ = fail("user", "10.0.0.1")
+	assert.InDelta(t, time.Minute, retryAfter, float64(time.Second))
+
+	// Отклоненная попытка не засчитывается адресу: четвертая неудача с адреса его блокирует
+	retryAfter, lockout = fail("other", "10.0.0.1")
+	assert.Zero(t, retryAfter)
+	assert.InDelta(t, time.Minute, lockout, float64(time.Second))
+	retryAfter, _ = fail("third", "10.0.0.1")
+	assert.Positive(t, retryAfter)
+	retryAfter, _ = fail("third", "10.0.0.2")
+	assert.Zero(t, retryAfter)
+
+	// Успешный вход сбрасывает счетчик логина и не засчитывается адресу
+	assert.NoError(t, storage.Store.ResetLoginFailures(ctx, "login:user"))
+	for i := 0; i < 3; i++ {
+		attempt, err := throttler.Begin(ctx, "user", "10.0.0.3")
+		assert.NoError(t, err)
+		assert.Zero(t, attempt.RetryAfter)
+		assert.NoError(t, throttler.Success(ctx, attempt))
+	}
+	retryAfter, lockout = fail("user", "10.0.0.3")
+	assert.Zero(t, retryAfter)
+	assert.Zero(t, lockout)
+
+	// Снятая попытка не засчитывается ни логину, ни адресу
+	attempt, err := throttler.Begin(ctx, "fourth", "10.0.0.4")
+	assert.NoError(t, err)
+	assert.NoError(t, throttler.Release(ctx, attempt))
+	for i := 0; i < 2; i++ {
+		retryAfter, lockout = fail("fourth", "10.0.0.4")
+		assert.Zero(t, retryAfter)
+		assert.Zero(t, lockout)
+	}
+}
+
+func TestThrottlerConcurrentAttempts(t *testing.T) {
+	assert.NoError(t, logger.Initialize())
+	storage.SetDBInstance(storage.NewMemoryStorage())
+	throttler := New(
+		Policy{FreeAttempts: 2, BaseLockout: time.Minute, MaxLockout: time.Hour, ResetAfter: time.Hour},
+		DefaultAddressPolicy,
+	)
+
+	// Параллельные попытки засчитываются до проверки пароля, поэтому проверяется не больше FreeAttempts + 1
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempt, err := throttler.Begin(context.Background(), "user", "10.0.0.1")
+			assert.NoError(t, err)
+			if attempt.RetryAfter == 0 {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(3), allowed.Load())
+}
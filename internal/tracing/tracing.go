@@ -0,0 +1,123 @@
+// Package tracing трассировка OpenTelemetry: настройка экспорта, спаны входящих запросов и общие атрибуты
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Экспортеры спанов
+const (
+	// ExporterNone спаны не экспортируются, контекст трассировки только передается дальше
+	ExporterNone = "none"
+	// ExporterStdout спаны пишутся в stdout в JSON, для локальной отладки
+	ExporterStdout = "stdout"
+	// ExporterOTLP спаны отправляются по OTLP/HTTP, адрес задается переменными OTEL_EXPORTER_OTLP_*
+	ExporterOTLP = "otlp"
+)
+
+// serviceName имя сервиса в ресурсе трассировки, переопределяется OTEL_SERVICE_NAME
+const serviceName = "gophermart"
+
+// instrumentationName имя библиотеки инструментирования для Tracer
+const instrumentationName = "github.com/fngoc/gofermart"
+
+// OrderNumberKey атрибут спана с номером заказа, по нему ищутся трассировки заказа
+const OrderNumberKey = attribute.Key("order.number")
+
+// Init настройка глобального провайдера трассировки с экспортером exporter.
+// Возвращает функцию, которая отправляет оставшиеся спаны и останавливает провайдер
+func Init(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New()
+	case ExporterOTLP:
+		spanExporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %s", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(),
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName)))
+	if err != nil && !errors.Is(err, resource.ErrPartialResource) {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+	// OTEL_SERVICE_NAME и OTEL_RESOURCE_ATTRIBUTES важнее имени по умолчанию
+	if envResource, envErr := resource.New(ctx, resource.WithFromEnv()); envErr == nil {
+		res, _ = resource.Merge(res, envResource)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start начало спана name трассировщиком сервиса
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End завершение спана, ошибка записывается в спан и выставляет статус Error
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// OrderNumber атрибут номера заказа
+func OrderNumber(orderID int) attribute.KeyValue {
+	return OrderNumberKey.String(strconv.Itoa(orderID))
+}
+
+// SetOrderNumber добавление номера заказа к текущему спану из ctx
+func SetOrderNumber(ctx context.Context, orderID int) {
+	trace.SpanFromContext(ctx).SetAttributes(OrderNumber(orderID))
+}
+
+// Middleware спан входящего запроса с извлечением контекста трассировки из заголовков.
+// Имя спана дополняется шаблоном маршрута chi, когда он известен после маршрутизации
+func Middleware(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		routeContext := chi.RouteContext(r.Context())
+		if routeContext == nil || routeContext.RoutePattern() == "" {
+			return
+		}
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + routeContext.RoutePattern())
+		span.SetAttributes(semconv.HTTPRoute(routeContext.RoutePattern()))
+	}), "http.request")
+}
+
+// Transport транспорт исходящих HTTP-запросов: спан клиента и передача контекста трассировки в заголовках
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
@@ -0,0 +1,94 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// recordSpans глобальный провайдер, который сохраняет завершенные спаны в памяти
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+	return recorder
+}
+
+func TestMiddleware(t *testing.T) {
+	recorder := recordSpans(t)
+
+	r := chi.NewRouter()
+	r.Use(Middleware)
+	r.Get("/api/user/orders/{number}", func(w http.ResponseWriter, r *http.Request) {
+		SetOrderNumber(r.Context(), 79927398713)
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user/orders/79927398713", nil)
+	// Контекст трассировки вызывающего сервиса продолжается
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 1)
+	span := spans[0]
+	assert.Equal(t, "GET /api/user/orders/{number}", span.Name())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+	assert.Contains(t, span.Attributes(), semconv.HTTPRoute("/api/user/orders/{number}"))
+	assert.Contains(t, span.Attributes(), OrderNumberKey.String("79927398713"))
+}
+
+func TestTransport(t *testing.T) {
+	recorder := recordSpans(t)
+
+	var traceparent string
+	accrual := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer accrual.Close()
+
+	ctx, span := Start(context.Background(), "accrual.poll", OrderNumber(79927398713))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, accrual.URL+"/api/orders/79927398713", nil)
+	assert.NoError(t, err)
+	resp, err := (&http.Client{Transport: Transport(http.DefaultTransport)}).Do(req)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	End(span, errors.New("no content"))
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 2)
+	client, parent := spans[0], spans[1]
+	// Заголовок ссылается на спан клиента, вложенный в спан опроса
+	assert.Equal(t, "00-"+client.SpanContext().TraceID().String()+"-"+client.SpanContext().SpanID().String()+"-01", traceparent)
+	assert.Equal(t, parent.SpanContext().SpanID(), client.Parent().SpanID())
+	assert.Equal(t, "accrual.poll", parent.Name())
+	assert.Equal(t, codes.Error, parent.Status().Code)
+	assert.Contains(t, parent.Attributes(), OrderNumberKey.String("79927398713"))
+}
+
+func TestInit(t *testing.T) {
+	shutdown, err := Init(context.Background(), ExporterNone)
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+
+	shutdown, err = Init(context.Background(), ExporterStdout)
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+
+	_, err = Init(context.Background(), "jaeger")
+	assert.Error(t, err)
+}